@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/alexflint/go-arg"
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/boltdb"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// caCmd contains the subcommands used to run Mattrax with an identity signed by an offline root or an existing CA. The server must be stopped.
+type caCmd struct {
+	CSR            *caCSRCmd            `arg:"subcommand:csr" help:"create a certificate signing request for an issuing identity which is signed by the offline root"`
+	Import         *caImportCmd         `arg:"subcommand:import" help:"import the issuing identity certificate signed by the offline root"`
+	ImportExisting *caImportExistingCmd `arg:"subcommand:import-existing" help:"import an existing CA certificate chain and private key from PEM or PKCS#12 files. It can't be used with a PKCS#11 token"`
+}
+
+// caCSRCmd contains the flags for the ca csr subcommand
+type caCSRCmd struct {
+	CommonName string `arg:"--common-name" help:"the common name of the issuing identity" default:"Mattrax Issuing CA"`
+	Out        string `arg:"-o,--out" help:"the path the PEM encoded certificate signing request is written to. It is written to stdout if not set" placeholder:"issuing.csr"`
+}
+
+// caImportCmd contains the flags for the ca import subcommand
+type caImportCmd struct {
+	Cert      string `arg:"--cert,required" help:"the path to the PEM or DER encoded issuing identity certificate" placeholder:"issuing.crt"`
+	Root      string `arg:"--root,required" help:"the path to the PEM or DER encoded offline root certificate" placeholder:"root.crt"`
+	CutoverAt string `arg:"--cutover-at" help:"when the imported identity replaces the current identity (RFC 3339). It defaults to the rollover overlap" placeholder:"2006-01-02T15:04:05Z"`
+}
+
+// caImportExistingCmd contains the flags for the ca import-existing subcommand
+type caImportExistingCmd struct {
+	Cert           string `arg:"--cert" help:"the path to the PEM encoded CA certificate chain. It must include the root" placeholder:"ca-chain.pem"`
+	Key            string `arg:"--key" help:"the path to the PEM encoded CA private key. It can be omitted if the key is in the --cert file" placeholder:"ca.key"`
+	PKCS12         string `arg:"--pkcs12" help:"the path to a PKCS#12 file containing the CA certificate chain and private key. It is used instead of --cert and --key" placeholder:"ca.p12"`
+	PKCS12Password string `arg:"--pkcs12-password,env:MATTRAX_PKCS12_PASSWORD" help:"the password of the PKCS#12 file. Set it using the MATTRAX_PKCS12_PASSWORD environment variable so it isn't visible in the process list" placeholder:"PASSWORD"`
+	CutoverAt      string `arg:"--cutover-at" help:"when the imported CA replaces the current identity (RFC 3339). It defaults to the rollover overlap" placeholder:"2006-01-02T15:04:05Z"`
+}
+
+// runCA creates or imports the issuing identity in the database
+func runCA(p *arg.Parser, config mattrax.Config, cmd caCmd) error {
+	if config.DBPath == "" {
+		p.Fail("you must provide a database path")
+	} else if cmd.CSR == nil && cmd.Import == nil && cmd.ImportExisting == nil {
+		p.Fail("you must provide a ca subcommand")
+	} else if cmd.ImportExisting != nil && (cmd.ImportExisting.PKCS12 == "") == (cmd.ImportExisting.Cert == "") {
+		p.Fail("you must provide either --cert or --pkcs12")
+	}
+
+	if err := mattrax.VerifyKEKSource(config.KEKFile, config.KEK, config.KEKPrompt); err != nil {
+		p.Fail(err.Error())
+	}
+
+	if err := config.KeyAlgorithm().Verify(); err != nil {
+		p.Fail("invalid ca key algorithm: " + err.Error())
+	}
+
+	var cutoverAt time.Time
+	if cmd.Import != nil && cmd.Import.CutoverAt != "" {
+		var err error
+		if cutoverAt, err = time.Parse(time.RFC3339, cmd.Import.CutoverAt); err != nil {
+			p.Fail("invalid cutover time: " + err.Error())
+		}
+	} else if cmd.ImportExisting != nil && cmd.ImportExisting.CutoverAt != "" {
+		var err error
+		if cutoverAt, err = time.Parse(time.RFC3339, cmd.ImportExisting.CutoverAt); err != nil {
+			p.Fail("invalid cutover time: " + err.Error())
+		}
+	}
+
+	keyEncryptionKey, err := loadKEK(config.KEKFile, config.KEK, config.KEKPrompt)
+	if err != nil {
+		return err
+	}
+
+	server := &mattrax.Server{
+		Version: mattrax.Version,
+		Config:  config,
+	}
+
+	keyStore, closeKeyStore, err := openKeyStore(config)
+	if err != nil {
+		return err
+	}
+	defer closeKeyStore()
+
+	if err := boltdb.Initialise(server, keyEncryptionKey, keyStore); err != nil {
+		return err
+	}
+
+	switch {
+	case cmd.CSR != nil:
+		err = runCACSR(server, *cmd.CSR)
+	case cmd.Import != nil:
+		err = runCAImport(server, *cmd.Import, cutoverAt)
+	default:
+		err = runCAImportExisting(server, *cmd.ImportExisting, cutoverAt)
+	}
+	if err != nil {
+		boltdb.Close()
+		return err
+	}
+
+	return boltdb.Close()
+}
+
+// runCACSR creates the certificate signing request and writes it in PEM encoding
+func runCACSR(server *mattrax.Server, cmd caCSRCmd) error {
+	csr, err := server.Certificates.CreateIntermediateRequest(pkix.Name{
+		CommonName: cmd.CommonName,
+	}, server.Config.KeyAlgorithm())
+	if err != nil {
+		return err
+	}
+
+	csrPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+	if cmd.Out == "" {
+		_, err := os.Stdout.Write(csrPem)
+		return err
+	}
+	return ioutil.WriteFile(cmd.Out, csrPem, 0644)
+}
+
+// runCAImport imports the signed issuing identity certificate
+func runCAImport(server *mattrax.Server, cmd caImportCmd, cutoverAt time.Time) error {
+	certificateDer, err := readCertificate(cmd.Cert)
+	if err != nil {
+		return pkgerrors.Wrap(err, "error reading issuing identity certificate")
+	}
+
+	rootDer, err := readCertificate(cmd.Root)
+	if err != nil {
+		return pkgerrors.Wrap(err, "error reading root certificate")
+	}
+
+	return server.Certificates.ImportIntermediate(certificateDer, rootDer, cutoverAt)
+}
+
+// runCAImportExisting imports the existing CA from the PEM or PKCS#12 files
+func runCAImportExisting(server *mattrax.Server, cmd caImportExistingCmd, cutoverAt time.Time) error {
+	var chain []*x509.Certificate
+	var privateKey crypto.Signer
+	if cmd.PKCS12 != "" {
+		pkcs12Der, err := ioutil.ReadFile(cmd.PKCS12)
+		if err != nil {
+			return pkgerrors.Wrap(err, "error reading pkcs12 file")
+		}
+
+		if chain, privateKey, err = certificates.ParsePKCS12(pkcs12Der, cmd.PKCS12Password); err != nil {
+			return err
+		}
+	} else {
+		bundle, err := ioutil.ReadFile(cmd.Cert)
+		if err != nil {
+			return pkgerrors.Wrap(err, "error reading ca certificate chain")
+		}
+
+		if cmd.Key != "" {
+			keyPem, err := ioutil.ReadFile(cmd.Key)
+			if err != nil {
+				return pkgerrors.Wrap(err, "error reading ca private key")
+			}
+			bundle = append(append(bundle, '\n'), keyPem...)
+		}
+
+		if chain, privateKey, err = certificates.ParsePEMBundle(bundle); err != nil {
+			return err
+		}
+	}
+
+	return server.Certificates.ImportCA(chain, privateKey, cutoverAt)
+}
+
+// readCertificate reads a PEM or DER encoded certificate from a file and returns it in DER encoding
+func readCertificate(path string) ([]byte, error) {
+	certificate, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(certificate); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, errors.New("the PEM block is not a certificate")
+		}
+		return block.Bytes, nil
+	}
+	return certificate, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/types"
+)
+
+// deepLinkCmd contains the flags for the deeplink subcommand
+type deepLinkCmd struct {
+	Username    string `arg:"positional" help:"the email of the user the link is for. If not set the link can be used by any user with the access token"`
+	AccessToken string `arg:"--access-token" help:"the access token included in the link. The device sends it to the server as its enrollment token"`
+	Output      string `arg:"-o" help:"the path to save a QR code of the link to. The format is chosen by the extension (.png or .svg)" placeholder:"qrcode.png"`
+	Scale       int    `arg:"--scale" help:"the size in pixels of each module of the QR code" default:"8"`
+}
+
+// runDeepLink prints an enrollment deep link and optionally saves it as a QR code
+func runDeepLink(p *arg.Parser, config mattrax.Config, cmd deepLinkCmd) error {
+	if config.Domain == "" {
+		p.Fail("you must provide a domain")
+	} else if !types.IsDNSNameRegex.MatchString(config.Domain) {
+		p.Fail("invalid domain name. Please ensure it doesn't start with a schema or end with a path.")
+	}
+
+	link, err := config.DeepLink(cmd.Username, cmd.AccessToken)
+	if err != nil {
+		return err
+	}
+	fmt.Println(link.String())
+
+	if cmd.Output == "" {
+		return nil
+	}
+
+	var write func(f *os.File) error
+	switch strings.ToLower(filepath.Ext(cmd.Output)) {
+	case ".png":
+		write = func(f *os.File) error { return link.WriteQRCodePNG(f, cmd.Scale) }
+	case ".svg":
+		write = func(f *os.File) error { return link.WriteQRCodeSVG(f, cmd.Scale) }
+	default:
+		p.Fail("invalid output file. The QR code can only be saved as a .png or .svg file.")
+	}
+
+	f, err := os.Create(cmd.Output)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/tlsstore"
+	"github.com/rs/zerolog/log"
+)
+
+// developmentIdentityName is the common name of the identity created in development mode if the tenant has no name
+const developmentIdentityName = "Mattrax Development Identity"
+
+// bootstrapDevelopmentFiles creates the key encryption key file and self-signed HTTPS certificate in development mode if they don't exist.
+// This allows the server to be started without any setup.
+func bootstrapDevelopmentFiles(config mattrax.Config) error {
+	if config.KEKFile == mattrax.DevelopmentKEKFile {
+		if _, err := os.Stat(config.KEKFile); os.IsNotExist(err) {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return err
+			}
+
+			if err := os.MkdirAll(filepath.Dir(config.KEKFile), 0700); err != nil {
+				return err
+			}
+
+			if err := ioutil.WriteFile(config.KEKFile, []byte(base64.StdEncoding.EncodeToString(secret)), 0600); err != nil {
+				return err
+			}
+			log.Warn().Str("kekfile", config.KEKFile).Msg("Generated a development key encryption key. Keep it with the database!")
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if config.CertFile == "" {
+		return nil
+	}
+
+	_, certErr := os.Stat(config.CertFile)
+	_, keyErr := os.Stat(config.KeyFile)
+	if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+		return nil // Existing certificates are never replaced. If only one of the files exists loading them reports the error.
+	}
+
+	if err := tlsstore.GenerateSelfSigned(config.CertFile, config.KeyFile, config.TLSHostnames()); err != nil {
+		return err
+	}
+	log.Warn().Str("certfile", config.CertFile).Str("keyfile", config.KeyFile).Msg("Generated a self-signed development HTTPS certificate. Devices won't trust it!")
+	return nil
+}
+
+// bootstrapDevelopmentIdentity creates the identity in development mode if it doesn't exist.
+// In production it is created when the tenant is named using the settings API.
+func bootstrapDevelopmentIdentity(server *mattrax.Server) error {
+	if server.Certificates.Get().Identity.Cert != nil {
+		return nil
+	}
+
+	commonName := developmentIdentityName
+	if tenantName := server.Settings.Get().Tenant.Name; tenantName != "" {
+		commonName = tenantName + " Identity"
+	}
+
+	if err := server.Certificates.GenerateIdentity(pkix.Name{CommonName: commonName}, server.Config.KeyAlgorithm()); err != nil {
+		return err
+	}
+	log.Info().Str("CommonName", commonName).Msg("Generated the development identity...")
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/alexflint/go-arg"
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/boltdb"
+	"github.com/mattrax/Mattrax/internal/kek"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// rotateKEKCmd contains the flags for the rotate-kek subcommand. The current key encryption key is set using the server's flags.
+type rotateKEKCmd struct {
+	NewKEKFile   string `arg:"--new-kek-file" help:"the path to a file containing the new key encryption key" placeholder:"/etc/mattrax/kek.new"`
+	NewKEK       string `arg:"--new-kek,env:MATTRAX_NEW_KEK" help:"the new key encryption key. Set it using the MATTRAX_NEW_KEK environment variable so it isn't visible in the process list" placeholder:"KEK"`
+	NewKEKPrompt bool   `arg:"--new-kek-prompt" help:"prompt for a passphrase which is used as the new key encryption key"`
+}
+
+// loadKEK creates the key encryption key from a file, value or passphrase prompt. Whitespace around the key is ignored.
+func loadKEK(file string, value string, prompt bool) (*kek.KEK, error) {
+	var secret []byte
+	switch {
+	case file != "":
+		var err error
+		if secret, err = ioutil.ReadFile(file); err != nil {
+			return nil, err
+		}
+	case value != "":
+		secret = []byte(value)
+	case prompt:
+		var err error
+		if secret, err = promptPassphrase("Key encryption passphrase: "); err != nil {
+			return nil, err
+		}
+	}
+
+	return kek.New(bytes.TrimSpace(secret))
+}
+
+// promptPassphrase reads a passphrase from the terminal without echoing it
+func promptPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return passphrase, err
+}
+
+// runRotateKEK re-encrypts the CA private keys in the database with the new key encryption key
+func runRotateKEK(p *arg.Parser, config mattrax.Config, cmd rotateKEKCmd) error {
+	if config.DBPath == "" {
+		p.Fail("you must provide a database path")
+	}
+
+	if err := mattrax.VerifyKEKSource(config.KEKFile, config.KEK, config.KEKPrompt); err != nil {
+		p.Fail(err.Error())
+	}
+
+	if err := mattrax.VerifyKEKSource(cmd.NewKEKFile, cmd.NewKEK, cmd.NewKEKPrompt); err != nil {
+		p.Fail("invalid new key encryption key: " + err.Error())
+	}
+
+	currentKEK, err := loadKEK(config.KEKFile, config.KEK, config.KEKPrompt)
+	if err != nil {
+		return err
+	}
+
+	var newKEK *kek.KEK
+	if cmd.NewKEKPrompt {
+		passphrase, err := promptPassphrase("New key encryption passphrase: ")
+		if err != nil {
+			return err
+		}
+
+		confirmation, err := promptPassphrase("Confirm new key encryption passphrase: ")
+		if err != nil {
+			return err
+		} else if !bytes.Equal(passphrase, confirmation) {
+			return errors.New("the passphrases do not match")
+		}
+
+		newKEK, err = kek.New(bytes.TrimSpace(passphrase))
+	} else {
+		newKEK, err = loadKEK(cmd.NewKEKFile, cmd.NewKEK, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	server := &mattrax.Server{
+		Version: mattrax.Version,
+		Config:  config,
+	}
+
+	keyStore, closeKeyStore, err := openKeyStore(config)
+	if err != nil {
+		return err
+	}
+	defer closeKeyStore()
+
+	if err := boltdb.Initialise(server, currentKEK, keyStore); err != nil {
+		return err
+	}
+
+	if err := server.Certificates.RotateKEK(newKEK); err != nil {
+		boltdb.Close()
+		return err
+	}
+
+	return boltdb.Close()
+}
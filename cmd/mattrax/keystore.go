@@ -0,0 +1,31 @@
+package main
+
+import (
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/mattrax/Mattrax/internal/pkcs11"
+	"github.com/rs/zerolog/log"
+)
+
+// openKeyStore connects to the PKCS#11 token if one is configured. The key store is nil if private keys are stored in the datastore.
+// The returned function must be called to disconnect from the token.
+func openKeyStore(config mattrax.Config) (certificates.KeyStore, func(), error) {
+	if config.PKCS11Module == "" {
+		return nil, func() {}, nil
+	}
+
+	keyStore, err := pkcs11.Open(pkcs11.Config{
+		ModulePath: config.PKCS11Module,
+		TokenLabel: config.PKCS11Token,
+		PIN:        config.PKCS11PIN,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keyStore, func() {
+		if err := keyStore.Close(); err != nil {
+			log.Error().Err(err).Msg("Error closing the PKCS#11 token!")
+		}
+	}, nil
+}
@@ -16,11 +16,25 @@ import (
 	"github.com/mattrax/Mattrax/internal/api"
 	"github.com/mattrax/Mattrax/internal/boltdb"
 	"github.com/mattrax/Mattrax/internal/middleware"
+	"github.com/mattrax/Mattrax/internal/tlsstore"
 	"github.com/mattrax/Mattrax/mdm"
+	"github.com/mattrax/Mattrax/pki"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
 )
 
+// certificateWatchInterval is how often the HTTPS certificate files are checked for changes
+const certificateWatchInterval = 30 * time.Second
+
+// args contains the command line flags and subcommands
+type args struct {
+	mattrax.Config
+	DeepLink  *deepLinkCmd  `arg:"subcommand:deeplink" help:"generate an enrollment deep link and QR code for a user or for anyone with the access token"`
+	RotateKEK *rotateKEKCmd `arg:"subcommand:rotate-kek" help:"re-encrypt the CA private keys with a new key encryption key. The server must be stopped"`
+	CA        *caCmd        `arg:"subcommand:ca" help:"create and import an identity signed by an offline root or import an existing CA. The server must be stopped"`
+}
+
 func main() {
 	// Allow non zero return code while retaining defer statement execution
 	// Also handle panic statements which stopped working
@@ -39,8 +53,33 @@ func main() {
 	}()
 
 	// Parse and verify command line flags
-	config := mattrax.Config{}
-	p := arg.MustParse(&config)
+	cmdArgs := args{}
+	p := arg.MustParse(&cmdArgs)
+	config := cmdArgs.Config
+
+	if cmdArgs.DeepLink != nil {
+		if err := runDeepLink(p, config, *cmdArgs.DeepLink); err != nil {
+			log.Error().Err(err).Msg("Error generating the enrollment deep link!")
+			returnCode = 1
+		}
+		return
+	}
+
+	if cmdArgs.RotateKEK != nil {
+		if err := runRotateKEK(p, config, *cmdArgs.RotateKEK); err != nil {
+			log.Error().Err(err).Msg("Error rotating the key encryption key!")
+			returnCode = 1
+		}
+		return
+	}
+
+	if cmdArgs.CA != nil {
+		if err := runCA(p, config, *cmdArgs.CA); err != nil {
+			log.Error().Err(err).Msg("Error managing the issuing identity!")
+			returnCode = 1
+		}
+		return
+	}
 	config.Verify(p)
 
 	// Create server
@@ -56,8 +95,34 @@ func main() {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
 
+	// Create the files which are required to start the server in development mode
+	if config.DevelopmentMode {
+		if err := bootstrapDevelopmentFiles(config); err != nil {
+			log.Error().Err(err).Msg("Error creating the development key encryption key and HTTPS certificate!")
+			returnCode = 1
+			return
+		}
+	}
+
+	// Load the key encryption key
+	keyEncryptionKey, err := loadKEK(config.KEKFile, config.KEK, config.KEKPrompt)
+	if err != nil {
+		log.Error().Err(err).Msg("Error loading the key encryption key!")
+		returnCode = 1
+		return
+	}
+
+	// Connect to the PKCS#11 token
+	keyStore, closeKeyStore, err := openKeyStore(config)
+	if err != nil {
+		log.Error().Str("module", config.PKCS11Module).Err(err).Msg("Error opening the PKCS#11 token!")
+		returnCode = 1
+		return
+	}
+	defer closeKeyStore()
+
 	// Initialise datastore
-	if err := boltdb.Initialise(server); err != nil {
+	if err := boltdb.Initialise(server, keyEncryptionKey, keyStore); err != nil {
 		log.Error().Str("dbpath", config.DBPath).Err(err).Msg("Error initialising the datastore!")
 		returnCode = 1
 		return
@@ -69,6 +134,59 @@ func main() {
 		}
 	}()
 
+	// Development servers have an identity from the first boot so devices can be enrolled without setup
+	if config.DevelopmentMode {
+		if err := bootstrapDevelopmentIdentity(server); err != nil {
+			log.Error().Err(err).Msg("Error generating the development identity!")
+			returnCode = 1
+			return
+		}
+	}
+
+	// Load the HTTPS certificates
+	certificates := &tlsstore.Store{}
+	if config.CertFile != "" {
+		if err := certificates.Load(append([]string{config.CertFile}, config.AdditionalCertFiles...), append([]string{config.KeyFile}, config.AdditionalKeyFiles...)); err != nil {
+			log.Error().Str("certfile", config.CertFile).Str("keyfile", config.KeyFile).Err(err).Msg("Error loading the HTTPS certificates!")
+			returnCode = 1
+			return
+		}
+	}
+	server.TLS = certificates
+
+	if config.ACME {
+		manager, err := tlsstore.NewACMEManager(tlsstore.ACMEConfig{
+			DirectoryURL: config.ACMEDirectory,
+			Email:        config.ACMEEmail,
+			CacheDir:     config.ACMECacheDir,
+			RootCAFile:   config.ACMERootCA,
+			Hosts:        config.TLSHostnames(),
+		})
+		if err != nil {
+			log.Error().Str("directory", config.ACMEDirectory).Err(err).Msg("Error initialising the ACME client!")
+			returnCode = 1
+			return
+		}
+		certificates.SetACME(manager, config.TLSHostnames())
+	}
+
+	// Reload the HTTPS certificates when they change on disk or the server receives SIGHUP
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	go certificates.Watch(certificateWatchInterval, stopWatching)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := certificates.Reload(); err != nil {
+				log.Error().Err(err).Msg("Error reloading the HTTPS certificates!")
+			} else {
+				log.Info().Msg("Reloaded the HTTPS certificates...")
+			}
+		}
+	}()
+
 	// Initialise router and HTTP server
 	r := mux.NewRouter()
 	httpSrv := &http.Server{
@@ -82,7 +200,11 @@ func main() {
 				tls.CurveP256,
 				tls.X25519,
 			},
-			MinVersion: tls.VersionTLS12,
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificates.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto}, // The ACME protocol is used for the TLS-ALPN-01 challenge
+			ClientAuth:     tls.RequestClientCert,                      // Device certificates are verified by the middleware.DeviceCertificate handler
+
 		},
 		// FUTURE: ErrorLog: {MAKE COMPATIBLE},
 	}
@@ -100,6 +222,19 @@ func main() {
 		}
 	}()
 
+	// Initialise PKI services
+	if err := pki.Initialise(server, r); err != nil {
+		log.Error().Err(err).Msg("Error initialising the PKI services!")
+		returnCode = 1
+		return
+	}
+	defer func() {
+		if err := pki.Deinitialise(); err != nil {
+			log.Error().Err(err).Msg("Error deinitialising the PKI services!")
+			returnCode = 1
+		}
+	}()
+
 	// Initialise API
 	if err := api.Initialise(server, r); err != nil {
 		log.Error().Err(err).Msg("Error initialising the API!")
@@ -107,16 +242,30 @@ func main() {
 		return
 	}
 
+	// The revocation status of issued certificates is served over plain HTTP
+	revocationSrv := &http.Server{
+		Addr:         ":" + strconv.Itoa(config.HTTPPort),
+		Handler:      middleware.Global(pki.RevocationHandler(server), config.DevelopmentMode),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
 	// Create gracefull shutdown channel
 	done := make(chan os.Signal, 1)
 
 	// Start the HTTP server
 	go func() {
-		if err := httpSrv.ListenAndServeTLS(config.CertFile, config.KeyFile); err != nil && err != http.ErrServerClosed {
+		if err := httpSrv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
 			log.Error().Int("port", config.Port).Str("certfile", config.CertFile).Str("keyfile", config.KeyFile).Err(err).Msg("Error with the webserver!")
 			done <- syscall.Signal(-1)
 		}
 	}()
+	go func() {
+		if err := revocationSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error().Int("port", config.HTTPPort).Err(err).Msg("Error with the revocation webserver!")
+			done <- syscall.Signal(-1)
+		}
+	}()
 
 	// Everything Good
 	if config.DevelopmentMode {
@@ -138,8 +287,11 @@ func main() {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	err := httpSrv.Shutdown(ctx)
+	err = httpSrv.Shutdown(ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("Error shutting down the webserver!")
 	}
+	if err := revocationSrv.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("Error shutting down the revocation webserver!")
+	}
 }
@@ -3,6 +3,7 @@ module github.com/mattrax/Mattrax
 go 1.13
 
 require (
+	github.com/ThalesIgnite/crypto11 v1.2.5
 	github.com/alexflint/go-arg v1.2.0
 	github.com/boltdb/bolt v1.3.1
 	github.com/gogo/protobuf v1.3.1 // indirect
@@ -12,11 +13,14 @@ require (
 	github.com/graphql-go/graphql v0.7.9 // indirect
 	github.com/imdario/mergo v0.3.8
 	github.com/matryer/is v1.2.0
+	github.com/micromdm/scep/v2 v2.1.0
 	github.com/pkg/errors v0.9.1
 	github.com/rs/zerolog v1.18.0
 	github.com/samsarahq/go v0.0.0-20191220233105-8077c9fbaed5 // indirect
 	github.com/samsarahq/thunder v0.5.0
 	github.com/satori/go.uuid v1.2.0
-	golang.org/x/crypto v0.0.0-20200220183623-bac4c82f6975
+	golang.org/x/crypto v0.0.0-20220331220935-ae2d96664a29
 	gopkg.in/yaml.v2 v2.2.8
+	rsc.io/qr v0.2.0
+	software.sslmate.com/src/go-pkcs12 v0.2.0
 )
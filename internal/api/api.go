@@ -1,14 +1,25 @@
 package api
 
 import (
+	"crypto"
+	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/mattrax/Mattrax/internal/devices"
+	"github.com/mattrax/Mattrax/internal/enrollment"
 	"github.com/mattrax/Mattrax/internal/settings"
+	"github.com/mattrax/Mattrax/pki"
+	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
 )
 
@@ -20,6 +31,15 @@ type Response struct {
 
 const maxRequestBodySize = 5000
 
+// maxCAImportSize is the largest CA certificate chain and private key (in bytes) which can be imported
+const maxCAImportSize = 64 << 10
+
+// maxHardwareCSVSize is the largest hardware CSV file (in bytes) which can be imported
+const maxHardwareCSVSize = 1 << 20
+
+// maxExpiringDays is the largest number of days which can be checked for expiring certificates
+const maxExpiringDays = 3650
+
 // Initialise creates the API and attaches its HTTP handler
 func Initialise(server *mattrax.Server, r *mux.Router) error {
 	r.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
@@ -51,14 +71,13 @@ func Initialise(server *mattrax.Server, r *mux.Router) error {
 			return
 		}
 
-		previousSettings := server.Settings.Get()
-
 		server.Settings.Set(cmd)
 
-		if previousSettings.Tenant.Name != cmd.Tenant.Name {
+		// The identity is only generated once. Renaming the tenant doesn't replace it because that would break trust with enrolled devices.
+		if server.Certificates.Get().Identity.Cert == nil && cmd.Tenant.Name != "" {
 			if err := server.Certificates.GenerateIdentity(pkix.Name{
 				CommonName: cmd.Tenant.Name + " Identity",
-			}); err != nil {
+			}, server.Config.KeyAlgorithm()); err != nil {
 				res, _ := json.Marshal(Response{
 					Success: false,
 					Msg:     err.Error(),
@@ -74,5 +93,537 @@ func Initialise(server *mattrax.Server, r *mux.Router) error {
 		w.Write(res)
 	}).Methods("POST")
 
+	r.HandleFunc("/api/certificates/template", func(w http.ResponseWriter, r *http.Request) {
+		yaml.NewEncoder(w).Encode(server.Certificates.Get().Template)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/certificates/template", func(w http.ResponseWriter, r *http.Request) {
+		var cmd certificates.Template
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		if err := yaml.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     "Invalid request body",
+			})
+			w.Write(res)
+			return
+		}
+
+		if err := server.Certificates.SetTemplate(cmd); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/certificates/templates", func(w http.ResponseWriter, r *http.Request) {
+		yaml.NewEncoder(w).Encode(server.Certificates.Get().Templates)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/certificates/templates", func(w http.ResponseWriter, r *http.Request) {
+		var cmd certificates.Template
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		if err := yaml.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     "Invalid request body",
+			})
+			w.Write(res)
+			return
+		}
+
+		if err := server.Certificates.SetNamedTemplate(cmd); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/certificates/templates/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if err := server.Certificates.DeleteTemplate(mux.Vars(r)["name"]); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/api/certificates/issued", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		var issuedCertificates []certificates.IssuedCertificate
+		var err error
+		if deviceUUID := query.Get("device"); deviceUUID != "" {
+			issuedCertificates, err = server.Certificates.GetIssuedByDevice(deviceUUID)
+		} else {
+			var issuedCertificate certificates.IssuedCertificate
+			var ok bool
+			if serialNumber := query.Get("serial"); serialNumber != "" {
+				issuedCertificate, ok, err = server.Certificates.GetIssued(serialNumber)
+			} else {
+				issuedCertificate, ok, err = server.Certificates.GetIssuedByHash(query.Get("hash"))
+			}
+
+			if ok {
+				issuedCertificates = []certificates.IssuedCertificate{issuedCertificate}
+			}
+		}
+
+		if err != nil {
+			log.Error().Err(err).Msg("error querying issued certificates")
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     "internal error querying issued certificates",
+			})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(res)
+			return
+		}
+
+		yaml.NewEncoder(w).Encode(issuedCertificates)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/certificates/expiring", func(w http.ResponseWriter, r *http.Request) {
+		days := 30
+		if rawDays := r.URL.Query().Get("days"); rawDays != "" {
+			var err error
+			if days, err = strconv.Atoi(rawDays); err != nil || days < 0 || days > maxExpiringDays {
+				res, _ := json.Marshal(Response{
+					Success: false,
+					Msg:     "invalid number of days. It must be between 0 and " + strconv.Itoa(maxExpiringDays) + ".",
+				})
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write(res)
+				return
+			}
+		}
+
+		expiring, err := server.Certificates.ExpiringDevices(time.Duration(days) * 24 * time.Hour)
+		if err != nil {
+			log.Error().Err(err).Msg("error querying expiring certificates")
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     "internal error querying expiring certificates",
+			})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(res)
+			return
+		}
+
+		yaml.NewEncoder(w).Encode(expiring)
+	}).Methods("GET")
+
+	// Only the certificate expiry metrics are served as the other published variables include the command line flags which contain secrets
+	r.HandleFunc("/api/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(pki.ExpiryMetrics.String()))
+	}).Methods("GET")
+
+	r.HandleFunc("/api/certificates/identities", func(w http.ResponseWriter, r *http.Request) {
+		identities, err := server.Certificates.Identities()
+		if err != nil {
+			log.Error().Err(err).Msg("error loading trusted identities")
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     "internal error loading trusted identities",
+			})
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(res)
+			return
+		}
+
+		yaml.NewEncoder(w).Encode(identities)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/certificates/identities/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+		if err := server.Certificates.RetireIdentity(mux.Vars(r)["hash"], force); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/api/certificates/rollover", func(w http.ResponseWriter, r *http.Request) {
+		var rollover struct {
+			certificates.Rollover `yaml:",inline"`
+			Deadline              time.Time `yaml:"deadline"`        // When the cutover happens even if devices haven't installed the next identity
+			PendingDevices        []string  `yaml:"pending_devices"` // The UUIDs of the devices blocking the cutover
+		}
+		current := server.Certificates.Get()
+		rollover.Rollover = current.Rollover
+
+		if current.NextIdentity.Cert != nil {
+			var err error
+			rollover.Deadline = current.CutoverDeadline()
+			if rollover.PendingDevices, err = pki.PendingDevices(server)(current.NextIdentity); err != nil {
+				log.Error().Err(err).Msg("error listing devices pending the next identity")
+				res, _ := json.Marshal(Response{
+					Success: false,
+					Msg:     "internal error listing devices pending the next identity",
+				})
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write(res)
+				return
+			}
+		}
+
+		yaml.NewEncoder(w).Encode(rollover)
+	}).Methods("GET")
+
+	r.HandleFunc("/api/certificates/rollover", func(w http.ResponseWriter, r *http.Request) {
+		var cmd struct {
+			CommonName   string                    `yaml:"common_name"`
+			KeyAlgorithm certificates.KeyAlgorithm `yaml:"key_algorithm"` // It defaults to the --ca-key-algorithm flag
+			CutoverAt    time.Time                 `yaml:"cutover_at"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		if err := yaml.NewDecoder(r.Body).Decode(&cmd); err != nil && err != io.EOF {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     "Invalid request body",
+			})
+			w.Write(res)
+			return
+		}
+
+		if cmd.CommonName == "" {
+			cmd.CommonName = server.Settings.Get().Tenant.Name + " Identity"
+		}
+		if cmd.KeyAlgorithm == "" {
+			cmd.KeyAlgorithm = server.Config.KeyAlgorithm()
+		}
+
+		if err := server.Certificates.StartRollover(pkix.Name{
+			CommonName: cmd.CommonName,
+		}, cmd.KeyAlgorithm, cmd.CutoverAt); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/certificates/rollover/cutover", func(w http.ResponseWriter, r *http.Request) {
+		if err := server.Certificates.Cutover(); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/certificates/import", func(w http.ResponseWriter, r *http.Request) {
+		var cmd struct {
+			PEM       string    `yaml:"pem"`      // The PEM encoded certificate chain and private key
+			PKCS12    string    `yaml:"pkcs12"`   // The base64 encoded PKCS#12 file. It is used instead of pem.
+			Password  string    `yaml:"password"` // The password of the PKCS#12 file
+			CutoverAt time.Time `yaml:"cutover_at"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxCAImportSize)
+		if err := yaml.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     "Invalid request body",
+			})
+			w.Write(res)
+			return
+		}
+
+		var chain []*x509.Certificate
+		var privateKey crypto.Signer
+		var err error
+		if cmd.PKCS12 != "" {
+			var pkcs12Der []byte
+			if pkcs12Der, err = base64.StdEncoding.DecodeString(cmd.PKCS12); err == nil {
+				chain, privateKey, err = certificates.ParsePKCS12(pkcs12Der, cmd.Password)
+			}
+		} else {
+			chain, privateKey, err = certificates.ParsePEMBundle([]byte(cmd.PEM))
+		}
+		if err == nil {
+			err = server.Certificates.ImportCA(chain, privateKey, cmd.CutoverAt)
+		}
+		if err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/certificates/revoke", func(w http.ResponseWriter, r *http.Request) {
+		var cmd struct {
+			SerialNumber string                        `yaml:"serial_number"`
+			Device       string                        `yaml:"device"`
+			Reason       certificates.RevocationReason `yaml:"reason"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		if err := yaml.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     "Invalid request body",
+			})
+			w.Write(res)
+			return
+		}
+
+		var err error
+		if cmd.Device != "" {
+			err = server.Certificates.RevokeDevice(cmd.Device, cmd.Reason)
+		} else {
+			err = server.Certificates.Revoke(cmd.SerialNumber, cmd.Reason)
+		}
+
+		if err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/devices/{uuid}", func(w http.ResponseWriter, r *http.Request) {
+		uuid := mux.Vars(r)["uuid"]
+
+		// The device's certificates are revoked first so it can't access the server even if deleting the device fails
+		if err := server.Certificates.RevokeDevice(uuid, certificates.ReasonCessationOfOperation); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		if err := server.Devices.Delete(uuid); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/api/devices/{uuid}/{action:retire|wipe}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		device, err := server.Devices.Get(vars["uuid"])
+		if err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		// TODO: Send the RemoteWipe CSP to the device once management sessions are implemented. The certificate would then be revoked after the command is delivered.
+		if err := server.Certificates.RevokeDevice(device.UUID, certificates.ReasonCessationOfOperation); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		device.Status = devices.StatusRetired
+		if vars["action"] == "wipe" {
+			device.Status = devices.StatusWiped
+		}
+
+		if err := server.Devices.EditOrCreate(device); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/enrollment/restrictions", func(w http.ResponseWriter, r *http.Request) {
+		yaml.NewEncoder(w).Encode(server.Enrollment.Get())
+	}).Methods("GET")
+
+	r.HandleFunc("/api/enrollment/restrictions", func(w http.ResponseWriter, r *http.Request) {
+		var cmd enrollment.Restrictions
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+		if err := yaml.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     "Invalid request body",
+			})
+			w.Write(res)
+			return
+		}
+
+		if err := server.Enrollment.Set(cmd); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/enrollment/rejections", func(w http.ResponseWriter, r *http.Request) {
+		yaml.NewEncoder(w).Encode(server.Enrollment.Rejections())
+	}).Methods("GET")
+
+	r.HandleFunc("/api/enrollment/hardware", func(w http.ResponseWriter, r *http.Request) {
+		yaml.NewEncoder(w).Encode(server.Enrollment.GetHardware())
+	}).Methods("GET")
+
+	r.HandleFunc("/api/enrollment/hardware", func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxHardwareCSVSize)
+		hardwareList, err := enrollment.ParseHardwareCSV(r.Body)
+		if err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		if err := server.Enrollment.ImportHardware(hardwareList); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("POST")
+
+	r.HandleFunc("/api/enrollment/hardware/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := server.Enrollment.DeleteHardware(mux.Vars(r)["id"]); err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.Write(res)
+			return
+		}
+
+		res, _ := json.Marshal(Response{
+			Success: true,
+		})
+		w.Write(res)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/api/enrollment/deeplink", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		link, err := server.Config.DeepLink(query.Get("username"), query.Get("accesstoken"))
+		if err != nil {
+			res, _ := json.Marshal(Response{
+				Success: false,
+				Msg:     err.Error(),
+			})
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(res)
+			return
+		}
+
+		scale, _ := strconv.Atoi(query.Get("scale"))
+		switch query.Get("format") {
+		case "png":
+			w.Header().Set("Content-Type", "image/png")
+			err = link.WriteQRCodePNG(w, scale)
+		case "svg":
+			w.Header().Set("Content-Type", "image/svg+xml")
+			err = link.WriteQRCodeSVG(w, scale)
+		default:
+			_, err = fmt.Fprint(w, link.String())
+		}
+
+		if err != nil {
+			log.Error().Err(err).Msg("error generating enrollment deep link")
+		}
+	}).Methods("GET")
+
 	return nil
 }
@@ -1,107 +1,57 @@
 package boltdb
 
 import (
-	"bytes"
-	"encoding/gob"
 	"strings"
 
-	"github.com/boltdb/bolt"
+	"github.com/mattrax/Mattrax/internal/datastore"
 	"github.com/mattrax/Mattrax/internal/devices"
 	"github.com/pkg/errors"
 )
 
-// devicesBucket stores the name of the boltdb bucket the users are stored in
-var devicesBucket = []byte("devices")
-
-// DeviceStore saves and loads devices
+// DeviceStore saves and loads devices. They are stored by their UUID.
 type DeviceStore struct {
-	db *bolt.DB
+	store datastore.Store
 }
 
 // GetAll returns all devices
 func (ds DeviceStore) GetAll() ([]devices.Device, error) {
-	var devicesList []devices.Device
-	err := ds.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(devicesBucket)
-		if bucket == nil {
-			return errors.New("error in DeviceStore.GetAll: devices bucket does not exist")
-		}
-
-		c := bucket.Cursor()
-		for key, deviceRaw := c.First(); key != nil; key, deviceRaw = c.Next() {
-			var device devices.Device
-			err := gob.NewDecoder(bytes.NewBuffer(deviceRaw)).Decode(&device)
-			if err != nil {
-				return errors.Wrap(err, "error problem to decoding the device struct")
-			}
-
-			devicesList = append(devicesList, device)
-		}
-
-		return nil
-	})
-
-	return devicesList, err
+	return ds.Search("")
 }
 
 // GetXDevices returns X (set by count) devices starting at the firstDeviceUUID
 func (ds DeviceStore) GetXDevices(firstDeviceUUID *string, count int64) ([]devices.Device, error) {
 	var devicesList []devices.Device
-	err := ds.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(devicesBucket)
-		if bucket == nil {
-			return errors.New("error in DeviceStore.GetXDevices: devices bucket does not exist")
-		}
-
-		c := bucket.Cursor()
-		scanning := false
-		scanCount := count
-		for key, deviceRaw := c.First(); key != nil; key, deviceRaw = c.Next() {
-			if !scanning && (firstDeviceUUID == nil || string(key) == *firstDeviceUUID) {
-				scanning = true
+	err := ds.store.View(func(tx datastore.Tx) error {
+		c := tx.Cursor(nil)
+		key := c.First()
+		if firstDeviceUUID != nil {
+			if key = c.Seek([]byte(*firstDeviceUUID)); key == nil || string(key) != *firstDeviceUUID {
+				return nil
 			}
+		}
 
-			if scanning {
-				scanCount = scanCount - 1
-				var device devices.Device
-				err := gob.NewDecoder(bytes.NewBuffer(deviceRaw)).Decode(&device)
-				if err != nil {
-					return errors.Wrap(err, "error problem to decoding the device struct")
-				}
-
-				devicesList = append(devicesList, device)
+		for ; key != nil && (count <= 0 || int64(len(devicesList)) < count); key = c.Next() {
+			var device devices.Device
+			if err := c.Value(&device); err != nil {
+				return errors.Wrap(err, "error problem to decoding the device struct")
 			}
 
-			if scanCount == 0 {
-				break
-			}
+			devicesList = append(devicesList, device)
 		}
 
 		return nil
 	})
 
 	return devicesList, err
-
 }
 
 // Get returns a device from its UUID
 func (ds DeviceStore) Get(uuid string) (devices.Device, error) {
 	var device devices.Device
-	err := ds.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(devicesBucket)
-		if bucket == nil {
-			return errors.New("error devices bucket does not exist")
-		}
-
-		deviceRaw := bucket.Get([]byte(uuid))
-		if deviceRaw == nil {
-			return errors.New("device not found")
-		}
-
-		err := gob.NewDecoder(bytes.NewBuffer(deviceRaw)).Decode(&device)
-
-		return err
-	})
+	err := ds.store.Get([]byte(uuid), &device)
+	if err == datastore.ErrNotFound {
+		return device, errors.New("device not found")
+	}
 
 	return device, err
 }
@@ -109,17 +59,11 @@ func (ds DeviceStore) Get(uuid string) (devices.Device, error) {
 // Search returns a list of device from a query
 func (ds DeviceStore) Search(query string) ([]devices.Device, error) {
 	var devicesList []devices.Device
-	err := ds.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(devicesBucket)
-		if bucket == nil {
-			return errors.New("error in DeviceStore.Search: devices bucket does not exist")
-		}
-
-		c := bucket.Cursor()
-		for key, deviceRaw := c.First(); key != nil; key, deviceRaw = c.Next() {
+	err := ds.store.View(func(tx datastore.Tx) error {
+		c := tx.Cursor(nil)
+		for key := c.First(); key != nil; key = c.Next() {
 			var device devices.Device
-			err := gob.NewDecoder(bytes.NewBuffer(deviceRaw)).Decode(&device)
-			if err != nil {
+			if err := c.Value(&device); err != nil {
 				return errors.Wrap(err, "error problem to decoding the device struct")
 			}
 
@@ -136,35 +80,27 @@ func (ds DeviceStore) Search(query string) ([]devices.Device, error) {
 
 // EditOrCreate adds a new device or edits the existing device in the DB
 func (ds DeviceStore) EditOrCreate(device devices.Device) error {
-	// Encode Device
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(device); err != nil {
-		return errors.Wrap(err, "error problem to encoding devices struct")
+	if err := ds.store.Set([]byte(device.UUID), device); err != nil {
+		return errors.Wrap(err, "error problem to saving the device")
 	}
-	deviceRaw := buf.Bytes()
 
-	// Store to DB
-	err := ds.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(devicesBucket)
-		if bucket == nil {
-			return errors.New("error devices bucket does not exist")
-		}
+	return nil
+}
 
-		err := bucket.Put([]byte(device.UUID), deviceRaw)
+// Delete removes the device
+func (ds DeviceStore) Delete(uuid string) error {
+	if err := ds.store.Delete([]byte(uuid)); err == datastore.ErrNotFound {
+		return errors.New("device not found")
+	} else if err != nil {
 		return err
-	})
+	}
 
-	return err
+	return nil
 }
 
-// NewDeviceStore creates and initialises a new DeviceStore from a DB connection
-func NewDeviceStore(db *bolt.DB) (DeviceStore, error) {
-	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(devicesBucket)
-		return err
-	})
-
+// NewDeviceStore creates and initialises a new DeviceStore from a datastore
+func NewDeviceStore(store datastore.Store) (DeviceStore, error) {
 	return DeviceStore{
-		db,
-	}, err
+		store,
+	}, store.Init()
 }
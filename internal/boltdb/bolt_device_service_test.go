@@ -0,0 +1,34 @@
+package boltdb
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mattrax/Mattrax/internal/datastore/memory"
+	"github.com/mattrax/Mattrax/internal/devices"
+)
+
+func TestDeviceStore(t *testing.T) {
+	is := is.New(t)
+	ds, err := NewDeviceStore(&memory.Store{})
+	is.NoErr(err) // create device store
+
+	for _, uuid := range []string{"c", "a", "b"} {
+		is.NoErr(ds.EditOrCreate(devices.Device{UUID: uuid})) // save device
+	}
+
+	all, err := ds.GetAll()
+	is.NoErr(err)         // get all devices
+	is.Equal(len(all), 3) // all devices returned
+
+	firstDeviceUUID := "b"
+	page, err := ds.GetXDevices(&firstDeviceUUID, 1)
+	is.NoErr(err)               // get page of devices
+	is.Equal(len(page), 1)      // page is limited to count
+	is.Equal(page[0].UUID, "b") // page starts at the first device
+
+	is.NoErr(ds.Delete("b")) // delete device
+	_, err = ds.Get("b")
+	is.True(err != nil)            // deleted device is not found
+	is.True(ds.Delete("b") != nil) // deleted device can't be deleted again
+}
@@ -1,10 +1,7 @@
 package boltdb
 
 import (
-	"bytes"
-	"encoding/gob"
-
-	"github.com/boltdb/bolt"
+	"github.com/mattrax/Mattrax/internal/datastore"
 	"github.com/mattrax/Mattrax/internal/types"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/bcrypt"
@@ -12,28 +9,19 @@ import (
 
 // TODO: Change to User Store and support AAD for Login + 2FA, etc in Service
 
-// usersBucket stores the name of the boltdb bucket the users are stored in
-var usersBucket = []byte("users")
-
 // UserService contains the implemented functionality for users
 type UserService struct {
-	db *bolt.DB
+	store datastore.Store
 }
 
 // GetAll returns all users
 func (us UserService) GetAll() ([]types.User, error) {
 	var users []types.User
-	err := us.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(usersBucket)
-		if bucket == nil {
-			return errors.New("error in UserService.GetAll: users bucket does not exist")
-		}
-
-		c := bucket.Cursor()
-		for key, userRaw := c.First(); key != nil; key, userRaw = c.Next() {
+	err := us.store.View(func(tx datastore.Tx) error {
+		c := tx.Cursor(nil)
+		for key := c.First(); key != nil; key = c.Next() {
 			var user types.User
-			err := gob.NewDecoder(bytes.NewBuffer(userRaw)).Decode(&user)
-			if err != nil {
+			if err := c.Value(&user); err != nil {
 				return errors.Wrap(err, "error problem to decoding the user struct")
 			}
 
@@ -52,21 +40,10 @@ func (us UserService) GetAll() ([]types.User, error) {
 // getUser is an internal function for retriveing a user from the database
 func (us UserService) getUser(email string) (types.User, error) {
 	var user types.User
-	err := us.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(usersBucket)
-		if bucket == nil {
-			return errors.New("error users bucket does not exist")
-		}
-
-		userRaw := bucket.Get([]byte(email))
-		if userRaw == nil {
-			return types.ErrUserNotFound
-		}
-
-		err := gob.NewDecoder(bytes.NewBuffer(userRaw)).Decode(&user)
-
-		return err
-	})
+	err := us.store.Get([]byte(email), &user)
+	if err == datastore.ErrNotFound {
+		return user, types.ErrUserNotFound
+	}
 
 	return user, err
 }
@@ -83,25 +60,11 @@ func (us UserService) Get(email string) (types.User, error) {
 
 // CreateOrEdit creates or edits an existing user if one exists
 func (us UserService) CreateOrEdit(email string, user types.User) error {
-	// Encode User
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(user); err != nil {
-		return errors.Wrap(err, "error problem to encoding user struct")
+	if err := us.store.Set([]byte(email), user); err != nil {
+		return errors.Wrap(err, "error problem to saving the user")
 	}
-	userRaw := buf.Bytes()
-
-	// Store to DB
-	err := us.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(usersBucket)
-		if bucket == nil {
-			return errors.New("error users bucket does not exist")
-		}
 
-		err := bucket.Put([]byte(email), userRaw)
-		return err
-	})
-
-	return err
+	return nil
 }
 
 // VerifyLogin takes in a users email & password and checks if they match the users hashed password
@@ -150,14 +113,9 @@ func (us UserService) HashPassword(password []byte) (types.RawPassword, error) {
 	return types.RawPassword(hashedPassword), err
 }
 
-// NewUserService creates and initialises a new UserService from a DB connection
-func NewUserService(db *bolt.DB) (UserService, error) {
-	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(usersBucket)
-		return err
-	})
-
+// NewUserService creates and initialises a new UserService from a datastore
+func NewUserService(store datastore.Store) (UserService, error) {
 	return UserService{
-		db,
-	}, err
+		store,
+	}, store.Init()
 }
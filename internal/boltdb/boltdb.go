@@ -7,17 +7,18 @@ import (
 	mattrax "github.com/mattrax/Mattrax/internal"
 	"github.com/mattrax/Mattrax/internal/certificates"
 	"github.com/mattrax/Mattrax/internal/datastore/boltdb"
+	"github.com/mattrax/Mattrax/internal/enrollment"
+	"github.com/mattrax/Mattrax/internal/kek"
 	"github.com/mattrax/Mattrax/internal/settings"
 	"github.com/pkg/errors"
 )
 
-// TODO: Use helpers in the package to cut down on duplicate code
-
 // FUTURE: Remove because globals are bad
 var globalDB *bolt.DB
 
-// Initialise the database connection and mount the services to the server
-func Initialise(server *mattrax.Server) error {
+// Initialise the database connection and mount the services to the server.
+// The key encryption key is used to encrypt the private keys stored in the database. New private keys are created in the key store if it is not nil.
+func Initialise(server *mattrax.Server, keyEncryptionKey *kek.KEK, keyStore certificates.KeyStore) error {
 	db, err := bolt.Open(server.Config.DBPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
 		return errors.Wrap(err, "Error initialising Boltdb")
@@ -26,12 +27,12 @@ func Initialise(server *mattrax.Server) error {
 
 	// TODO: Could this be done in parallel to shorten startup time
 
-	if server.UserService, err = NewUserService(db); err != nil {
-		return err
+	if server.UserService, err = NewUserService(&boltdb.Store{DB: db, Bucket: []byte("users")}); err != nil {
+		return errors.Wrap(err, "Error initialising users bucket")
 	}
 
-	if server.PolicyService, err = NewPolicyService(db); err != nil {
-		return err
+	if server.PolicyService, err = NewPolicyService(&boltdb.Store{DB: db, Bucket: []byte("policies")}); err != nil {
+		return errors.Wrap(err, "Error initialising policies bucket")
 	}
 
 	settingStore := &boltdb.Store{
@@ -43,11 +44,31 @@ func Initialise(server *mattrax.Server) error {
 	if server.Settings, err = settings.NewService(settingStore); err != nil {
 		return err
 	}
-	if server.Certificates, err = certificates.NewService(settingStore); err != nil {
+	issuedCertificatesStore := &boltdb.Store{
+		DB:     db,
+		Bucket: []byte("issued_certificates"),
+	}
+	if err := issuedCertificatesStore.Init(); err != nil {
+		return errors.Wrap(err, "Error initialising issued certificates bucket")
+	}
+
+	if server.Certificates, err = certificates.NewService(settingStore, issuedCertificatesStore, keyEncryptionKey, keyStore); err != nil {
 		return err
 	}
 
-	if server.Devices, err = NewDeviceStore(db); err != nil {
+	if server.Devices, err = NewDeviceStore(&boltdb.Store{DB: db, Bucket: []byte("devices")}); err != nil {
+		return errors.Wrap(err, "Error initialising devices bucket")
+	}
+
+	enrollmentStore := &boltdb.Store{
+		DB:     db,
+		Bucket: []byte("enrollment"),
+	}
+	if err := enrollmentStore.Init(); err != nil {
+		return errors.Wrap(err, "Error initialising enrollment bucket")
+	}
+
+	if server.Enrollment, err = enrollment.NewService(enrollmentStore); err != nil {
 		return err
 	}
 
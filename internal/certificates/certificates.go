@@ -1,13 +1,27 @@
 package certificates
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/gob"
+	"errors"
 	"math/big"
+	"reflect"
 	"time"
+
+	"github.com/mattrax/Mattrax/internal/kek"
+	uuid "github.com/satori/go.uuid"
 )
 
+// The public key types stored in parsed certificates are registered so the certificates can be saved to the datastore
+func init() {
+	gob.Register(&rsa.PublicKey{})
+}
+
 // RsaPublicKey reflects the ASN.1 structure of a PKCS#1 public key.
 type RsaPublicKey struct {
 	N *big.Int
@@ -16,17 +30,227 @@ type RsaPublicKey struct {
 
 // Certificates contains all the certificates for the server. It has both their raw and processed values.
 type Certificates struct {
-	Identity Identity
+	Identity           Identity
+	PolicyID           string              // A unique identifier for the enrollment policy. It is generated once and never changes.
+	Template           Template            // The template used for certificates issued to enrolling devices
+	Templates          map[string]Template // Named templates which issuers can select instead of Template. The key is the template's name.
+	TemplatesUpdatedAt time.Time           // The time a named template was last created, changed or deleted
+	CRLNumber          int64               // The number of the last CRL generated. It must increase with each CRL.
+	OCSPSigner         OCSPSigner          // The delegated certificate used to sign OCSP responses
+
+	NextIdentity       Identity   // The identity which will replace Identity when the rollover cuts over. It is trusted but not used for issuing.
+	PreviousIdentities []Identity // Identities which were replaced by a rollover. They are trusted until every certificate they issued has been renewed.
+	Rollover           Rollover   // The schedule of the current identity rollover
+
+	IntermediateRequest IntermediateRequest // The pending request for an issuing identity to be signed by an offline root
+
+	SCEPRA           SCEPRA        // The registration authority certificate of the SCEP server
+	SCEPChallengeKey *kek.Envelope `graphql:"-"` // The key SCEP challenge passwords are derived with. It is encrypted with the key encryption key.
 }
 
+// IdentityOrigin is where an identity's certificate came from
+type IdentityOrigin string
+
+// The origins of an identity. Only generated identities are renewed automatically.
+const (
+	IdentityGenerated   IdentityOrigin = "generated"    // The identity is a self-signed root generated by Mattrax
+	IdentityImported    IdentityOrigin = "imported"     // The identity and its private key were imported
+	IdentityOfflineRoot IdentityOrigin = "offline-root" // The identity was signed by an offline root from a request created by Mattrax
+)
+
 // Identity contains the certificates related to identifying and validating MDM clients
 type Identity struct {
-	Cert      *x509.Certificate `graphql:"-"`
-	CertRaw   []byte
-	CertHash  string          // SHA-1 hash of IdentityCertRaw
-	Key       *rsa.PrivateKey `graphql:"-"`
-	KeyRaw    []byte          `graphql:"-"`
-	Subject   pkix.Name       `graphql:"-"`
-	NotBefore time.Time
-	NotAfter  time.Time
+	Origin       IdentityOrigin
+	Cert         *x509.Certificate `graphql:"-"` // It is parsed from CertRaw when the server starts and is never stored
+	CertRaw      []byte
+	CertHash     string        // SHA-1 hash of IdentityCertRaw
+	Signer       crypto.Signer `graphql:"-"` // Signs using the identity's private key. It is loaded when the server starts and is never stored.
+	KeyRaw       []byte        `graphql:"-"` // The PKCS#1 private key stored in plaintext by previous versions. It is only read to migrate the key.
+	EncryptedKey *kek.Envelope `graphql:"-"` // The PKCS#8 private key (PKCS#1 if created by a previous version) encrypted with the key encryption key. It is empty if the key is in the key store.
+	KeyID        []byte        `graphql:"-"` // The ID of the private key in the key store. It is empty if the key is stored encrypted in the datastore.
+	Subject      pkix.Name     `graphql:"-"`
+	NotBefore    time.Time
+	NotAfter     time.Time
+
+	// The root which signed the identity. They are empty if the identity is a self-signed root.
+	RootCert     *x509.Certificate `graphql:"-"` // It is parsed from RootCertRaw when the server starts and is never stored
+	RootCertRaw  []byte
+	RootCertHash string // SHA-1 hash of RootCertRaw
+
+	// The intermediate certificates between the identity and the root, starting with the identity's issuer. They are empty if the root signed the identity.
+	Chain    []*x509.Certificate `graphql:"-"` // It is parsed from ChainRaw when the server starts and is never stored
+	ChainRaw [][]byte
+}
+
+// TrustAnchor returns the root certificate of the identity. This is the identity itself unless it was issued by an offline root.
+func (identity Identity) TrustAnchor() *x509.Certificate {
+	if identity.RootCert != nil {
+		return identity.RootCert
+	}
+	return identity.Cert
+}
+
+// Template contains the properties of the certificates issued to enrolling devices.
+// It is advertised to Windows devices through the enrollment policy (MS-XCEP) endpoint.
+// The subject and subject alternative names are patterns which can contain the variables listed in TemplateVariables.
+type Template struct {
+	Name               string        `yaml:"name"`                 // The unique name of a named template. It is empty for the default template.
+	Subject            string        `yaml:"subject"`              // The subject pattern in the form 'CN=...,O=...'. If empty the issuer's default subject is used.
+	DNSNames           []string      `yaml:"dns_names"`            // The DNS name patterns
+	EmailAddresses     []string      `yaml:"email_addresses"`      // The email address patterns
+	UPNs               []string      `yaml:"upns"`                 // The Microsoft user principal name patterns
+	URIs               []string      `yaml:"uris"`                 // The URI patterns
+	KeyUsages          []string      `yaml:"key_usages"`           // The names of the key usages. See keyUsageNames.
+	ExtKeyUsages       []string      `yaml:"ext_key_usages"`       // The names or dotted OIDs of the extended key usages. See extKeyUsageNames.
+	PublicKeyAlgorithm string        `yaml:"public_key_algorithm"` // The algorithm of the device's private key. It is either rsa or ecdsa.
+	MinimalKeyLength   int           `yaml:"minimal_key_length"`   // The minimum size in bits of the device's private key. For ECDSA it is the size of the curve.
+	HashAlgorithmOID   string        `yaml:"hash_algorithm_oid"`   // The OID of the hash algorithm the device signs its certificate request with
+	ValidityPeriod     time.Duration `yaml:"validity_period"`      // How long an issued certificate is valid for
+	RenewalPeriod      time.Duration `yaml:"renewal_period"`       // How long before expiry the device should renew its certificate
+	Machine            *bool         `yaml:"machine"`              // If enabled the certificate enrollment web services only issue the template to devices authenticated by their client certificate
+	CopyRequestSANs    *bool         `yaml:"copy_request_sans"`    // If enabled the request's subject alternative names are used when the template has no patterns for them. Any requester can then choose the names.
+	Revision           int           `yaml:"revision"`             // Incremented every time the template is changed (Read only)
+	UpdatedAt          time.Time     `yaml:"updated_at"`           // The time the template was last changed (Read only)
+}
+
+// Public key algorithms which can be used in a Template
+const (
+	PublicKeyAlgorithmRSA   = "rsa"
+	PublicKeyAlgorithmECDSA = "ecdsa"
+)
+
+// Public key algorithm OIDs advertised to devices. ECDSA keys are identified by their curve.
+const (
+	OIDRSA       = "1.2.840.113549.1.1.1"
+	OIDECDSAP256 = "1.2.840.10045.3.1.7"
+	OIDECDSAP384 = "1.3.132.0.34"
+)
+
+// Hash algorithm OIDs which can be used in a Template
+const (
+	OIDSHA256 = "2.16.840.1.101.3.4.2.1"
+	OIDSHA384 = "2.16.840.1.101.3.4.2.2"
+	OIDSHA512 = "2.16.840.1.101.3.4.2.3"
+)
+
+// hashAlgorithmNames maps the supported hash algorithm OIDs to their names
+var hashAlgorithmNames = map[string]string{
+	OIDSHA256: "sha256",
+	OIDSHA384: "sha384",
+	OIDSHA512: "sha512",
+}
+
+// DefaultTemplate is the Template used before an administrator has configured one
+var DefaultTemplate = Template{
+	PublicKeyAlgorithm: PublicKeyAlgorithmRSA,
+	MinimalKeyLength:   2048,
+	HashAlgorithmOID:   OIDSHA256,
+	ValidityPeriod:     365 * 24 * time.Hour,
+	RenewalPeriod:      42 * 24 * time.Hour,
+	KeyUsages:          []string{"digital_signature"},
+	ExtKeyUsages:       []string{"client_auth"},
+	Revision:           1,
+}
+
+// HashAlgorithmName returns the friendly name of the templates hash algorithm
+func (template Template) HashAlgorithmName() string {
+	return hashAlgorithmNames[template.HashAlgorithmOID]
+}
+
+// PublicKeyAlgorithmOID returns the OID of the templates public key algorithm and the name of it used by Windows
+func (template Template) PublicKeyAlgorithmOID() (string, string) {
+	if template.PublicKeyAlgorithm != PublicKeyAlgorithmECDSA {
+		return OIDRSA, "RSA"
+	} else if template.MinimalKeyLength > 256 {
+		return OIDECDSAP384, "ECDSA_P384"
+	}
+	return OIDECDSAP256, "ECDSA_P256"
+}
+
+// VerifyPublicKey checks the public key from a device's certificate request can be used. RSA and ECDSA keys are accepted.
+// The minimal key length applies to keys using the templates public key algorithm. Keys using the other algorithm must be at least RSA-2048 or P-256.
+func (template Template) VerifyPublicKey(publicKey crypto.PublicKey) error {
+	switch publicKey := publicKey.(type) {
+	case *rsa.PublicKey:
+		minimalKeyLength := 2048
+		if template.PublicKeyAlgorithm == PublicKeyAlgorithmRSA {
+			minimalKeyLength = template.MinimalKeyLength
+		}
+
+		if publicKey.N.BitLen() < minimalKeyLength {
+			return errors.New("certificate request public key is smaller than the templates minimal key length")
+		}
+	case *ecdsa.PublicKey:
+		minimalKeyLength := 256
+		if template.PublicKeyAlgorithm == PublicKeyAlgorithmECDSA {
+			minimalKeyLength = template.MinimalKeyLength
+		}
+
+		if publicKey.Curve != elliptic.P256() && publicKey.Curve != elliptic.P384() {
+			return errors.New("certificate request public key must use the P-256 or P-384 curve")
+		} else if publicKey.Curve.Params().BitSize < minimalKeyLength {
+			return errors.New("certificate request public key is smaller than the templates minimal key length")
+		}
+	default:
+		return errors.New("certificate request public key is not an rsa or ecdsa key")
+	}
+	return nil
+}
+
+// Verify checks the Template is valid. This is done prior to saving an updated template.
+func (template Template) Verify() error {
+	switch template.PublicKeyAlgorithm {
+	case PublicKeyAlgorithmRSA:
+		if template.MinimalKeyLength < 2048 || template.MinimalKeyLength > 16384 {
+			return errors.New("invalid template: minimal key length must be between 2048 and 16384 bits")
+		}
+	case PublicKeyAlgorithmECDSA:
+		if template.MinimalKeyLength != 256 && template.MinimalKeyLength != 384 {
+			return errors.New("invalid template: minimal key length must be 256 or 384 bits for ecdsa")
+		}
+	default:
+		return errors.New("invalid template: unsupported public key algorithm '" + template.PublicKeyAlgorithm + "'. It must be rsa or ecdsa")
+	}
+
+	if _, ok := hashAlgorithmNames[template.HashAlgorithmOID]; !ok {
+		return errors.New("invalid template: unsupported hash algorithm oid '" + template.HashAlgorithmOID + "'")
+	}
+
+	if template.ValidityPeriod < 24*time.Hour {
+		return errors.New("invalid template: validity period must be at least 24 hours")
+	}
+
+	if template.RenewalPeriod <= 0 || template.RenewalPeriod >= template.ValidityPeriod {
+		return errors.New("invalid template: renewal period must be positive and shorter than the validity period")
+	}
+
+	return template.verifyCertificateProperties()
+}
+
+// IsMachine checks if the template can only be issued to devices authenticated by their client certificate
+func (template Template) IsMachine() bool {
+	return template.Machine != nil && *template.Machine
+}
+
+// CopiesRequestSANs checks if the request's subject alternative names are used when the template has no patterns for them
+func (template Template) CopiesRequestSANs() bool {
+	return template.CopyRequestSANs != nil && *template.CopyRequestSANs
+}
+
+// equal checks if two templates contain the same certificate properties. The revision details are ignored.
+func (template Template) equal(other Template) bool {
+	template.Revision, template.UpdatedAt = 0, time.Time{}
+	other.Revision, other.UpdatedAt = 0, time.Time{}
+	return reflect.DeepEqual(template, other)
+}
+
+// PolicyOID returns the object identifier of the enrollment policy.
+// It is derived from the PolicyID using the UUID arc (2.25) defined in ITU-T X.667.
+func (certificates Certificates) PolicyOID() string {
+	id, err := uuid.FromString(certificates.PolicyID)
+	if err != nil {
+		return ""
+	}
+
+	return "2.25." + new(big.Int).SetBytes(id.Bytes()).String()
 }
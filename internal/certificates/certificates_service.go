@@ -2,19 +2,20 @@ package certificates
 
 import (
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/asn1"
 	"fmt"
-	"math/big"
 	mathrand "math/rand"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/mattrax/Mattrax/internal/datastore"
+	"github.com/mattrax/Mattrax/internal/generic"
+	"github.com/mattrax/Mattrax/internal/kek"
+	"github.com/mattrax/Mattrax/internal/merge"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
@@ -26,6 +27,27 @@ type Service struct {
 	certificates Certificates
 	mutex        *sync.Mutex // Mutex is used to ensures exclusive access to the certificates
 	store        datastore.Store
+	issuedMutex  *sync.Mutex     // issuedMutex is used to ensure exclusive access to the issued certificate registry
+	issued       datastore.Store // issued stores the registry of certificates issued by the identity certificate
+	ocspMutex    *sync.Mutex     // ocspMutex is used to ensure only one OCSP signing certificate is issued at a time
+	scepMutex    *sync.Mutex     // scepMutex is used to ensure only one SCEP registration authority certificate is issued at a time
+
+	crls     map[string]cachedCRL // The cached CRLs of each identity indexed by the identity's CertHash
+	kek      *kek.KEK             // kek encrypts the private keys before they are stored
+	keyStore KeyStore             // keyStore creates the private keys if they must be kept outside the datastore. It is nil if keys are stored encrypted in the datastore.
+
+	scepChallengeKey    []byte              // The decrypted key SCEP challenge passwords are derived with. It is nil until the first challenge is created.
+	revocationLocations RevocationLocations // Returns the revocation locations added to issued certificates. It is nil if they aren't served.
+}
+
+// RevocationLocations returns the CRL distribution points and OCSP responders for certificates issued by the identity with the CertHash
+type RevocationLocations func(issuerCertHash string) (crlDistributionPoints []string, ocspServers []string)
+
+// SetRevocationLocations sets the revocation locations which are added to every issued certificate
+func (s *Service) SetRevocationLocations(locations RevocationLocations) {
+	s.mutex.Lock()
+	s.revocationLocations = locations
+	s.mutex.Unlock()
 }
 
 // Get returns the loaded settings.
@@ -37,27 +59,57 @@ func (s *Service) Get() Certificates {
 	return settings
 }
 
-// GenerateIdentity creates a new identity certificate and key pair
-func (s *Service) GenerateIdentity(subject pkix.Name) error {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+// GenerateIdentity creates the initial identity certificate and key pair using the key algorithm.
+// It fails if an identity already exists because replacing it would break trust with every enrolled device. StartRollover must be used instead.
+func (s *Service) GenerateIdentity(subject pkix.Name, algorithm KeyAlgorithm) error {
+	identity, err := s.newIdentity(subject, algorithm)
 	if err != nil {
-		return errors.Wrap(err, "error generating identity private key")
+		return err
 	}
 
-	publicKeyBytes, err := asn1.Marshal(RsaPublicKey{
-		N: privateKey.PublicKey.N,
-		E: privateKey.PublicKey.E,
-	})
+	s.mutex.Lock()
+	if s.certificates.Identity.Cert != nil {
+		s.mutex.Unlock()
+		return errors.New("error generating identity: an identity already exists. a rollover must be used to replace it")
+	}
+	previousCertificates := s.certificates
+	s.certificates.Identity = identity
+	s.certificates.OCSPSigner = OCSPSigner{} // The OCSP signer must be reissued by the new identity
+	s.crls = map[string]cachedCRL{}
+
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		s.mutex.Unlock()
+		log.Error().Err(err).Msg("error saving new Mattrax identity")
+		return errors.New("internal error saving certificates. intiial certificates were restored")
+
+	}
+
+	s.mutex.Unlock()
+	log.Info().Str("CommonName", identity.Subject.CommonName).Time("Expires", identity.NotAfter).Msg("Generated new Mattrax identity...")
+	return nil
+}
+
+// newIdentity creates a new identity certificate and key pair. The private key is created in the key store if one is configured.
+func (s *Service) newIdentity(subject pkix.Name, algorithm KeyAlgorithm) (Identity, error) {
+	privateKey, encryptedKey, keyID, err := s.generateKey(algorithm)
 	if err != nil {
-		return errors.Wrap(err, "error marshalling identity rsaPublicKey")
+		return Identity{}, errors.Wrap(err, "error generating identity private key")
 	}
 
-	subjectKeyIDRaw := sha1.Sum(publicKeyBytes)
-	subjectKeyID := subjectKeyIDRaw[:]
+	subjectKeyID, err := subjectKeyID(privateKey.Public())
+	if err != nil {
+		return Identity{}, errors.Wrap(err, "error marshalling identity public key")
+	}
+
+	serialNumber, err := NewSerialNumber()
+	if err != nil {
+		return Identity{}, errors.Wrap(err, "error generating identity serial number")
+	}
 
 	NotBefore := time.Now().Add(time.Duration(mathrand.Int31n(120)) * -time.Minute) // This randomises the creation time for added security
 	certificate := &x509.Certificate{
-		SerialNumber:                big.NewInt(1), // TODO: What does it do. Should it be increasing
+		SerialNumber:                serialNumber,
 		Subject:                     subject,
 		NotBefore:                   NotBefore,
 		NotAfter:                    NotBefore.Add(365 * 24 * time.Hour),
@@ -73,9 +125,15 @@ func (s *Service) GenerateIdentity(subject pkix.Name) error {
 		PermittedDNSDomains:         nil,   // TODO: What does it do
 	}
 
-	certificateDer, err := x509.CreateCertificate(rand.Reader, certificate, certificate, &privateKey.PublicKey, privateKey)
+	certificateDer, err := x509.CreateCertificate(rand.Reader, certificate, certificate, privateKey.Public(), privateKey)
 	if err != nil {
-		return errors.Wrap(err, "error generating identity certificate")
+		return Identity{}, errors.Wrap(err, "error generating identity certificate")
+	}
+
+	// The certificate is parsed so it contains the values filled in when it was signed
+	certificate, err = x509.ParseCertificate(certificateDer)
+	if err != nil {
+		return Identity{}, errors.Wrap(err, "error parsing identity certificate")
 	}
 
 	// TODO: Replace with sha1_hash := fmt.Sprintf("%x", sha1.Sum(form_value))
@@ -83,45 +141,268 @@ func (s *Service) GenerateIdentity(subject pkix.Name) error {
 	sha1Hasher.Write(certificateDer)
 	certificateHash := strings.ToUpper(fmt.Sprintf("%x", sha1Hasher.Sum(nil))) // TODO: Cleanup
 
-	privateKeyDer := x509.MarshalPKCS1PrivateKey(privateKey)
+	return Identity{
+		Origin:       IdentityGenerated,
+		Cert:         certificate,
+		CertRaw:      certificateDer,
+		CertHash:     certificateHash,
+		Signer:       privateKey,
+		EncryptedKey: encryptedKey,
+		KeyID:        keyID,
+		Subject:      certificate.Subject,
+		NotBefore:    certificate.NotBefore,
+		NotAfter:     certificate.NotAfter,
+	}, nil
+}
+
+// SetTemplate saves an updated device certificate template. The templates revision is incremented if it was changed.
+// Fields which are not set in the new template are kept from the current template.
+func (s *Service) SetTemplate(template Template) error {
+	if template.Name != "" {
+		return errors.New("invalid template: the default template can't be named. Use a named template instead")
+	}
 
 	s.mutex.Lock()
-	previousCertificates := s.certificates
-	s.certificates.Identity = Identity{
-		Cert:      certificate,
-		CertRaw:   certificateDer,
-		CertHash:  certificateHash,
-		Key:       privateKey,
-		KeyRaw:    privateKeyDer,
-		Subject:   certificate.Subject,
-		NotBefore: certificate.NotBefore,
-		NotAfter:  certificate.NotAfter,
-	}
-
-	if err := s.store.Set(certificatesKey, s.certificates); err != nil {
-		s.certificates = previousCertificates
-		s.mutex.Unlock()
-		log.Error().Err(err).Msg("error saving new Mattrax identity")
-		return errors.New("internal error saving certificates. intiial certificates were restored")
+	defer s.mutex.Unlock()
 
+	previousTemplate := s.certificates.Template
+	if err := merge.Merge(&template, previousTemplate); err != nil {
+		log.Error().Err(err).Msg("error merging Template structs")
+		return errors.New("internal server error: failed to merge certificate template")
 	}
 
-	s.mutex.Unlock()
-	log.Info().Str("CommonName", s.certificates.Identity.Subject.CommonName).Time("Expires", s.certificates.Identity.NotAfter).Msg("Generated new Mattrax identity...")
+	if err := template.Verify(); err != nil {
+		return err
+	}
+
+	if template.equal(previousTemplate) {
+		return nil
+	}
+	template.Revision = previousTemplate.Revision + 1
+	template.UpdatedAt = time.Now().UTC()
+	s.certificates.Template = template
+
+	if err := s.save(); err != nil {
+		s.certificates.Template = previousTemplate
+		log.Error().Err(err).Msg("error saving certificate template")
+		return errors.New("internal error saving certificate template. values were not changed")
+	}
+
+	log.Info().Int("revision", template.Revision).Msg("Updated device certificate template...")
 	return nil
 }
 
-// NewService initialises and returns a new CertificateService
-func NewService(store datastore.Store) (*Service, error) {
-	var certificates Certificates
-	err := store.Get(certificatesKey, &certificates)
+// Issue signs the certificate using the identity certificate and records it in the issued certificate registry.
+// A unique serial number is generated for the certificate and the revocation locations of the identity which signs it are added.
+func (s *Service) Issue(template *x509.Certificate, publicKey interface{}, deviceUUID string) (*x509.Certificate, error) {
+	s.mutex.Lock()
+	identity, revocationLocations := s.certificates.Identity, s.revocationLocations
+	s.mutex.Unlock()
+	if identity.Cert == nil || identity.Signer == nil {
+		return nil, errors.New("error issuing certificate: the identity certificate has not been generated")
+	}
+
+	// The locations are taken from the identity used to sign the certificate so a cutover can't make them point to another identity
+	if revocationLocations != nil {
+		template.CRLDistributionPoints, template.OCSPServer = revocationLocations(identity.CertHash)
+	}
+
+	s.issuedMutex.Lock()
+	defer s.issuedMutex.Unlock()
+
+	for {
+		serialNumber, err := NewSerialNumber()
+		if err != nil {
+			return nil, errors.Wrap(err, "error generating certificate serial number")
+		}
+
+		var existing IssuedCertificate
+		if err := s.issued.Get(issuedSerialKey(FormatSerialNumber(serialNumber)), &existing); err != nil && err != datastore.ErrNotFound {
+			return nil, errors.Wrap(err, "error checking certificate serial number is unique")
+		} else if existing.SerialNumber == "" {
+			template.SerialNumber = serialNumber
+			break
+		}
+	}
+
+	certificateDer, err := x509.CreateCertificate(rand.Reader, template, identity.Cert, publicKey, identity.Signer)
 	if err != nil {
+		return nil, errors.Wrap(err, "error signing certificate")
+	}
+
+	certificate, err := x509.ParseCertificate(certificateDer)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing signed certificate")
+	}
+
+	// The certificate and its indexes are saved together so the registry is never partially updated
+	issuedCertificate := newIssuedCertificate(certificate, identity.CertHash, deviceUUID)
+	if err := s.issued.Update(func(tx datastore.Tx) error {
+		if err := saveIssued(tx, issuedCertificate); err != nil {
+			return err
+		}
+
+		var issuerSerialNumbers []string
+		if err := tx.Get(issuedIssuerKey(identity.CertHash), &issuerSerialNumbers); err != nil && err != datastore.ErrNotFound {
+			return errors.Wrap(err, "error loading identity's issued certificates")
+		}
+
+		if err := tx.Set(issuedIssuerKey(identity.CertHash), append(issuerSerialNumbers, issuedCertificate.SerialNumber)); err != nil {
+			return errors.Wrap(err, "error saving identity's issued certificates")
+		}
+
+		if deviceUUID != "" {
+			var serialNumbers []string
+			if err := tx.Get(issuedDeviceKey(deviceUUID), &serialNumbers); err != nil && err != datastore.ErrNotFound {
+				return errors.Wrap(err, "error loading device's issued certificates")
+			}
+
+			if err := tx.Set(issuedDeviceKey(deviceUUID), append(serialNumbers, issuedCertificate.SerialNumber)); err != nil {
+				return errors.Wrap(err, "error saving device's issued certificates")
+			}
+		}
+
+		return nil
+	}); err != nil {
 		return nil, err
 	}
 
-	return &Service{
-		certificates: certificates,
-		mutex:        &sync.Mutex{},
-		store:        store,
-	}, nil
+	log.Debug().Str("serial-number", issuedCertificate.SerialNumber).Str("subject", issuedCertificate.Subject).Str("device-uuid", deviceUUID).Msg("Issued certificate")
+	return certificate, nil
+}
+
+// saveIssued stores the issued certificate and its hash indexes in the transaction. The caller must hold the issuedMutex.
+func saveIssued(tx datastore.Tx, issuedCertificate IssuedCertificate) error {
+	if err := tx.Set(issuedSerialKey(issuedCertificate.SerialNumber), issuedCertificate); err != nil {
+		return errors.Wrap(err, "error saving issued certificate")
+	}
+
+	if err := tx.Set(issuedSHA1Key(issuedCertificate.SHA1Hash), issuedCertificate.SerialNumber); err != nil {
+		return errors.Wrap(err, "error saving issued certificate sha1 index")
+	}
+
+	if err := tx.Set(issuedSHA256Key(issuedCertificate.SHA256Hash), issuedCertificate.SerialNumber); err != nil {
+		return errors.Wrap(err, "error saving issued certificate sha256 index")
+	}
+
+	return nil
+}
+
+// GetIssued returns the issued certificate with the serial number (in hex). The bool is false if no certificate has the serial number.
+func (s *Service) GetIssued(serialNumber string) (IssuedCertificate, bool, error) {
+	var issuedCertificate IssuedCertificate
+	if err := s.issued.Get(issuedSerialKey(serialNumber), &issuedCertificate); err != nil && err != datastore.ErrNotFound {
+		return IssuedCertificate{}, false, err
+	}
+
+	return issuedCertificate, issuedCertificate.SerialNumber != "", nil
+}
+
+// GetIssuedByHash returns the issued certificate with the SHA-1 or SHA-256 hash (in hex). The bool is false if no certificate has the hash.
+func (s *Service) GetIssuedByHash(hash string) (IssuedCertificate, bool, error) {
+	var key []byte
+	switch len(hash) {
+	case sha1.Size * 2:
+		key = issuedSHA1Key(hash)
+	case sha256.Size * 2:
+		key = issuedSHA256Key(hash)
+	default:
+		return IssuedCertificate{}, false, nil
+	}
+
+	var serialNumber string
+	if err := s.issued.Get(key, &serialNumber); err == datastore.ErrNotFound {
+		return IssuedCertificate{}, false, nil
+	} else if err != nil {
+		return IssuedCertificate{}, false, err
+	}
+
+	return s.GetIssued(serialNumber)
+}
+
+// GetIssuedByDevice returns the certificates issued to the device in the order they were issued
+func (s *Service) GetIssuedByDevice(deviceUUID string) ([]IssuedCertificate, error) {
+	var serialNumbers []string
+	if err := s.issued.Get(issuedDeviceKey(deviceUUID), &serialNumbers); err != nil && err != datastore.ErrNotFound {
+		return nil, err
+	}
+
+	issuedCertificates := make([]IssuedCertificate, 0, len(serialNumbers))
+	for _, serialNumber := range serialNumbers {
+		issuedCertificate, ok, err := s.GetIssued(serialNumber)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			issuedCertificates = append(issuedCertificates, issuedCertificate)
+		}
+	}
+
+	return issuedCertificates, nil
+}
+
+// NewService initialises and returns a new CertificateService.
+// The issued store is used for the registry of certificates issued by the identity certificate.
+// Private keys are encrypted with the key encryption key before they are saved to the store.
+// If a key store is given new private keys are created in it instead.
+func NewService(store datastore.Store, issued datastore.Store, keyEncryptionKey *kek.KEK, keyStore KeyStore) (*Service, error) {
+	if keyEncryptionKey == nil {
+		return nil, errors.New("a key encryption key is required to protect the certificate private keys")
+	}
+
+	s := &Service{
+		mutex:       &sync.Mutex{},
+		store:       store,
+		issuedMutex: &sync.Mutex{},
+		issued:      issued,
+		ocspMutex:   &sync.Mutex{},
+		scepMutex:   &sync.Mutex{},
+		crls:        map[string]cachedCRL{},
+		kek:         keyEncryptionKey,
+		keyStore:    keyStore,
+	}
+
+	if err := store.Get(certificatesKey, &s.certificates); err != nil && err != datastore.ErrNotFound {
+		return nil, err
+	}
+
+	if err := s.loadKeys(); err != nil {
+		return nil, err
+	}
+
+	// The policy id and template are created on first boot. The policy id must stay constant afterwards.
+	if s.certificates.PolicyID == "" {
+		s.certificates.PolicyID = generic.GenerateID()
+		s.certificates.Template = DefaultTemplate
+		s.certificates.Template.UpdatedAt = time.Now().UTC()
+
+		if err := s.save(); err != nil {
+			return nil, errors.Wrap(err, "error saving initial certificate template")
+		}
+	} else if s.certificates.Template.PublicKeyAlgorithm == "" {
+		s.certificates.Template.PublicKeyAlgorithm = PublicKeyAlgorithmRSA // Templates saved by previous versions only supported RSA
+	}
+
+	// Templates saved by previous versions always issued client authentication certificates
+	if len(s.certificates.Template.KeyUsages) == 0 && len(s.certificates.Template.ExtKeyUsages) == 0 {
+		s.certificates.Template.KeyUsages = DefaultTemplate.KeyUsages
+		s.certificates.Template.ExtKeyUsages = DefaultTemplate.ExtKeyUsages
+	}
+
+	if s.certificates.Templates == nil {
+		s.certificates.Templates = make(map[string]Template, len(defaultNamedTemplates))
+		for _, template := range defaultNamedTemplates {
+			if err := merge.Merge(&template, DefaultTemplate); err != nil {
+				return nil, errors.Wrap(err, "error creating default certificate templates")
+			}
+			template.UpdatedAt = time.Now().UTC()
+			s.certificates.Templates[template.Name] = template
+		}
+		s.certificates.TemplatesUpdatedAt = time.Now().UTC()
+
+		if err := s.save(); err != nil {
+			return nil, errors.Wrap(err, "error saving default certificate templates")
+		}
+	}
+
+	return s, nil
 }
@@ -0,0 +1,73 @@
+package certificates
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mattrax/Mattrax/internal/datastore"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ExpiringDevices returns the newest valid certificate of every device whose certificates all expire within the duration.
+// Devices which have already renewed their certificate are not returned. The certificates are sorted by when they expire.
+func (s *Service) ExpiringDevices(within time.Duration) ([]IssuedCertificate, error) {
+	newest := make(map[string]IssuedCertificate)
+	for _, identity := range s.Get().TrustedIdentities() {
+		var serialNumbers []string
+		if err := s.issued.Get(issuedIssuerKey(identity.CertHash), &serialNumbers); err != nil && err != datastore.ErrNotFound {
+			return nil, pkgerrors.Wrap(err, "error loading identity's issued certificates")
+		}
+
+		for _, serialNumber := range serialNumbers {
+			issuedCertificate, ok, err := s.GetIssued(serialNumber)
+			if err != nil {
+				return nil, pkgerrors.Wrap(err, "error loading issued certificate")
+			} else if !ok || issuedCertificate.DeviceUUID == "" || issuedCertificate.Status != StatusValid {
+				continue
+			}
+
+			if previous, ok := newest[issuedCertificate.DeviceUUID]; !ok || issuedCertificate.NotAfter.After(previous.NotAfter) {
+				newest[issuedCertificate.DeviceUUID] = issuedCertificate
+			}
+		}
+	}
+
+	deadline := time.Now().Add(within)
+	var expiring []IssuedCertificate
+	for _, issuedCertificate := range newest {
+		if issuedCertificate.NotAfter.Before(deadline) {
+			expiring = append(expiring, issuedCertificate)
+		}
+	}
+
+	sort.Slice(expiring, func(i, j int) bool {
+		return expiring[i].NotAfter.Before(expiring[j].NotAfter)
+	})
+	return expiring, nil
+}
+
+// RenewIdentity starts a rollover to a new identity using the key algorithm if the current identity expires within renewBefore.
+// Only identities generated by Mattrax are renewed. Imported identities and identities signed by an offline root are only renewed using the ca command. The bool is true if a rollover was started.
+func (s *Service) RenewIdentity(renewBefore time.Duration, algorithm KeyAlgorithm) (bool, error) {
+	certificates := s.Get()
+	if certificates.Identity.Cert == nil || certificates.NextIdentity.Cert != nil || time.Until(certificates.Identity.NotAfter) > renewBefore {
+		return false, nil
+	} else if certificates.Identity.Origin != IdentityGenerated {
+		return false, nil
+	}
+
+	// The overlap is shortened if needed so the new identity is used before the current one expires
+	overlap := DefaultRolloverOverlap
+	if remaining := time.Until(certificates.Identity.NotAfter) / 2; remaining < overlap {
+		overlap = remaining
+	}
+	cutoverAt := time.Now().Add(overlap)
+
+	if err := s.StartRollover(certificates.Identity.Subject, algorithm, cutoverAt); err != nil {
+		return false, err
+	}
+
+	log.Info().Str("CertHash", certificates.Identity.CertHash).Time("NotAfter", certificates.Identity.NotAfter).Msg("Renewing expiring Mattrax identity...")
+	return true, nil
+}
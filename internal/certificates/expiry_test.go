@@ -0,0 +1,53 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestExpiry(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating device key
+	issue := func(deviceUUID string, lifetime time.Duration) {
+		_, err := service.Issue(&x509.Certificate{
+			Subject:   pkix.Name{CommonName: deviceUUID},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(lifetime),
+		}, &privateKey.PublicKey, deviceUUID)
+		is.NoErr(err) // Error issuing certificate
+	}
+
+	issue("expiring", 24*time.Hour)
+	issue("renewed", 24*time.Hour)
+	issue("renewed", 90*24*time.Hour)
+	issue("valid", 90*24*time.Hour)
+
+	expiring, err := service.ExpiringDevices(7 * 24 * time.Hour)
+	is.NoErr(err)                                // Error listing expiring devices
+	is.Equal(len(expiring), 1)                   // Only devices which haven't renewed should be expiring
+	is.Equal(expiring[0].DeviceUUID, "expiring") // The device with an expiring certificate should be returned
+	expiring, err = service.ExpiringDevices(365 * 24 * time.Hour)
+	is.NoErr(err)
+	is.Equal(len(expiring), 3)                   // Every device should expire within a year
+	is.Equal(expiring[0].DeviceUUID, "expiring") // Devices should be sorted by expiry
+
+	renewed, err := service.RenewIdentity(30*24*time.Hour, ECDSAP256)
+	is.NoErr(err)
+	is.True(!renewed) // Identity which isn't expiring must not be renewed
+
+	renewed, err = service.RenewIdentity(400*24*time.Hour, ECDSAP256)
+	is.NoErr(err)                                                                     // Error renewing identity
+	is.True(renewed)                                                                  // Expiring identity should be renewed
+	is.True(service.Get().NextIdentity.Cert != nil)                                   // Renewal should start a rollover
+	is.True(service.Get().Rollover.CutoverAt.Before(service.Get().Identity.NotAfter)) // Cutover must happen before the identity expires
+}
@@ -0,0 +1,245 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mattrax/Mattrax/internal/kek"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// IntermediateRequest is a certificate signing request for an issuing identity which must be signed by an offline root.
+// The private key is kept by the server until the signed certificate is imported.
+type IntermediateRequest struct {
+	Subject      pkix.Name `graphql:"-"`
+	CSR          []byte    // The DER encoded certificate signing request
+	CreatedAt    time.Time
+	Signer       crypto.Signer `graphql:"-"` // Signs using the private key. It is loaded when the server starts and is never stored.
+	EncryptedKey *kek.Envelope `graphql:"-"` // The PKCS#8 private key (PKCS#1 if created by a previous version) encrypted with the key encryption key. It is empty if the key is in the key store.
+	KeyID        []byte        `graphql:"-"` // The ID of the private key in the key store. It is empty if the key is stored encrypted in the datastore.
+}
+
+// CreateIntermediateRequest generates a private key using the key algorithm for a new issuing identity and returns the DER encoded certificate signing request for it.
+// The request must be signed by the offline root and imported using ImportIntermediate. Creating a new request replaces the pending request.
+func (s *Service) CreateIntermediateRequest(subject pkix.Name, algorithm KeyAlgorithm) ([]byte, error) {
+	privateKey, encryptedKey, keyID, err := s.generateKey(algorithm)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error generating intermediate private key")
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: subject,
+	}, privateKey)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error creating intermediate certificate request")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previousCertificates := s.certificates
+	s.certificates.IntermediateRequest = IntermediateRequest{
+		Subject:      subject,
+		CSR:          csr,
+		CreatedAt:    time.Now().UTC(),
+		Signer:       privateKey,
+		EncryptedKey: encryptedKey,
+		KeyID:        keyID,
+	}
+
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		return nil, pkgerrors.Wrap(err, "error saving intermediate certificate request")
+	}
+
+	log.Info().Str("CommonName", subject.CommonName).Msg("Created intermediate certificate request...")
+	return csr, nil
+}
+
+// ImportIntermediate imports the DER encoded certificate the offline root issued for the pending intermediate request.
+// The intermediate becomes the identity if none exists, otherwise it is staged as the next identity and cut over to at cutoverAt.
+func (s *Service) ImportIntermediate(certificateDer []byte, rootDer []byte, cutoverAt time.Time) error {
+	request := s.Get().IntermediateRequest
+	if request.Signer == nil {
+		return errors.New("error importing intermediate: there is no pending intermediate certificate request")
+	}
+
+	certificate, err := x509.ParseCertificate(certificateDer)
+	if err != nil {
+		return pkgerrors.Wrap(err, "error parsing intermediate certificate")
+	}
+
+	root, err := x509.ParseCertificate(rootDer)
+	if err != nil {
+		return pkgerrors.Wrap(err, "error parsing root certificate")
+	}
+
+	if ok, err := samePublicKey(certificate.PublicKey, request.Signer.Public()); err != nil {
+		return pkgerrors.Wrap(err, "invalid intermediate certificate")
+	} else if !ok {
+		return errors.New("invalid intermediate certificate: it was not issued for the pending certificate request")
+	}
+
+	if _, err := verifyIssuingCA(certificate, root, nil); err != nil {
+		return err
+	}
+
+	identity := Identity{
+		Origin:       IdentityOfflineRoot,
+		Cert:         certificate,
+		CertRaw:      certificate.Raw,
+		CertHash:     fmt.Sprintf("%X", sha1.Sum(certificate.Raw)),
+		Signer:       request.Signer,
+		EncryptedKey: request.EncryptedKey,
+		KeyID:        request.KeyID,
+		Subject:      certificate.Subject,
+		NotBefore:    certificate.NotBefore,
+		NotAfter:     certificate.NotAfter,
+		RootCert:     root,
+		RootCertRaw:  root.Raw,
+		RootCertHash: fmt.Sprintf("%X", sha1.Sum(root.Raw)),
+	}
+
+	if err := s.installIdentity(identity, cutoverAt); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	if bytes.Equal(s.certificates.IntermediateRequest.CSR, request.CSR) {
+		s.certificates.IntermediateRequest = IntermediateRequest{}
+		if err := s.save(); err != nil {
+			log.Error().Err(err).Msg("error removing imported intermediate certificate request")
+		}
+	}
+	s.mutex.Unlock()
+
+	log.Info().Str("CommonName", identity.Subject.CommonName).Str("Root", root.Subject.CommonName).Time("Expires", identity.NotAfter).Msg("Imported intermediate Mattrax identity...")
+	return nil
+}
+
+// installIdentity makes the identity the current identity if none exists, otherwise it is staged as the next identity and cut over to at cutoverAt
+func (s *Service) installIdentity(identity Identity, cutoverAt time.Time) error {
+	s.mutex.Lock()
+	if s.certificates.Identity.Cert != nil {
+		s.mutex.Unlock()
+		return s.stageIdentity(identity, cutoverAt)
+	}
+	defer s.mutex.Unlock()
+
+	previousCertificates := s.certificates
+	s.certificates.Identity = identity
+	s.certificates.OCSPSigner = OCSPSigner{} // The OCSP signer must be reissued by the new identity
+	s.crls = map[string]cachedCRL{}
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error saving identity")
+	}
+	return nil
+}
+
+// samePublicKey checks if the public keys are equal
+func samePublicKey(publicKey crypto.PublicKey, other crypto.PublicKey) (bool, error) {
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return false, err
+	}
+
+	otherDer, err := x509.MarshalPKIXPublicKey(other)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(publicKeyDer, otherDer), nil
+}
+
+// verifyIssuingCA checks the certificate chains to the root through the intermediates and can be used to issue device certificates.
+// The verified chain is returned starting with the certificate and ending with the root.
+func verifyIssuingCA(certificate *x509.Certificate, root *x509.Certificate, intermediates []*x509.Certificate) ([]*x509.Certificate, error) {
+	if !root.IsCA || !bytes.Equal(root.RawIssuer, root.RawSubject) {
+		return nil, errors.New("invalid root certificate: the root must be a self-signed certificate authority")
+	} else if err := root.CheckSignatureFrom(root); err != nil {
+		return nil, pkgerrors.Wrap(err, "invalid root certificate")
+	}
+
+	if !certificate.IsCA || !certificate.BasicConstraintsValid {
+		return nil, errors.New("invalid ca certificate: it must be a certificate authority")
+	} else if certificate.KeyUsage&x509.KeyUsageCertSign == 0 || certificate.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return nil, errors.New("invalid ca certificate: it must allow the certificate sign and crl sign key usages")
+	} else if time.Now().After(certificate.NotAfter) {
+		return nil, errors.New("invalid ca certificate: it has expired")
+	}
+
+	roots, intermediatePool := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(root)
+	for _, intermediate := range intermediates {
+		intermediatePool.AddCert(intermediate)
+	}
+	chains, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediatePool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "invalid ca certificate: it was not issued by the root")
+	}
+
+	return chains[0], nil
+}
+
+// TrustChain returns the root and intermediate certificates of the identities. Each certificate is only included once.
+func TrustChain(identities []Identity) (roots []*x509.Certificate, intermediates []*x509.Certificate) {
+	seen := map[string]bool{}
+	for _, identity := range identities {
+		anchor := identity.TrustAnchor()
+		if !seen[string(anchor.Raw)] {
+			seen[string(anchor.Raw)] = true
+			roots = append(roots, anchor)
+		}
+
+		if identity.RootCert == nil {
+			continue
+		}
+
+		for _, intermediate := range append([]*x509.Certificate{identity.Cert}, identity.Chain...) {
+			if !seen[string(intermediate.Raw)] {
+				seen[string(intermediate.Raw)] = true
+				intermediates = append(intermediates, intermediate)
+			}
+		}
+	}
+	return roots, intermediates
+}
+
+// TrustChainHashes returns the uppercase hex SHA-1 hashes of the certificates devices must install to trust the identities.
+// They are the names the certificates are installed under by the CertificateStore CSP and are sorted.
+func TrustChainHashes(identities []Identity) []string {
+	roots, intermediates := TrustChain(identities)
+	var hashes []string
+	for _, certificate := range append(roots, intermediates...) {
+		hashes = append(hashes, fmt.Sprintf("%X", sha1.Sum(certificate.Raw)))
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// TrustedCertPools returns the pools used to verify certificates issued by a trusted identity
+func (certificates Certificates) TrustedCertPools() (*x509.CertPool, *x509.CertPool) {
+	roots, intermediates := TrustChain(certificates.TrustedIdentities())
+
+	rootPool, intermediatePool := x509.NewCertPool(), x509.NewCertPool()
+	for _, root := range roots {
+		rootPool.AddCert(root)
+	}
+	for _, intermediate := range intermediates {
+		intermediatePool.AddCert(intermediate)
+	}
+	return rootPool, intermediatePool
+}
@@ -0,0 +1,96 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestImportIntermediate(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating root key
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Offline Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDer, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	is.NoErr(err) // Error creating root
+	root, err := x509.ParseCertificate(rootDer)
+	is.NoErr(err) // Error parsing root
+
+	is.True(service.ImportIntermediate(rootDer, rootDer, time.Time{}) != nil) // Import requires a pending request
+
+	csrDer, err := service.CreateIntermediateRequest(pkix.Name{CommonName: "Issuing CA"}, RSA2048)
+	is.NoErr(err) // Error creating intermediate request
+	csr, err := x509.ParseCertificateRequest(csrDer)
+	is.NoErr(err)                  // Error parsing intermediate request
+	is.NoErr(csr.CheckSignature()) // Request should be signed by the pending key
+	is.Equal(csr.Subject.CommonName, "Issuing CA")
+
+	sign := func(publicKey interface{}, keyUsage x509.KeyUsage) []byte {
+		certificateDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber:          big.NewInt(2),
+			Subject:               csr.Subject,
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(12 * time.Hour),
+			KeyUsage:              keyUsage,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}, root, publicKey, rootKey)
+		is.NoErr(err) // Error signing intermediate
+		return certificateDer
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)                                                                                                                           // Error generating other key
+	is.True(service.ImportIntermediate(sign(&otherKey.PublicKey, x509.KeyUsageCertSign|x509.KeyUsageCRLSign), rootDer, time.Time{}) != nil) // Certificate must be for the pending key
+	is.True(service.ImportIntermediate(sign(csr.PublicKey, x509.KeyUsageDigitalSignature), rootDer, time.Time{}) != nil)                    // Certificate must be able to sign certificates
+
+	is.NoErr(service.ImportIntermediate(sign(csr.PublicKey, x509.KeyUsageCertSign|x509.KeyUsageCRLSign), rootDer, time.Now().Add(time.Hour))) // Error importing intermediate
+	is.Equal(len(service.Get().IntermediateRequest.CSR), 0)                                                                                   // Pending request should be removed
+	is.True(service.Get().NextIdentity.RootCert.Equal(root))                                                                                  // Intermediate should be staged as the next identity
+	is.NoErr(service.Cutover())                                                                                                               // Error cutting over to the intermediate
+
+	roots, intermediates := TrustChain(service.Get().TrustedIdentities())
+	is.Equal(len(roots), 2)         // The previous self-signed identity and the offline root should be roots
+	is.Equal(len(intermediates), 1) // The issuing identity should be an intermediate
+
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating device key
+	certificate, err := service.Issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "device"},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &deviceKey.PublicKey, "device-uuid")
+	is.NoErr(err) // Error issuing certificate
+
+	reloaded, err := NewService(service.store, service.issued, service.kek, nil)
+	is.NoErr(err)                                              // Error reloading certificates
+	is.True(reloaded.Get().Identity.TrustAnchor().Equal(root)) // Offline root should be loaded
+
+	rootPool, intermediatePool := reloaded.Get().TrustedCertPools()
+	chains, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	is.NoErr(err)                                    // Device certificate should chain to the offline root
+	is.True(chains[0][len(chains[0])-1].Equal(root)) // Chain should end at the offline root
+}
@@ -0,0 +1,158 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ParsePEMBundle parses the certificates and private key of a CA from PEM blocks. The certificates can be in any order.
+// The private key must be unencrypted and in PKCS#8, PKCS#1 or SEC 1 form.
+func ParsePEMBundle(data []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	var chain []*x509.Certificate
+	var privateKey crypto.Signer
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			certificate, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, pkgerrors.Wrap(err, "error parsing certificate")
+			}
+			chain = append(chain, certificate)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			if privateKey != nil {
+				return nil, nil, errors.New("the bundle contains more than one private key")
+			} else if _, encrypted := block.Headers["DEK-Info"]; encrypted {
+				return nil, nil, errors.New("encrypted private keys are not supported. decrypt the private key before importing it")
+			}
+
+			var err error
+			if privateKey, err = parsePrivateKey(block.Bytes); err != nil {
+				return nil, nil, pkgerrors.Wrap(err, "error parsing private key")
+			}
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, nil, errors.New("encrypted private keys are not supported. decrypt the private key before importing it")
+		}
+	}
+
+	if len(chain) == 0 {
+		return nil, nil, errors.New("the bundle doesn't contain a certificate")
+	} else if privateKey == nil {
+		return nil, nil, errors.New("the bundle doesn't contain a private key")
+	}
+	return chain, privateKey, nil
+}
+
+// ParsePKCS12 parses the certificates and private key of a CA from a PKCS#12 (PFX) file
+func ParsePKCS12(data []byte, password string) ([]*x509.Certificate, crypto.Signer, error) {
+	privateKey, certificate, caCertificates, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, nil, pkgerrors.Wrap(err, "error decoding pkcs12 file")
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported private key type")
+	}
+	return append([]*x509.Certificate{certificate}, caCertificates...), signer, nil
+}
+
+// ErrKeyStoreImport is returned when importing a CA while a key store is configured. Its private key would be stored outside the key store.
+var ErrKeyStoreImport = errors.New("error importing ca: the private key can't be imported when a key store is configured")
+
+// ImportCA imports an existing CA certificate and its private key which are used to issue device certificates.
+// The chain must contain the CA certificate, the root and any intermediates between them. They can be in any order.
+// The CA becomes the identity if none exists, otherwise it is staged as the next identity and cut over to at cutoverAt.
+// The private key is encrypted with the key encryption key and stored in the datastore so the import is refused if a key store is configured.
+func (s *Service) ImportCA(chain []*x509.Certificate, privateKey crypto.Signer, cutoverAt time.Time) error {
+	if s.keyStore != nil {
+		return ErrKeyStoreImport
+	}
+
+	var certificate, root *x509.Certificate
+	var intermediates []*x509.Certificate
+	for _, chainCertificate := range chain {
+		if ok, err := samePublicKey(chainCertificate.PublicKey, privateKey.Public()); err != nil {
+			return pkgerrors.Wrap(err, "invalid ca certificate")
+		} else if ok && certificate == nil {
+			certificate = chainCertificate
+		} else if bytes.Equal(chainCertificate.RawIssuer, chainCertificate.RawSubject) && root == nil {
+			root = chainCertificate
+		} else {
+			intermediates = append(intermediates, chainCertificate)
+		}
+	}
+
+	if certificate == nil {
+		return errors.New("invalid ca certificate: the private key doesn't match any of the certificates")
+	} else if root == nil && bytes.Equal(certificate.RawIssuer, certificate.RawSubject) {
+		root = certificate // A self-signed CA is its own root
+	} else if root == nil {
+		return errors.New("invalid ca certificate: the chain must contain the root certificate")
+	}
+
+	verifiedChain, err := verifyIssuingCA(certificate, root, intermediates)
+	if err != nil {
+		return err
+	}
+
+	// Only the intermediates the CA was verified through are kept. They are stored in order from the CA's issuer to the root so they can be sent to devices.
+	var identityChain []*x509.Certificate
+	var chainRaw [][]byte
+	if len(verifiedChain) > 2 {
+		identityChain = verifiedChain[1 : len(verifiedChain)-1]
+		for _, intermediate := range identityChain {
+			chainRaw = append(chainRaw, intermediate.Raw)
+		}
+	}
+
+	privateKeyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return pkgerrors.Wrap(err, "error marshalling ca private key")
+	}
+
+	encryptedKey, err := s.kek.Seal(privateKeyDer)
+	if err != nil {
+		return pkgerrors.Wrap(err, "error encrypting ca private key")
+	}
+
+	identity := Identity{
+		Origin:       IdentityImported,
+		Cert:         certificate,
+		CertRaw:      certificate.Raw,
+		CertHash:     fmt.Sprintf("%X", sha1.Sum(certificate.Raw)),
+		Signer:       privateKey,
+		EncryptedKey: encryptedKey,
+		Subject:      certificate.Subject,
+		NotBefore:    certificate.NotBefore,
+		NotAfter:     certificate.NotAfter,
+		Chain:        identityChain,
+		ChainRaw:     chainRaw,
+	}
+	if !certificate.Equal(root) {
+		identity.RootCert = root
+		identity.RootCertRaw = root.Raw
+		identity.RootCertHash = fmt.Sprintf("%X", sha1.Sum(root.Raw))
+	}
+
+	if err := s.installIdentity(identity, cutoverAt); err != nil {
+		return err
+	}
+
+	log.Info().Str("CommonName", identity.Subject.CommonName).Str("Root", root.Subject.CommonName).Time("Expires", identity.NotAfter).Msg("Imported existing CA as the Mattrax identity...")
+	return nil
+}
@@ -0,0 +1,122 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mattrax/Mattrax/internal/datastore/memory"
+	"github.com/mattrax/Mattrax/internal/kek"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestImportCA(t *testing.T) {
+	is := is.New(t)
+
+	// The enterprise PKI is a root, a policy intermediate and the issuing CA Mattrax imports
+	newCA := func(commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, keyUsage x509.KeyUsage) (*x509.Certificate, *ecdsa.PrivateKey) {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		is.NoErr(err) // Error generating ca key
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: commonName},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(24 * time.Hour),
+			KeyUsage:              keyUsage,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		if parent == nil {
+			parent, parentKey = template, privateKey
+		}
+
+		certificateDer, err := x509.CreateCertificate(rand.Reader, template, parent, &privateKey.PublicKey, parentKey)
+		is.NoErr(err) // Error creating ca
+		certificate, err := x509.ParseCertificate(certificateDer)
+		is.NoErr(err) // Error parsing ca
+		return certificate, privateKey
+	}
+	caUsage := x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	root, rootKey := newCA("Enterprise Root", nil, nil, caUsage)
+	policy, policyKey := newCA("Enterprise Policy CA", root, rootKey, caUsage)
+	issuing, issuingKey := newCA("Enterprise Issuing CA", policy, policyKey, caUsage)
+	signingOnly, signingOnlyKey := newCA("Enterprise Signing CA", policy, policyKey, x509.KeyUsageDigitalSignature)
+
+	store, issuedStore := &memory.Store{}, &memory.Store{}
+	store.Init()
+	issuedStore.Init()
+	keyEncryptionKey, err := kek.New([]byte("test"))
+	is.NoErr(err)
+	service, err := NewService(store, issuedStore, keyEncryptionKey, nil)
+	is.NoErr(err) // Error creating service
+
+	is.True(service.ImportCA([]*x509.Certificate{issuing, policy}, issuingKey, time.Time{}) != nil)               // Chain must contain the root
+	is.True(service.ImportCA([]*x509.Certificate{issuing, root}, issuingKey, time.Time{}) != nil)                 // Chain must be complete
+	is.True(service.ImportCA([]*x509.Certificate{signingOnly, policy, root}, signingOnlyKey, time.Time{}) != nil) // CA must be able to sign certificates
+	is.True(service.ImportCA([]*x509.Certificate{issuing, policy, root}, signingOnlyKey, time.Time{}) != nil)     // Key must match a certificate in the chain
+
+	keyDer, err := x509.MarshalECPrivateKey(issuingKey)
+	is.NoErr(err)
+	var bundle []byte
+	for _, certificate := range []*x509.Certificate{root, issuing, policy} {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})...)
+	}
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})...)
+
+	chain, privateKey, err := ParsePEMBundle(bundle)
+	is.NoErr(err)                                              // Error parsing PEM bundle
+	is.NoErr(service.ImportCA(chain, privateKey, time.Time{})) // Error importing CA
+	is.True(service.Get().Identity.Cert.Equal(issuing))        // Issuing CA should be the identity
+
+	roots, intermediates := TrustChain(service.Get().TrustedIdentities())
+	is.Equal(len(roots), 1)                 // Only the enterprise root should be trusted as a root
+	is.Equal(len(intermediates), 2)         // The issuing and policy CAs should be sent to devices
+	is.True(intermediates[1].Equal(policy)) // The chain should be in order from the issuing CA to the root
+
+	reloaded, err := NewService(store, issuedStore, keyEncryptionKey, nil)
+	is.NoErr(err)                                              // Error reloading imported CA
+	is.True(reloaded.Get().Identity.Chain[0].Equal(policy))    // Chain should be loaded
+	is.Equal(reloaded.Get().Identity.Origin, IdentityImported) // Origin should be saved
+
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	certificate, err := reloaded.Issue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "device"},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &deviceKey.PublicKey, "device-uuid")
+	is.NoErr(err) // Error issuing certificate with imported CA
+	rootPool, intermediatePool := reloaded.Get().TrustedCertPools()
+	_, err = certificate.Verify(x509.VerifyOptions{
+		Roots:         rootPool,
+		Intermediates: intermediatePool,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	is.NoErr(err) // Device certificate should chain to the enterprise root
+
+	pfx, err := pkcs12.Encode(rand.Reader, issuingKey, issuing, []*x509.Certificate{policy, root}, "password")
+	is.NoErr(err) // Error encoding PKCS#12 file
+	_, _, err = ParsePKCS12(pfx, "incorrect")
+	is.True(err != nil) // Incorrect password must be rejected
+	chain, privateKey, err = ParsePKCS12(pfx, "password")
+	is.NoErr(err) // Error parsing PKCS#12 file
+	is.Equal(len(chain), 3)
+	is.True(privateKey.(*ecdsa.PrivateKey).Equal(issuingKey))
+
+	selfSignedStore := &memory.Store{}
+	selfSignedStore.Init()
+	selfSigned, err := NewService(selfSignedStore, issuedStore, keyEncryptionKey, nil)
+	is.NoErr(err)                                                                  // Error creating service
+	is.NoErr(selfSigned.ImportCA([]*x509.Certificate{root}, rootKey, time.Time{})) // Error importing self-signed CA
+	renewed, err := selfSigned.RenewIdentity(48*time.Hour, ECDSAP256)
+	is.NoErr(err)
+	is.True(!renewed) // Imported identities must not be replaced by a generated identity
+}
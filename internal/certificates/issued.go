@@ -0,0 +1,111 @@
+package certificates
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// serialNumberLimit is the exclusive upper bound of generated serial numbers (128 bits)
+var serialNumberLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// CertificateStatus is the current state of an issued certificate
+type CertificateStatus string
+
+// The statuses an issued certificate can have
+const (
+	StatusValid   CertificateStatus = "valid"
+	StatusRevoked CertificateStatus = "revoked"
+)
+
+// IssuedCertificate is the record of a certificate signed by the Mattrax Identity CA
+type IssuedCertificate struct {
+	SerialNumber     string            `yaml:"serial_number"` // Uppercase hex
+	Subject          string            `yaml:"subject"`
+	SHA1Hash         string            `yaml:"sha1_hash"`   // Uppercase hex of the hash of the DER certificate. This is the thumbprint shown by Windows.
+	SHA256Hash       string            `yaml:"sha256_hash"` // Uppercase hex of the hash of the DER certificate
+	IssuerHash       string            `yaml:"issuer_hash"` // The CertHash of the identity which issued the certificate. It is empty for certificates issued before identity rollover was supported.
+	DeviceUUID       string            `yaml:"device_uuid"`
+	NotBefore        time.Time         `yaml:"not_before"`
+	NotAfter         time.Time         `yaml:"not_after"`
+	IssuedAt         time.Time         `yaml:"issued_at"`
+	Status           CertificateStatus `yaml:"status"`
+	RevokedAt        time.Time         `yaml:"revoked_at,omitempty"`
+	RevocationReason RevocationReason  `yaml:"revocation_reason,omitempty"`
+	Raw              []byte            `yaml:"-"` // The DER encoded certificate
+}
+
+// Expired checks if the certificate has expired
+func (certificate IssuedCertificate) Expired() bool {
+	return time.Now().After(certificate.NotAfter)
+}
+
+// NewSerialNumber generates a random 128 bit certificate serial number.
+// Serial numbers must be positive and unique so they can be used to identify a certificate for revocation (RFC 5280 4.1.2.2).
+func NewSerialNumber() (*big.Int, error) {
+	for {
+		serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		if serialNumber.Sign() > 0 {
+			return serialNumber, nil
+		}
+	}
+}
+
+// FormatSerialNumber returns the uppercase hex representation of a serial number which is used to index the registry
+func FormatSerialNumber(serialNumber *big.Int) string {
+	return fmt.Sprintf("%X", serialNumber)
+}
+
+// newIssuedCertificate creates the registry record for a signed certificate
+func newIssuedCertificate(certificate *x509.Certificate, issuerHash string, deviceUUID string) IssuedCertificate {
+	sha1Hash := sha1.Sum(certificate.Raw)
+	sha256Hash := sha256.Sum256(certificate.Raw)
+
+	return IssuedCertificate{
+		SerialNumber: FormatSerialNumber(certificate.SerialNumber),
+		Subject:      certificate.Subject.String(),
+		SHA1Hash:     fmt.Sprintf("%X", sha1Hash),
+		SHA256Hash:   fmt.Sprintf("%X", sha256Hash),
+		IssuerHash:   issuerHash,
+		DeviceUUID:   deviceUUID,
+		NotBefore:    certificate.NotBefore,
+		NotAfter:     certificate.NotAfter,
+		IssuedAt:     time.Now().UTC(),
+		Status:       StatusValid,
+		Raw:          certificate.Raw,
+	}
+}
+
+// issuedSerialKey is the key an issued certificate is stored under
+func issuedSerialKey(serialNumber string) []byte {
+	return []byte("serial/" + strings.ToUpper(serialNumber))
+}
+
+// issuedSHA1Key is the key the serial number of an issued certificate is indexed by its SHA-1 hash under
+func issuedSHA1Key(hash string) []byte {
+	return []byte("sha1/" + strings.ToUpper(hash))
+}
+
+// issuedSHA256Key is the key the serial number of an issued certificate is indexed by its SHA-256 hash under
+func issuedSHA256Key(hash string) []byte {
+	return []byte("sha256/" + strings.ToUpper(hash))
+}
+
+// issuedIssuerKey is the key the serial numbers of the certificates issued by an identity are stored under
+func issuedIssuerKey(certHash string) []byte {
+	return []byte("issuer/" + strings.ToUpper(certHash))
+}
+
+// issuedDeviceKey is the key the serial numbers of the certificates issued to a device are stored under
+func issuedDeviceKey(deviceUUID string) []byte {
+	return []byte("device/" + deviceUUID)
+}
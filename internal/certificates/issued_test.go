@@ -0,0 +1,86 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mattrax/Mattrax/internal/datastore/memory"
+	"github.com/mattrax/Mattrax/internal/kek"
+)
+
+func newTestService(t *testing.T) *Service {
+	store, issuedStore := &memory.Store{}, &memory.Store{}
+	store.Init()
+	issuedStore.Init()
+
+	keyEncryptionKey, err := kek.New([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := NewService(store, issuedStore, keyEncryptionKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.GenerateIdentity(pkix.Name{CommonName: "Test Identity"}, RSA2048); err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func TestIssue(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating device key
+	service.SetRevocationLocations(func(issuerCertHash string) ([]string, []string) {
+		return []string{"http://crl/" + issuerCertHash}, []string{"http://ocsp"}
+	})
+
+	var issued []*x509.Certificate
+	for i := 0; i < 2; i++ {
+		certificate, err := service.Issue(&x509.Certificate{
+			Subject:   pkix.Name{CommonName: "device"},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Hour),
+		}, &privateKey.PublicKey, "device-uuid")
+		is.NoErr(err)                                   // Error issuing certificate
+		is.True(certificate.SerialNumber.BitLen() > 64) // Serial number should be random
+		issued = append(issued, certificate)
+	}
+	is.True(issued[0].SerialNumber.Cmp(issued[1].SerialNumber) != 0)                                     // Serial numbers must be unique
+	is.Equal(issued[0].CRLDistributionPoints, []string{"http://crl/" + service.Get().Identity.CertHash}) // CRL of the signing identity should be added
+	is.Equal(issued[0].OCSPServer, []string{"http://ocsp"})                                              // OCSP responder should be added
+
+	record, ok, err := service.GetIssued(FormatSerialNumber(issued[0].SerialNumber))
+	is.NoErr(err)
+	is.True(ok)                                // Certificate should be found by serial number
+	is.Equal(record.DeviceUUID, "device-uuid") // Certificate should be linked to the device
+	is.Equal(record.Status, StatusValid)
+
+	byHash, ok, err := service.GetIssuedByHash(record.SHA256Hash)
+	is.NoErr(err)
+	is.True(ok) // Certificate should be found by SHA-256 hash
+	is.Equal(byHash.SerialNumber, record.SerialNumber)
+
+	byHash, ok, err = service.GetIssuedByHash(record.SHA1Hash)
+	is.NoErr(err)
+	is.True(ok) // Certificate should be found by SHA-1 hash
+	is.Equal(byHash.SerialNumber, record.SerialNumber)
+
+	byDevice, err := service.GetIssuedByDevice("device-uuid")
+	is.NoErr(err)
+	is.Equal(len(byDevice), 2) // Both certificates should be found by device
+
+	_, ok, err = service.GetIssued("00")
+	is.NoErr(err)
+	is.True(!ok) // Unknown serial numbers should not be found
+}
@@ -0,0 +1,388 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"errors"
+
+	"github.com/mattrax/Mattrax/internal/kek"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// KeyAlgorithm is the algorithm and size of a CA private key
+type KeyAlgorithm string
+
+// Key algorithms which can be used for the CA private keys
+const (
+	RSA2048   KeyAlgorithm = "rsa-2048"
+	RSA3072   KeyAlgorithm = "rsa-3072"
+	RSA4096   KeyAlgorithm = "rsa-4096"
+	ECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	ECDSAP384 KeyAlgorithm = "ecdsa-p384"
+)
+
+// DefaultKeyAlgorithm is the key algorithm used for identities if one is not configured
+const DefaultKeyAlgorithm = RSA4096
+
+// keyAlgorithmParameters maps the supported key algorithms to their RSA size in bits or ECDSA curve
+var keyAlgorithmParameters = map[KeyAlgorithm]struct {
+	bits  int
+	curve elliptic.Curve
+}{
+	RSA2048:   {bits: 2048},
+	RSA3072:   {bits: 3072},
+	RSA4096:   {bits: 4096},
+	ECDSAP256: {curve: elliptic.P256()},
+	ECDSAP384: {curve: elliptic.P384()},
+}
+
+// Verify checks the key algorithm is supported
+func (algorithm KeyAlgorithm) Verify() error {
+	if _, ok := keyAlgorithmParameters[algorithm]; !ok {
+		return errors.New("unsupported key algorithm '" + string(algorithm) + "'. It must be one of rsa-2048, rsa-3072, rsa-4096, ecdsa-p256 or ecdsa-p384")
+	}
+	return nil
+}
+
+// RSABits returns the size in bits of an RSA key algorithm. It is zero for ECDSA key algorithms.
+func (algorithm KeyAlgorithm) RSABits() int {
+	return keyAlgorithmParameters[algorithm].bits
+}
+
+// Curve returns the curve of an ECDSA key algorithm. It is nil for RSA key algorithms.
+func (algorithm KeyAlgorithm) Curve() elliptic.Curve {
+	return keyAlgorithmParameters[algorithm].curve
+}
+
+// generate creates a new private key using the algorithm
+func (algorithm KeyAlgorithm) generate() (crypto.Signer, error) {
+	if err := algorithm.Verify(); err != nil {
+		return nil, err
+	} else if curve := algorithm.Curve(); curve != nil {
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	return rsa.GenerateKey(rand.Reader, algorithm.RSABits())
+}
+
+// signerKeyAlgorithm returns the key algorithm used for keys signed by the public key. ECDSA keys use the same curve and RSA keys use RSA-2048.
+func signerKeyAlgorithm(publicKey crypto.PublicKey) KeyAlgorithm {
+	if publicKey, ok := publicKey.(*ecdsa.PublicKey); ok {
+		for algorithm, parameters := range keyAlgorithmParameters {
+			if parameters.curve == publicKey.Curve {
+				return algorithm
+			}
+		}
+	}
+	return RSA2048
+}
+
+// KeyStore stores private keys outside of the datastore, for example in a PKCS#11 token (HSM).
+// The keys can't be exported so they are only used through the crypto.Signer interface.
+type KeyStore interface {
+	// GenerateKey creates a new private key using the algorithm. The returned ID is saved and used to find the key with FindKey.
+	GenerateKey(algorithm KeyAlgorithm) (crypto.Signer, []byte, error)
+	// FindKey loads the private key with the ID
+	FindKey(id []byte) (crypto.Signer, error)
+}
+
+// generateKey creates a new private key using the algorithm.
+// If a key store is configured the key is created in it and its ID is returned. Otherwise the key is encrypted with the KEK so it can be stored.
+func (s *Service) generateKey(algorithm KeyAlgorithm) (crypto.Signer, *kek.Envelope, []byte, error) {
+	if err := algorithm.Verify(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if s.keyStore != nil {
+		signer, keyID, err := s.keyStore.GenerateKey(algorithm)
+		if err != nil {
+			return nil, nil, nil, pkgerrors.Wrap(err, "error generating private key in key store")
+		}
+		return signer, nil, keyID, nil
+	}
+
+	privateKey, err := algorithm.generate()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	privateKeyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, nil, pkgerrors.Wrap(err, "error marshalling private key")
+	}
+
+	encryptedKey, err := s.kek.Seal(privateKeyDer)
+	if err != nil {
+		return nil, nil, nil, pkgerrors.Wrap(err, "error encrypting private key")
+	}
+	return privateKey, encryptedKey, nil, nil
+}
+
+// loadKey returns the signer for a private key which is either in the key store or encrypted in the datastore.
+// Keys stored in plaintext by previous versions are encrypted and the envelope is returned so they can be migrated.
+func (s *Service) loadKey(keyID []byte, encryptedKey *kek.Envelope, keyRaw []byte) (crypto.Signer, *kek.Envelope, error) {
+	if len(keyID) != 0 {
+		if s.keyStore == nil {
+			return nil, nil, errors.New("the private key is in a key store but no key store is configured")
+		}
+
+		signer, err := s.keyStore.FindKey(keyID)
+		if err != nil {
+			return nil, nil, pkgerrors.Wrap(err, "error loading private key from key store")
+		}
+		return signer, nil, nil
+	}
+
+	var migratedKey *kek.Envelope
+	if encryptedKey != nil {
+		var err error
+		if keyRaw, err = s.kek.Open(encryptedKey); err != nil {
+			return nil, nil, pkgerrors.Wrap(err, "error decrypting private key")
+		}
+	} else if len(keyRaw) != 0 {
+		var err error
+		if migratedKey, err = s.kek.Seal(keyRaw); err != nil {
+			return nil, nil, pkgerrors.Wrap(err, "error encrypting private key")
+		}
+	} else {
+		return nil, nil, errors.New("the private key is missing")
+	}
+
+	privateKey, err := parsePrivateKey(keyRaw)
+	if err != nil {
+		return nil, nil, pkgerrors.Wrap(err, "error parsing private key")
+	}
+	return privateKey, migratedKey, nil
+}
+
+// parsePrivateKey parses a PKCS#8 private key. Keys stored by previous versions are PKCS#1 RSA keys and imported ECDSA keys may be SEC 1 keys.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if privateKey, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return privateKey, nil
+	} else if privateKey, err := x509.ParseECPrivateKey(der); err == nil {
+		return privateKey, nil
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+// subjectKeyID returns the SHA-1 hash of the public key as described in RFC 5280 4.2.1.2
+func subjectKeyID(publicKey crypto.PublicKey) ([]byte, error) {
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return publicKeyHash(publicKeyDer, sha1.New())
+}
+
+// save stores the certificates. Private keys are only stored in their encrypted form and certificates are only stored in their raw form. The caller must hold the mutex.
+func (s *Service) save() error {
+	certificates := s.certificates
+	certificates.Identity = certificates.Identity.stored()
+	certificates.NextIdentity = certificates.NextIdentity.stored()
+	certificates.PreviousIdentities = make([]Identity, len(s.certificates.PreviousIdentities))
+	for i, identity := range s.certificates.PreviousIdentities {
+		certificates.PreviousIdentities[i] = identity.stored()
+	}
+	certificates.OCSPSigner.Cert, certificates.OCSPSigner.Signer, certificates.OCSPSigner.KeyRaw = nil, nil, nil
+	certificates.IntermediateRequest.Signer = nil
+	certificates.SCEPRA.Cert, certificates.SCEPRA.Signer = nil, nil
+
+	return s.store.Set(certificatesKey, certificates)
+}
+
+// stored returns the identity with the loaded and plaintext private key and the parsed certificates removed.
+// Parsed ECDSA certificates can't be encoded by gob so only the raw certificates are stored.
+func (identity Identity) stored() Identity {
+	identity.Signer, identity.KeyRaw = nil, nil
+	identity.Cert, identity.RootCert, identity.Chain = nil, nil, nil
+	return identity
+}
+
+// loadKeys parses the certificates and loads the private keys of every identity, the OCSP signer, the SCEP registration authority and the pending intermediate request.
+// Private keys stored in plaintext by previous versions are encrypted and the certificates are saved again.
+func (s *Service) loadKeys() error {
+	identities := []*Identity{&s.certificates.Identity, &s.certificates.NextIdentity}
+	for i := range s.certificates.PreviousIdentities {
+		identities = append(identities, &s.certificates.PreviousIdentities[i])
+	}
+
+	var migrate bool
+	for _, identity := range identities {
+		if len(identity.CertRaw) == 0 {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(identity.CertRaw)
+		if err != nil {
+			return pkgerrors.Wrap(err, "error parsing identity '"+identity.CertHash+"'")
+		}
+		identity.Cert = cert
+
+		if len(identity.RootCertRaw) != 0 {
+			rootCert, err := x509.ParseCertificate(identity.RootCertRaw)
+			if err != nil {
+				return pkgerrors.Wrap(err, "error parsing root of identity '"+identity.CertHash+"'")
+			}
+			identity.RootCert = rootCert
+		}
+
+		// Identities saved by previous versions don't have an origin. Importing a CA was added together with the origin so they were generated unless signed by an offline root.
+		if identity.Origin == "" {
+			identity.Origin = IdentityGenerated
+			if identity.RootCert != nil {
+				identity.Origin = IdentityOfflineRoot
+			}
+			migrate = true
+		}
+
+		identity.Chain = make([]*x509.Certificate, len(identity.ChainRaw))
+		for i, intermediateDer := range identity.ChainRaw {
+			intermediate, err := x509.ParseCertificate(intermediateDer)
+			if err != nil {
+				return pkgerrors.Wrap(err, "error parsing chain of identity '"+identity.CertHash+"'")
+			}
+			identity.Chain[i] = intermediate
+		}
+
+		signer, migratedKey, err := s.loadKey(identity.KeyID, identity.EncryptedKey, identity.KeyRaw)
+		if err != nil {
+			return pkgerrors.Wrap(err, "error loading identity '"+identity.CertHash+"'")
+		}
+		identity.Signer, identity.KeyRaw = signer, nil
+
+		if migratedKey != nil {
+			identity.EncryptedKey = migratedKey
+			migrate = true
+		}
+	}
+
+	if signer := &s.certificates.OCSPSigner; len(signer.CertRaw) != 0 {
+		cert, err := x509.ParseCertificate(signer.CertRaw)
+		if err != nil {
+			return pkgerrors.Wrap(err, "error parsing ocsp signer")
+		}
+		signer.Cert = cert
+
+		privateKey, migratedKey, err := s.loadKey(signer.KeyID, signer.EncryptedKey, signer.KeyRaw)
+		if err != nil {
+			return pkgerrors.Wrap(err, "error loading ocsp signer")
+		}
+		signer.Signer, signer.KeyRaw = privateKey, nil
+
+		if migratedKey != nil {
+			signer.EncryptedKey = migratedKey
+			migrate = true
+		}
+	}
+
+	if ra := &s.certificates.SCEPRA; len(ra.CertRaw) != 0 {
+		cert, err := x509.ParseCertificate(ra.CertRaw)
+		if err != nil {
+			return pkgerrors.Wrap(err, "error parsing scep registration authority")
+		}
+		ra.Cert = cert
+
+		if ra.Signer, _, err = s.loadKey(nil, ra.EncryptedKey, nil); err != nil {
+			return pkgerrors.Wrap(err, "error loading scep registration authority")
+		}
+	}
+
+	if s.certificates.SCEPChallengeKey != nil {
+		challengeKey, err := s.kek.Open(s.certificates.SCEPChallengeKey)
+		if err != nil {
+			return pkgerrors.Wrap(err, "error decrypting scep challenge key")
+		}
+		s.scepChallengeKey = challengeKey
+	}
+
+	if request := &s.certificates.IntermediateRequest; len(request.CSR) != 0 {
+		privateKey, _, err := s.loadKey(request.KeyID, request.EncryptedKey, nil)
+		if err != nil {
+			return pkgerrors.Wrap(err, "error loading intermediate certificate request")
+		}
+		request.Signer = privateKey
+	}
+
+	if migrate {
+		if err := s.save(); err != nil {
+			return pkgerrors.Wrap(err, "error saving encrypted private keys")
+		}
+		log.Info().Msg("Encrypted private keys which were stored in plaintext...")
+	}
+
+	return nil
+}
+
+// RotateKEK re-encrypts every private key's data encryption key with the new KEK and saves them.
+// Private keys in the key store are not affected.
+// The new KEK must be used from the next start of the server.
+func (s *Service) RotateKEK(newKEK *kek.KEK) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previousCertificates := s.certificates
+	rewrap := func(encryptedKey *kek.Envelope) (*kek.Envelope, error) {
+		if encryptedKey == nil {
+			return nil, nil
+		}
+		return s.kek.Rewrap(encryptedKey, newKEK)
+	}
+
+	var err error
+	if s.certificates.Identity.EncryptedKey, err = rewrap(s.certificates.Identity.EncryptedKey); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error rotating identity key encryption key")
+	}
+	if s.certificates.NextIdentity.EncryptedKey, err = rewrap(s.certificates.NextIdentity.EncryptedKey); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error rotating next identity key encryption key")
+	}
+	s.certificates.PreviousIdentities = append([]Identity{}, previousCertificates.PreviousIdentities...)
+	for i := range s.certificates.PreviousIdentities {
+		if s.certificates.PreviousIdentities[i].EncryptedKey, err = rewrap(s.certificates.PreviousIdentities[i].EncryptedKey); err != nil {
+			s.certificates = previousCertificates
+			return pkgerrors.Wrap(err, "error rotating previous identity key encryption key")
+		}
+	}
+	if s.certificates.OCSPSigner.EncryptedKey, err = rewrap(s.certificates.OCSPSigner.EncryptedKey); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error rotating ocsp signer key encryption key")
+	}
+	if s.certificates.IntermediateRequest.EncryptedKey, err = rewrap(s.certificates.IntermediateRequest.EncryptedKey); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error rotating intermediate request key encryption key")
+	}
+	if s.certificates.SCEPRA.EncryptedKey, err = rewrap(s.certificates.SCEPRA.EncryptedKey); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error rotating scep registration authority key encryption key")
+	}
+	if s.certificates.SCEPChallengeKey, err = rewrap(s.certificates.SCEPChallengeKey); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error rotating scep challenge key encryption key")
+	}
+
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error saving rotated private keys")
+	}
+	s.kek = newKEK
+
+	log.Info().Msg("Rotated the key encryption key...")
+	return nil
+}
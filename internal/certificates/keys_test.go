@@ -0,0 +1,192 @@
+package certificates
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mattrax/Mattrax/internal/datastore/memory"
+	"github.com/mattrax/Mattrax/internal/kek"
+)
+
+func TestKeyEncryption(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+	identity := service.Get().Identity
+	previousKEK := service.kek
+
+	var stored Certificates
+	is.NoErr(service.store.Get(certificatesKey, &stored))
+	is.True(stored.Identity.Signer == nil && stored.Identity.KeyRaw == nil) // Private key must not be stored in plaintext
+	is.True(stored.Identity.EncryptedKey != nil)                            // Private key should be stored encrypted
+
+	incorrectKEK, err := kek.New([]byte("incorrect"))
+	is.NoErr(err)
+	_, err = NewService(service.store, service.issued, incorrectKEK, nil)
+	is.True(err != nil) // Private key must not be loaded with an incorrect KEK
+
+	newKEK, err := kek.New([]byte("rotated"))
+	is.NoErr(err)
+	is.NoErr(service.RotateKEK(newKEK)) // Error rotating KEK
+
+	reloaded, err := NewService(service.store, service.issued, newKEK, nil)
+	is.NoErr(err)                                                                    // Error loading service with the rotated KEK
+	is.True(reloaded.Get().Identity.Signer.(*rsa.PrivateKey).Equal(identity.Signer)) // Private key should be unchanged
+
+	_, err = NewService(service.store, service.issued, previousKEK, nil)
+	is.True(err != nil) // Private key must not be loaded with the previous KEK
+}
+
+func TestKeyEncryptionMigration(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+	identity := service.Get().Identity
+
+	// Private keys were stored in plaintext by previous versions
+	legacy := service.Get()
+	legacy.Identity.KeyRaw = x509.MarshalPKCS1PrivateKey(identity.Signer.(*rsa.PrivateKey))
+	legacy.Identity.Signer, legacy.Identity.EncryptedKey = nil, nil
+	is.NoErr(service.store.Set(certificatesKey, legacy))
+
+	migrated, err := NewService(service.store, service.issued, service.kek, nil)
+	is.NoErr(err)                                                                    // Error loading plaintext private key
+	is.True(migrated.Get().Identity.Signer.(*rsa.PrivateKey).Equal(identity.Signer)) // Private key should be unchanged
+
+	var stored Certificates
+	is.NoErr(service.store.Get(certificatesKey, &stored))
+	is.True(stored.Identity.Signer == nil && stored.Identity.KeyRaw == nil) // Plaintext private key should be removed from the store
+	is.True(stored.Identity.EncryptedKey != nil)                            // Private key should be encrypted
+}
+
+// memoryKeyStore is a KeyStore which keeps keys in memory. It is used to test keys which can't be exported.
+type memoryKeyStore struct {
+	keys map[string]crypto.Signer
+}
+
+func (keyStore *memoryKeyStore) GenerateKey(algorithm KeyAlgorithm) (crypto.Signer, []byte, error) {
+	privateKey, err := algorithm.generate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := []byte(strconv.Itoa(len(keyStore.keys)))
+	keyStore.keys[string(id)] = privateKey
+	return privateKey, id, nil
+}
+
+func (keyStore *memoryKeyStore) FindKey(id []byte) (crypto.Signer, error) {
+	signer, ok := keyStore.keys[string(id)]
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+	return signer, nil
+}
+
+func TestKeyStore(t *testing.T) {
+	is := is.New(t)
+	store, issuedStore := &memory.Store{}, &memory.Store{}
+	store.Init()
+	issuedStore.Init()
+	keyEncryptionKey, err := kek.New([]byte("test"))
+	is.NoErr(err)
+	keyStore := &memoryKeyStore{keys: map[string]crypto.Signer{}}
+
+	service, err := NewService(store, issuedStore, keyEncryptionKey, keyStore)
+	is.NoErr(err)                                                                       // Error creating service
+	is.NoErr(service.GenerateIdentity(pkix.Name{CommonName: "Test Identity"}, RSA2048)) // Error generating identity
+	_, err = service.OCSPSigner()
+	is.NoErr(err) // Error issuing OCSP signer
+
+	var stored Certificates
+	is.NoErr(store.Get(certificatesKey, &stored))
+	is.True(stored.Identity.KeyID != nil)          // Identity key should be in the key store
+	is.True(stored.Identity.EncryptedKey == nil)   // Identity key must not be stored in the datastore
+	is.True(stored.OCSPSigner.KeyID != nil)        // OCSP signer key should be in the key store
+	is.True(stored.OCSPSigner.EncryptedKey == nil) // OCSP signer key must not be stored in the datastore
+
+	reloaded, err := NewService(store, issuedStore, keyEncryptionKey, keyStore)
+	is.NoErr(err)                                                           // Error loading keys from the key store
+	is.Equal(reloaded.Get().Identity.Signer, service.Get().Identity.Signer) // Identity key should be loaded from the key store
+
+	crl, _, err := reloaded.CRL(reloaded.Get().Identity.CertHash)
+	is.NoErr(err) // Error signing CRL with the key store
+	revocationList, err := x509.ParseRevocationList(crl)
+	is.NoErr(err)
+	is.NoErr(revocationList.CheckSignatureFrom(reloaded.Get().Identity.Cert)) // CRL should be signed by the key in the key store
+
+	_, err = NewService(store, issuedStore, keyEncryptionKey, nil)
+	is.True(err != nil) // Keys in a key store must not be loaded without it
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)                                                                                                            // Error generating ca key
+	is.Equal(service.ImportCA([]*x509.Certificate{service.Get().Identity.Cert}, privateKey, time.Time{}), ErrKeyStoreImport) // Imported keys must not be stored outside the key store
+}
+
+func TestECDSAIdentity(t *testing.T) {
+	is := is.New(t)
+	store, issuedStore := &memory.Store{}, &memory.Store{}
+	store.Init()
+	issuedStore.Init()
+	keyEncryptionKey, err := kek.New([]byte("test"))
+	is.NoErr(err)
+
+	service, err := NewService(store, issuedStore, keyEncryptionKey, nil)
+	is.NoErr(err)                                                                                // Error creating service
+	is.True(service.GenerateIdentity(pkix.Name{CommonName: "Test Identity"}, "dsa-1024") != nil) // Unsupported key algorithm must be rejected
+	is.NoErr(service.GenerateIdentity(pkix.Name{CommonName: "Test Identity"}, ECDSAP384))        // Error generating identity
+	signer, err := service.OCSPSigner()
+	is.NoErr(err)                                                  // Error issuing OCSP signer
+	is.Equal(signer.Cert.PublicKeyAlgorithm, x509.ECDSA)           // OCSP signer should use the identity's curve
+	is.Equal(signer.Cert.SignatureAlgorithm, x509.ECDSAWithSHA384) // OCSP signer should be signed by the identity
+
+	reloaded, err := NewService(store, issuedStore, keyEncryptionKey, nil)
+	is.NoErr(err)                                                                                    // Error loading ecdsa identity
+	is.True(reloaded.Get().Identity.Signer.(*ecdsa.PrivateKey).Equal(service.Get().Identity.Signer)) // Private key should be unchanged
+
+	deviceKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	is.NoErr(err)                                                           // Error generating device key
+	is.NoErr(reloaded.Get().Template.VerifyPublicKey(&deviceKey.PublicKey)) // RSA device keys should be accepted
+
+	certificate, err := reloaded.Issue(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "device"},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+	}, &deviceKey.PublicKey, "device-uuid")
+	is.NoErr(err)                                                          // Error issuing certificate
+	is.NoErr(certificate.CheckSignatureFrom(reloaded.Get().Identity.Cert)) // Certificate should be signed by the ecdsa identity
+}
+
+func TestTemplatePublicKey(t *testing.T) {
+	is := is.New(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	is.NoErr(err)
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err)
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	is.NoErr(err)
+
+	template := DefaultTemplate
+	is.NoErr(template.VerifyPublicKey(&rsaKey.PublicKey))        // RSA key should be accepted
+	is.NoErr(template.VerifyPublicKey(&p256Key.PublicKey))       // ECDSA key should be accepted by an rsa template
+	is.True(template.VerifyPublicKey(&p224Key.PublicKey) != nil) // Unsupported curve must be rejected
+	template.MinimalKeyLength = 4096
+	is.True(template.VerifyPublicKey(&rsaKey.PublicKey) != nil) // RSA key smaller than the minimal key length must be rejected
+
+	template = DefaultTemplate
+	template.PublicKeyAlgorithm = PublicKeyAlgorithmECDSA
+	is.True(template.Verify() != nil) // Minimal key length must be a supported curve
+	template.MinimalKeyLength = 384
+	is.NoErr(template.Verify())
+	is.True(template.VerifyPublicKey(&p256Key.PublicKey) != nil) // Curve smaller than the minimal key length must be rejected
+	oid, _ := template.PublicKeyAlgorithmOID()
+	is.Equal(oid, OIDECDSAP384)
+}
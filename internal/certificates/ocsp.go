@@ -0,0 +1,186 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+	"time"
+
+	"github.com/mattrax/Mattrax/internal/kek"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPResponseLifetime is how long an OCSP response can be cached by a client. It is kept short so revocations are seen quickly.
+const OCSPResponseLifetime = time.Hour
+
+// ocspSignerLifetime is how long the delegated OCSP signing certificate is valid for
+const ocspSignerLifetime = 30 * 24 * time.Hour
+
+// ocspSignerRenewalPeriod is how long before the OCSP signing certificate expires that a new one is issued
+const ocspSignerRenewalPeriod = 7 * 24 * time.Hour
+
+// oidOCSPNoCheck is the id-pkix-ocsp-nocheck extension. It tells clients not to check the revocation status of the OCSP signing certificate (RFC 6960 4.2.2.2.1).
+var oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+// ErrOCSPUnauthorized is returned when an OCSP request is for a certificate which was not issued by the identity certificate
+var ErrOCSPUnauthorized = errors.New("ocsp request is not for a certificate issued by the identity certificate")
+
+// OCSPSigner contains the delegated certificate OCSP responses are signed with.
+// It is issued by the identity certificate so the identity key is not used for every response.
+type OCSPSigner struct {
+	Cert         *x509.Certificate `graphql:"-"` // It is parsed from CertRaw when the server starts and is never stored
+	CertRaw      []byte
+	Signer       crypto.Signer `graphql:"-"` // Signs using the private key. It is loaded when the server starts and is never stored.
+	KeyRaw       []byte        `graphql:"-"` // The PKCS#1 private key stored in plaintext by previous versions. It is only read to migrate the key.
+	EncryptedKey *kek.Envelope `graphql:"-"` // The PKCS#8 private key (PKCS#1 if created by a previous version) encrypted with the key encryption key. It is empty if the key is in the key store.
+	KeyID        []byte        `graphql:"-"` // The ID of the private key in the key store. It is empty if the key is stored encrypted in the datastore.
+}
+
+// valid checks the signer was issued by the identity certificate and does not need renewing
+func (signer OCSPSigner) valid(identity Identity) bool {
+	return signer.Cert != nil && signer.Signer != nil && bytes.Equal(signer.Cert.AuthorityKeyId, identity.Cert.SubjectKeyId) && time.Now().Before(signer.Cert.NotAfter.Add(-ocspSignerRenewalPeriod))
+}
+
+// OCSPSigner returns the delegated OCSP signing certificate. A new one is issued if it doesn't exist, is close to expiring or was issued by a previous identity certificate.
+func (s *Service) OCSPSigner() (OCSPSigner, error) {
+	s.ocspMutex.Lock()
+	defer s.ocspMutex.Unlock()
+
+	certificates := s.Get()
+	if certificates.Identity.Cert == nil || certificates.Identity.Signer == nil {
+		return OCSPSigner{}, errors.New("error loading ocsp signer: the identity certificate has not been generated")
+	} else if certificates.OCSPSigner.valid(certificates.Identity) {
+		return certificates.OCSPSigner, nil
+	}
+
+	privateKey, encryptedKey, keyID, err := s.generateKey(signerKeyAlgorithm(certificates.Identity.Cert.PublicKey))
+	if err != nil {
+		return OCSPSigner{}, pkgerrors.Wrap(err, "error generating ocsp signer private key")
+	}
+
+	notBefore := time.Now().Add(-5 * time.Minute) // This allows for clock skew on clients
+	certificate, err := s.Issue(&x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: certificates.Identity.Subject.CommonName + " OCSP Signer",
+		},
+		NotBefore:   notBefore,
+		NotAfter:    notBefore.Add(ocspSignerLifetime),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:    oidOCSPNoCheck,
+				Value: asn1.NullBytes,
+			},
+		},
+	}, privateKey.Public(), "")
+	if err != nil {
+		return OCSPSigner{}, pkgerrors.Wrap(err, "error issuing ocsp signer certificate")
+	}
+
+	signer := OCSPSigner{
+		Cert:         certificate,
+		CertRaw:      certificate.Raw,
+		Signer:       privateKey,
+		EncryptedKey: encryptedKey,
+		KeyID:        keyID,
+	}
+
+	s.mutex.Lock()
+	previousCertificates := s.certificates
+	s.certificates.OCSPSigner = signer
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		s.mutex.Unlock()
+		return OCSPSigner{}, pkgerrors.Wrap(err, "error saving ocsp signer")
+	}
+	s.mutex.Unlock()
+
+	log.Info().Str("serial-number", FormatSerialNumber(certificate.SerialNumber)).Time("Expires", certificate.NotAfter).Msg("Issued new OCSP signing certificate...")
+	return signer, nil
+}
+
+// OCSPResponse returns the signed response to a DER encoded OCSP request (RFC 6960).
+// Certificates which are not in the issued certificate registry have the unknown status.
+// Responses for the current identity are signed by the delegated OCSP signer and responses for other trusted identities are signed by the identity itself.
+// ErrOCSPUnauthorized is returned if the request is for a certificate issued by another CA.
+func (s *Service) OCSPResponse(requestDer []byte) ([]byte, error) {
+	request, err := ocsp.ParseRequest(requestDer)
+	if err != nil {
+		return nil, err
+	} else if !request.HashAlgorithm.Available() {
+		return nil, ErrOCSPUnauthorized
+	}
+
+	certificates := s.Get()
+	var identity Identity
+	for _, trustedIdentity := range certificates.TrustedIdentities() {
+		issuerKeyHash, err := publicKeyHash(trustedIdentity.Cert.RawSubjectPublicKeyInfo, request.HashAlgorithm.New())
+		if err != nil {
+			return nil, pkgerrors.Wrap(err, "error hashing identity public key")
+		} else if bytes.Equal(issuerKeyHash, request.IssuerKeyHash) {
+			identity = trustedIdentity
+			break
+		}
+	}
+	if identity.Cert == nil {
+		return nil, ErrOCSPUnauthorized
+	}
+
+	responderCert, responderKey := identity.Cert, identity.Signer
+	var signerCert *x509.Certificate
+	if identity.CertHash == certificates.Identity.CertHash {
+		signer, err := s.OCSPSigner()
+		if err != nil {
+			return nil, err
+		}
+		responderCert, responderKey, signerCert = signer.Cert, signer.Signer, signer.Cert
+	}
+
+	thisUpdate := time.Now().UTC().Truncate(time.Minute)
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   thisUpdate,
+		NextUpdate:   thisUpdate.Add(OCSPResponseLifetime),
+		Certificate:  signerCert,
+		IssuerHash:   request.HashAlgorithm,
+	}
+
+	issuedCertificate, ok, err := s.GetIssued(FormatSerialNumber(request.SerialNumber))
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error loading issued certificate")
+	} else if ok && issuedCertificate.IssuerHash != "" && issuedCertificate.IssuerHash != identity.CertHash {
+		ok = false // The serial number was issued by another trusted identity
+	}
+
+	if ok && issuedCertificate.Status == StatusRevoked {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = issuedCertificate.RevokedAt
+		template.RevocationReason = int(issuedCertificate.RevocationReason)
+	} else if ok {
+		template.Status = ocsp.Good
+	}
+
+	return ocsp.CreateResponse(identity.Cert, responderCert, template, responderKey)
+}
+
+// publicKeyHash hashes the public key in the DER encoded subject public key info. It is used to identify the issuer in OCSP requests.
+func publicKeyHash(publicKeyDer []byte, hasher hash.Hash) ([]byte, error) {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(publicKeyDer, &publicKeyInfo); err != nil {
+		return nil, err
+	}
+
+	hasher.Write(publicKeyInfo.PublicKey.RightAlign())
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,59 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPResponse(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+	identity := service.Get().Identity
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating device key
+
+	certificate, err := service.Issue(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "device"},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+	}, &privateKey.PublicKey, "device-uuid")
+	is.NoErr(err) // Error issuing certificate
+
+	request, err := ocsp.CreateRequest(certificate, identity.Cert, nil)
+	is.NoErr(err) // Error creating OCSP request
+
+	responseDer, err := service.OCSPResponse(request)
+	is.NoErr(err) // Error generating OCSP response
+	response, err := ocsp.ParseResponseForCert(responseDer, certificate, identity.Cert)
+	is.NoErr(err)                                                        // OCSP response should be signed by a delegated signer issued by the identity certificate
+	is.Equal(response.Status, ocsp.Good)                                 // Certificate should be good
+	is.True(response.Certificate != nil)                                 // OCSP signing certificate should be included in the response
+	is.Equal(response.Certificate.Raw, service.Get().OCSPSigner.CertRaw) // Response should be signed by the saved signer
+
+	is.NoErr(service.Revoke(FormatSerialNumber(certificate.SerialNumber), ReasonKeyCompromise)) // Error revoking certificate
+
+	responseDer, err = service.OCSPResponse(request)
+	is.NoErr(err) // Error generating OCSP response
+	response, err = ocsp.ParseResponseForCert(responseDer, certificate, identity.Cert)
+	is.NoErr(err)
+	is.Equal(response.Status, ocsp.Revoked) // Certificate should be revoked
+	is.Equal(response.RevocationReason, int(ReasonKeyCompromise))
+
+	// A certificate from another CA must not be answered
+	otherIdentity := *identity.Cert
+	otherIdentity.RawSubjectPublicKeyInfo = certificate.RawSubjectPublicKeyInfo
+	otherIdentity.PublicKey = certificate.PublicKey
+	request, err = ocsp.CreateRequest(certificate, &otherIdentity, nil)
+	is.NoErr(err)
+	_, err = service.OCSPResponse(request)
+	is.Equal(err, ErrOCSPUnauthorized) // Request for another issuer should be unauthorized
+}
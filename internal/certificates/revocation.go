@@ -0,0 +1,199 @@
+package certificates
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/mattrax/Mattrax/internal/datastore"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// RevocationReason is the reason a certificate was revoked. The values are defined in RFC 5280 5.3.1.
+type RevocationReason int
+
+// The revocation reasons which can be used when revoking a certificate
+const (
+	ReasonUnspecified          RevocationReason = 0
+	ReasonKeyCompromise        RevocationReason = 1
+	ReasonAffiliationChanged   RevocationReason = 3
+	ReasonSuperseded           RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+	ReasonPrivilegeWithdrawn   RevocationReason = 9
+)
+
+// crlLifetime is how long a generated CRL is valid for
+const crlLifetime = 24 * time.Hour
+
+// crlRefreshPeriod is how long before the CRL expires that a new one is generated
+const crlRefreshPeriod = 12 * time.Hour
+
+// revokedKey is the key the serial numbers of all revoked certificates are stored under. It is used to generate the CRL.
+var revokedKey = []byte("revoked")
+
+// Verify checks the RevocationReason is supported
+func (reason RevocationReason) Verify() error {
+	switch reason {
+	case ReasonUnspecified, ReasonKeyCompromise, ReasonAffiliationChanged, ReasonSuperseded, ReasonCessationOfOperation, ReasonPrivilegeWithdrawn:
+		return nil
+	}
+	return errors.New("invalid revocation reason: unsupported reason code")
+}
+
+// Revoke revokes the issued certificate with the serial number (in hex). Revoking a certificate which is already revoked does nothing.
+func (s *Service) Revoke(serialNumber string, reason RevocationReason) error {
+	if err := reason.Verify(); err != nil {
+		return err
+	}
+
+	s.issuedMutex.Lock()
+	defer s.issuedMutex.Unlock()
+
+	issuedCertificate, ok, err := s.GetIssued(serialNumber)
+	if err != nil {
+		return pkgerrors.Wrap(err, "error loading issued certificate")
+	} else if !ok {
+		return errors.New("the certificate '" + serialNumber + "' was not issued by this server")
+	} else if issuedCertificate.Status == StatusRevoked {
+		return nil
+	}
+
+	issuedCertificate.Status = StatusRevoked
+	issuedCertificate.RevokedAt = time.Now().UTC()
+	issuedCertificate.RevocationReason = reason
+	if err := s.issued.Update(func(tx datastore.Tx) error {
+		var revoked []string
+		if err := tx.Get(revokedKey, &revoked); err != nil && err != datastore.ErrNotFound {
+			return pkgerrors.Wrap(err, "error loading revoked certificates")
+		}
+
+		if err := tx.Set(issuedSerialKey(issuedCertificate.SerialNumber), issuedCertificate); err != nil {
+			return pkgerrors.Wrap(err, "error saving revoked certificate")
+		}
+
+		if err := tx.Set(revokedKey, append(revoked, issuedCertificate.SerialNumber)); err != nil {
+			return pkgerrors.Wrap(err, "error saving revoked certificates")
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// The CRLs are regenerated on the next request so the revocation is published immediately
+	s.mutex.Lock()
+	s.crls = map[string]cachedCRL{}
+	s.mutex.Unlock()
+
+	log.Info().Str("serial-number", issuedCertificate.SerialNumber).Str("device-uuid", issuedCertificate.DeviceUUID).Int("reason", int(reason)).Msg("Revoked certificate")
+	return nil
+}
+
+// RevokeDevice revokes every certificate issued to the device
+func (s *Service) RevokeDevice(deviceUUID string, reason RevocationReason) error {
+	issuedCertificates, err := s.GetIssuedByDevice(deviceUUID)
+	if err != nil {
+		return pkgerrors.Wrap(err, "error loading device's issued certificates")
+	}
+
+	for _, issuedCertificate := range issuedCertificates {
+		if err := s.Revoke(issuedCertificate.SerialNumber, reason); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// IsRevoked checks if the certificate has been revoked and returns its record in the issued certificate registry.
+// A certificate which is not in the registry wasn't issued by this server so it is treated as revoked.
+func (s *Service) IsRevoked(certificate *x509.Certificate) (IssuedCertificate, bool, error) {
+	issuedCertificate, ok, err := s.GetIssued(FormatSerialNumber(certificate.SerialNumber))
+	if err != nil {
+		return IssuedCertificate{}, true, err
+	}
+
+	return issuedCertificate, !ok || issuedCertificate.Status == StatusRevoked, nil
+}
+
+// cachedCRL is a generated CRL which is reused until it is close to expiring
+type cachedCRL struct {
+	crl        []byte
+	nextUpdate time.Time
+}
+
+// CRL returns the DER encoded certificate revocation list signed by the identity with the CertHash.
+// Each trusted identity has its own CRL containing the certificates it issued.
+// The CRL is cached and regenerated when a certificate is revoked or it is close to expiring.
+func (s *Service) CRL(certHash string) ([]byte, time.Time, error) {
+	s.mutex.Lock()
+	if cached, ok := s.crls[certHash]; ok && time.Now().Before(cached.nextUpdate.Add(-crlRefreshPeriod)) {
+		s.mutex.Unlock()
+		return cached.crl, cached.nextUpdate, nil
+	}
+	s.mutex.Unlock()
+
+	s.issuedMutex.Lock()
+	var revoked []string
+	err := s.issued.Get(revokedKey, &revoked)
+	s.issuedMutex.Unlock()
+	if err != nil && err != datastore.ErrNotFound {
+		return nil, time.Time{}, pkgerrors.Wrap(err, "error loading revoked certificates")
+	}
+
+	var entries []x509.RevocationListEntry
+	for _, serialNumber := range revoked {
+		issuedCertificate, ok, err := s.GetIssued(serialNumber)
+		if err != nil {
+			return nil, time.Time{}, pkgerrors.Wrap(err, "error loading revoked certificate")
+		} else if !ok || issuedCertificate.Expired() {
+			continue // Expired certificates don't need to be in the CRL (RFC 5280 3.3)
+		} else if issuedCertificate.IssuerHash != "" && issuedCertificate.IssuerHash != certHash {
+			continue // Certificates without an issuer were issued before rollover was supported so they are included in every CRL
+		}
+
+		serial, _ := new(big.Int).SetString(issuedCertificate.SerialNumber, 16)
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: issuedCertificate.RevokedAt,
+			ReasonCode:     int(issuedCertificate.RevocationReason),
+		})
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	identity, ok := s.certificates.FindIdentity(certHash)
+	if !ok || identity.Cert == nil || identity.Signer == nil {
+		return nil, time.Time{}, ErrUnknownIdentity
+	}
+
+	previousCertificates := s.certificates
+	s.certificates.CRLNumber++
+
+	thisUpdate := time.Now().UTC()
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(s.certificates.CRLNumber),
+		ThisUpdate:                thisUpdate,
+		NextUpdate:                thisUpdate.Add(crlLifetime),
+	}, identity.Cert, identity.Signer)
+	if err != nil {
+		s.certificates = previousCertificates
+		return nil, time.Time{}, pkgerrors.Wrap(err, "error generating crl")
+	}
+
+	// The CRL number must increase with every CRL so it is saved before the CRL is published
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		return nil, time.Time{}, pkgerrors.Wrap(err, "error saving crl number")
+	}
+
+	s.crls[certHash] = cachedCRL{
+		crl:        crl,
+		nextUpdate: thisUpdate.Add(crlLifetime),
+	}
+	return crl, thisUpdate.Add(crlLifetime), nil
+}
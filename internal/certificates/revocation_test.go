@@ -0,0 +1,56 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestRevokeDevice(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating device key
+
+	certificate, err := service.Issue(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "device"},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+	}, &privateKey.PublicKey, "device-uuid")
+	is.NoErr(err) // Error issuing certificate
+
+	crlDer, _, err := service.CRL(service.Get().Identity.CertHash)
+	is.NoErr(err) // Error generating CRL
+	crl, err := x509.ParseRevocationList(crlDer)
+	is.NoErr(err)                                                 // CRL should be valid
+	is.NoErr(crl.CheckSignatureFrom(service.Get().Identity.Cert)) // CRL should be signed by the identity certificate
+	is.Equal(len(crl.RevokedCertificateEntries), 0)               // No certificates should be revoked
+	firstNumber := crl.Number
+
+	issuedCertificate, revoked, err := service.IsRevoked(certificate)
+	is.NoErr(err)
+	is.True(!revoked)                                     // Certificate should not be revoked
+	is.Equal(issuedCertificate.DeviceUUID, "device-uuid") // Registry record of the certificate should be returned
+
+	is.NoErr(service.RevokeDevice("device-uuid", ReasonCessationOfOperation)) // Error revoking device certificates
+
+	_, revoked, err = service.IsRevoked(certificate)
+	is.NoErr(err)
+	is.True(revoked) // Certificate should be revoked
+
+	crlDer, _, err = service.CRL(service.Get().Identity.CertHash)
+	is.NoErr(err) // Error generating CRL
+	crl, err = x509.ParseRevocationList(crlDer)
+	is.NoErr(err)
+	is.Equal(len(crl.RevokedCertificateEntries), 1)                                          // Revoked certificate should be in the CRL
+	is.Equal(crl.RevokedCertificateEntries[0].SerialNumber.Cmp(certificate.SerialNumber), 0) // CRL entry should have the certificate's serial number
+	is.Equal(crl.RevokedCertificateEntries[0].ReasonCode, int(ReasonCessationOfOperation))
+	is.True(crl.Number.Cmp(firstNumber) > 0) // CRL number must increase
+}
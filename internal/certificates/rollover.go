@@ -0,0 +1,273 @@
+package certificates
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mattrax/Mattrax/internal/datastore"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultRolloverOverlap is how long a new identity is distributed to devices before it is used to issue certificates if no cutover time is given
+const DefaultRolloverOverlap = 14 * 24 * time.Hour
+
+// RolloverCutoverMargin is how long before the current identity expires the cutover happens even if devices haven't installed the next identity
+const RolloverCutoverMargin = 7 * 24 * time.Hour
+
+// ErrUnknownIdentity is returned when an identity is not trusted by the server
+var ErrUnknownIdentity = errors.New("the identity is not trusted by this server")
+
+// ErrIdentityInUse is returned when retiring an identity which still has valid device certificates
+var ErrIdentityInUse = errors.New("error retiring identity: devices have not renewed the certificates issued by it")
+
+// Rollover is the schedule for replacing the identity certificate.
+// The next identity is trusted by the server and distributed to devices as a trusted root from StartedAt.
+// At CutoverAt it becomes the identity used to issue certificates and the current identity is kept as a previous identity.
+type Rollover struct {
+	StartedAt time.Time `yaml:"started_at"`
+	CutoverAt time.Time `yaml:"cutover_at"`
+}
+
+// IdentityState is the role an identity has in the rollover process
+type IdentityState string
+
+// The states of a trusted identity
+const (
+	IdentityCurrent  IdentityState = "current"  // The identity used to issue certificates
+	IdentityNext     IdentityState = "next"     // The identity which will be used after the rollover cuts over
+	IdentityPrevious IdentityState = "previous" // An identity which was replaced but still has valid certificates
+)
+
+// IdentityStatus is a summary of a trusted identity
+type IdentityStatus struct {
+	CertHash    string        `yaml:"cert_hash"`
+	Subject     string        `yaml:"subject"`
+	NotBefore   time.Time     `yaml:"not_before"`
+	NotAfter    time.Time     `yaml:"not_after"`
+	State       IdentityState `yaml:"state"`
+	Outstanding int           `yaml:"outstanding"` // The number of valid device certificates issued by the identity
+}
+
+// TrustedIdentities returns every identity which certificates are accepted from. This is the current, next and previous identities.
+func (certificates Certificates) TrustedIdentities() []Identity {
+	var identities []Identity
+	if certificates.Identity.Cert != nil {
+		identities = append(identities, certificates.Identity)
+	}
+	if certificates.NextIdentity.Cert != nil {
+		identities = append(identities, certificates.NextIdentity)
+	}
+	return append(identities, certificates.PreviousIdentities...)
+}
+
+// FindIdentity returns the trusted identity with the CertHash
+func (certificates Certificates) FindIdentity(certHash string) (Identity, bool) {
+	for _, identity := range certificates.TrustedIdentities() {
+		if strings.EqualFold(identity.CertHash, certHash) {
+			return identity, true
+		}
+	}
+	return Identity{}, false
+}
+
+// StartRollover generates the next identity using the key algorithm. It replaces the current identity at cutoverAt.
+// If cutoverAt is zero DefaultRolloverOverlap is used. Only one rollover can be in progress at a time.
+func (s *Service) StartRollover(subject pkix.Name, algorithm KeyAlgorithm, cutoverAt time.Time) error {
+	identity, err := s.newIdentity(subject, algorithm)
+	if err != nil {
+		return err
+	}
+
+	return s.stageIdentity(identity, cutoverAt)
+}
+
+// stageIdentity makes the identity the next identity which replaces the current identity at cutoverAt.
+// If cutoverAt is zero DefaultRolloverOverlap is used.
+func (s *Service) stageIdentity(identity Identity, cutoverAt time.Time) error {
+	if cutoverAt.IsZero() {
+		cutoverAt = time.Now().Add(DefaultRolloverOverlap)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.certificates.Identity.Cert == nil {
+		return errors.New("error starting rollover: the identity certificate has not been generated")
+	} else if s.certificates.NextIdentity.Cert != nil {
+		return errors.New("error starting rollover: a rollover is already in progress")
+	}
+
+	previousCertificates := s.certificates
+	s.certificates.NextIdentity = identity
+	s.certificates.Rollover = Rollover{
+		StartedAt: time.Now().UTC(),
+		CutoverAt: cutoverAt.UTC(),
+	}
+
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error saving next identity")
+	}
+
+	log.Info().Str("CommonName", identity.Subject.CommonName).Time("Cutover", cutoverAt).Msg("Started Mattrax identity rollover...")
+	return nil
+}
+
+// Cutover makes the next identity the identity used to issue certificates. The replaced identity remains trusted as a previous identity.
+func (s *Service) Cutover() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.certificates.NextIdentity.Cert == nil {
+		return errors.New("error cutting over identity: no rollover is in progress")
+	}
+
+	previousCertificates := s.certificates
+	s.certificates.PreviousIdentities = append([]Identity{s.certificates.Identity}, s.certificates.PreviousIdentities...)
+	s.certificates.Identity = s.certificates.NextIdentity
+	s.certificates.NextIdentity = Identity{}
+	s.certificates.Rollover = Rollover{}
+	s.certificates.OCSPSigner = OCSPSigner{} // The OCSP signer must be reissued by the new identity
+
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error saving identity cutover")
+	}
+
+	log.Info().Str("CommonName", s.certificates.Identity.Subject.CommonName).Time("Expires", s.certificates.Identity.NotAfter).Msg("Cut over to new Mattrax identity...")
+	return nil
+}
+
+// RetireIdentity removes a previous identity so certificates it issued are no longer trusted.
+// It fails if the identity still has valid device certificates unless force is set.
+func (s *Service) RetireIdentity(certHash string, force bool) error {
+	if !force {
+		outstanding, err := s.Outstanding(certHash)
+		if err != nil {
+			return err
+		} else if outstanding != 0 {
+			return ErrIdentityInUse
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var previousIdentities []Identity
+	for _, identity := range s.certificates.PreviousIdentities {
+		if !strings.EqualFold(identity.CertHash, certHash) {
+			previousIdentities = append(previousIdentities, identity)
+		}
+	}
+	if len(previousIdentities) == len(s.certificates.PreviousIdentities) {
+		return errors.New("error retiring identity: only previous identities can be retired")
+	}
+
+	previousCertificates := s.certificates
+	s.certificates.PreviousIdentities = previousIdentities
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		return pkgerrors.Wrap(err, "error saving retired identity")
+	}
+	delete(s.crls, certHash)
+
+	log.Info().Str("CertHash", certHash).Bool("forced", force).Msg("Retired Mattrax identity...")
+	return nil
+}
+
+// Outstanding returns the number of valid device certificates which were issued by the identity
+func (s *Service) Outstanding(certHash string) (int, error) {
+	var serialNumbers []string
+	if err := s.issued.Get(issuedIssuerKey(certHash), &serialNumbers); err != nil && err != datastore.ErrNotFound {
+		return 0, pkgerrors.Wrap(err, "error loading identity's issued certificates")
+	}
+
+	var outstanding int
+	for _, serialNumber := range serialNumbers {
+		issuedCertificate, ok, err := s.GetIssued(serialNumber)
+		if err != nil {
+			return 0, pkgerrors.Wrap(err, "error loading issued certificate")
+		} else if ok && issuedCertificate.DeviceUUID != "" && issuedCertificate.Status == StatusValid && !issuedCertificate.Expired() {
+			outstanding++
+		}
+	}
+
+	return outstanding, nil
+}
+
+// Identities returns a summary of every trusted identity
+func (s *Service) Identities() ([]IdentityStatus, error) {
+	certificates := s.Get()
+
+	var identities []IdentityStatus
+	for _, identity := range certificates.TrustedIdentities() {
+		state := IdentityPrevious
+		if identity.CertHash == certificates.Identity.CertHash {
+			state = IdentityCurrent
+		} else if identity.CertHash == certificates.NextIdentity.CertHash {
+			state = IdentityNext
+		}
+
+		outstanding, err := s.Outstanding(identity.CertHash)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, IdentityStatus{
+			CertHash:    identity.CertHash,
+			Subject:     identity.Subject.String(),
+			NotBefore:   identity.NotBefore,
+			NotAfter:    identity.NotAfter,
+			State:       state,
+			Outstanding: outstanding,
+		})
+	}
+
+	return identities, nil
+}
+
+// CutoverDeadline returns when the rollover cuts over even if devices haven't installed the next identity.
+// It is RolloverCutoverMargin before the current identity expires so an offline device can't stop the identity being replaced.
+func (certificates Certificates) CutoverDeadline() time.Time {
+	return certificates.Identity.NotAfter.Add(-RolloverCutoverMargin)
+}
+
+// CheckRollover runs the scheduled steps of the identity rollover.
+// The next identity is cut over to once CutoverAt has passed and previous identities are retired once they have no valid device certificates or have expired.
+// pendingDevices returns the UUIDs of the devices which haven't installed the next identity yet. The cutover is postponed until there are none or the CutoverDeadline has passed.
+// It can be nil if devices don't need to install identities.
+func (s *Service) CheckRollover(pendingDevices func(next Identity) ([]string, error)) error {
+	certificates := s.Get()
+	if certificates.NextIdentity.Cert != nil && time.Now().After(certificates.Rollover.CutoverAt) {
+		var pending []string
+		if pendingDevices != nil {
+			var err error
+			if pending, err = pendingDevices(certificates.NextIdentity); err != nil {
+				return pkgerrors.Wrap(err, "error checking devices trust the next identity")
+			}
+		}
+
+		if len(pending) != 0 && time.Now().Before(certificates.CutoverDeadline()) {
+			log.Warn().Strs("pending-devices", pending).Str("next-identity", certificates.NextIdentity.CertHash).Time("deadline", certificates.CutoverDeadline()).Msg("postponing identity cutover until every device has installed the next identity")
+		} else {
+			if len(pending) != 0 {
+				log.Warn().Strs("pending-devices", pending).Str("next-identity", certificates.NextIdentity.CertHash).Msg("cutting over to the next identity before every device has installed it as the current identity is about to expire")
+			}
+
+			if err := s.Cutover(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, identity := range s.Get().PreviousIdentities {
+		if err := s.RetireIdentity(identity.CertHash, time.Now().After(identity.NotAfter)); err != nil && err != ErrIdentityInUse {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestRollover(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+	previousIdentity := service.Get().Identity
+
+	is.True(service.GenerateIdentity(pkix.Name{CommonName: "Replacement"}, RSA2048) != nil) // Existing identity must not be replaced
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating device key
+	template := func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:   pkix.Name{CommonName: "device"},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Hour),
+		}
+	}
+
+	certificate, err := service.Issue(template(), &privateKey.PublicKey, "device-uuid")
+	is.NoErr(err) // Error issuing certificate
+
+	is.NoErr(service.StartRollover(pkix.Name{CommonName: "Test Identity 2"}, ECDSAP256, time.Now().Add(time.Hour))) // Error starting rollover
+	is.True(service.StartRollover(pkix.Name{CommonName: "Test Identity 3"}, RSA2048, time.Time{}) != nil)           // Only one rollover can be in progress
+	nextIdentity := service.Get().NextIdentity
+	is.Equal(len(service.Get().TrustedIdentities()), 2) // Next identity should be trusted
+
+	is.NoErr(service.CheckRollover(nil))                                              // Error checking rollover
+	is.Equal(service.Get().Identity.CertHash, previousIdentity.CertHash)              // Cutover should not happen before it is scheduled
+	is.NoErr(certificate.CheckSignatureFrom(service.Get().Identity.Cert))             // Certificates should be issued by the current identity until cutover
+	is.NoErr(service.Cutover())                                                       // Error cutting over
+	is.Equal(service.Get().Identity.CertHash, nextIdentity.CertHash)                  // Next identity should become the current identity
+	is.Equal(service.Get().PreviousIdentities[0].CertHash, previousIdentity.CertHash) // Replaced identity should still be trusted
+
+	renewed, err := service.Issue(template(), &privateKey.PublicKey, "device-uuid")
+	is.NoErr(err)                                           // Error issuing certificate
+	is.NoErr(renewed.CheckSignatureFrom(nextIdentity.Cert)) // Certificates should be issued by the new identity after cutover
+
+	_, _, err = service.CRL(previousIdentity.CertHash)
+	is.NoErr(err) // Previous identity should still publish a CRL
+
+	is.NoErr(service.CheckRollover(nil))               // Error checking rollover
+	is.Equal(len(service.Get().PreviousIdentities), 1) // Identity with outstanding certificates should not be retired
+	is.Equal(service.RetireIdentity(previousIdentity.CertHash, false), ErrIdentityInUse)
+
+	is.NoErr(service.Revoke(FormatSerialNumber(certificate.SerialNumber), ReasonSuperseded)) // Error revoking certificate
+	is.NoErr(service.CheckRollover(nil))                                                     // Error checking rollover
+	is.Equal(len(service.Get().PreviousIdentities), 0)                                       // Identity should be retired once every device has renewed
+
+	_, _, err = service.CRL(previousIdentity.CertHash)
+	is.Equal(err, ErrUnknownIdentity) // Retired identity should no longer be trusted
+}
+
+func TestRolloverPendingDevices(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+	previousIdentity := service.Get().Identity
+
+	is.NoErr(service.StartRollover(pkix.Name{CommonName: "Test Identity 2"}, ECDSAP256, time.Now().Add(-time.Second))) // Error starting rollover
+	nextIdentity := service.Get().NextIdentity
+
+	pending := []string{"offline-device"}
+	pendingDevices := func(next Identity) ([]string, error) {
+		is.Equal(next.CertHash, nextIdentity.CertHash) // Devices should be checked for the next identity
+		return pending, nil
+	}
+
+	is.NoErr(service.CheckRollover(pendingDevices))                      // Error checking rollover
+	is.Equal(service.Get().Identity.CertHash, previousIdentity.CertHash) // Cutover should wait for every device to install the next identity
+
+	pending = nil
+	is.NoErr(service.CheckRollover(pendingDevices))                  // Error checking rollover
+	is.Equal(service.Get().Identity.CertHash, nextIdentity.CertHash) // Cutover should happen once every device has installed the next identity
+}
+
+func TestRolloverCutoverDeadline(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+
+	is.NoErr(service.StartRollover(pkix.Name{CommonName: "Test Identity 2"}, ECDSAP256, time.Now().Add(-time.Second))) // Error starting rollover
+	nextIdentity := service.Get().NextIdentity
+	service.certificates.Identity.NotAfter = time.Now().Add(RolloverCutoverMargin - time.Hour)
+
+	is.NoErr(service.CheckRollover(func(next Identity) ([]string, error) {
+		return []string{"offline-device"}, nil
+	})) // Error checking rollover
+	is.Equal(service.Get().Identity.CertHash, nextIdentity.CertHash) // Cutover must not wait for devices once the current identity is about to expire
+}
@@ -0,0 +1,236 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattrax/Mattrax/internal/datastore"
+	"github.com/mattrax/Mattrax/internal/kek"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// scepRALifetime is how long the SCEP registration authority certificate is valid for
+const scepRALifetime = 30 * 24 * time.Hour
+
+// scepRARenewalPeriod is how long before the SCEP registration authority certificate expires that a new one is issued
+const scepRARenewalPeriod = 7 * 24 * time.Hour
+
+// scepChallengeKeySize is the size in bytes of the key SCEP challenge passwords are derived with
+const scepChallengeKeySize = 32
+
+// scepChallengeNonceSize is the size in bytes of the random nonce which makes each SCEP challenge password unique
+const scepChallengeNonceSize = 16
+
+// SCEPChallengeLifetime is how long a SCEP challenge password can be used for
+const SCEPChallengeLifetime = 24 * time.Hour
+
+// ErrInvalidSCEPChallenge is returned when a SCEP challenge password was not created by the server, has expired or has already been used
+var ErrInvalidSCEPChallenge = errors.New("the scep challenge password is invalid")
+
+// SCEPRA contains the registration authority certificate for the SCEP server (RFC 8894).
+// Devices encrypt their requests to it and it signs the responses. It is issued by the identity certificate.
+// SCEP requires an RSA key which can decrypt the requests so it is always created in software, even if the identity uses ECDSA or a key store.
+type SCEPRA struct {
+	Cert         *x509.Certificate `graphql:"-"` // It is parsed from CertRaw when the server starts and is never stored
+	CertRaw      []byte
+	Signer       crypto.Signer `graphql:"-"` // The RSA private key. It is loaded when the server starts and is never stored.
+	EncryptedKey *kek.Envelope `graphql:"-"` // The PKCS#8 private key encrypted with the key encryption key
+}
+
+// PrivateKey returns the RSA private key of the registration authority
+func (ra SCEPRA) PrivateKey() *rsa.PrivateKey {
+	privateKey, _ := ra.Signer.(*rsa.PrivateKey)
+	return privateKey
+}
+
+// valid checks the registration authority was issued by the identity certificate and does not need renewing
+func (ra SCEPRA) valid(identity Identity) bool {
+	return ra.Cert != nil && ra.PrivateKey() != nil && bytes.Equal(ra.Cert.AuthorityKeyId, identity.Cert.SubjectKeyId) && time.Now().Before(ra.Cert.NotAfter.Add(-scepRARenewalPeriod))
+}
+
+// SCEPRA returns the SCEP registration authority certificate. A new one is issued if it doesn't exist, is close to expiring or was issued by a previous identity certificate.
+func (s *Service) SCEPRA() (SCEPRA, error) {
+	s.scepMutex.Lock()
+	defer s.scepMutex.Unlock()
+
+	certificates := s.Get()
+	if certificates.Identity.Cert == nil || certificates.Identity.Signer == nil {
+		return SCEPRA{}, errors.New("error loading scep registration authority: the identity certificate has not been generated")
+	} else if certificates.SCEPRA.valid(certificates.Identity) {
+		return certificates.SCEPRA, nil
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return SCEPRA{}, pkgerrors.Wrap(err, "error generating scep registration authority private key")
+	}
+
+	privateKeyDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return SCEPRA{}, pkgerrors.Wrap(err, "error marshalling scep registration authority private key")
+	}
+
+	encryptedKey, err := s.kek.Seal(privateKeyDer)
+	if err != nil {
+		return SCEPRA{}, pkgerrors.Wrap(err, "error encrypting scep registration authority private key")
+	}
+
+	notBefore := time.Now().Add(-5 * time.Minute) // This allows for clock skew on clients
+	certificate, err := s.Issue(&x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: certificates.Identity.Subject.CommonName + " SCEP RA",
+		},
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(scepRALifetime),
+		KeyUsage:  x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}, &privateKey.PublicKey, "")
+	if err != nil {
+		return SCEPRA{}, pkgerrors.Wrap(err, "error issuing scep registration authority certificate")
+	}
+
+	ra := SCEPRA{
+		Cert:         certificate,
+		CertRaw:      certificate.Raw,
+		Signer:       privateKey,
+		EncryptedKey: encryptedKey,
+	}
+
+	s.mutex.Lock()
+	previousCertificates := s.certificates
+	s.certificates.SCEPRA = ra
+	if err := s.save(); err != nil {
+		s.certificates = previousCertificates
+		s.mutex.Unlock()
+		return SCEPRA{}, pkgerrors.Wrap(err, "error saving scep registration authority")
+	}
+	s.mutex.Unlock()
+
+	log.Info().Str("serial-number", FormatSerialNumber(certificate.SerialNumber)).Time("Expires", certificate.NotAfter).Msg("Issued new SCEP registration authority certificate...")
+	return ra, nil
+}
+
+// SCEPChallenge returns a SCEP challenge password for the device. It contains the device's UUID, the name of the template, when it expires and a random nonce which are authenticated with an HMAC so it doesn't need to be stored.
+// The default template is used if templateName is empty. The challenge key is created the first time a challenge is requested.
+func (s *Service) SCEPChallenge(deviceUUID string, templateName string) (string, error) {
+	if _, err := s.Get().GetTemplate(templateName); err != nil {
+		return "", err
+	} else if strings.Contains(deviceUUID, ":") || strings.Contains(templateName, ":") {
+		return "", errors.New("error creating scep challenge: the device uuid and template name must not contain ':'")
+	}
+
+	nonce := make([]byte, scepChallengeNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", pkgerrors.Wrap(err, "error generating scep challenge nonce")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.scepChallengeKey == nil {
+		challengeKey := make([]byte, scepChallengeKeySize)
+		if _, err := io.ReadFull(rand.Reader, challengeKey); err != nil {
+			return "", pkgerrors.Wrap(err, "error generating scep challenge key")
+		}
+
+		encryptedKey, err := s.kek.Seal(challengeKey)
+		if err != nil {
+			return "", pkgerrors.Wrap(err, "error encrypting scep challenge key")
+		}
+
+		previousCertificates := s.certificates
+		s.certificates.SCEPChallengeKey = encryptedKey
+		if err := s.save(); err != nil {
+			s.certificates = previousCertificates
+			return "", pkgerrors.Wrap(err, "error saving scep challenge key")
+		}
+		s.scepChallengeKey = challengeKey
+	}
+
+	payload := strings.Join([]string{deviceUUID, templateName, strconv.FormatInt(time.Now().Add(SCEPChallengeLifetime).Unix(), 10), hex.EncodeToString(nonce)}, ":")
+	return payload + ":" + hex.EncodeToString(scepChallengeMAC(s.scepChallengeKey, payload)), nil
+}
+
+// VerifySCEPChallenge checks the challenge password was created by SCEPChallenge, hasn't expired and hasn't been used before. It returns the UUID of the device and the name of the template it was created for.
+// The challenge can't be used again once it has been verified.
+func (s *Service) VerifySCEPChallenge(challenge string) (string, string, error) {
+	s.mutex.Lock()
+	challengeKey := s.scepChallengeKey
+	s.mutex.Unlock()
+
+	parts := strings.Split(challenge, ":")
+	if challengeKey == nil || len(parts) != 5 {
+		return "", "", ErrInvalidSCEPChallenge
+	}
+
+	payload := strings.Join(parts[:4], ":")
+	mac, err := hex.DecodeString(parts[4])
+	if err != nil || !hmac.Equal(mac, scepChallengeMAC(challengeKey, payload)) {
+		return "", "", ErrInvalidSCEPChallenge
+	}
+
+	expiresAt, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return "", "", ErrInvalidSCEPChallenge
+	}
+
+	// Used challenges are remembered until they expire
+	if err := s.store.Update(func(tx datastore.Tx) error {
+		if err := tx.Get(usedSCEPChallengeKey(parts[3]), new(int64)); err == nil {
+			return ErrInvalidSCEPChallenge
+		} else if err != datastore.ErrNotFound {
+			return err
+		}
+
+		var expired [][]byte
+		cursor := tx.Cursor(usedSCEPChallengePrefix)
+		for key := cursor.First(); key != nil; key = cursor.Next() {
+			var usedExpiresAt int64
+			if err := cursor.Value(&usedExpiresAt); err != nil {
+				return err
+			} else if time.Now().Unix() > usedExpiresAt {
+				expired = append(expired, key)
+			}
+		}
+		for _, key := range expired {
+			if err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return tx.Set(usedSCEPChallengeKey(parts[3]), expiresAt)
+	}); err == ErrInvalidSCEPChallenge {
+		return "", "", err
+	} else if err != nil {
+		return "", "", pkgerrors.Wrap(err, "error saving used scep challenge")
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// usedSCEPChallengePrefix is the prefix of the keys the nonces of used SCEP challenges are stored under
+var usedSCEPChallengePrefix = []byte("scep-challenge/")
+
+// usedSCEPChallengeKey returns the key a used SCEP challenge is stored under
+func usedSCEPChallengeKey(nonce string) []byte {
+	return []byte(string(usedSCEPChallengePrefix) + nonce)
+}
+
+// scepChallengeMAC returns the HMAC of the challenge's payload
+func scepChallengeMAC(challengeKey []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, challengeKey)
+	mac.Write([]byte("mattrax-scep-challenge:" + payload))
+	return mac.Sum(nil)
+}
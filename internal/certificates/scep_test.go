@@ -0,0 +1,67 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestSCEP(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+	identity := service.Get().Identity
+
+	ra, err := service.SCEPRA()
+	is.NoErr(err)                                               // Error issuing scep registration authority
+	is.NoErr(ra.Cert.CheckSignatureFrom(identity.Cert))         // Registration authority should be issued by the identity
+	is.True(ra.PrivateKey() != nil)                             // Registration authority must have an RSA key
+	is.True(ra.Cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0) // Registration authority must be able to decrypt requests
+
+	again, err := service.SCEPRA()
+	is.NoErr(err)
+	is.Equal(again.CertRaw, ra.CertRaw) // A valid registration authority should be reused
+
+	challenge, err := service.SCEPChallenge("device-uuid", "")
+	is.NoErr(err) // Error creating scep challenge
+	deviceUUID, templateName, err := service.VerifySCEPChallenge(challenge)
+	is.NoErr(err)                       // Challenge should be valid
+	is.Equal(deviceUUID, "device-uuid") // Challenge should be for the device
+	is.Equal(templateName, "")          // Challenge should be for the default template
+
+	_, _, err = service.VerifySCEPChallenge("other-device" + challenge[len("device-uuid"):])
+	is.Equal(err, ErrInvalidSCEPChallenge) // Challenge must not be valid for another device
+	_, _, err = service.VerifySCEPChallenge("device-uuid")
+	is.Equal(err, ErrInvalidSCEPChallenge) // Malformed challenge must be rejected
+	_, _, err = service.VerifySCEPChallenge(challenge)
+	is.Equal(err, ErrInvalidSCEPChallenge) // Challenge must not be used twice
+
+	expiredPayload := "device-uuid::" + strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) + ":00"
+	_, _, err = service.VerifySCEPChallenge(expiredPayload + ":" + hex.EncodeToString(scepChallengeMAC(service.scepChallengeKey, expiredPayload)))
+	is.Equal(err, ErrInvalidSCEPChallenge) // Expired challenge must be rejected
+
+	templateChallenge, err := service.SCEPChallenge("device-uuid", "computer")
+	is.NoErr(err) // Error creating scep challenge for a named template
+	_, templateName, err = service.VerifySCEPChallenge(templateChallenge)
+	is.NoErr(err)
+	is.Equal(templateName, "computer") // Challenge should be for the named template
+	_, _, err = service.VerifySCEPChallenge(strings.Replace(templateChallenge, ":computer:", ":user:", 1))
+	is.Equal(err, ErrInvalidSCEPChallenge) // Challenge must not be valid for another template
+	_, err = service.SCEPChallenge("device-uuid", "missing")
+	is.Equal(err, ErrUnknownTemplate) // Challenge must not be created for a template which doesn't exist
+
+	reloaded, err := NewService(service.store, service.issued, service.kek, nil)
+	is.NoErr(err) // Error reloading service
+	unusedChallenge, err := service.SCEPChallenge("device-uuid", "")
+	is.NoErr(err)
+	_, _, err = reloaded.VerifySCEPChallenge(unusedChallenge)
+	is.NoErr(err) // Challenge key should be persisted
+	_, _, err = reloaded.VerifySCEPChallenge(challenge)
+	is.Equal(err, ErrInvalidSCEPChallenge)                       // Used challenges should be persisted
+	is.Equal(reloaded.Get().SCEPRA.CertRaw, ra.CertRaw)          // Registration authority should be persisted
+	is.True(reloaded.Get().SCEPRA.PrivateKey().Equal(ra.Signer)) // Registration authority key should be loaded
+}
@@ -0,0 +1,458 @@
+package certificates
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattrax/Mattrax/internal/merge"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrUnknownTemplate is returned when a named template doesn't exist
+var ErrUnknownTemplate = errors.New("the certificate template does not exist")
+
+// templateNameRegex is used to verify the name of a named template. It is used in URLs so it is restricted to lowercase letters, numbers and dashes.
+var templateNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// templateVariableRegex matches the variables in a subject or subject alternative name pattern
+var templateVariableRegex = regexp.MustCompile(`\{[^{}]*\}`)
+
+// keyUsageNames maps the key usages which can be used in a Template to their x509 value
+var keyUsageNames = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+}
+
+// extKeyUsageNames maps the extended key usages which can be used by name in a Template to their x509 value
+var extKeyUsageNames = map[string]x509.ExtKeyUsage{
+	"client_auth":      x509.ExtKeyUsageClientAuth,
+	"server_auth":      x509.ExtKeyUsageServerAuth,
+	"email_protection": x509.ExtKeyUsageEmailProtection,
+	"code_signing":     x509.ExtKeyUsageCodeSigning,
+	"time_stamping":    x509.ExtKeyUsageTimeStamping,
+	"ipsec_end_system": x509.ExtKeyUsageIPSECEndSystem,
+	"ipsec_user":       x509.ExtKeyUsageIPSECUser,
+}
+
+// subjectAttributes are the attributes which can be used in a templates subject pattern
+var subjectAttributes = map[string]func(name *pkix.Name, value string){
+	"CN": func(name *pkix.Name, value string) { name.CommonName = value },
+	"O":  func(name *pkix.Name, value string) { name.Organization = append(name.Organization, value) },
+	"OU": func(name *pkix.Name, value string) { name.OrganizationalUnit = append(name.OrganizationalUnit, value) },
+	"C":  func(name *pkix.Name, value string) { name.Country = append(name.Country, value) },
+	"ST": func(name *pkix.Name, value string) { name.Province = append(name.Province, value) },
+	"L":  func(name *pkix.Name, value string) { name.Locality = append(name.Locality, value) },
+}
+
+// oidSubjectAltName is the subject alternative name extension. It is created manually when it contains a UPN as crypto/x509 doesn't support otherName.
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// oidUPN is the otherName type of a Microsoft user principal name (szOID_NT_PRINCIPAL_NAME)
+var oidUPN = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+
+// TemplateVariables contains the values of the variables which can be used in a templates subject and subject alternative name patterns
+type TemplateVariables struct {
+	DeviceUUID        string // {device_uuid} is the UUID of the device in Mattrax
+	DeviceID          string // {device_id} is the Windows DeviceID of the device
+	HWDevID           string // {hw_dev_id} is the hardware id of the device
+	UPN               string // {upn} is the email of the user who enrolled the device or authenticated the request
+	RequestCommonName string // {request_common_name} is the common name from the certificate request
+}
+
+// values returns the value of every variable by its name
+func (variables TemplateVariables) values() map[string]string {
+	return map[string]string{
+		"{device_uuid}":         variables.DeviceUUID,
+		"{device_id}":           variables.DeviceID,
+		"{hw_dev_id}":           variables.HWDevID,
+		"{upn}":                 variables.UPN,
+		"{request_common_name}": variables.RequestCommonName,
+	}
+}
+
+// expand replaces the variables in the pattern with their values. An error is returned if a variable used in the pattern has no value.
+func (variables TemplateVariables) expand(pattern string) (string, error) {
+	values := variables.values()
+	var err error
+	expanded := templateVariableRegex.ReplaceAllStringFunc(pattern, func(variable string) string {
+		value := values[variable]
+		if value == "" && err == nil {
+			err = errors.New("the template variable " + variable + " has no value for this request")
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// expandSubject builds the subject from the pattern. The pattern is split into its attributes before the variables are replaced so their values can't add attributes.
+func (variables TemplateVariables) expandSubject(pattern string) (pkix.Name, error) {
+	attributes, err := parseSubject(pattern)
+	if err != nil {
+		return pkix.Name{}, err
+	}
+
+	var name pkix.Name
+	for _, attribute := range attributes {
+		value, err := variables.expand(attribute.value)
+		if err != nil {
+			return pkix.Name{}, err
+		}
+		subjectAttributes[attribute.name](&name, value)
+	}
+	return name, nil
+}
+
+// expandAll expands every pattern
+func (variables TemplateVariables) expandAll(patterns []string) ([]string, error) {
+	expanded := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		value, err := variables.expand(pattern)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, value)
+	}
+	return expanded, nil
+}
+
+// Certificate creates the certificate for the request using the template. The variables in the patterns are replaced with their values.
+// The defaultSubject is used if the template has no subject pattern. The request's subject alternative names are only used if the template has no patterns for them and CopyRequestSANs is enabled.
+// The caller must add the CRL and OCSP locations before issuing it.
+func (template Template) Certificate(variables TemplateVariables, request *x509.CertificateRequest, defaultSubject pkix.Name) (*x509.Certificate, error) {
+	notBefore := time.Now().Add(-5 * time.Minute) // This allows for clock skew on clients
+	certificate := &x509.Certificate{
+		Subject:   defaultSubject,
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(template.ValidityPeriod),
+	}
+
+	if template.Subject != "" {
+		subject, err := variables.expandSubject(template.Subject)
+		if err != nil {
+			return nil, err
+		}
+		certificate.Subject = subject
+	}
+
+	if len(template.DNSNames) != 0 || len(template.EmailAddresses) != 0 || len(template.UPNs) != 0 || len(template.URIs) != 0 {
+		if err := template.setSubjectAltNames(certificate, variables); err != nil {
+			return nil, err
+		}
+	} else if template.CopiesRequestSANs() {
+		certificate.DNSNames = request.DNSNames
+		certificate.EmailAddresses = request.EmailAddresses
+		certificate.IPAddresses = request.IPAddresses
+		certificate.URIs = request.URIs
+	}
+
+	for _, keyUsage := range template.KeyUsages {
+		certificate.KeyUsage |= keyUsageNames[keyUsage]
+	}
+
+	for _, extKeyUsage := range template.ExtKeyUsages {
+		if usage, ok := extKeyUsageNames[extKeyUsage]; ok {
+			certificate.ExtKeyUsage = append(certificate.ExtKeyUsage, usage)
+		} else {
+			certificate.UnknownExtKeyUsage = append(certificate.UnknownExtKeyUsage, ParseOID(extKeyUsage))
+		}
+	}
+
+	return certificate, nil
+}
+
+// setSubjectAltNames expands the templates subject alternative name patterns into the certificate
+func (template Template) setSubjectAltNames(certificate *x509.Certificate, variables TemplateVariables) error {
+	dnsNames, err := variables.expandAll(template.DNSNames)
+	if err != nil {
+		return err
+	}
+	emailAddresses, err := variables.expandAll(template.EmailAddresses)
+	if err != nil {
+		return err
+	}
+	upns, err := variables.expandAll(template.UPNs)
+	if err != nil {
+		return err
+	}
+	uris, err := variables.expandAll(template.URIs)
+	if err != nil {
+		return err
+	}
+
+	if len(upns) == 0 {
+		certificate.DNSNames, certificate.EmailAddresses = dnsNames, emailAddresses
+		for _, rawURI := range uris {
+			uri, err := url.Parse(rawURI)
+			if err != nil {
+				return errors.New("the uri '" + rawURI + "' is invalid")
+			}
+			certificate.URIs = append(certificate.URIs, uri)
+		}
+		return nil
+	}
+
+	// GeneralName tags defined in RFC 5280 Section 4.2.1.6
+	var generalNames []asn1.RawValue
+	for _, upn := range upns {
+		otherName, err := marshalUPN(upn)
+		if err != nil {
+			return err
+		}
+		generalNames = append(generalNames, asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: otherName})
+	}
+	for _, email := range emailAddresses {
+		generalNames = append(generalNames, asn1.RawValue{Tag: 1, Class: asn1.ClassContextSpecific, Bytes: []byte(email)})
+	}
+	for _, dnsName := range dnsNames {
+		generalNames = append(generalNames, asn1.RawValue{Tag: 2, Class: asn1.ClassContextSpecific, Bytes: []byte(dnsName)})
+	}
+	for _, uri := range uris {
+		generalNames = append(generalNames, asn1.RawValue{Tag: 6, Class: asn1.ClassContextSpecific, Bytes: []byte(uri)})
+	}
+
+	subjectAltName, err := asn1.Marshal(generalNames)
+	if err != nil {
+		return err
+	}
+
+	certificate.ExtraExtensions = append(certificate.ExtraExtensions, pkix.Extension{
+		Id:       oidSubjectAltName,
+		Critical: len(certificate.Subject.ToRDNSequence()) == 0, // RFC 5280 requires the extension to be critical if the subject is empty
+		Value:    subjectAltName,
+	})
+	return nil
+}
+
+// marshalUPN encodes the contents of the otherName containing the user principal name
+func marshalUPN(upn string) ([]byte, error) {
+	typeID, err := asn1.Marshal(oidUPN)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := asn1.MarshalWithParams(upn, "utf8")
+	if err != nil {
+		return nil, err
+	}
+
+	explicitValue, err := asn1.Marshal(asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: value})
+	if err != nil {
+		return nil, err
+	}
+	return append(typeID, explicitValue...), nil
+}
+
+// verifyCertificateProperties checks the name, patterns and key usages of the template are valid
+func (template Template) verifyCertificateProperties() error {
+	if template.Name != "" && !templateNameRegex.MatchString(template.Name) {
+		return errors.New("invalid template: the name must only contain lowercase letters, numbers and dashes")
+	}
+
+	patterns := append([]string{template.Subject}, template.DNSNames...)
+	patterns = append(patterns, template.EmailAddresses...)
+	patterns = append(patterns, template.UPNs...)
+	patterns = append(patterns, template.URIs...)
+	values := TemplateVariables{}.values()
+	for _, pattern := range patterns {
+		for _, variable := range templateVariableRegex.FindAllString(pattern, -1) {
+			if _, ok := values[variable]; !ok {
+				return errors.New("invalid template: unknown variable " + variable)
+			}
+		}
+	}
+
+	if template.Subject != "" {
+		if _, err := parseSubject(template.Subject); err != nil {
+			return errors.New("invalid template: " + err.Error())
+		}
+	}
+
+	for _, keyUsage := range template.KeyUsages {
+		if _, ok := keyUsageNames[keyUsage]; !ok {
+			return errors.New("invalid template: unsupported key usage '" + keyUsage + "'")
+		}
+	}
+
+	for _, extKeyUsage := range template.ExtKeyUsages {
+		if _, ok := extKeyUsageNames[extKeyUsage]; !ok && ParseOID(extKeyUsage) == nil {
+			return errors.New("invalid template: unsupported extended key usage '" + extKeyUsage + "'. It must be a name or a dotted oid")
+		}
+	}
+
+	return nil
+}
+
+// subjectAttribute is an attribute of a subject pattern
+type subjectAttribute struct {
+	name  string // One of the keys of subjectAttributes
+	value string // The value pattern
+}
+
+// parseSubject splits a subject pattern in the form 'CN=...,O=...' into its attributes. Values can't contain commas.
+func parseSubject(subject string) ([]subjectAttribute, error) {
+	var attributes []subjectAttribute
+	for _, attribute := range strings.Split(subject, ",") {
+		parts := strings.SplitN(attribute, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("the subject attribute '" + attribute + "' must be in the form 'CN=value'")
+		}
+
+		name := strings.ToUpper(strings.TrimSpace(parts[0]))
+		if _, ok := subjectAttributes[name]; !ok {
+			return nil, errors.New("the subject attribute '" + parts[0] + "' is not supported. It must be one of CN, O, OU, C, ST or L")
+		}
+		attributes = append(attributes, subjectAttribute{name: name, value: strings.TrimSpace(parts[1])})
+	}
+	return attributes, nil
+}
+
+// ParseOID parses a dotted OID. It returns nil if the OID is invalid.
+func ParseOID(oid string) asn1.ObjectIdentifier {
+	var parsed asn1.ObjectIdentifier
+	for _, part := range strings.Split(oid, ".") {
+		arc, err := strconv.Atoi(part)
+		if err != nil || arc < 0 {
+			return nil
+		}
+		parsed = append(parsed, arc)
+	}
+	if len(parsed) < 2 {
+		return nil
+	}
+	return parsed
+}
+
+// OID returns the object identifier of a named template. It is an arc below the enrollment policy OID derived from the templates name.
+func (template Template) OID(policyOID string) string {
+	hash := sha256.Sum256([]byte(template.Name))
+	// The arc is limited to 31 bits as larger arcs can't be parsed by encoding/asn1
+	return policyOID + "." + strconv.FormatUint(uint64(binary.BigEndian.Uint32(hash[:4])>>1), 10)
+}
+
+// defaultNamedTemplates are created on first boot. They are offered to Windows clients by the standalone certificate enrollment web services.
+var defaultNamedTemplates = []Template{
+	{
+		Name:           "user",
+		Subject:        "CN={upn}",
+		EmailAddresses: []string{"{upn}"},
+		UPNs:           []string{"{upn}"},
+		KeyUsages:      []string{"digital_signature", "key_encipherment"},
+		ExtKeyUsages:   []string{"client_auth", "email_protection"},
+	},
+	{
+		Name:         "computer",
+		Subject:      "CN={device_uuid}",
+		KeyUsages:    []string{"digital_signature", "key_encipherment"},
+		ExtKeyUsages: []string{"client_auth"},
+		Machine:      boolPtr(true),
+	},
+}
+
+// boolPtr returns a pointer to the bool
+func boolPtr(value bool) *bool {
+	return &value
+}
+
+// GetTemplate returns the named template. The default template is returned if the name is empty.
+func (certificates Certificates) GetTemplate(name string) (Template, error) {
+	if name == "" {
+		return certificates.Template, nil
+	}
+
+	template, ok := certificates.Templates[name]
+	if !ok {
+		return Template{}, ErrUnknownTemplate
+	}
+	return template, nil
+}
+
+// SetNamedTemplate creates or updates a named template. The templates revision is incremented if it was changed.
+// Fields which are not set are kept from the current template with the name or taken from the DefaultTemplate if it is new.
+func (s *Service) SetNamedTemplate(template Template) error {
+	if template.Name == "" {
+		return errors.New("invalid template: a name is required")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previousTemplate, exists := s.certificates.Templates[template.Name]
+	if !exists {
+		previousTemplate = DefaultTemplate
+		previousTemplate.Revision = 0
+	}
+
+	if err := merge.Merge(&template, previousTemplate); err != nil {
+		log.Error().Err(err).Msg("error merging Template structs")
+		return errors.New("internal server error: failed to merge certificate template")
+	}
+
+	if err := template.Verify(); err != nil {
+		return err
+	}
+
+	if exists && template.equal(previousTemplate) {
+		return nil
+	}
+	template.Revision = previousTemplate.Revision + 1
+	template.UpdatedAt = time.Now().UTC()
+
+	previousTemplates := s.certificates.Templates
+	s.certificates.Templates = make(map[string]Template, len(previousTemplates)+1)
+	for name, namedTemplate := range previousTemplates {
+		s.certificates.Templates[name] = namedTemplate
+	}
+	s.certificates.Templates[template.Name] = template
+	previousUpdatedAt := s.certificates.TemplatesUpdatedAt
+	s.certificates.TemplatesUpdatedAt = template.UpdatedAt
+
+	if err := s.save(); err != nil {
+		s.certificates.Templates, s.certificates.TemplatesUpdatedAt = previousTemplates, previousUpdatedAt
+		log.Error().Err(err).Msg("error saving certificate template")
+		return errors.New("internal error saving certificate template. values were not changed")
+	}
+
+	log.Info().Str("name", template.Name).Int("revision", template.Revision).Msg("Updated certificate template...")
+	return nil
+}
+
+// DeleteTemplate deletes a named template. Certificates already issued using it are not affected.
+func (s *Service) DeleteTemplate(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.certificates.Templates[name]; !ok {
+		return ErrUnknownTemplate
+	}
+
+	previousTemplates := s.certificates.Templates
+	s.certificates.Templates = make(map[string]Template, len(previousTemplates))
+	for templateName, namedTemplate := range previousTemplates {
+		if templateName != name {
+			s.certificates.Templates[templateName] = namedTemplate
+		}
+	}
+	previousUpdatedAt := s.certificates.TemplatesUpdatedAt
+	s.certificates.TemplatesUpdatedAt = time.Now().UTC()
+
+	if err := s.save(); err != nil {
+		s.certificates.Templates, s.certificates.TemplatesUpdatedAt = previousTemplates, previousUpdatedAt
+		log.Error().Err(err).Msg("error deleting certificate template")
+		return errors.New("internal error deleting certificate template. values were not changed")
+	}
+
+	log.Info().Str("name", name).Msg("Deleted certificate template...")
+	return nil
+}
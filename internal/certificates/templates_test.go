@@ -0,0 +1,101 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestTemplateCertificate(t *testing.T) {
+	is := is.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating key
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "laptop"},
+		DNSNames: []string{"laptop.example.com"},
+	}, privateKey)
+	is.NoErr(err)
+	csr, err := x509.ParseCertificateRequest(csrDer)
+	is.NoErr(err)
+
+	variables := TemplateVariables{DeviceUUID: "device-uuid", UPN: "oscar@example.com", RequestCommonName: csr.Subject.CommonName}
+	template := Template{
+		Name:           "user",
+		Subject:        "CN={upn},OU={device_uuid},O=Mattrax",
+		EmailAddresses: []string{"{upn}"},
+		UPNs:           []string{"{upn}"},
+		KeyUsages:      []string{"digital_signature"},
+		ExtKeyUsages:   []string{"client_auth", "1.3.6.1.4.1.311.10.3.4"},
+	}
+	is.NoErr(template.verifyCertificateProperties()) // Template should be valid
+
+	certificate, err := template.Certificate(variables, csr, pkix.Name{CommonName: "default"})
+	is.NoErr(err)                                                             // Error creating certificate from template
+	is.Equal(certificate.Subject.CommonName, "oscar@example.com")             // Subject should be expanded from the pattern
+	is.Equal(certificate.Subject.OrganizationalUnit, []string{"device-uuid"}) // Subject should contain every attribute
+	is.Equal(len(certificate.DNSNames), 0)                                    // Request names must not be used when the template has patterns
+	is.Equal(len(certificate.ExtraExtensions), 1)                             // Subject alternative names with a UPN must be built manually
+	is.Equal(certificate.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+	is.Equal(len(certificate.UnknownExtKeyUsage), 1) // Extended key usages should be accepted by OID
+
+	certificate, err = Template{}.Certificate(variables, csr, pkix.Name{CommonName: "default"})
+	is.NoErr(err)
+	is.Equal(certificate.Subject.CommonName, "default") // Default subject should be used without a pattern
+	is.Equal(len(certificate.DNSNames), 0)              // Request names must not be used unless enabled
+
+	copyRequestSANs := true
+	certificate, err = Template{CopyRequestSANs: &copyRequestSANs}.Certificate(variables, csr, pkix.Name{CommonName: "default"})
+	is.NoErr(err)
+	is.Equal(certificate.DNSNames, []string{"laptop.example.com"}) // Request names should be used without patterns if enabled
+
+	variables.RequestCommonName = "laptop,O=Contoso,OU=Admins"
+	certificate, err = Template{Subject: "CN={request_common_name},O=Mattrax"}.Certificate(variables, csr, pkix.Name{})
+	is.NoErr(err)
+	is.Equal(certificate.Subject.CommonName, "laptop,O=Contoso,OU=Admins") // Variables must not add subject attributes
+	is.Equal(certificate.Subject.Organization, []string{"Mattrax"})        // Only the pattern's attributes are used
+	is.Equal(len(certificate.Subject.OrganizationalUnit), 0)
+
+	_, err = Template{Subject: "CN={device_id}"}.Certificate(variables, csr, pkix.Name{})
+	is.True(err != nil) // A variable without a value must be rejected
+
+	is.True(Template{ExtKeyUsages: []string{"unknown"}}.verifyCertificateProperties() != nil) // Unknown usages must be rejected
+}
+
+func TestNamedTemplates(t *testing.T) {
+	is := is.New(t)
+	service := newTestService(t)
+
+	_, err := service.Get().GetTemplate("user")
+	is.NoErr(err) // Default named templates should be created
+	computer, err := service.Get().GetTemplate("computer")
+	is.NoErr(err)
+	is.True(computer.IsMachine())       // Computer certificates must only be issued to authenticated devices
+	is.Equal(len(computer.DNSNames), 0) // Computer certificates must not take DNS names from the request
+
+	err = service.SetNamedTemplate(Template{Name: "wifi", Subject: "CN={device_uuid}"})
+	is.NoErr(err) // Error creating named template
+	template, err := service.Get().GetTemplate("wifi")
+	is.NoErr(err)
+	is.Equal(template.Revision, 1)                                    // New template should have the first revision
+	is.Equal(template.ValidityPeriod, DefaultTemplate.ValidityPeriod) // Unset fields should be taken from the default template
+	is.True(!template.IsMachine())                                    // Templates are user templates unless set
+
+	machine := false
+	is.NoErr(service.SetNamedTemplate(Template{Name: "computer", Machine: &machine})) // Error updating named template
+	computer, err = service.Get().GetTemplate("computer")
+	is.NoErr(err)
+	is.True(!computer.IsMachine()) // Machine option should be able to be disabled
+
+	is.True(service.SetNamedTemplate(Template{Name: "Not Valid"}) != nil) // Invalid names must be rejected
+
+	is.NoErr(service.DeleteTemplate("wifi")) // Error deleting named template
+	_, err = service.Get().GetTemplate("wifi")
+	is.Equal(err, ErrUnknownTemplate)                            // Deleted template must not exist
+	is.Equal(service.DeleteTemplate("wifi"), ErrUnknownTemplate) // Deleting a missing template must fail
+}
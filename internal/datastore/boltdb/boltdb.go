@@ -5,9 +5,11 @@ import (
 	"encoding/gob"
 
 	"github.com/boltdb/bolt"
+	"github.com/mattrax/Mattrax/internal/datastore"
 	"github.com/pkg/errors"
 )
 
+// Store is a datastore which saves its values in a bucket of a bolt database
 type Store struct {
 	DB     *bolt.DB
 	Bucket []byte
@@ -21,40 +23,130 @@ func (s *Store) Init() error {
 }
 
 func (s *Store) Set(key []byte, value interface{}) error {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(value); err != nil {
-		return errors.Wrap(err, "error: boltdb: unable to encode value")
-	}
-	raw := buf.Bytes()
+	return s.Update(func(tx datastore.Tx) error {
+		return tx.Set(key, value)
+	})
+}
+
+func (s *Store) Get(key []byte, model interface{}) error {
+	return s.View(func(tx datastore.Tx) error {
+		return tx.Get(key, model)
+	})
+}
+
+func (s *Store) Delete(key []byte) error {
+	return s.Update(func(tx datastore.Tx) error {
+		return tx.Delete(key)
+	})
+}
+
+func (s *Store) List(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := s.View(func(tx datastore.Tx) error {
+		c := tx.Cursor(prefix)
+		for key := c.First(); key != nil; key = c.Next() {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
 
-	err := s.DB.Update(func(tx *bolt.Tx) error {
+func (s *Store) View(fn func(tx datastore.Tx) error) error {
+	return s.DB.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(s.Bucket)
 		if bucket == nil {
 			return errors.New("error: boltdb: bucket does not exist")
 		}
-
-		err := bucket.Put(key, raw)
-		return err
+		return fn(boltTx{bucket})
 	})
-
-	return err
 }
 
-func (s *Store) Get(key []byte, model interface{}) error {
-	err := s.DB.View(func(tx *bolt.Tx) error {
+func (s *Store) Update(fn func(tx datastore.Tx) error) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(s.Bucket)
 		if bucket == nil {
 			return errors.New("error: boltdb: bucket does not exist")
 		}
+		return fn(boltTx{bucket})
+	})
+}
 
-		raw := bucket.Get(key)
-		if raw == nil {
-			return nil
-		}
+// boltTx is a transaction on the store's bucket
+type boltTx struct {
+	bucket *bolt.Bucket
+}
 
-		err := gob.NewDecoder(bytes.NewBuffer(raw)).Decode(model)
-		return err
-	})
+func (tx boltTx) Set(key []byte, value interface{}) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(value); err != nil {
+		return errors.Wrap(err, "error: boltdb: unable to encode value")
+	}
+
+	return tx.bucket.Put(key, buf.Bytes())
+}
+
+func (tx boltTx) Get(key []byte, model interface{}) error {
+	raw := tx.bucket.Get(key)
+	if raw == nil {
+		return datastore.ErrNotFound
+	}
+
+	return gob.NewDecoder(bytes.NewBuffer(raw)).Decode(model)
+}
+
+func (tx boltTx) Delete(key []byte) error {
+	if tx.bucket.Get(key) == nil {
+		return datastore.ErrNotFound
+	}
+
+	return tx.bucket.Delete(key)
+}
+
+func (tx boltTx) Cursor(prefix []byte) datastore.Cursor {
+	return &boltCursor{
+		cursor: tx.bucket.Cursor(),
+		prefix: prefix,
+	}
+}
+
+// boltCursor iterates over the keys in the bucket which start with the prefix
+type boltCursor struct {
+	cursor *bolt.Cursor
+	prefix []byte
+	value  []byte
+}
+
+// position checks the key is within the prefix and remembers its value. Keys are copied as bolt's are only valid during the transaction.
+func (c *boltCursor) position(key []byte, value []byte) []byte {
+	if key == nil || !bytes.HasPrefix(key, c.prefix) {
+		c.value = nil
+		return nil
+	}
+
+	c.value = value
+	return append([]byte{}, key...)
+}
+
+func (c *boltCursor) First() []byte {
+	return c.position(c.cursor.Seek(c.prefix))
+}
+
+func (c *boltCursor) Seek(key []byte) []byte {
+	if bytes.Compare(key, c.prefix) < 0 {
+		key = c.prefix
+	}
+	return c.position(c.cursor.Seek(key))
+}
+
+func (c *boltCursor) Next() []byte {
+	return c.position(c.cursor.Next())
+}
+
+func (c *boltCursor) Value(model interface{}) error {
+	if c.value == nil {
+		return datastore.ErrNotFound
+	}
 
-	return err
+	return gob.NewDecoder(bytes.NewBuffer(c.value)).Decode(model)
 }
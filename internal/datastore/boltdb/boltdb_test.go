@@ -0,0 +1,72 @@
+package boltdb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/matryer/is"
+	"github.com/mattrax/Mattrax/internal/datastore"
+)
+
+// newTestStore creates a store in a temporary database which is removed when the test finishes
+func newTestStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "mattrax-boltdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	store := &Store{DB: db, Bucket: []byte("test")}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestStore(t *testing.T) {
+	is := is.New(t)
+	store := newTestStore(t)
+
+	var value string
+	is.Equal(store.Get([]byte("missing"), &value), datastore.ErrNotFound) // missing key is not found
+	is.Equal(store.Delete([]byte("missing")), datastore.ErrNotFound)      // missing key can't be deleted
+
+	for _, key := range []string{"device/b", "device/a", "user/a"} {
+		is.NoErr(store.Set([]byte(key), key)) // set value
+	}
+
+	keys, err := store.List([]byte("device/"))
+	is.NoErr(err)                                                          // list keys
+	is.Equal(keys, [][]byte{[]byte("device/a"), []byte("device/b")})       // only keys with the prefix are listed in order
+	is.NoErr(store.Delete([]byte("device/a")))                             // delete value
+	is.Equal(store.Get([]byte("device/a"), &value), datastore.ErrNotFound) // deleted key is not found
+
+	errRollback := errors.New("rollback")
+	is.Equal(store.Update(func(tx datastore.Tx) error {
+		if err := tx.Set([]byte("device/c"), "device/c"); err != nil {
+			return err
+		}
+		return errRollback
+	}), errRollback) // update returns error of fn
+	is.Equal(store.Get([]byte("device/c"), &value), datastore.ErrNotFound) // writes are discarded when fn fails
+
+	is.NoErr(store.View(func(tx datastore.Tx) error {
+		c := tx.Cursor([]byte("device/"))
+		is.Equal(string(c.Seek([]byte("a"))), "device/b") // seek before the prefix starts at the first key
+		is.NoErr(c.Value(&value))                         // decode value at cursor
+		is.Equal(value, "device/b")                       // value matches key
+		is.Equal(c.Next(), nil)                           // keys outside the prefix are skipped
+		return nil
+	})) // iterate keys
+}
@@ -1,7 +1,35 @@
 package datastore
 
+import "errors"
+
+// ErrNotFound is returned when a key doesn't exist in the store
+var ErrNotFound = errors.New("datastore: key not found")
+
+// Store is a key value store. Values are gob encoded.
 type Store interface {
 	Init() error
 	Set(key []byte, value interface{}) error
-	Get(key []byte, value interface{}) error
+	Get(key []byte, value interface{}) error // ErrNotFound is returned if the key doesn't exist
+	Delete(key []byte) error                 // ErrNotFound is returned if the key doesn't exist
+	List(prefix []byte) ([][]byte, error)    // Returns every key which starts with the prefix in byte order
+	View(fn func(tx Tx) error) error         // Runs fn in a read-only transaction
+	Update(fn func(tx Tx) error) error       // Runs fn in a read-write transaction. Its writes are only saved if fn returns nil.
+}
+
+// Tx is a transaction on a Store. It must not be used after the function it was passed to returns.
+// Writes in a read-only transaction return an error.
+type Tx interface {
+	Set(key []byte, value interface{}) error
+	Get(key []byte, value interface{}) error // ErrNotFound is returned if the key doesn't exist
+	Delete(key []byte) error                 // ErrNotFound is returned if the key doesn't exist
+	Cursor(prefix []byte) Cursor
+}
+
+// Cursor iterates over the keys which start with a prefix in byte order.
+// The methods which move the cursor return the key at its new position or nil once there are no more keys.
+type Cursor interface {
+	First() []byte
+	Seek(key []byte) []byte // Moves to the first key which is equal to or after the key
+	Next() []byte
+	Value(value interface{}) error // Decodes the value at the cursor's position
 }
@@ -0,0 +1,184 @@
+package memory
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mattrax/Mattrax/internal/datastore"
+	"github.com/pkg/errors"
+)
+
+// Store is an in memory datastore. It is used for testing and values are lost when the process exits.
+// Values are gob encoded so they behave the same as in the persistent datastores.
+type Store struct {
+	values map[string][]byte
+	mutex  sync.RWMutex
+}
+
+func (s *Store) Init() error {
+	s.mutex.Lock()
+	if s.values == nil {
+		s.values = make(map[string][]byte)
+	}
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *Store) Set(key []byte, value interface{}) error {
+	return s.Update(func(tx datastore.Tx) error {
+		return tx.Set(key, value)
+	})
+}
+
+func (s *Store) Get(key []byte, model interface{}) error {
+	return s.View(func(tx datastore.Tx) error {
+		return tx.Get(key, model)
+	})
+}
+
+func (s *Store) Delete(key []byte) error {
+	return s.Update(func(tx datastore.Tx) error {
+		return tx.Delete(key)
+	})
+}
+
+func (s *Store) List(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := s.View(func(tx datastore.Tx) error {
+		c := tx.Cursor(prefix)
+		for key := c.First(); key != nil; key = c.Next() {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (s *Store) View(fn func(tx datastore.Tx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.values == nil {
+		return errors.New("error: memory: store not initialised")
+	}
+
+	return fn(&memoryTx{values: s.values})
+}
+
+// Update runs fn on a copy of the values which replaces them if fn succeeds
+func (s *Store) Update(fn func(tx datastore.Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.values == nil {
+		return errors.New("error: memory: store not initialised")
+	}
+
+	values := make(map[string][]byte, len(s.values))
+	for key, value := range s.values {
+		values[key] = value
+	}
+
+	if err := fn(&memoryTx{values: values, writable: true}); err != nil {
+		return err
+	}
+	s.values = values
+	return nil
+}
+
+// memoryTx is a transaction on the values of the store
+type memoryTx struct {
+	values   map[string][]byte
+	writable bool
+}
+
+func (tx *memoryTx) Set(key []byte, value interface{}) error {
+	if !tx.writable {
+		return errors.New("error: memory: transaction is read-only")
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(value); err != nil {
+		return errors.Wrap(err, "error: memory: unable to encode value")
+	}
+	tx.values[string(key)] = buf.Bytes()
+	return nil
+}
+
+func (tx *memoryTx) Get(key []byte, model interface{}) error {
+	raw, ok := tx.values[string(key)]
+	if !ok {
+		return datastore.ErrNotFound
+	}
+
+	return gob.NewDecoder(bytes.NewBuffer(raw)).Decode(model)
+}
+
+func (tx *memoryTx) Delete(key []byte) error {
+	if !tx.writable {
+		return errors.New("error: memory: transaction is read-only")
+	} else if _, ok := tx.values[string(key)]; !ok {
+		return datastore.ErrNotFound
+	}
+
+	delete(tx.values, string(key))
+	return nil
+}
+
+// Cursor returns a cursor over the keys which have the prefix when it is created
+func (tx *memoryTx) Cursor(prefix []byte) datastore.Cursor {
+	var keys []string
+	for key := range tx.values {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return &memoryCursor{
+		tx:       tx,
+		keys:     keys,
+		position: len(keys),
+	}
+}
+
+// memoryCursor iterates over a sorted snapshot of the keys
+type memoryCursor struct {
+	tx       *memoryTx
+	keys     []string
+	position int
+}
+
+// current returns the key at the cursor's position or nil if it is past the last key
+func (c *memoryCursor) current() []byte {
+	if c.position >= len(c.keys) {
+		return nil
+	}
+	return []byte(c.keys[c.position])
+}
+
+func (c *memoryCursor) First() []byte {
+	c.position = 0
+	return c.current()
+}
+
+func (c *memoryCursor) Seek(key []byte) []byte {
+	c.position = sort.SearchStrings(c.keys, string(key))
+	return c.current()
+}
+
+func (c *memoryCursor) Next() []byte {
+	if c.position < len(c.keys) {
+		c.position++
+	}
+	return c.current()
+}
+
+func (c *memoryCursor) Value(model interface{}) error {
+	key := c.current()
+	if key == nil {
+		return datastore.ErrNotFound
+	}
+	return c.tx.Get(key, model)
+}
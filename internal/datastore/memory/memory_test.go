@@ -0,0 +1,69 @@
+package memory
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mattrax/Mattrax/internal/datastore"
+)
+
+func TestStore(t *testing.T) {
+	is := is.New(t)
+	store := &Store{}
+	is.NoErr(store.Init()) // initialise store
+
+	var value string
+	is.Equal(store.Get([]byte("missing"), &value), datastore.ErrNotFound) // missing key is not found
+	is.Equal(store.Delete([]byte("missing")), datastore.ErrNotFound)      // missing key can't be deleted
+
+	for _, key := range []string{"device/b", "device/a", "user/a"} {
+		is.NoErr(store.Set([]byte(key), key)) // set value
+	}
+
+	keys, err := store.List([]byte("device/"))
+	is.NoErr(err)                                                                             // list keys
+	is.Equal(keys, [][]byte{[]byte("device/a"), []byte("device/b")})                          // only keys with the prefix are listed in order
+	is.NoErr(store.Get([]byte("device/a"), &value))                                           // get value
+	is.Equal(value, "device/a")                                                               // value is decoded
+	is.NoErr(store.Delete([]byte("device/a")))                                                // delete value
+	is.Equal(store.Get([]byte("device/a"), &value), datastore.ErrNotFound)                    // deleted key is not found
+	is.True(store.View(func(tx datastore.Tx) error { return tx.Set([]byte("a"), 1) }) != nil) // view is read-only
+}
+
+func TestStoreUpdate(t *testing.T) {
+	is := is.New(t)
+	store := &Store{}
+	is.NoErr(store.Init()) // initialise store
+
+	errRollback := errors.New("rollback")
+	err := store.Update(func(tx datastore.Tx) error {
+		if err := tx.Set([]byte("a"), "a"); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	is.Equal(err, errRollback) // update returns error of fn
+
+	var value string
+	is.Equal(store.Get([]byte("a"), &value), datastore.ErrNotFound) // writes are discarded when fn fails
+
+	is.NoErr(store.Update(func(tx datastore.Tx) error {
+		for _, key := range []string{"a", "b", "c"} {
+			if err := tx.Set([]byte(key), key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})) // update multiple keys
+
+	is.NoErr(store.View(func(tx datastore.Tx) error {
+		c := tx.Cursor(nil)
+		is.Equal(string(c.Seek([]byte("b"))), "b") // seek to key
+		is.NoErr(c.Value(&value))                  // decode value at cursor
+		is.Equal(value, "b")                       // value matches key
+		is.Equal(string(c.Next()), "c")            // next key
+		is.Equal(c.Next(), nil)                    // no more keys
+		return nil
+	})) // iterate keys
+}
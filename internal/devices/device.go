@@ -17,6 +17,18 @@ const (
 	AppleMDM
 )
 
+// DeviceStatus is the management state of a device
+type DeviceStatus string
+
+const (
+	// StatusActive is the DeviceStatus of an enrolled device
+	StatusActive DeviceStatus = ""
+	// StatusRetired is the DeviceStatus of a device which is no longer managed. Its data is kept.
+	StatusRetired DeviceStatus = "retired"
+	// StatusWiped is the DeviceStatus of a device which has been requested to factory reset
+	StatusWiped DeviceStatus = "wiped"
+)
+
 // Device is an electronic device that is managed by the MDM server
 // TODO: Make cross platform. Currently it has lots of Windows only values.
 type Device struct {
@@ -25,6 +37,9 @@ type Device struct {
 	Protocol            MDMProtcol                `graphql:",optional"` // The MDM Protocol that manages the device
 	EnrolledAt          time.Time                 `graphql:",optional"` // Time device was enrolled in MDM (Read only)
 	EnrolledBy          types.User                `graphql:",optional"` // The user that enrolled the device in MDM (Stores UUID only in struct as reference) (Read only)
+	AssignedUser        string                    `graphql:",optional"` // The email of the user the device is assigned to by its pre-registered hardware. It doesn't change who enrolled the device.
+	Groups              []string                  `graphql:",optional"` // The groups the device is a member of
+	Status              DeviceStatus              `graphql:",optional"` // The management state of the device (Read only)
 	Windows             WindowsDevice             `graphql:",optional"`
 	Hardware            DeviceHardware            `graphql:",optional"`
 	IdentityCertificate DeviceIdentityCertificate `graphql:",optional"`
@@ -34,16 +49,18 @@ type Device struct {
 
 // DeviceHardware contains details about the physical device managed by MDM
 type DeviceHardware struct {
-	ID  string   `graphql:",optional"` // HardwareID
-	MAC []string `graphql:",optional"`
+	ID           string   `graphql:",optional"` // HardwareID
+	SerialNumber string   `graphql:",optional"`
+	MAC          []string `graphql:",optional"`
 }
 
 // DeviceIdentityCertificate contains detials about the identity certificate issued to the device
 type DeviceIdentityCertificate struct {
-	Subject   pkix.Name `graphql:"-"`
-	Hash      string    `graphql:",optional"`
-	NotBefore time.Time `graphql:",optional"`
-	NotAfter  time.Time `graphql:",optional"`
+	Subject      pkix.Name `graphql:"-"`
+	SerialNumber string    `graphql:",optional"` // Uppercase hex. Used to find the certificate in the issued certificate registry
+	Hash         string    `graphql:",optional"`
+	NotBefore    time.Time `graphql:",optional"`
+	NotAfter     time.Time `graphql:",optional"`
 }
 
 // TODO: move to Windows package
@@ -54,4 +71,6 @@ type WindowsDevice struct {
 	OSEdition          string `graphql:",optional"`
 	OSVersion          string `graphql:",optional"`
 	ApplicationVersion string `graphql:",optional"`
+
+	TrustedCertificates []string `graphql:",optional"` // The SHA-1 hashes of the identity certificates installed on the device as trusted roots and intermediates (Read only)
 }
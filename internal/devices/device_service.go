@@ -7,4 +7,5 @@ type Service interface {
 	Get(uuid string) (Device, error)
 	Search(query string) ([]Device, error)
 	EditOrCreate(device Device) error
+	Delete(uuid string) error
 }
@@ -0,0 +1,118 @@
+package enrollment
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/url"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+// qrQuietZone is the number of white modules around a QR code. It is required by scanners to find the code.
+const qrQuietZone = 4
+
+// DefaultQRScale is the size in pixels of each QR code module if no scale is given
+const DefaultQRScale = 8
+
+// DeepLink is a link which opens the Windows enrollment wizard with the enrollment details filled in.
+// It allows a user to enroll without typing the server address.
+type DeepLink struct {
+	Username    string // The email of the user enrolling
+	ServerName  string // The domain of the enrollment server
+	AccessToken string // An access token which is sent to the server as the enrollment BinarySecurityToken
+}
+
+// Verify checks the DeepLink is valid.
+func (link DeepLink) Verify() error {
+	if link.ServerName == "" {
+		return errors.New("invalid deep link: server name is required")
+	}
+
+	if strings.ContainsAny(link.ServerName, "/?#:") {
+		return errors.New("invalid deep link: server name must be a domain")
+	}
+
+	return nil
+}
+
+// String returns the ms-device-enrollment link
+func (link DeepLink) String() string {
+	params := []string{"mode=mdm"}
+	if link.Username != "" {
+		// Note: The @ is left unescaped to match the link format documented by Microsoft
+		params = append(params, "username="+strings.Replace(url.QueryEscape(link.Username), "%40", "@", 1))
+	}
+	params = append(params, "servername="+url.QueryEscape(link.ServerName))
+	if link.AccessToken != "" {
+		params = append(params, "accesstoken="+url.QueryEscape(link.AccessToken))
+	}
+
+	return "ms-device-enrollment:?" + strings.Join(params, "&")
+}
+
+// QRCode encodes the link as a QR code
+func (link DeepLink) QRCode() (*qr.Code, error) {
+	if err := link.Verify(); err != nil {
+		return nil, err
+	}
+
+	return qr.Encode(link.String(), qr.M)
+}
+
+// WriteQRCodePNG writes the link as a PNG QR code with each module scale pixels wide
+func (link DeepLink) WriteQRCodePNG(w io.Writer, scale int) error {
+	code, err := link.QRCode()
+	if err != nil {
+		return err
+	}
+
+	if scale <= 0 {
+		scale = DefaultQRScale
+	}
+
+	size := (code.Size + 2*qrQuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			pixel := color.Gray{Y: 0xFF}
+			if code.Black(x/scale-qrQuietZone, y/scale-qrQuietZone) {
+				pixel = color.Gray{Y: 0x00}
+			}
+			img.SetGray(x, y, pixel)
+		}
+	}
+
+	return png.Encode(w, img)
+}
+
+// WriteQRCodeSVG writes the link as a SVG QR code with each module scale pixels wide
+func (link DeepLink) WriteQRCodeSVG(w io.Writer, scale int) error {
+	code, err := link.QRCode()
+	if err != nil {
+		return err
+	}
+
+	if scale <= 0 {
+		scale = DefaultQRScale
+	}
+
+	// Every black module is drawn as a square in a single path
+	var path bytes.Buffer
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+
+	modules := code.Size + 2*qrQuietZone
+	_, err = fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`, modules*scale, modules*scale, modules, modules, path.String())
+	return err
+}
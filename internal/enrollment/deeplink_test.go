@@ -0,0 +1,28 @@
+package enrollment
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestDeepLink(t *testing.T) {
+	is := is.New(t)
+
+	link := DeepLink{
+		Username:    "oscar@otbeaumont.me",
+		ServerName:  "mdm.otbeaumont.me",
+		AccessToken: "a b&c",
+	}
+	is.Equal(link.String(), "ms-device-enrollment:?mode=mdm&username=oscar@otbeaumont.me&servername=mdm.otbeaumont.me&accesstoken=a+b%26c") // Parameters should be escaped
+
+	var buf bytes.Buffer
+	is.NoErr(link.WriteQRCodePNG(&buf, 2)) // Error generating PNG QR code
+	img, err := png.Decode(&buf)
+	is.NoErr(err)                                                        // QR code should be a valid PNG
+	is.Equal(img.Bounds().Dx(), img.Bounds().Dy())                       // QR code should be square
+	is.Equal(img.At(0, 0), img.At(img.Bounds().Dx()-1, 0))               // Quiet zone should be white
+	is.True(DeepLink{ServerName: "https://example.com"}.Verify() != nil) // Server name must be a domain
+}
@@ -0,0 +1,313 @@
+package enrollment
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattrax/Mattrax/internal/datastore"
+	"github.com/rs/zerolog/log"
+)
+
+var restrictionsKey = []byte("restrictions")
+var legacyRejectionsKey = []byte("rejections") // Rejections used to be saved as a single list
+var rejectionPrefix = []byte("rejection/")
+var hardwareKey = []byte("hardware")
+
+// maxRejections is the number of rejected enrollment attempts kept for the report. The oldest are removed first.
+const maxRejections = 1000
+
+// Stage is the step of enrollment an attempt was evaluated at
+type Stage string
+
+// The stages of enrollment where restrictions are evaluated
+const (
+	Discovery Stage = "discovery"
+	Provision Stage = "provision"
+)
+
+// Rejection is an enrollment attempt which was blocked by the restrictions.
+// Each rejection is saved as its own record so recording one doesn't rewrite the whole report.
+type Rejection struct {
+	Time       time.Time `yaml:"time"`
+	Stage      Stage     `yaml:"stage"`
+	RemoteAddr string    `yaml:"remote_addr"`
+	Attempt    Attempt   `yaml:"attempt"`
+	Rule       string    `yaml:"rule,omitempty"`
+	Reason     string    `yaml:"reason"`
+}
+
+// Service contains the code for safely (using a Mutex) getting and updating the enrollment restrictions.
+type Service struct {
+	restrictions Restrictions
+	rejections   []Rejection
+	hardware     map[string]Hardware // Registered hardware indexed by its lowercase hardware id
+	mutex        *sync.Mutex         // Mutex is used to ensures exclusive access to the restrictions, rejections and hardware
+	store        datastore.Store
+}
+
+// Get returns the loaded restrictions.
+func (s *Service) Get() Restrictions {
+	s.mutex.Lock()
+	restrictions := s.restrictions
+	s.mutex.Unlock()
+
+	return restrictions
+}
+
+// Set saves updated restrictions, if saving fails restore the current values.
+func (s *Service) Set(restrictions Restrictions) error {
+	if err := restrictions.Verify(); err != nil {
+		return err
+	}
+
+	if restrictions.DefaultAction == "" {
+		restrictions.DefaultAction = Allow
+	}
+
+	s.mutex.Lock()
+	previousRestrictions := s.restrictions
+	s.restrictions = restrictions
+
+	if err := s.store.Set(restrictionsKey, restrictions); err != nil {
+		s.restrictions = previousRestrictions
+		s.mutex.Unlock()
+		log.Error().Err(err).Msg("error saving enrollment restrictions")
+		return errors.New("internal error saving enrollment restrictions. values were not changed")
+	}
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// Rejections returns the most recent rejected enrollment attempts, newest first.
+func (s *Service) Rejections() []Rejection {
+	s.mutex.Lock()
+	rejections := make([]Rejection, len(s.rejections))
+	for i, rejection := range s.rejections {
+		rejections[len(s.rejections)-1-i] = rejection
+	}
+	s.mutex.Unlock()
+
+	return rejections
+}
+
+// Check evaluates the restrictions for an enrollment attempt. If the attempt is rejected it is recorded for the report.
+func (s *Service) Check(stage Stage, remoteAddr string, attempt Attempt) Decision {
+	restrictions := s.Get()
+
+	// The hardware id is only sent to the provision endpoint
+	_, registered := s.LookupHardware(attempt.HardwareID)
+	var decision Decision
+	if stage == Discovery {
+		// The enrollment type is only sent to the provision endpoint so rules depending on it are decided there
+		decision = restrictions.EvaluatePartial(attempt)
+	} else {
+		decision = restrictions.Evaluate(attempt)
+	}
+
+	if restrictions.RegisteredHardwareOnly && stage == Provision && !registered {
+		decision = Decision{
+			Allowed:   false,
+			Reason:    "this device has not been registered for enrollment",
+			FaultType: "DeviceNotSupported",
+		}
+	} else if decision.Allowed {
+		return decision
+	}
+
+	log.Info().Str("stage", string(stage)).Str("remote-addr", remoteAddr).Str("rule", decision.Rule).Interface("attempt", attempt).Msg("Rejected enrollment attempt")
+
+	s.mutex.Lock()
+	rejection := Rejection{
+		Time:       time.Now().UTC(),
+		Stage:      stage,
+		RemoteAddr: remoteAddr,
+		Attempt:    attempt,
+		Rule:       decision.Rule,
+		Reason:     decision.Reason,
+	}
+	if len(s.rejections) != 0 && !rejection.Time.After(s.rejections[len(s.rejections)-1].Time) {
+		rejection.Time = s.rejections[len(s.rejections)-1].Time.Add(time.Nanosecond) // The time is the key so it must be unique
+	}
+
+	if err := s.store.Update(func(tx datastore.Tx) error {
+		if err := tx.Set(rejectionKey(rejection.Time), rejection); err != nil {
+			return err
+		}
+
+		if len(s.rejections) >= maxRejections {
+			if err := tx.Delete(rejectionKey(s.rejections[0].Time)); err != nil && err != datastore.ErrNotFound {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Error().Err(err).Msg("error saving rejected enrollment attempt")
+	} else {
+		s.rejections = append(s.rejections, rejection)
+		if len(s.rejections) > maxRejections {
+			s.rejections = s.rejections[len(s.rejections)-maxRejections:]
+		}
+	}
+	s.mutex.Unlock()
+
+	return decision
+}
+
+// GetHardware returns the registered hardware.
+func (s *Service) GetHardware() []Hardware {
+	s.mutex.Lock()
+	hardwareList := make([]Hardware, 0, len(s.hardware))
+	for _, hardware := range s.hardware {
+		hardwareList = append(hardwareList, hardware)
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(hardwareList, func(i, j int) bool { return hardwareList[i].HardwareID < hardwareList[j].HardwareID })
+	return hardwareList
+}
+
+// LookupHardware finds the registered hardware with the hardware id
+func (s *Service) LookupHardware(hardwareID string) (Hardware, bool) {
+	if hardwareID == "" {
+		return Hardware{}, false
+	}
+
+	s.mutex.Lock()
+	hardware, ok := s.hardware[strings.ToLower(hardwareID)]
+	s.mutex.Unlock()
+
+	return hardware, ok
+}
+
+// ImportHardware registers the hardware. Hardware which is already registered is replaced.
+func (s *Service) ImportHardware(hardwareList []Hardware) error {
+	for _, hardware := range hardwareList {
+		if err := hardware.Verify(); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	updatedHardware := make(map[string]Hardware, len(s.hardware)+len(hardwareList))
+	for key, hardware := range s.hardware {
+		updatedHardware[key] = hardware
+	}
+
+	importedAt := time.Now().UTC()
+	for _, hardware := range hardwareList {
+		hardware.ImportedAt = importedAt
+		updatedHardware[strings.ToLower(hardware.HardwareID)] = hardware
+	}
+
+	if err := s.store.Set(hardwareKey, updatedHardware); err != nil {
+		log.Error().Err(err).Msg("error saving imported hardware")
+		return errors.New("internal error saving imported hardware. no hardware was imported")
+	}
+	s.hardware = updatedHardware
+
+	log.Info().Int("count", len(hardwareList)).Msg("Imported hardware...")
+	return nil
+}
+
+// DeleteHardware removes the registered hardware with the hardware id
+func (s *Service) DeleteHardware(hardwareID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := strings.ToLower(hardwareID)
+	hardware, ok := s.hardware[key]
+	if !ok {
+		return errors.New("hardware '" + hardwareID + "' is not registered")
+	}
+
+	delete(s.hardware, key)
+	if err := s.store.Set(hardwareKey, s.hardware); err != nil {
+		s.hardware[key] = hardware
+		log.Error().Err(err).Msg("error saving hardware")
+		return errors.New("internal error deleting hardware. values were not changed")
+	}
+
+	return nil
+}
+
+// NewService initialises and returns a new enrollment Service
+func NewService(store datastore.Store) (*Service, error) {
+	var restrictions Restrictions
+	if err := store.Get(restrictionsKey, &restrictions); err != nil && err != datastore.ErrNotFound {
+		return nil, err
+	}
+
+	if restrictions.DefaultAction == "" {
+		restrictions.DefaultAction = Allow
+	}
+
+	if err := migrateRejections(store); err != nil {
+		return nil, err
+	}
+
+	var rejections []Rejection
+	if err := store.View(func(tx datastore.Tx) error {
+		c := tx.Cursor(rejectionPrefix)
+		for key := c.First(); key != nil; key = c.Next() {
+			var rejection Rejection
+			if err := c.Value(&rejection); err != nil {
+				return err
+			}
+			rejections = append(rejections, rejection)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	hardware := make(map[string]Hardware)
+	if err := store.Get(hardwareKey, &hardware); err != nil && err != datastore.ErrNotFound {
+		return nil, err
+	}
+
+	return &Service{
+		restrictions: restrictions,
+		rejections:   rejections,
+		hardware:     hardware,
+		mutex:        &sync.Mutex{},
+		store:        store,
+	}, nil
+}
+
+// rejectionKey returns the key of the rejection recorded at the time. Keys sort in the order the rejections were recorded.
+func rejectionKey(recordedAt time.Time) []byte {
+	return []byte(fmt.Sprintf("%s%020d", rejectionPrefix, recordedAt.UnixNano()))
+}
+
+// migrateRejections moves the rejections from the legacy list into their own records
+func migrateRejections(store datastore.Store) error {
+	return store.Update(func(tx datastore.Tx) error {
+		var rejections []Rejection
+		if err := tx.Get(legacyRejectionsKey, &rejections); err == datastore.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var previous time.Time
+		for _, rejection := range rejections {
+			if !rejection.Time.After(previous) {
+				rejection.Time = previous.Add(time.Nanosecond)
+			}
+			previous = rejection.Time
+
+			if err := tx.Set(rejectionKey(rejection.Time), rejection); err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(legacyRejectionsKey)
+	})
+}
@@ -0,0 +1,35 @@
+package enrollment
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mattrax/Mattrax/internal/datastore/memory"
+)
+
+func TestRejections(t *testing.T) {
+	is := is.New(t)
+	store := &memory.Store{}
+	is.NoErr(store.Init())                                                                                              // initialise store
+	is.NoErr(store.Set(legacyRejectionsKey, []Rejection{{Time: time.Now().UTC(), Stage: Discovery, Reason: "legacy"}})) // save legacy rejection list
+
+	s, err := NewService(store)
+	is.NoErr(err)                                      // create service
+	is.Equal(len(s.Rejections()), 1)                   // legacy rejections are migrated
+	is.NoErr(s.Set(Restrictions{DefaultAction: Deny})) // deny every attempt
+
+	for i := 0; i < maxRejections+1; i++ {
+		is.True(!s.Check(Provision, "127.0.0.1", Attempt{}).Allowed) // attempt is rejected
+	}
+	is.True(!s.Check(Discovery, "127.0.0.1", Attempt{}).Allowed) // default action is taken at discovery when no rule depends on a later property
+
+	keys, err := store.List(rejectionPrefix)
+	is.NoErr(err)                                              // list rejection records
+	is.Equal(len(keys), maxRejections)                         // oldest rejections are removed
+	is.Equal(s.Rejections()[maxRejections-1].Stage, Provision) // legacy rejection was removed first
+
+	s, err = NewService(store)
+	is.NoErr(err)                                // reload service
+	is.Equal(len(s.Rejections()), maxRejections) // rejections are loaded from their records
+}
@@ -0,0 +1,162 @@
+package enrollment
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"errors"
+	"io"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattrax/Mattrax/internal/types"
+)
+
+// maxDeviceNameLength is the longest device name Windows accepts (the NetBIOS name limit)
+const maxDeviceNameLength = 15
+
+// Hardware is a device which has been registered before it enrolls.
+// When a device with the same hardware id enrolls it is named and assigned to the user and group automatically.
+// The hardware id is required as Windows doesn't send the serial number during enrollment so it can't be used to recognise the device.
+type Hardware struct {
+	HardwareID   string    `yaml:"hardware_id"`   // The HWDevID the device sends during enrollment
+	SerialNumber string    `yaml:"serial_number"` // Used to fill %SERIAL% in the device name template. It isn't used to recognise the device.
+	User         string    `yaml:"user"`          // The email of the user the device is assigned to
+	Group        string    `yaml:"group"`         // The group the device is added to
+	DeviceName   string    `yaml:"device_name"`   // A template for the name of the device. It supports %SERIAL% and %RAND:x% where x is the number of random digits.
+	ImportedAt   time.Time `yaml:"imported_at"`
+}
+
+// deviceNameTemplateRegex matches the variables which can be used in a device name template
+var deviceNameTemplateRegex = regexp.MustCompile(`%SERIAL%|%RAND:([0-9]+)%`)
+
+// deviceNameRegex is a regex used to verify a generated device name. It must be a valid NetBIOS name.
+var deviceNameRegex = regexp.MustCompile(`^[a-zA-Z0-9-]*$`)
+
+// hardwareCSVColumns maps the accepted CSV column headers (lowercase with spaces and underscores removed) to the Hardware field they contain
+var hardwareCSVColumns = map[string]string{
+	"hardwareid":         "hardware_id",
+	"hwdevid":            "hardware_id",
+	"serialnumber":       "serial_number",
+	"deviceserialnumber": "serial_number",
+	"user":               "user",
+	"assigneduser":       "user",
+	"group":              "group",
+	"grouptag":           "group",
+	"devicename":         "device_name",
+}
+
+// Verify checks the Hardware is valid. This is done prior to importing it.
+func (hardware Hardware) Verify() error {
+	if hardware.HardwareID == "" && hardware.SerialNumber != "" {
+		return errors.New("invalid hardware '" + hardware.SerialNumber + "': hardware id is required. Devices can't be recognised by their serial number as Windows doesn't send it during enrollment")
+	} else if hardware.HardwareID == "" {
+		return errors.New("invalid hardware: hardware id is required to recognise the device during enrollment")
+	}
+
+	if hardware.User != "" && !types.ValidEmail.MatchString(hardware.User) {
+		return errors.New("invalid hardware '" + hardware.HardwareID + "': user must be an email address")
+	}
+
+	if hardware.DeviceName != "" {
+		// The longest name the template can generate is checked by filling the variables with their longest values
+		longestName := deviceNameTemplateRegex.ReplaceAllStringFunc(hardware.DeviceName, func(variable string) string {
+			if variable == "%SERIAL%" {
+				return hardware.SerialNumber
+			}
+			digits, _ := strconv.Atoi(deviceNameTemplateRegex.FindStringSubmatch(variable)[1])
+			return strings.Repeat("0", digits)
+		})
+
+		if !deviceNameRegex.MatchString(longestName) {
+			return errors.New("invalid hardware '" + hardware.HardwareID + "': device name may only contain letters, numbers and hyphens")
+		} else if len(longestName) > maxDeviceNameLength {
+			return errors.New("invalid hardware '" + hardware.HardwareID + "': device name must be at most " + strconv.Itoa(maxDeviceNameLength) + " characters")
+		} else if strings.Contains(hardware.DeviceName, "%SERIAL%") && hardware.SerialNumber == "" {
+			return errors.New("invalid hardware '" + hardware.HardwareID + "': device name uses %SERIAL% but no serial number was given")
+		}
+	}
+
+	return nil
+}
+
+// GenerateDeviceName fills the variables in the DeviceName template. It returns an empty string if no template is set.
+func (hardware Hardware) GenerateDeviceName() string {
+	return deviceNameTemplateRegex.ReplaceAllStringFunc(hardware.DeviceName, func(variable string) string {
+		if variable == "%SERIAL%" {
+			return hardware.SerialNumber
+		}
+
+		digits, _ := strconv.Atoi(deviceNameTemplateRegex.FindStringSubmatch(variable)[1])
+		var name strings.Builder
+		for i := 0; i < digits; i++ {
+			digit, err := rand.Int(rand.Reader, big.NewInt(10))
+			if err != nil {
+				digit = big.NewInt(0)
+			}
+			name.WriteString(digit.String())
+		}
+		return name.String()
+	})
+}
+
+// ParseHardwareCSV reads registered hardware from a CSV file. The first row must contain the column headers.
+// The supported columns are "Hardware ID", "Serial Number", "User", "Group" and "Device Name". Unknown columns are ignored.
+// Every row must have a hardware id. Rows which only have a serial number are rejected.
+func ParseHardwareCSV(r io.Reader) ([]Hardware, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("invalid hardware csv: the file is empty")
+	} else if err != nil {
+		return nil, errors.New("invalid hardware csv: " + err.Error())
+	}
+
+	columns := make([]string, len(header))
+	for i, name := range header {
+		columns[i] = hardwareCSVColumns[strings.NewReplacer(" ", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(name)))]
+	}
+
+	var hardwareList []Hardware
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New("invalid hardware csv: " + err.Error())
+		}
+
+		var hardware Hardware
+		for i, value := range record {
+			if i >= len(columns) {
+				break
+			}
+
+			value = strings.TrimSpace(value)
+			switch columns[i] {
+			case "hardware_id":
+				hardware.HardwareID = value
+			case "serial_number":
+				hardware.SerialNumber = value
+			case "user":
+				hardware.User = strings.ToLower(value)
+			case "group":
+				hardware.Group = value
+			case "device_name":
+				hardware.DeviceName = value
+			}
+		}
+
+		if err := hardware.Verify(); err != nil {
+			return nil, errors.New("line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		hardwareList = append(hardwareList, hardware)
+	}
+
+	return hardwareList, nil
+}
@@ -0,0 +1,33 @@
+package enrollment
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestParseHardwareCSV(t *testing.T) {
+	is := is.New(t)
+
+	hardwareList, err := ParseHardwareCSV(strings.NewReader("Hardware ID,Serial Number,User,Group,Device Name\n" +
+		"6F8E1A2B3C4D,PF1ABCDE,Oscar@otbeaumont.me,Sales,CORP-%SERIAL%\n" +
+		"7A9B0C1D2E3F,,,,LAB-%RAND:4%\n"))
+	is.NoErr(err)                                         // CSV should be parsed
+	is.Equal(len(hardwareList), 2)                        // Every row should be imported
+	is.Equal(hardwareList[0].User, "oscar@otbeaumont.me") // User emails should be lowercase
+	is.Equal(hardwareList[0].GenerateDeviceName(), "CORP-PF1ABCDE")
+	is.True(regexp.MustCompile(`^LAB-[0-9]{4}$`).MatchString(hardwareList[1].GenerateDeviceName())) // Random digits should be generated
+}
+
+func TestParseHardwareCSV_InvalidDeviceName(t *testing.T) {
+	is := is.New(t)
+
+	_, err := ParseHardwareCSV(strings.NewReader("Hardware ID,Serial Number,Device Name\n6F8E1A2B3C4D,PF1ABCDE0123456789,%SERIAL%\n"))
+	is.True(err != nil) // Device names longer than 15 characters should be rejected
+
+	_, err = ParseHardwareCSV(strings.NewReader("Serial Number,Device Name\nPF1ABCDE,%SERIAL%\n"))
+	is.True(err != nil)                                                           // Hardware without a hardware id should be rejected
+	is.True(strings.Contains(err.Error(), "line 2: invalid hardware 'PF1ABCDE'")) // Serial only rows should be identified by their serial number
+}
@@ -0,0 +1,222 @@
+package enrollment
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// RuleAction is what happens to an enrollment attempt matched by a Rule
+type RuleAction string
+
+// The actions a Rule can take
+const (
+	Allow RuleAction = "allow"
+	Deny  RuleAction = "deny"
+)
+
+// Restrictions contains the rules which decide which devices are allowed to enroll.
+// The rules are evaluated in order and the first rule which matches the enrollment attempt decides if it is allowed.
+// If no rule matches DefaultAction is taken.
+type Restrictions struct {
+	Rules                  []Rule     `yaml:"rules"`
+	DefaultAction          RuleAction `yaml:"default_action"`           // Defaults to allow
+	RegisteredHardwareOnly bool       `yaml:"registered_hardware_only"` // If enabled only devices with imported hardware can enroll
+}
+
+// Rule matches enrollment attempts by the properties of the user and device.
+// Every condition which is set must match for the rule to match. Lists match if they contain the attempt's value.
+type Rule struct {
+	Name            string     `yaml:"name"`
+	Action          RuleAction `yaml:"action"`
+	EmailDomains    []string   `yaml:"email_domains,omitempty"`
+	OSEditions      []string   `yaml:"os_editions,omitempty"`
+	MinOSVersion    string     `yaml:"min_os_version,omitempty"` // Inclusive. Compared numerically by each dot separated part
+	MaxOSVersion    string     `yaml:"max_os_version,omitempty"` // Inclusive. Compared numerically by each dot separated part
+	DeviceTypes     []string   `yaml:"device_types,omitempty"`
+	EnrollmentTypes []string   `yaml:"enrollment_types,omitempty"`
+}
+
+// Attempt contains the properties of an enrollment attempt.
+// Properties are empty if they are not known at the stage of enrollment they were collected from.
+type Attempt struct {
+	EmailDomain    string `yaml:"email_domain,omitempty"`
+	OSEdition      string `yaml:"os_edition,omitempty"`
+	OSVersion      string `yaml:"os_version,omitempty"`
+	DeviceType     string `yaml:"device_type,omitempty"`
+	EnrollmentType string `yaml:"enrollment_type,omitempty"`
+	HardwareID     string `yaml:"hardware_id,omitempty"`
+}
+
+// Decision is the result of evaluating the Restrictions for an Attempt
+type Decision struct {
+	Allowed   bool
+	Deferred  bool   // The attempt is missing properties a rule depends on so it is decided at a later stage of enrollment
+	Rule      string // The name of the rule which decided the attempt. Empty if the default action was taken.
+	Reason    string // A description of why the attempt was rejected which is safe to show to the user
+	FaultType string // The DeviceEnrollmentServiceError type which should be returned to a rejected device
+}
+
+// Verify checks the Restrictions are valid. This is done prior to saving updated restrictions.
+func (restrictions Restrictions) Verify() error {
+	if restrictions.DefaultAction != "" && restrictions.DefaultAction != Allow && restrictions.DefaultAction != Deny {
+		return errors.New("invalid restrictions: default action must be 'allow' or 'deny'")
+	}
+
+	for i, rule := range restrictions.Rules {
+		if rule.Name == "" {
+			return errors.New("invalid restrictions: rule " + strconv.Itoa(i+1) + " is missing a name")
+		}
+
+		if rule.Action != Allow && rule.Action != Deny {
+			return errors.New("invalid restrictions: rule '" + rule.Name + "' action must be 'allow' or 'deny'")
+		}
+
+		for _, version := range []string{rule.MinOSVersion, rule.MaxOSVersion} {
+			if _, err := parseVersion(version); version != "" && err != nil {
+				return errors.New("invalid restrictions: rule '" + rule.Name + "' has invalid os version '" + version + "'")
+			}
+		}
+	}
+
+	return nil
+}
+
+// Evaluate decides if the enrollment attempt is allowed.
+// A rule which depends on a property the attempt is missing doesn't match, so the later rules and the default action are evaluated instead.
+// This means a device can't bypass a deny by default policy by leaving out a property.
+func (restrictions Restrictions) Evaluate(attempt Attempt) Decision {
+	return restrictions.evaluate(attempt, false)
+}
+
+// EvaluatePartial decides the enrollment attempt at a stage where some of its properties are only sent later in the enrollment.
+// Rules are evaluated in order until one depends on a missing property it could match once it is known.
+// The attempt is then allowed with Deferred set so it is decided at the later stage using Evaluate.
+func (restrictions Restrictions) EvaluatePartial(attempt Attempt) Decision {
+	return restrictions.evaluate(attempt, true)
+}
+
+// evaluate decides the attempt. If partial is true evaluation stops at the first rule which depends on a missing property.
+func (restrictions Restrictions) evaluate(attempt Attempt, partial bool) Decision {
+	for _, rule := range restrictions.Rules {
+		matched, missing := rule.matches(attempt)
+		if partial && missing {
+			return Decision{Allowed: true, Deferred: true}
+		} else if !matched {
+			continue
+		}
+
+		if rule.Action == Allow {
+			return Decision{Allowed: true, Rule: rule.Name}
+		}
+
+		faultType := "NotSupported"
+		if len(rule.OSEditions) != 0 || rule.MinOSVersion != "" || rule.MaxOSVersion != "" || len(rule.DeviceTypes) != 0 {
+			faultType = "DeviceNotSupported"
+		}
+
+		return Decision{
+			Allowed:   false,
+			Rule:      rule.Name,
+			Reason:    "enrollment of this device is blocked by the restriction '" + rule.Name + "'",
+			FaultType: faultType,
+		}
+	}
+
+	if restrictions.DefaultAction == Deny {
+		return Decision{
+			Allowed:   false,
+			Reason:    "this device is not allowed to enroll",
+			FaultType: "NotSupported",
+		}
+	}
+
+	return Decision{Allowed: true}
+}
+
+// matches checks if every condition of the rule matches the attempt. A condition on a property the attempt is missing never matches.
+// missing is true if the rule could match once the missing properties are known because every condition on a known property matches.
+func (rule Rule) matches(attempt Attempt) (matched bool, missing bool) {
+	type condition struct {
+		set   bool
+		value string
+		ok    func() bool
+	}
+
+	conditions := []condition{
+		{len(rule.EmailDomains) != 0, attempt.EmailDomain, func() bool { return containsFold(rule.EmailDomains, attempt.EmailDomain) }},
+		{len(rule.OSEditions) != 0, attempt.OSEdition, func() bool { return containsFold(rule.OSEditions, attempt.OSEdition) }},
+		{rule.MinOSVersion != "", attempt.OSVersion, func() bool { return compareVersions(attempt.OSVersion, rule.MinOSVersion) >= 0 }},
+		{rule.MaxOSVersion != "", attempt.OSVersion, func() bool { return compareVersions(attempt.OSVersion, rule.MaxOSVersion) <= 0 }},
+		{len(rule.DeviceTypes) != 0, attempt.DeviceType, func() bool { return containsFold(rule.DeviceTypes, attempt.DeviceType) }},
+		{len(rule.EnrollmentTypes) != 0, attempt.EnrollmentType, func() bool { return containsFold(rule.EnrollmentTypes, attempt.EnrollmentType) }},
+	}
+
+	for _, condition := range conditions {
+		if !condition.set {
+			continue
+		} else if condition.value == "" {
+			missing = true
+		} else if !condition.ok() {
+			return false, false
+		}
+	}
+
+	return !missing, missing
+}
+
+// containsFold checks if the list contains the value ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseVersion splits a dot separated version (eg. 10.0.18362.0) into its numeric parts
+func parseVersion(version string) ([]int, error) {
+	parts := strings.Split(version, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		numbers[i] = number
+	}
+	return numbers, nil
+}
+
+// compareVersions returns -1, 0 or 1 if version a is less than, equal to or greater than version b.
+// Missing parts are treated as 0. An invalid version is less than every valid version.
+func compareVersions(a string, b string) int {
+	aParts, aErr := parseVersion(a)
+	bParts, bErr := parseVersion(b)
+	if aErr != nil || bErr != nil {
+		if aErr != nil && bErr != nil {
+			return 0
+		} else if aErr != nil {
+			return -1
+		}
+		return 1
+	}
+
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+
+		if aPart < bPart {
+			return -1
+		} else if aPart > bPart {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package enrollment
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestEvaluate(t *testing.T) {
+	is := is.New(t)
+
+	restrictions := Restrictions{
+		Rules: []Rule{
+			{Name: "old-windows", Action: Deny, MaxOSVersion: "10.0.17763"},
+			{Name: "contoso-full", Action: Allow, EmailDomains: []string{"contoso.com"}, EnrollmentTypes: []string{"Full"}},
+			{Name: "home-edition", Action: Deny, OSEditions: []string{"101"}},
+		},
+		DefaultAction: Deny,
+	}
+	is.NoErr(restrictions.Verify()) // Restrictions should be valid
+
+	decision := restrictions.Evaluate(Attempt{EmailDomain: "contoso.com", OSVersion: "10.0.17134.1", OSEdition: "48"})
+	is.True(!decision.Allowed)                         // Old OS version should be rejected
+	is.Equal(decision.Rule, "old-windows")             // Rejected by the OS version rule
+	is.Equal(decision.FaultType, "DeviceNotSupported") // Device property rules return DeviceNotSupported
+
+	decision = restrictions.Evaluate(Attempt{EmailDomain: "contoso.com", OSVersion: "10.0.18362.0", OSEdition: "48"})
+	is.True(!decision.Allowed)  // Rules depending on the missing enrollment type don't match
+	is.Equal(decision.Rule, "") // Rejected by the default action
+
+	decision = restrictions.Evaluate(Attempt{OSVersion: "10.0.18362.0", OSEdition: "48", EnrollmentType: "Device"})
+	is.True(!decision.Allowed)                   // Enrollment type doesn't match so the default action is taken
+	is.Equal(decision.FaultType, "NotSupported") // Default action returns NotSupported
+
+	decision = restrictions.Evaluate(Attempt{OSVersion: "10.0.18362.0", OSEdition: "48", EnrollmentType: "Full"})
+	is.True(!decision.Allowed) // Leaving out the email domain doesn't bypass the default action
+
+	decision = restrictions.Evaluate(Attempt{EmailDomain: "contoso.com", OSVersion: "10.0.18362.0", OSEdition: "48", EnrollmentType: "Full"})
+	is.True(decision.Allowed)               // Every property of the allow rule matches
+	is.Equal(decision.Rule, "contoso-full") // Allowed by the email domain rule
+
+	decision = restrictions.EvaluatePartial(Attempt{EmailDomain: "contoso.com", OSVersion: "10.0.18362.0", OSEdition: "48"})
+	is.True(decision.Allowed && decision.Deferred) // Rule depending on the enrollment type is decided at a later stage
+
+	decision = restrictions.EvaluatePartial(Attempt{EmailDomain: "example.com", OSVersion: "10.0.18362.0", OSEdition: "48"})
+	is.True(!decision.Allowed && !decision.Deferred) // Email domain doesn't match so no later property can change the decision
+
+	decision = restrictions.EvaluatePartial(Attempt{EmailDomain: "contoso.com", OSVersion: "10.0.17134.1", OSEdition: "48"})
+	is.Equal(decision.Rule, "old-windows") // Rules before one depending on a missing property are decided
+
+	decision = restrictions.Evaluate(Attempt{EmailDomain: "example.com", OSVersion: "10.0.18362.0", OSEdition: "101"})
+	is.True(!decision.Allowed)              // Home edition should be rejected
+	is.Equal(decision.Rule, "home-edition") // Rejected by the OS edition rule
+}
+
+func TestVerify_InvalidRule(t *testing.T) {
+	is := is.New(t)
+
+	is.True(Restrictions{Rules: []Rule{{Name: "test", Action: "block"}}}.Verify() != nil)                   // Invalid action should be rejected
+	is.True(Restrictions{Rules: []Rule{{Name: "test", Action: Deny, MinOSVersion: "ten"}}}.Verify() != nil) // Invalid OS version should be rejected
+	is.True(Restrictions{Rules: []Rule{{Action: Allow}}}.Verify() != nil)                                   // Rules must be named
+	is.True(Restrictions{DefaultAction: "block"}.Verify() != nil)                                           // Invalid default action should be rejected
+}
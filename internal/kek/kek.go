@@ -0,0 +1,209 @@
+package kek
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+
+	pkgerrors "github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The scrypt parameters used to derive the KEK from the secret. They follow the recommendations for interactive logins.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// keySize is the size in bytes of the AES-256 keys
+const keySize = 32
+
+// saltSize is the size in bytes of the scrypt salt
+const saltSize = 16
+
+// ErrIncorrectKEK is returned when an envelope can't be opened because it was sealed with a different KEK
+var ErrIncorrectKEK = errors.New("the key encryption key is incorrect")
+
+// KEK is a key encryption key derived from a secret (a key file, environment variable or passphrase).
+// Secrets are sealed using envelope encryption. Each secret is encrypted with its own random data encryption key which is then encrypted with the KEK.
+// This allows the KEK to be rotated by only re-encrypting the data encryption keys.
+type KEK struct {
+	secret   []byte
+	sealSalt []byte            // The salt used when sealing new envelopes so the KEK is only derived once per process
+	mutex    *sync.Mutex       // mutex is used to ensure exclusive access to the derived keys
+	derived  map[string][]byte // The keys derived from the secret indexed by their salt
+}
+
+// Envelope is a secret encrypted using envelope encryption. It is safe to store.
+type Envelope struct {
+	Salt       []byte // The salt the KEK was derived with
+	WrappedKey []byte // The data encryption key encrypted with the KEK. The nonce is prepended.
+	Ciphertext []byte // The secret encrypted with the data encryption key. The nonce is prepended.
+}
+
+// New creates a KEK from the secret. The secret must not be empty.
+func New(secret []byte) (*KEK, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("invalid key encryption key: the key must not be empty")
+	}
+
+	sealSalt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, sealSalt); err != nil {
+		return nil, pkgerrors.Wrap(err, "error generating key encryption key salt")
+	}
+
+	return &KEK{
+		secret:   secret,
+		sealSalt: sealSalt,
+		mutex:    &sync.Mutex{},
+		derived:  map[string][]byte{},
+	}, nil
+}
+
+// key returns the AES key derived from the secret with the salt
+func (kek *KEK) key(salt []byte) ([]byte, error) {
+	kek.mutex.Lock()
+	defer kek.mutex.Unlock()
+
+	if key, ok := kek.derived[string(salt)]; ok {
+		return key, nil
+	}
+
+	key, err := scrypt.Key(kek.secret, salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error deriving key encryption key")
+	}
+	kek.derived[string(salt)] = key
+	return key, nil
+}
+
+// Seal encrypts the plaintext with a new data encryption key
+func (kek *KEK) Seal(plaintext []byte) (*Envelope, error) {
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, pkgerrors.Wrap(err, "error generating data encryption key")
+	}
+
+	ciphertext, err := encrypt(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := &Envelope{
+		Ciphertext: ciphertext,
+	}
+	if err := kek.wrap(envelope, dataKey); err != nil {
+		return nil, err
+	}
+
+	return envelope, nil
+}
+
+// Open decrypts the envelope. ErrIncorrectKEK is returned if it was sealed by another KEK.
+func (kek *KEK) Open(envelope *Envelope) ([]byte, error) {
+	dataKey, err := kek.unwrap(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := decrypt(dataKey, envelope.Ciphertext)
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "error decrypting envelope")
+	}
+	return plaintext, nil
+}
+
+// Rewrap returns the envelope with its data encryption key encrypted by the new KEK. The secret is not re-encrypted.
+func (kek *KEK) Rewrap(envelope *Envelope, newKEK *KEK) (*Envelope, error) {
+	dataKey, err := kek.unwrap(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	rewrapped := &Envelope{
+		Ciphertext: envelope.Ciphertext,
+	}
+	if err := newKEK.wrap(rewrapped, dataKey); err != nil {
+		return nil, err
+	}
+
+	return rewrapped, nil
+}
+
+// wrap encrypts the data encryption key into the envelope
+func (kek *KEK) wrap(envelope *Envelope, dataKey []byte) error {
+	key, err := kek.key(kek.sealSalt)
+	if err != nil {
+		return err
+	}
+
+	wrappedKey, err := encrypt(key, dataKey)
+	if err != nil {
+		return err
+	}
+
+	envelope.Salt = kek.sealSalt
+	envelope.WrappedKey = wrappedKey
+	return nil
+}
+
+// unwrap decrypts the envelope's data encryption key
+func (kek *KEK) unwrap(envelope *Envelope) ([]byte, error) {
+	if envelope == nil || len(envelope.Salt) == 0 {
+		return nil, errors.New("error opening envelope: the envelope is empty")
+	}
+
+	key, err := kek.key(envelope.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := decrypt(key, envelope.WrappedKey)
+	if err != nil {
+		return nil, ErrIncorrectKEK
+	}
+	return dataKey, nil
+}
+
+// encrypt encrypts the plaintext using AES-GCM. The random nonce is prepended to the ciphertext.
+func encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, pkgerrors.Wrap(err, "error generating nonce")
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt decrypts a ciphertext created by encrypt
+func decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+}
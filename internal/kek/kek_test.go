@@ -0,0 +1,37 @@
+package kek
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestSealOpenRewrap(t *testing.T) {
+	is := is.New(t)
+
+	kek, err := New([]byte("correct horse battery staple"))
+	is.NoErr(err) // Error creating KEK
+
+	envelope, err := kek.Seal([]byte("secret"))
+	is.NoErr(err) // Error sealing secret
+
+	plaintext, err := kek.Open(envelope)
+	is.NoErr(err) // Error opening envelope
+	is.Equal(string(plaintext), "secret")
+
+	otherKEK, err := New([]byte("incorrect"))
+	is.NoErr(err)
+	_, err = otherKEK.Open(envelope)
+	is.Equal(err, ErrIncorrectKEK) // Envelope must not be opened by another KEK
+
+	rewrapped, err := kek.Rewrap(envelope, otherKEK)
+	is.NoErr(err)                                       // Error rewrapping envelope
+	is.Equal(rewrapped.Ciphertext, envelope.Ciphertext) // Secret should not be re-encrypted
+
+	plaintext, err = otherKEK.Open(rewrapped)
+	is.NoErr(err) // Error opening rewrapped envelope
+	is.Equal(string(plaintext), "secret")
+
+	_, err = kek.Open(rewrapped)
+	is.Equal(err, ErrIncorrectKEK) // Previous KEK must not open the rewrapped envelope
+}
@@ -1,10 +1,19 @@
 package mattrax
 
 import (
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/alexflint/go-arg"
 	"github.com/mattrax/Mattrax/internal/certificates"
 	"github.com/mattrax/Mattrax/internal/devices"
+	"github.com/mattrax/Mattrax/internal/enrollment"
 	"github.com/mattrax/Mattrax/internal/settings"
+	"github.com/mattrax/Mattrax/internal/tlsstore"
 	"github.com/mattrax/Mattrax/internal/types"
 )
 
@@ -19,6 +28,8 @@ type Server struct {
 	Settings     *settings.Service
 	Certificates *certificates.Service
 	Devices      devices.Service
+	Enrollment   *enrollment.Service
+	TLS          *tlsstore.Store // The HTTPS certificates served by the webserver
 
 	// TODO Cleanup below
 	UserService   types.UserService
@@ -28,20 +39,83 @@ type Server struct {
 // Config holds the static server config
 // These values are set by command line flags.
 type Config struct {
-	Port            int    `arg:"-p" help:"the port for the HTTPS webserver to listen on" placeholder:"443" default:"443"`
-	Domain          string `arg:"-d" help:"the domain name the server is accessible on" placeholder:"mdm.example.com"`
-	DBPath          string `help:"the path where the file database is stored" placeholder:"/var/mattrax.db" default:"/var/mattrax.db" graphql:"DBPath"`
-	CertFile        string `arg:"--cert" help:"the path to the https certificate for the HTTPS webserver" placeholder:"/dont-put-your-cert-file-here.pem"`
-	KeyFile         string `arg:"--key" help:"the path to the https certificate private key for the HTTPS webserver" placeholder:"/dont-put-your-key-file-here.pem"`
-	DevelopmentMode bool   `arg:"--dev" help:"enables verbose output and loosens security measures to aid developers" default:"false"`
+	Port            int           `arg:"-p" help:"the port for the HTTPS webserver to listen on. Development mode uses 8443 instead of 443" placeholder:"443" default:"443"`
+	HTTPPort        int           `arg:"--http-port" help:"the port for the plain HTTP webserver which serves the CRLs and OCSP responder. Revocation is checked over HTTP because checking it over HTTPS would require checking the revocation of the HTTPS certificate. Development mode uses 8080 instead of 80" placeholder:"80" default:"80"`
+	Domain          string        `arg:"-d" help:"the domain name the server is accessible on" placeholder:"mdm.example.com"`
+	DBPath          string        `help:"the path where the file database is stored. Development mode uses ./mattrax.db instead of /var/mattrax.db" placeholder:"/var/mattrax.db" default:"/var/mattrax.db" graphql:"DBPath"`
+	CertFile        string        `arg:"--cert" help:"the path to the https certificate for the HTTPS webserver" placeholder:"/dont-put-your-cert-file-here.pem"`
+	KeyFile         string        `arg:"--key" help:"the path to the https certificate private key for the HTTPS webserver" placeholder:"/dont-put-your-key-file-here.pem"`
+	DevelopmentMode bool          `arg:"--dev" help:"enables verbose output and loosens security measures to aid developers" default:"false"`
+	ClockSkew       time.Duration `arg:"--clock-skew" help:"the difference allowed between a device's clock and the server's clock when validating request timestamps" placeholder:"5m" default:"5m"`
+
+	EnrollmentDomains   []string `arg:"--enrollment-domain,separate" help:"an email domain devices can enroll from. Use the form 'example.com=mdm.example.com' to serve its enrollment from a public domain other than --domain. If not set every email domain is accepted" placeholder:"example.com"`
+	AdditionalCertFiles []string `arg:"--additional-cert,separate" help:"the path to an extra https certificate which is selected using SNI. It must be paired with an --additional-key" placeholder:"/dont-put-your-cert-file-here.pem"`
+	AdditionalKeyFiles  []string `arg:"--additional-key,separate" help:"the path to the private key of the --additional-cert at the same position" placeholder:"/dont-put-your-key-file-here.pem"`
+
+	KEKFile   string `arg:"--kek-file" help:"the path to a file containing the key encryption key which protects the CA private keys" placeholder:"/etc/mattrax/kek"`
+	KEK       string `arg:"--kek,env:MATTRAX_KEK" help:"the key encryption key which protects the CA private keys. Set it using the MATTRAX_KEK environment variable so it isn't visible in the process list" placeholder:"KEK"`
+	KEKPrompt bool   `arg:"--kek-prompt" help:"prompt for a passphrase which is used as the key encryption key" default:"false"`
+
+	PKCS11Module string `arg:"--pkcs11-module" help:"the path to a PKCS#11 library. If set the CA private keys are created in the PKCS#11 token so they can't be exported" placeholder:"/usr/lib/softhsm/libsofthsm2.so"`
+	PKCS11Token  string `arg:"--pkcs11-token" help:"the label of the PKCS#11 token the CA private keys are stored in" placeholder:"mattrax"`
+	PKCS11PIN    string `arg:"--pkcs11-pin,env:MATTRAX_PKCS11_PIN" help:"the user PIN of the PKCS#11 token. Set it using the MATTRAX_PKCS11_PIN environment variable so it isn't visible in the process list" placeholder:"PIN"`
+
+	CAKeyAlgorithm string `arg:"--ca-key-algorithm" help:"the algorithm of new identity private keys. It is one of rsa-2048, rsa-3072, rsa-4096, ecdsa-p256 or ecdsa-p384" placeholder:"rsa-4096" default:"rsa-4096"`
+
+	ExpiryThresholds    []time.Duration `arg:"--expiry-threshold,separate" help:"how long before a certificate expires to warn about it. It can be set multiple times. If not set warnings are sent 720h, 168h and 24h before expiry" placeholder:"720h"`
+	ExpiryWebhook       string          `arg:"--expiry-webhook" help:"a URL which is sent a JSON POST request when a certificate reaches an expiry threshold" placeholder:"https://example.com/webhook"`
+	IdentityRenewBefore time.Duration   `arg:"--identity-renew-before" help:"how long before the identity certificate expires to automatically start a rollover to a new one. Identities signed by an offline root aren't renewed" placeholder:"1440h" default:"1440h"`
+
+	ACME          bool   `arg:"--acme" help:"obtain and renew the HTTPS certificates for --domain and the enrollment domains using ACME. The server must be reachable on port 443 for the TLS-ALPN-01 challenge" default:"false"`
+	ACMEDirectory string `arg:"--acme-directory" help:"the directory URL of the ACME CA" placeholder:"https://acme-v02.api.letsencrypt.org/directory" default:"https://acme-v02.api.letsencrypt.org/directory"`
+	ACMEEmail     string `arg:"--acme-email" help:"the contact email of the ACME account" placeholder:"admin@example.com"`
+	ACMECacheDir  string `arg:"--acme-cache" help:"the directory the ACME account key and certificates are stored in" placeholder:"/var/mattrax-acme" default:"/var/mattrax-acme"`
+	ACMERootCA    string `arg:"--acme-root-ca" help:"the path to a PEM file of extra root certificates trusted for the ACME directory. Used for private ACME CAs" placeholder:"/etc/mattrax/acme-ca.pem"`
+}
+
+// DevelopmentKEKFile is the key encryption key file used in development mode if no key encryption key is given
+const DevelopmentKEKFile = "./certs/kek"
+
+// The defaults used in development mode instead of the defaults which require running as root
+const (
+	DevelopmentPort     = 8443
+	DevelopmentHTTPPort = 8080
+	DevelopmentDBPath   = "./mattrax.db"
+)
+
+// DefaultExpiryThresholds are used if no --expiry-threshold is given
+var DefaultExpiryThresholds = []time.Duration{30 * 24 * time.Hour, 7 * 24 * time.Hour, 24 * time.Hour}
+
+// KeyAlgorithm returns the algorithm used for new identity private keys
+func (config Config) KeyAlgorithm() certificates.KeyAlgorithm {
+	return certificates.KeyAlgorithm(config.CAKeyAlgorithm)
 }
 
 // Verify checks that the recieved values are valid and are what the server is expecting
 func (config *Config) Verify(p *arg.Parser) {
+	// The flags can't tell if the default was given explicitly so the default values are replaced
+	if config.DevelopmentMode {
+		if config.Port == 443 {
+			config.Port = DevelopmentPort
+		}
+		if config.HTTPPort == 80 {
+			config.HTTPPort = DevelopmentHTTPPort
+		}
+		if config.DBPath == "/var/mattrax.db" {
+			config.DBPath = DevelopmentDBPath
+		}
+	}
+
 	if config.Port <= 0 || config.Port > 49151 {
 		p.Fail("invalid port. The port must be between 0 and 49151.")
 	}
 
+	if config.HTTPPort <= 0 || config.HTTPPort > 49151 {
+		p.Fail("invalid HTTP port. The port must be between 0 and 49151.")
+	} else if config.HTTPPort == config.Port {
+		p.Fail("the HTTP port must be different to the HTTPS port")
+	}
+
 	if config.Domain == "" {
 		p.Fail("you must provide a domain")
 	} else if !types.IsDNSNameRegex.MatchString(config.Domain) {
@@ -54,21 +128,225 @@ func (config *Config) Verify(p *arg.Parser) {
 		config.DBPath = "./mattrax.db"
 	}
 
-	if config.CertFile == "" {
-		if config.DevelopmentMode == true {
-			config.CertFile = "./certs/certificate.pem"
-		} else {
-			p.Fail("you must provide a certificate file")
+	if config.ClockSkew <= 0 || config.ClockSkew > 24*time.Hour {
+		p.Fail("invalid clock skew. The clock skew must be greater than 0 and at most 24 hours.")
+	}
+
+	for _, enrollmentDomain := range config.EnrollmentDomains {
+		parts := strings.Split(enrollmentDomain, "=")
+		if len(parts) > 2 {
+			p.Fail("invalid enrollment domain '" + enrollmentDomain + "'. It must be in the form 'example.com' or 'example.com=mdm.example.com'.")
+		}
+
+		for _, domain := range parts {
+			if !types.IsDNSNameRegex.MatchString(domain) {
+				p.Fail("invalid enrollment domain '" + enrollmentDomain + "'. Please ensure it doesn't start with a schema or end with a path.")
+			}
 		}
 	}
 
-	if config.KeyFile == "" {
-		if config.DevelopmentMode == true {
-			config.KeyFile = "./certs/privatekey.pem"
-		} else {
+	if len(config.AdditionalCertFiles) != len(config.AdditionalKeyFiles) {
+		p.Fail("every additional certificate file must have a matching additional key file")
+	}
+
+	if config.DevelopmentMode && config.KEKFile == "" && config.KEK == "" && !config.KEKPrompt {
+		config.KEKFile = DevelopmentKEKFile // It is generated on first boot
+	}
+
+	if err := VerifyKEKSource(config.KEKFile, config.KEK, config.KEKPrompt); err != nil {
+		p.Fail(err.Error())
+	}
+
+	if config.PKCS11Module != "" && config.PKCS11Token == "" {
+		p.Fail("you must provide the label of the PKCS#11 token using --pkcs11-token")
+	}
+
+	if err := config.KeyAlgorithm().Verify(); err != nil {
+		p.Fail("invalid ca key algorithm: " + err.Error())
+	}
+
+	if len(config.ExpiryThresholds) == 0 {
+		config.ExpiryThresholds = DefaultExpiryThresholds
+	}
+	for _, threshold := range config.ExpiryThresholds {
+		if threshold <= 0 {
+			p.Fail("invalid expiry threshold. It must be greater than 0.")
+		}
+	}
+
+	if config.ExpiryWebhook != "" {
+		if webhook, err := url.Parse(config.ExpiryWebhook); err != nil || (webhook.Scheme != "https" && !(config.DevelopmentMode && webhook.Scheme == "http")) || webhook.Host == "" {
+			p.Fail("invalid expiry webhook. It must be an https URL.")
+		}
+	}
+
+	if config.IdentityRenewBefore < 0 {
+		p.Fail("invalid identity renew before. It must not be negative.")
+	}
+
+	if config.ACME {
+		if config.ACMECacheDir == "" {
+			p.Fail("you must provide an acme cache directory")
+		}
+
+		if directory, err := url.Parse(config.ACMEDirectory); err != nil || directory.Scheme != "https" || directory.Host == "" {
+			p.Fail("invalid acme directory. It must be an https URL.")
+		}
+
+		if config.ACMEEmail != "" && !types.ValidEmail.MatchString(config.ACMEEmail) {
+			p.Fail("invalid acme email.")
+		}
+
+		// The certificate files are optional with ACME. If set they are served to clients which don't use an ACME hostname.
+		if config.CertFile != "" && config.KeyFile == "" {
 			p.Fail("you must provide a certificate key file")
 		}
+	} else {
+		if config.CertFile == "" {
+			if config.DevelopmentMode == true {
+				config.CertFile = "./certs/certificate.pem"
+			} else {
+				p.Fail("you must provide a certificate file")
+			}
+		}
+
+		if config.KeyFile == "" {
+			if config.DevelopmentMode == true {
+				config.KeyFile = "./certs/privatekey.pem"
+			} else {
+				p.Fail("you must provide a certificate key file")
+			}
+		}
+	}
+}
+
+// TLSHostnames returns the hostnames the server is accessed on. These are --domain, the public domain of each enrollment domain
+// and the EnterpriseEnrollment subdomain of each enrollment email domain which Windows uses for discovery.
+func (config Config) TLSHostnames() []string {
+	hostnames := []string{strings.ToLower(config.Domain)}
+	seen := map[string]bool{hostnames[0]: true}
+	add := func(hostname string) {
+		if !seen[hostname] {
+			seen[hostname] = true
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	enrollmentDomains := config.enrollmentDomains()
+	emailDomains := make([]string, 0, len(enrollmentDomains))
+	for emailDomain := range enrollmentDomains {
+		emailDomains = append(emailDomains, emailDomain)
+	}
+	sort.Strings(emailDomains)
+
+	for _, emailDomain := range emailDomains {
+		add(enrollmentDomains[emailDomain])
+		add("enterpriseenrollment." + emailDomain)
+	}
+	return hostnames
+}
+
+// VerifyKEKSource checks exactly one source for the key encryption key was provided
+func VerifyKEKSource(file string, value string, prompt bool) error {
+	var sources int
+	for _, set := range []bool{file != "", value != "", prompt} {
+		if set {
+			sources++
+		}
+	}
+
+	if sources == 0 {
+		return errors.New("you must provide a key encryption key using --kek-file, the MATTRAX_KEK environment variable or --kek-prompt")
+	} else if sources > 1 {
+		return errors.New("only one of --kek-file, MATTRAX_KEK or --kek-prompt can be used to provide the key encryption key")
+	}
+	return nil
+}
+
+// PublicDomain returns the domain the server is accessible on for a request from a user.
+// The email domain of the user must be configured for enrollment. The request's host is used if it is configured (with or without the EnterpriseEnrollment subdomain) otherwise the public domain of the email domain is used.
+// The bool is false if the user's email domain isn't configured for enrollment.
+func (config Config) PublicDomain(host string, emailDomain string) (string, bool) {
+	enrollmentDomains := config.enrollmentDomains()
+	if len(enrollmentDomains) == 0 {
+		return config.Domain, true
+	}
+
+	emailPublicDomain, ok := enrollmentDomains[strings.ToLower(emailDomain)]
+	if !ok {
+		return "", false
+	}
+
+	if publicDomain, ok := config.HostPublicDomain(host); ok {
+		return publicDomain, true
+	}
+	return emailPublicDomain, true
+}
+
+// HostPublicDomain returns the domain the server is accessible on for a request which doesn't identify the user's email domain.
+// The bool is false if the request's host isn't configured for enrollment.
+func (config Config) HostPublicDomain(host string) (string, bool) {
+	enrollmentDomains := config.enrollmentDomains()
+	if len(enrollmentDomains) == 0 {
+		return config.Domain, true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if publicDomain, ok := enrollmentDomains[strings.TrimPrefix(host, "enterpriseenrollment.")]; ok {
+		return publicDomain, true
+	}
+
+	if strings.EqualFold(host, config.Domain) {
+		return config.Domain, true
+	}
+	for _, publicDomain := range enrollmentDomains {
+		if host == publicDomain {
+			return publicDomain, true
+		}
+	}
+
+	return "", false
+}
+
+// DeepLink creates an enrollment deep link for the user or for anyone with the access token. The user's email domain decides the server name in the link.
+// The username can be empty so the link can be used by any user with the access token.
+func (config Config) DeepLink(username string, accessToken string) (enrollment.DeepLink, error) {
+	serverName := config.Domain
+	if username != "" {
+		if !types.ValidEmail.MatchString(username) {
+			return enrollment.DeepLink{}, errors.New("the username '" + username + "' must be an email address")
+		}
+
+		var ok bool
+		if serverName, ok = config.PublicDomain("", username[strings.LastIndex(username, "@")+1:]); !ok {
+			return enrollment.DeepLink{}, errors.New("the domain of the user '" + username + "' is not configured for enrollment")
+		}
+	}
+
+	link := enrollment.DeepLink{
+		Username:    username,
+		ServerName:  serverName,
+		AccessToken: accessToken,
+	}
+	return link, link.Verify()
+}
+
+// enrollmentDomains returns a map of the configured enrollment email domains to the public domain their enrollment is served on
+func (config Config) enrollmentDomains() map[string]string {
+	enrollmentDomains := make(map[string]string, len(config.EnrollmentDomains))
+	for _, enrollmentDomain := range config.EnrollmentDomains {
+		parts := strings.SplitN(strings.ToLower(enrollmentDomain), "=", 2)
+		if len(parts) == 2 {
+			enrollmentDomains[parts[0]] = parts[1]
+		} else {
+			enrollmentDomains[parts[0]] = strings.ToLower(config.Domain)
+		}
 	}
+	return enrollmentDomains
 }
 
 // Version is used by go-args to show a custom version string.
@@ -1,10 +1,47 @@
 package mattrax
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/mattrax/Mattrax/internal/datastore/memory"
+	"github.com/mattrax/Mattrax/internal/enrollment"
+	"github.com/mattrax/Mattrax/internal/kek"
+	"github.com/mattrax/Mattrax/internal/settings"
+)
 
 func NewMockServer(t *testing.T) *Server {
 	// TODO: Make this fully functional. Init using other packages so it is functional and tests everything
+	store := &memory.Store{}
+	store.Init()
+	issuedStore := &memory.Store{}
+	issuedStore.Init()
+
+	settingsService, err := settings.NewService(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyEncryptionKey, err := kek.New([]byte("mattrax-mock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificatesService, err := certificates.NewService(store, issuedStore, keyEncryptionKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enrollmentService, err := enrollment.NewService(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	return &Server{
-		Version: "0.0.0-test",
+		Version:      "0.0.0-test",
+		Config:       Config{Domain: "mdm.example.com"},
+		Settings:     settingsService,
+		Certificates: certificatesService,
+		Enrollment:   enrollmentService,
 	}
 }
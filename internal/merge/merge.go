@@ -0,0 +1,44 @@
+// Package merge fills in the fields of a partial update from the current value.
+package merge
+
+import (
+	"errors"
+	"reflect"
+)
+
+// Merge sets the fields of dst which are the zero value to their value in src. Nested structs are merged field by field.
+// Unlike mergo a pointer which is set in dst is always kept, so a pointer to false or 0 can be used to replace a value.
+func Merge(dst interface{}, src interface{}) error {
+	dstValue, srcValue := reflect.ValueOf(dst), reflect.ValueOf(src)
+	if dstValue.Kind() != reflect.Ptr || dstValue.Elem().Kind() != reflect.Struct {
+		return errors.New("merge: dst must be a pointer to a struct")
+	} else if dstValue.Elem().Type() != srcValue.Type() {
+		return errors.New("merge: dst and src must be the same type")
+	}
+
+	merge(dstValue.Elem(), srcValue)
+	return nil
+}
+
+// merge sets dst to src if it is the zero value. Structs with exported fields are merged field by field.
+func merge(dst reflect.Value, src reflect.Value) {
+	if dst.Kind() == reflect.Struct && hasExportedField(dst.Type()) {
+		for i := 0; i < dst.NumField(); i++ {
+			if dst.Field(i).CanSet() {
+				merge(dst.Field(i), src.Field(i))
+			}
+		}
+	} else if dst.IsZero() {
+		dst.Set(src)
+	}
+}
+
+// hasExportedField checks if the struct has an exported field. Structs without one such as time.Time are merged as a single value.
+func hasExportedField(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			return true
+		}
+	}
+	return false
+}
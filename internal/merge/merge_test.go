@@ -0,0 +1,33 @@
+package merge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestMerge(t *testing.T) {
+	is := is.New(t)
+	type nested struct {
+		Count *int
+	}
+	type values struct {
+		Name      string
+		Enabled   *bool
+		UpdatedAt time.Time
+		Nested    nested
+	}
+
+	enabled, count, disabled := true, 5, false
+	current := values{Name: "current", Enabled: &enabled, UpdatedAt: time.Now(), Nested: nested{Count: &count}}
+	update := values{Enabled: &disabled}
+	is.NoErr(Merge(&update, current))                  // merge values
+	is.Equal(update.Name, "current")                   // empty fields are taken from the current value
+	is.Equal(*update.Enabled, false)                   // set pointers are kept
+	is.Equal(*update.Nested.Count, 5)                  // nested structs are merged
+	is.True(update.UpdatedAt.Equal(current.UpdatedAt)) // structs without exported fields are merged as a value
+	is.Equal(enabled, true)                            // the current value is not changed
+
+	is.True(Merge(update, current) != nil) // dst must be a pointer
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/rs/zerolog/log"
+)
+
+// deviceCertificateKey is the context key the verified device certificate is stored under
+type deviceCertificateKey struct{}
+
+// DeviceCertificate requires the request to be authenticated using a client certificate issued by a trusted identity certificate.
+// Requests with a missing, invalid or revoked certificate are rejected. The verified certificate's registry record is stored in the request context.
+func DeviceCertificate(certificatesService *certificates.Service, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "a device certificate is required", http.StatusUnauthorized)
+			return
+		}
+		certificate := r.TLS.PeerCertificates[0]
+
+		trustedCertificates := certificatesService.Get()
+		if len(trustedCertificates.TrustedIdentities()) == 0 {
+			http.Error(w, "the server is not ready to accept devices", http.StatusServiceUnavailable)
+			return
+		}
+
+		// Certificates issued by the next and previous identities are accepted so devices keep working during an identity rollover.
+		// Identities issued by an offline root are intermediates so the chain is verified to the root.
+		roots, intermediates := trustedCertificates.TrustedCertPools()
+		for _, intermediate := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(intermediate)
+		}
+
+		if _, err := certificate.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}); err != nil {
+			log.Debug().Str("remote-addr", r.RemoteAddr).Str("subject", certificate.Subject.String()).Err(err).Msg("rejected request with an invalid device certificate")
+			http.Error(w, "the device certificate is invalid", http.StatusUnauthorized)
+			return
+		}
+
+		issuedCertificate, revoked, err := certificatesService.IsRevoked(certificate)
+		if err != nil {
+			log.Error().Err(err).Msg("error checking device certificate revocation")
+			http.Error(w, "internal error checking the device certificate", http.StatusInternalServerError)
+			return
+		} else if revoked {
+			log.Info().Str("remote-addr", r.RemoteAddr).Str("serial-number", certificates.FormatSerialNumber(certificate.SerialNumber)).Msg("rejected request with a revoked device certificate")
+			http.Error(w, "the device certificate has been revoked", http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), deviceCertificateKey{}, issuedCertificate)))
+	}
+}
+
+// GetDeviceCertificate returns the device certificate verified by the DeviceCertificate middleware
+func GetDeviceCertificate(r *http.Request) (certificates.IssuedCertificate, bool) {
+	issuedCertificate, ok := r.Context().Value(deviceCertificateKey{}).(certificates.IssuedCertificate)
+	return issuedCertificate, ok
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mattrax/Mattrax/internal/types"
+	"github.com/rs/zerolog/log"
+)
+
+// userLoginKey is the context key the email of the authenticated user is stored under
+type userLoginKey struct{}
+
+// UserLogin requires the request to be authenticated using HTTP basic authentication with a user's email and password.
+// The email of the authenticated user is stored in the request context.
+func UserLogin(userService types.UserService, realm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		email, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			http.Error(w, "authentication is required", http.StatusUnauthorized)
+			return
+		}
+
+		loggedIn, err := userService.VerifyLogin(email, password)
+		if err != nil && err != types.ErrUserNotFound {
+			log.Error().Err(err).Msg("error verifying user login")
+			http.Error(w, "internal error verifying the login", http.StatusInternalServerError)
+			return
+		} else if !loggedIn {
+			log.Info().Str("remote-addr", r.RemoteAddr).Str("email", email).Msg("rejected request with an invalid login")
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+			http.Error(w, "the email or password is incorrect", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), userLoginKey{}, email)))
+	}
+}
+
+// GetUserLogin returns the email of the user authenticated by the UserLogin middleware
+func GetUserLogin(r *http.Request) (string, bool) {
+	email, ok := r.Context().Value(userLoginKey{}).(string)
+	return email, ok
+}
@@ -0,0 +1,8 @@
+package pkcs11
+
+// Config contains the details used to connect to a PKCS#11 token
+type Config struct {
+	ModulePath string // The path to the PKCS#11 library provided by the HSM vendor
+	TokenLabel string // The label of the token the keys are stored in
+	PIN        string // The user PIN used to login to the token
+}
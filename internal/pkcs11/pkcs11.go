@@ -0,0 +1,78 @@
+//go:build pkcs11
+// +build pkcs11
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/pkg/errors"
+)
+
+// idSize is the size in bytes of the random CKA_ID given to generated keys
+const idSize = 16
+
+// KeyStore creates and loads private keys in a PKCS#11 token. The keys are generated as sensitive and non-extractable so they never leave the token.
+type KeyStore struct {
+	ctx *crypto11.Context
+}
+
+// Open connects to the PKCS#11 token
+func Open(config Config) (*KeyStore, error) {
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       config.ModulePath,
+		TokenLabel: config.TokenLabel,
+		Pin:        config.PIN,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error connecting to pkcs11 token")
+	}
+
+	return &KeyStore{
+		ctx: ctx,
+	}, nil
+}
+
+// GenerateKey creates a new RSA or ECDSA key pair in the token. The returned ID is the key's CKA_ID.
+func (keyStore *KeyStore) GenerateKey(algorithm certificates.KeyAlgorithm) (crypto.Signer, []byte, error) {
+	id := make([]byte, idSize)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, nil, errors.Wrap(err, "error generating key id")
+	}
+
+	var signer crypto.Signer
+	var err error
+	label := []byte("mattrax-" + hex.EncodeToString(id))
+	if curve := algorithm.Curve(); curve != nil {
+		signer, err = keyStore.ctx.GenerateECDSAKeyPairWithLabel(id, label, curve)
+	} else {
+		signer, err = keyStore.ctx.GenerateRSAKeyPairWithLabel(id, label, algorithm.RSABits())
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error generating key pair in pkcs11 token")
+	}
+
+	return signer, id, nil
+}
+
+// FindKey loads the key pair with the CKA_ID from the token
+func (keyStore *KeyStore) FindKey(id []byte) (crypto.Signer, error) {
+	signer, err := keyStore.ctx.FindKeyPair(id, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error finding key pair in pkcs11 token")
+	} else if signer == nil {
+		return nil, errors.New("the key pair '" + hex.EncodeToString(id) + "' was not found in the pkcs11 token")
+	}
+
+	return signer, nil
+}
+
+// Close logs out of the token and unloads the PKCS#11 library
+func (keyStore *KeyStore) Close() error {
+	return keyStore.ctx.Close()
+}
@@ -0,0 +1,37 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package pkcs11
+
+import (
+	"crypto"
+	"errors"
+
+	"github.com/mattrax/Mattrax/internal/certificates"
+)
+
+// ErrNotSupported is returned when the server was built without PKCS#11 support
+var ErrNotSupported = errors.New("mattrax was built without pkcs11 support. it must be built with '-tags pkcs11' to use a pkcs11 token")
+
+// KeyStore creates and loads private keys in a PKCS#11 token. This build doesn't support PKCS#11 so it can't be opened.
+type KeyStore struct{}
+
+// Open returns ErrNotSupported because the server was built without PKCS#11 support
+func Open(config Config) (*KeyStore, error) {
+	return nil, ErrNotSupported
+}
+
+// GenerateKey returns ErrNotSupported
+func (keyStore *KeyStore) GenerateKey(algorithm certificates.KeyAlgorithm) (crypto.Signer, []byte, error) {
+	return nil, nil, ErrNotSupported
+}
+
+// FindKey returns ErrNotSupported
+func (keyStore *KeyStore) FindKey(id []byte) (crypto.Signer, error) {
+	return nil, ErrNotSupported
+}
+
+// Close does nothing
+func (keyStore *KeyStore) Close() error {
+	return nil
+}
@@ -0,0 +1,81 @@
+//go:build pkcs11
+// +build pkcs11
+
+package pkcs11
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/mattrax/Mattrax/internal/datastore/memory"
+	"github.com/mattrax/Mattrax/internal/kek"
+	"golang.org/x/crypto/ocsp"
+)
+
+// TestSoftHSM runs against an initialised SoftHSM token. For example:
+//
+//	softhsm2-util --init-token --free --label mattrax-test --so-pin 1234 --pin 1234
+//	MATTRAX_TEST_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so MATTRAX_TEST_PKCS11_TOKEN=mattrax-test MATTRAX_TEST_PKCS11_PIN=1234 go test -tags pkcs11 ./internal/pkcs11
+func TestSoftHSM(t *testing.T) {
+	config := Config{
+		ModulePath: os.Getenv("MATTRAX_TEST_PKCS11_MODULE"),
+		TokenLabel: os.Getenv("MATTRAX_TEST_PKCS11_TOKEN"),
+		PIN:        os.Getenv("MATTRAX_TEST_PKCS11_PIN"),
+	}
+	if config.ModulePath == "" {
+		t.Skip("MATTRAX_TEST_PKCS11_MODULE is not set")
+	}
+	is := is.New(t)
+
+	keyStore, err := Open(config)
+	is.NoErr(err) // Error opening token
+	defer keyStore.Close()
+
+	store, issuedStore := &memory.Store{}, &memory.Store{}
+	store.Init()
+	issuedStore.Init()
+	keyEncryptionKey, err := kek.New([]byte("test"))
+	is.NoErr(err)
+
+	service, err := certificates.NewService(store, issuedStore, keyEncryptionKey, keyStore)
+	is.NoErr(err)                                                                                            // Error creating service
+	is.NoErr(service.GenerateIdentity(pkix.Name{CommonName: "SoftHSM Test Identity"}, certificates.RSA4096)) // Error generating identity in token
+	identity := service.Get().Identity
+	_, exportable := identity.Signer.(*rsa.PrivateKey)
+	is.True(!exportable)           // Identity key must stay in the token
+	is.True(identity.KeyID != nil) // Identity key should be referenced by its id
+
+	device, _, err := keyStore.GenerateKey(certificates.ECDSAP256)
+	is.NoErr(err) // Error generating device key
+	certificate, err := service.Issue(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "device"},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+	}, device.Public(), "device-uuid")
+	is.NoErr(err)                                           // Error issuing certificate with token key
+	is.NoErr(certificate.CheckSignatureFrom(identity.Cert)) // Certificate should be signed by the identity
+
+	crlDer, _, err := service.CRL(identity.CertHash)
+	is.NoErr(err) // Error signing CRL with token key
+	crl, err := x509.ParseRevocationList(crlDer)
+	is.NoErr(err)
+	is.NoErr(crl.CheckSignatureFrom(identity.Cert)) // CRL should be signed by the identity
+
+	request, err := ocsp.CreateRequest(certificate, identity.Cert, nil)
+	is.NoErr(err)
+	responseDer, err := service.OCSPResponse(request)
+	is.NoErr(err) // Error signing OCSP response with token key
+	response, err := ocsp.ParseResponseForCert(responseDer, certificate, identity.Cert)
+	is.NoErr(err) // OCSP response should be signed by a signer issued by the identity
+	is.Equal(response.Status, ocsp.Good)
+
+	reloaded, err := certificates.NewService(store, issuedStore, keyEncryptionKey, keyStore)
+	is.NoErr(err) // Error loading keys from token
+	is.Equal(reloaded.Get().Identity.Signer.Public(), identity.Signer.Public())
+}
@@ -4,12 +4,14 @@ import (
 	"errors"
 	"net/url"
 	"regexp"
+	"time"
 )
 
 // Settings contains the Mattrax's dynamic configuration.
 // These values can be changed at runtime although it is recommended some of them never change.
 type Settings struct {
-	Tenant TenantSettings `yaml:"tenant"`
+	Tenant       TenantSettings       `yaml:"tenant"`
+	Provisioning ProvisioningSettings `yaml:"provisioning"`
 }
 
 // TenantSettings contains details about the server's owner
@@ -22,6 +24,74 @@ type TenantSettings struct {
 	EnrollmentDisabled bool   `yaml:"enrollment_disabled"`
 }
 
+// ProvisioningSettings contains the values sent to Windows devices in their provisioning profile when they enroll.
+// Changes only apply to devices which enroll after the change.
+// Pointers are used for the values which can be 0 so they can be distinguished from not set when settings are merged.
+type ProvisioningSettings struct {
+	Poll                                   PollSettings   `yaml:"poll"`
+	NumberOfDaysAfterLostContactToUnenroll int            `yaml:"days_after_lost_contact_to_unenroll"`
+	EnrollmentCompleteTitle                string         `yaml:"enrollment_complete_title"`
+	EnrollmentCompleteBodyText             string         `yaml:"enrollment_complete_body_text"` // %TENANT_NAME% is replaced with the tenant's name
+	Role                                   *uint32        `yaml:"role"`                          // The security roles the server is granted on the device
+	ConnectionRetryFrequency               *int           `yaml:"connection_retry_frequency"`    // The number of times the device retries connecting to the server
+	InitialBackoffTime                     *time.Duration `yaml:"initial_backoff_time"`          // The wait before the first connection retry
+	MaxBackoffTime                         *time.Duration `yaml:"max_backoff_time"`              // The longest wait between connection retries
+}
+
+// PollSettings contains the schedule a device checks in to the server on. The intervals are in minutes.
+// Pointers are used so false and 0 can be distinguished from not set when settings are merged.
+type PollSettings struct {
+	IntervalForFirstSetOfRetries         int   `yaml:"interval_for_first_set_of_retries"`
+	NumberOfFirstRetries                 *int  `yaml:"number_of_first_retries"`
+	IntervalForSecondSetOfRetries        int   `yaml:"interval_for_second_set_of_retries"`
+	NumberOfSecondRetries                *int  `yaml:"number_of_second_retries"`
+	IntervalForRemainingScheduledRetries int   `yaml:"interval_for_remaining_scheduled_retries"`
+	NumberOfRemainingScheduledRetries    *int  `yaml:"number_of_remaining_scheduled_retries"` // 0 means the device polls forever
+	PollOnLogin                          *bool `yaml:"poll_on_login"`
+	AllUsersPollOnFirstLogin             *bool `yaml:"all_users_poll_on_first_login"`
+}
+
+// DefaultProvisioningSettings are used for any provisioning settings which have not been set
+var DefaultProvisioningSettings = ProvisioningSettings{
+	Poll: PollSettings{
+		IntervalForFirstSetOfRetries:         15,
+		NumberOfFirstRetries:                 intPtr(5),
+		IntervalForSecondSetOfRetries:        60,
+		NumberOfSecondRetries:                intPtr(10),
+		IntervalForRemainingScheduledRetries: 1440,
+		NumberOfRemainingScheduledRetries:    intPtr(0),
+		PollOnLogin:                          boolPtr(true),
+		AllUsersPollOnFirstLogin:             boolPtr(true),
+	},
+	NumberOfDaysAfterLostContactToUnenroll: 730, // 2 years
+	EnrollmentCompleteTitle:                "Enrollment Complete",
+	EnrollmentCompleteBodyText:             "Your device is now being managed by '%TENANT_NAME%'. Please contact your IT administrators for support if you have any problems.",
+	Role:                                   uint32Ptr(4294967295), // All roles
+	ConnectionRetryFrequency:               intPtr(3),
+	InitialBackoffTime:                     durationPtr(16 * time.Second),
+	MaxBackoffTime:                         durationPtr(24 * time.Hour),
+}
+
+// boolPtr returns a pointer to the bool
+func boolPtr(value bool) *bool {
+	return &value
+}
+
+// intPtr returns a pointer to the int
+func intPtr(value int) *int {
+	return &value
+}
+
+// uint32Ptr returns a pointer to the uint32
+func uint32Ptr(value uint32) *uint32 {
+	return &value
+}
+
+// durationPtr returns a pointer to the time.Duration
+func durationPtr(value time.Duration) *time.Duration {
+	return &value
+}
+
 // genericStringRegex is a regex used to verify a simple string
 var genericStringRegex = regexp.MustCompile(`^[a-zA-Z0-9- '"]+$`)
 
@@ -39,5 +109,39 @@ func (settings Settings) Verify() error {
 		}
 	}
 
+	return settings.Provisioning.Verify()
+}
+
+// Verify checks the ProvisioningSettings are valid. Values which are not set are not checked because they are filled from the current settings.
+func (provisioning ProvisioningSettings) Verify() error {
+	poll := provisioning.Poll
+	if poll.IntervalForFirstSetOfRetries < 0 || poll.IntervalForSecondSetOfRetries < 0 || poll.IntervalForRemainingScheduledRetries < 0 {
+		return errors.New("invalid settings: poll intervals must not be negative. 0 keeps the current value")
+	}
+
+	for _, retries := range []*int{poll.NumberOfFirstRetries, poll.NumberOfSecondRetries, poll.NumberOfRemainingScheduledRetries} {
+		if retries != nil && *retries < 0 {
+			return errors.New("invalid settings: poll retries must not be negative")
+		}
+	}
+
+	if provisioning.NumberOfDaysAfterLostContactToUnenroll < 0 || provisioning.NumberOfDaysAfterLostContactToUnenroll > 3650 {
+		return errors.New("invalid settings: days after lost contact to unenroll must be between 0 and 3650. 0 keeps the current value")
+	}
+
+	if len(provisioning.EnrollmentCompleteTitle) > 256 || len(provisioning.EnrollmentCompleteBodyText) > 1024 {
+		return errors.New("invalid settings: enrollment complete page title must be at most 256 characters and body text at most 1024 characters")
+	}
+
+	if provisioning.ConnectionRetryFrequency != nil && *provisioning.ConnectionRetryFrequency < 0 {
+		return errors.New("invalid settings: connection retry frequency must not be negative")
+	}
+
+	if (provisioning.InitialBackoffTime != nil && *provisioning.InitialBackoffTime < 0) || (provisioning.MaxBackoffTime != nil && *provisioning.MaxBackoffTime < 0) {
+		return errors.New("invalid settings: backoff times must not be negative")
+	} else if provisioning.InitialBackoffTime != nil && provisioning.MaxBackoffTime != nil && *provisioning.MaxBackoffTime < *provisioning.InitialBackoffTime {
+		return errors.New("invalid settings: max backoff time must not be less than the initial backoff time")
+	}
+
 	return nil
 }
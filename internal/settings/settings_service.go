@@ -4,8 +4,8 @@ import (
 	"errors"
 	"sync"
 
-	"github.com/imdario/mergo"
 	"github.com/mattrax/Mattrax/internal/datastore"
+	"github.com/mattrax/Mattrax/internal/merge"
 	"github.com/rs/zerolog/log"
 )
 
@@ -34,11 +34,16 @@ func (s *Service) Set(settings Settings) error {
 	}
 
 	currentSettings := s.Get()
-	if err := mergo.Merge(&settings, currentSettings); err != nil {
+	if err := merge.Merge(&settings, currentSettings); err != nil {
 		log.Error().Err(err).Msg("error merging Settings structs")
 		return errors.New("internal server error: failed to merge settings")
 	}
 
+	// The merged values are checked again because some values depend on each other
+	if err := settings.Verify(); err != nil {
+		return err
+	}
+
 	s.mutex.Lock()
 	previousSettings := s.settings
 	s.settings = settings
@@ -58,7 +63,11 @@ func (s *Service) Set(settings Settings) error {
 func NewService(store datastore.Store) (*Service, error) {
 	var settings Settings
 	err := store.Get(settingsKey, &settings)
-	if err != nil {
+	if err != nil && err != datastore.ErrNotFound {
+		return nil, err
+	}
+
+	if err := merge.Merge(&settings.Provisioning, DefaultProvisioningSettings); err != nil {
 		return nil, err
 	}
 
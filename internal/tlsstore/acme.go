@@ -0,0 +1,79 @@
+package tlsstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// LetsEncryptDirectory is the directory of the Let's Encrypt production CA. It is used if no ACME directory is given.
+const LetsEncryptDirectory = acme.LetsEncryptURL
+
+// acmeRenewBefore is how long before a certificate expires the manager renews it
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// ACMEConfig configures the client which obtains certificates from an ACME CA
+type ACMEConfig struct {
+	DirectoryURL string   // The directory of the ACME CA. Let's Encrypt is used if it is empty.
+	Email        string   // The contact email of the ACME account. The CA uses it to warn about problems with the certificates.
+	CacheDir     string   // The directory the account key and certificates are stored in so they are kept between restarts
+	RootCAFile   string   // An optional PEM file of the root certificates which are trusted for the ACME directory. It is used for private CAs like Pebble.
+	Hosts        []string // The hostnames certificates are obtained for
+}
+
+// NewACMEManager creates the manager which obtains and renews certificates for the hosts using the TLS-ALPN-01 challenge.
+// The certificates are obtained when a client first connects using a host and renewed in the background before they expire.
+func NewACMEManager(config ACMEConfig) (*autocert.Manager, error) {
+	if len(config.Hosts) == 0 {
+		return nil, errors.New("tlsstore: acme requires at least one host")
+	} else if config.CacheDir == "" {
+		return nil, errors.New("tlsstore: acme requires a cache directory")
+	}
+
+	directoryURL := config.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = LetsEncryptDirectory
+	}
+
+	client := &acme.Client{
+		DirectoryURL: directoryURL,
+		UserAgent:    "mattrax",
+	}
+
+	if config.RootCAFile != "" {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil || rootCAs == nil {
+			rootCAs = x509.NewCertPool()
+		}
+
+		rootCAsPEM, err := ioutil.ReadFile(config.RootCAFile)
+		if err != nil {
+			return nil, err
+		} else if !rootCAs.AppendCertsFromPEM(rootCAsPEM) {
+			return nil, errors.New("tlsstore: the acme root ca file doesn't contain any PEM certificates")
+		}
+
+		client.HTTPClient = &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(config.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(config.Hosts...),
+		RenewBefore: acmeRenewBefore,
+		Client:      client,
+		Email:       config.Email,
+	}, nil
+}
@@ -0,0 +1,75 @@
+//go:build pebble
+// +build pebble
+
+package tlsstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+	"golang.org/x/crypto/acme"
+)
+
+// TestPebble obtains a certificate from a local Pebble ACME server using the TLS-ALPN-01 challenge. For example:
+//
+//	PEBBLE_VA_NOSLEEP=1 pebble -config ./test/config/pebble-config.json
+//	MATTRAX_TEST_ACME_DIRECTORY=https://localhost:14000/dir MATTRAX_TEST_ACME_ROOT_CA=./test/certs/pebble.minica.pem go test -tags pebble ./internal/tlsstore
+//
+// Pebble connects to MATTRAX_TEST_ACME_HOST (default localhost) on its tlsPort (default 5001) to validate the challenge.
+func TestPebble(t *testing.T) {
+	directoryURL := os.Getenv("MATTRAX_TEST_ACME_DIRECTORY")
+	if directoryURL == "" {
+		t.Skip("MATTRAX_TEST_ACME_DIRECTORY is not set")
+	}
+	is := is.New(t)
+
+	host := os.Getenv("MATTRAX_TEST_ACME_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	tlsPort := os.Getenv("MATTRAX_TEST_ACME_TLS_PORT")
+	if tlsPort == "" {
+		tlsPort = "5001"
+	}
+
+	cacheDir, err := ioutil.TempDir("", "mattrax-acme")
+	is.NoErr(err)
+	defer os.RemoveAll(cacheDir)
+
+	manager, err := NewACMEManager(ACMEConfig{
+		DirectoryURL: directoryURL,
+		Email:        "admin@example.com",
+		CacheDir:     cacheDir,
+		RootCAFile:   os.Getenv("MATTRAX_TEST_ACME_ROOT_CA"),
+		Hosts:        []string{host},
+	})
+	is.NoErr(err) // Error creating acme manager
+
+	store := &Store{}
+	store.SetACME(manager, []string{host})
+
+	// Pebble validates the challenge by connecting to this listener
+	listener, err := tls.Listen("tcp", net.JoinHostPort("", tlsPort), &tls.Config{
+		GetCertificate: store.GetCertificate,
+		NextProtos:     []string{"http/1.1", acme.ALPNProto},
+	})
+	is.NoErr(err) // Error listening for the challenge
+	defer listener.Close()
+	go http.Serve(listener, http.NotFoundHandler())
+
+	certificate, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+	is.NoErr(err) // Error obtaining certificate from pebble
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	is.NoErr(err)
+	is.NoErr(leaf.VerifyHostname(host)) // Certificate should be for the host
+
+	cached, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+	is.NoErr(err)
+	is.Equal(cached.Certificate[0], certificate.Certificate[0]) // Certificate should be reused until it is renewed
+}
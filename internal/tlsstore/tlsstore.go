@@ -0,0 +1,176 @@
+package tlsstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Store holds the HTTPS certificates served by the webserver.
+// The certificate for a connection is selected using the server name (SNI) sent by the client.
+// Certificates for the ACME hosts are obtained from the ACME manager if one is set.
+type Store struct {
+	certificates []*tls.Certificate
+	certFiles    []string
+	keyFiles     []string
+	modified     map[string]time.Time // The modification time of each file when it was loaded
+	acme         *autocert.Manager
+	acmeHosts    map[string]bool
+	mutex        sync.RWMutex
+}
+
+// Load reads the certificate and private key pairs from disk and replaces the certificates in the store.
+// The first pair is the default certificate which is served to clients which don't match any other certificate.
+// If any pair can't be loaded the current certificates are kept.
+func (store *Store) Load(certFiles []string, keyFiles []string) error {
+	if len(certFiles) == 0 || len(certFiles) != len(keyFiles) {
+		return errors.New("tlsstore: every certificate must have a matching private key")
+	}
+
+	modified := make(map[string]time.Time, len(certFiles)+len(keyFiles))
+	for _, file := range append(append([]string{}, certFiles...), keyFiles...) {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modified[file] = info.ModTime()
+	}
+
+	certificates := make([]*tls.Certificate, 0, len(certFiles))
+	for i := range certFiles {
+		certificate, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, &certificate)
+	}
+
+	store.mutex.Lock()
+	store.certificates = certificates
+	store.certFiles, store.keyFiles = certFiles, keyFiles
+	store.modified = modified
+	store.mutex.Unlock()
+	return nil
+}
+
+// Reload reads the certificate and private key files the store was last loaded from again.
+// It is used to rotate the HTTPS certificates without restarting the webserver so existing connections are kept.
+func (store *Store) Reload() error {
+	store.mutex.RLock()
+	certFiles, keyFiles := store.certFiles, store.keyFiles
+	store.mutex.RUnlock()
+
+	if len(certFiles) == 0 {
+		return nil
+	}
+	return store.Load(certFiles, keyFiles)
+}
+
+// changed checks if any of the loaded files have been modified since they were loaded
+func (store *Store) changed() bool {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for file, modTime := range store.modified {
+		if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the certificates when their files change on disk. The files are checked every interval until stop is closed.
+// Files are often written in multiple steps so a reload which fails is retried at the next interval.
+func (store *Store) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		if !store.changed() {
+			continue
+		}
+
+		if err := store.Reload(); err != nil {
+			log.Error().Err(err).Msg("error reloading the changed HTTPS certificates")
+			continue
+		}
+		log.Info().Msg("Reloaded the changed HTTPS certificates...")
+	}
+}
+
+// SetACME sets the ACME manager which is used to obtain the certificates of the hosts.
+// The manager handles the TLS-ALPN-01 challenge so the webserver's TLS config must include acme.ALPNProto in NextProtos.
+func (store *Store) SetACME(manager *autocert.Manager, hosts []string) {
+	acmeHosts := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		acmeHosts[strings.ToLower(host)] = true
+	}
+
+	store.mutex.Lock()
+	store.acme, store.acmeHosts = manager, acmeHosts
+	store.mutex.Unlock()
+}
+
+// GetCertificate returns the certificate which should be served for a TLS handshake. It is used as the tls.Config GetCertificate function.
+func (store *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store.mutex.RLock()
+	manager, isACMEHost := store.acme, store.acmeHosts[strings.ToLower(hello.ServerName)]
+	store.mutex.RUnlock()
+
+	// The lock isn't held while the manager obtains a certificate as it can take a while
+	if manager != nil && isACMEHost {
+		return manager.GetCertificate(hello)
+	} else if manager != nil && len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+		return nil, errors.New("tlsstore: the acme challenge is not for a configured host")
+	}
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	if len(store.certificates) == 0 {
+		return nil, errors.New("tlsstore: no certificates loaded")
+	}
+
+	if hello.ServerName != "" {
+		for _, certificate := range store.certificates {
+			if hello.SupportsCertificate(certificate) == nil {
+				return certificate, nil
+			}
+		}
+	}
+
+	return store.certificates[0], nil
+}
+
+// Leaves returns the parsed leaf certificate of every certificate loaded from disk. Certificates obtained using ACME are renewed by the manager so they aren't included.
+func (store *Store) Leaves() ([]*x509.Certificate, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	leaves := make([]*x509.Certificate, 0, len(store.certificates))
+	for _, certificate := range store.certificates {
+		leaf := certificate.Leaf
+		if leaf == nil {
+			var err error
+			if leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+				return nil, err
+			}
+		}
+		leaves = append(leaves, leaf)
+	}
+	return leaves, nil
+}
@@ -0,0 +1,110 @@
+package tlsstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// writeCertificate writes a self-signed certificate for the common name and its private key to the files
+func writeCertificate(t *testing.T, certFile string, keyFile string, commonName string) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "tlsstore")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "certificate.pem"), filepath.Join(dir, "privatekey.pem")
+
+	servedName := func(store *Store) string {
+		certificate, err := store.GetCertificate(&tls.ClientHelloInfo{})
+		is.NoErr(err) // Error getting certificate
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		is.NoErr(err)
+		return leaf.Subject.CommonName
+	}
+
+	writeCertificate(t, certFile, keyFile, "first.example.com")
+	store := &Store{}
+	is.NoErr(store.Load([]string{certFile}, []string{keyFile})) // Error loading certificates
+	is.Equal(servedName(store), "first.example.com")
+
+	writeCertificate(t, certFile, keyFile, "second.example.com")
+	is.NoErr(store.Reload())                          // Error reloading certificates
+	is.Equal(servedName(store), "second.example.com") // Reload should serve the new certificate
+
+	is.NoErr(ioutil.WriteFile(keyFile, []byte("partially written"), 0600))
+	is.True(store.Reload() != nil)                    // Invalid files must be rejected
+	is.Equal(servedName(store), "second.example.com") // The previous certificate should be kept if reloading fails
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go store.Watch(10*time.Millisecond, stop)
+
+	writeCertificate(t, certFile, keyFile, "third.example.com")
+	modTime := time.Now().Add(time.Minute)
+	is.NoErr(os.Chtimes(certFile, modTime, modTime))
+	is.NoErr(os.Chtimes(keyFile, modTime, modTime))
+	for i := 0; i < 100 && servedName(store) != "third.example.com"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	is.Equal(servedName(store), "third.example.com") // Changed files should be reloaded automatically
+}
+
+func TestGenerateSelfSigned(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "tlsstore")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "certs", "certificate.pem"), filepath.Join(dir, "certs", "privatekey.pem")
+
+	is.NoErr(GenerateSelfSigned(certFile, keyFile, []string{"localhost", "mdm.example.com"})) // Error generating certificate
+	store := &Store{}
+	is.NoErr(store.Load([]string{certFile}, []string{keyFile})) // Generated certificate should be loadable
+
+	leaves, err := store.Leaves()
+	is.NoErr(err)
+	is.NoErr(leaves[0].VerifyHostname("localhost"))       // Certificate should be valid for the first hostname
+	is.NoErr(leaves[0].VerifyHostname("mdm.example.com")) // Certificate should be valid for every hostname
+	is.NoErr(leaves[0].VerifyHostname("127.0.0.1"))       // Certificate for localhost should be valid for the loopback address
+}
@@ -0,0 +1,82 @@
+package cepces
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/middleware"
+	enrollpolicy "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_policy"
+	"github.com/mattrax/Mattrax/mdm/windows/soap"
+)
+
+// The paths the certificate enrollment policy (MS-XCEP) and enrollment (MS-WSTEP) web services are served at for each authentication type
+const (
+	UsernamePasswordPolicyPath     = "/CertificateEnrollment/UsernamePassword/Policy.svc"
+	UsernamePasswordEnrollmentPath = "/CertificateEnrollment/UsernamePassword/Enrollment.svc"
+	CertificatePolicyPath          = "/CertificateEnrollment/Certificate/Policy.svc"
+	CertificateEnrollmentPath      = "/CertificateEnrollment/Certificate/Enrollment.svc"
+)
+
+// errInvalidLogin is returned when the username or password in the WS-Security header is incorrect
+var errInvalidLogin = errors.New("the users login is incorrect")
+
+// Authentication is how the client authenticates to the web services. The values match the clientAuthentication of MS-XCEP.
+type Authentication int
+
+const (
+	UsernamePassword Authentication = enrollpolicy.ClientAuthenticationUsernamePassword // The WS-Security UsernameToken is checked against the users
+	Certificate      Authentication = enrollpolicy.ClientAuthenticationCertificate      // The TLS client certificate must have been issued by Mattrax
+)
+
+// enrollmentPath returns the path of the enrollment web service clients using the authentication are sent to by the policy
+func (auth Authentication) enrollmentPath() string {
+	if auth == Certificate {
+		return CertificateEnrollmentPath
+	}
+	return UsernamePasswordEnrollmentPath
+}
+
+// Init attaches the standalone certificate enrollment web services to the router.
+// They let Windows devices which aren't MDM enrolled or domain joined autoenroll user and machine certificates.
+func Init(server *mattrax.Server, r *mux.Router) {
+	r.Path(UsernamePasswordPolicyPath).Methods("POST").HandlerFunc(PolicyHandler(server, UsernamePassword))
+	r.Path(UsernamePasswordEnrollmentPath).Methods("POST").HandlerFunc(EnrollmentHandler(server, UsernamePassword))
+	r.Path(CertificatePolicyPath).Methods("POST").HandlerFunc(middleware.DeviceCertificate(server.Certificates, PolicyHandler(server, Certificate)))
+	r.Path(CertificateEnrollmentPath).Methods("POST").HandlerFunc(middleware.DeviceCertificate(server.Certificates, EnrollmentHandler(server, Certificate)))
+}
+
+// authenticate checks the client's credentials. The email of the user is returned for username and password authentication and the device's UUID for certificate authentication.
+func authenticate(server *mattrax.Server, auth Authentication, r *http.Request, header soap.Header) (email string, deviceUUID string, err error) {
+	if auth == Certificate {
+		issuedCertificate, ok := middleware.GetDeviceCertificate(r)
+		if !ok {
+			return "", "", errors.New("the request was not authenticated with a client certificate")
+		}
+		return "", issuedCertificate.DeviceUUID, nil
+	}
+
+	loggedIn, err := server.UserService.VerifyLogin(header.WSSESecurity.Username, header.WSSESecurity.Password)
+	if err != nil {
+		return "", "", err
+	} else if !loggedIn {
+		return "", "", errInvalidLogin
+	}
+	return header.WSSESecurity.Username, "", nil
+}
+
+// serviceURL returns the URL of the web service at the path on the domain the request was sent to
+func serviceURL(server *mattrax.Server, r *http.Request, path string) string {
+	publicDomain, ok := server.Config.HostPublicDomain(r.Host)
+	if !ok {
+		publicDomain = server.Config.Domain
+	}
+
+	return (&url.URL{
+		Scheme: "https",
+		Host:   publicDomain,
+		Path:   path,
+	}).String()
+}
@@ -0,0 +1,177 @@
+package cepces
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	enrollprovision "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_provision"
+	"github.com/mattrax/Mattrax/mdm/windows/soap"
+	"github.com/mattrax/Mattrax/pki"
+	"github.com/micromdm/scep/v2/scep"
+	"github.com/rs/zerolog/log"
+)
+
+// Value types of the BinarySecurityToken defined in MS-WSTEP
+const (
+	valueTypePKCS10 = "http://schemas.microsoft.com/windows/pki/2009/01/enrollment#PKCS10"
+	valueTypePKCS7  = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-x509-token-profile-1.0#PKCS7"
+	valueTypeX509v3 = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-x509-token-profile-1.0#X509v3"
+	encodingBase64  = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd#base64binary"
+)
+
+// oidCertificateTemplate is the certificate request extension Windows uses to name the template the certificate is requested for (szOID_CERTIFICATE_TEMPLATE)
+var oidCertificateTemplate = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 21, 7}
+
+// certificateTemplateExtension is the value of the szOID_CERTIFICATE_TEMPLATE extension
+type certificateTemplateExtension struct {
+	TemplateID   asn1.ObjectIdentifier
+	MajorVersion int `asn1:"optional"`
+	MinorVersion int `asn1:"optional"`
+}
+
+// EnrollmentHandler handles the HTTP POST request for certificate enrollment (MS-WSTEP).
+// The handler signs the certificate request using the requested template and responds with the certificate and its chain.
+func EnrollmentHandler(server *mattrax.Server, auth Authentication) http.HandlerFunc {
+	endpoint := soap.Endpoint{
+		Action:      "http://schemas.microsoft.com/windows/pki/2009/01/enrollment/RST/wstep",
+		MaxBodySize: 10000,
+		ClockSkew:   server.Config.ClockSkew,
+		MessageIDs:  soap.NewMessageIDCache(soap.MessageIDCacheSize),
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cmd enrollprovision.Request
+		header, ok := endpoint.ReadRequest(w, r, &cmd)
+		if !ok {
+			return
+		}
+
+		email, deviceUUID, err := authenticate(server, auth, r, header)
+		if err != nil {
+			log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Err(err).Msg("error: ces request: client request could not be authenticated")
+			endpoint.Release(header)
+			fault := soap.NewBasicFault("s:Sender", "s:Authentication", "client request could not be authenticated")
+			fault.Response(w)
+			return
+		}
+
+		clientCertificate, err := issueCertificate(server, cmd.Body, email, deviceUUID)
+		if err != nil {
+			log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Err(err).Msg("error: ces request: failed to sign client certificate request")
+			endpoint.Release(header)
+			fault := soap.NewEnrollmentFault("s:Receiver", "s:CertificateRequest", "the certificate request could not be signed", "EnrollmentServer", "EnrollmentInternalServiceError", "")
+			fault.Response(w)
+			return
+		}
+
+		identity := server.Certificates.Get().Identity
+		chain := append([]*x509.Certificate{clientCertificate, identity.Cert}, identity.Chain...)
+		if identity.RootCert != nil {
+			chain = append(chain, identity.RootCert)
+		}
+
+		chainDer, err := scep.DegenerateCertificates(chain)
+		if err != nil {
+			log.Error().Err(err).Msg("error: ces request: failed to encode certificate chain")
+			fault := soap.NewBasicFault("s:Receiver", "a:InternalServiceFault", "mattrax error: failed to encode certificate chain")
+			fault.Response(w)
+			return
+		}
+
+		soap.Respond(w, ResponseEnvelope{
+			NamespaceS: "http://www.w3.org/2003/05/soap-envelope",
+			NamespaceA: "http://www.w3.org/2005/08/addressing",
+			NamespaceU: "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd",
+			Header:     soap.NewHeaderRes("http://schemas.microsoft.com/windows/pki/2009/01/enrollment/RSTRC/wstep", header),
+			Body: ResponseBody{
+				TokenType:          valueTypeX509v3,
+				DispositionMessage: "Issued",
+				BinarySecurityToken: enrollprovision.BinarySecurityToken{
+					ValueType:    valueTypePKCS7,
+					EncodingType: encodingBase64,
+					Value:        base64.StdEncoding.EncodeToString(chainDer),
+				},
+				RequestedSecurityToken: enrollprovision.BinarySecurityToken{
+					ValueType:    valueTypeX509v3,
+					EncodingType: encodingBase64,
+					Value:        base64.StdEncoding.EncodeToString(clientCertificate.Raw),
+				},
+				RequestID: 0,
+			},
+		})
+	}
+}
+
+// issueCertificate signs the PKCS#10 certificate request in the request body using the template it was requested for
+func issueCertificate(server *mattrax.Server, body enrollprovision.RequestBody, email string, deviceUUID string) (*x509.Certificate, error) {
+	// TODO: Support renewal requests which Windows sends as a CMC request signed by the previous certificate
+	if body.BinarySecurityToken.ValueType != valueTypePKCS10 {
+		return nil, errors.New("the certificate request type '" + body.BinarySecurityToken.ValueType + "' is not supported")
+	}
+
+	csrDer, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body.BinarySecurityToken.Value), ""))
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		return nil, err
+	} else if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	certificatesConfig := server.Certificates.Get()
+	template, err := requestedTemplate(csr, body, certificatesConfig.Templates, certificatesConfig.PolicyOID())
+	if err != nil {
+		return nil, err
+	}
+
+	// The variables and default subject are only taken from the authenticated user or device as the request's subject and context items are set by the client
+	variables, defaultSubject := certificates.TemplateVariables{UPN: email}, pki.UserSubject(email)
+	if template.IsMachine() && deviceUUID == "" {
+		return nil, errors.New("the certificate template '" + template.Name + "' can only be issued to devices authenticated by their certificate")
+	} else if deviceUUID != "" {
+		device, err := server.Devices.Get(deviceUUID)
+		if err != nil {
+			return nil, err
+		}
+		variables, defaultSubject = pki.DeviceTemplateVariables(device), device.IdentityCertificate.Subject
+	}
+
+	return pki.Issue(server, template, variables, csr, defaultSubject, deviceUUID)
+}
+
+// requestedTemplate returns the named template selected by the certificate request's template extension or the CertificateTemplate context item
+func requestedTemplate(csr *x509.CertificateRequest, body enrollprovision.RequestBody, templates map[string]certificates.Template, policyOID string) (certificates.Template, error) {
+	for _, extension := range csr.Extensions {
+		if !extension.Id.Equal(oidCertificateTemplate) {
+			continue
+		}
+
+		var templateExtension certificateTemplateExtension
+		if _, err := asn1.Unmarshal(extension.Value, &templateExtension); err != nil {
+			return certificates.Template{}, err
+		}
+
+		for _, template := range templates {
+			if template.OID(policyOID) == templateExtension.TemplateID.String() {
+				return template, nil
+			}
+		}
+	}
+
+	templateName := body.GetAdditionalContextItem("CertificateTemplate")
+	for _, template := range templates {
+		if strings.EqualFold(template.Name, templateName) {
+			return template, nil
+		}
+	}
+	return certificates.Template{}, errors.New("the certificate template '" + templateName + "' does not exist")
+}
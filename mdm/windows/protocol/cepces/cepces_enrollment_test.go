@@ -0,0 +1,83 @@
+package cepces
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"testing"
+
+	"github.com/matryer/is"
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	enrollprovision "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_provision"
+)
+
+func TestRequestedTemplate(t *testing.T) {
+	is := is.New(t)
+	policyOID := "2.25.1234"
+	templates := map[string]certificates.Template{
+		"user":     {Name: "user"},
+		"computer": {Name: "computer"},
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating key
+
+	templateOID, err := asn1.Marshal(certificateTemplateExtension{
+		TemplateID:   certificates.ParseOID(templates["computer"].OID(policyOID)),
+		MajorVersion: 1,
+	})
+	is.NoErr(err) // Error encoding template extension
+
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:         pkix.Name{CommonName: "computer"},
+		ExtraExtensions: []pkix.Extension{{Id: oidCertificateTemplate, Value: templateOID}},
+	}, privateKey)
+	is.NoErr(err)
+	csr, err := x509.ParseCertificateRequest(csrDer)
+	is.NoErr(err)
+
+	template, err := requestedTemplate(csr, enrollprovision.RequestBody{}, templates, policyOID)
+	is.NoErr(err)                       // Template from the extension should be found
+	is.Equal(template.Name, "computer") // Template should be selected by its OID
+
+	csr.Extensions = nil
+	template, err = requestedTemplate(csr, enrollprovision.RequestBody{
+		AdditionalContext: []enrollprovision.ContextItem{{Name: "CertificateTemplate", Value: "User"}},
+	}, templates, policyOID)
+	is.NoErr(err)                   // Template from the context item should be found
+	is.Equal(template.Name, "user") // Template should be selected by its name
+
+	_, err = requestedTemplate(csr, enrollprovision.RequestBody{}, templates, policyOID)
+	is.True(err != nil) // A request without a template must be rejected
+}
+
+func TestIssueCertificateSubject(t *testing.T) {
+	is := is.New(t)
+
+	server := mattrax.NewMockServer(t)
+	is.NoErr(server.Certificates.GenerateIdentity(pkix.Name{CommonName: "Mattrax Identity"}, certificates.ECDSAP256)) // Error generating identity
+	is.NoErr(server.Certificates.SetNamedTemplate(certificates.Template{Name: "user"}))                               // Error creating template
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating key
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "someone-else@example.com"},
+	}, privateKey)
+	is.NoErr(err)
+	body := enrollprovision.RequestBody{
+		BinarySecurityToken: enrollprovision.RequestBinarySecurityToken{ValueType: valueTypePKCS10, Value: base64.StdEncoding.EncodeToString(csrDer)},
+		AdditionalContext:   []enrollprovision.ContextItem{{Name: "CertificateTemplate", Value: "user"}},
+	}
+
+	certificate, err := issueCertificate(server, body, "oscar@example.com", "")
+	is.NoErr(err)                                                 // Error issuing certificate
+	is.Equal(certificate.Subject.CommonName, "oscar@example.com") // Subject should default to the authenticated user instead of the request's subject
+
+	_, err = issueCertificate(server, body, "", "")
+	is.True(err != nil) // A template without a subject pattern must be rejected without an authenticated identity
+}
@@ -0,0 +1,119 @@
+package cepces
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+
+	mattrax "github.com/mattrax/Mattrax/internal"
+	enrollpolicy "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_policy"
+	"github.com/mattrax/Mattrax/mdm/windows/soap"
+	"github.com/rs/zerolog/log"
+)
+
+// caReference is the cAReferenceID of the identity certificate in the policy response
+const caReference = 0
+
+// PolicyHandler handles the HTTP POST request for the certificate enrollment policy (MS-XCEP).
+// The handler responds with a policy for every template the client can enroll for. They reference the enrollment web service using the same authentication.
+func PolicyHandler(server *mattrax.Server, auth Authentication) http.HandlerFunc {
+	endpoint := soap.Endpoint{
+		Action:      "http://schemas.microsoft.com/windows/pki/2009/01/enrollmentpolicy/IPolicy/GetPolicies",
+		MaxBodySize: 5000,
+		ClockSkew:   server.Config.ClockSkew,
+		MessageIDs:  soap.NewMessageIDCache(soap.MessageIDCacheSize),
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cmd enrollpolicy.Request
+		header, ok := endpoint.ReadRequest(w, r, &cmd)
+		if !ok {
+			return
+		}
+
+		if _, _, err := authenticate(server, auth, r, header); err != nil {
+			log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Err(err).Msg("error: cep request: client request could not be authenticated")
+			endpoint.Release(header)
+			fault := soap.NewBasicFault("s:Sender", "s:Authentication", "client request could not be authenticated")
+			fault.Response(w)
+			return
+		}
+
+		certificates := server.Certificates.Get()
+		if certificates.Identity.Cert == nil {
+			endpoint.Release(header)
+			fault := soap.NewBasicFault("s:Receiver", "a:EndpointUnavailable", "the server is currently not ready to issue certificates")
+			fault.Response(w)
+			return
+		}
+		template := certificates.Template
+		policyOID := certificates.PolicyOID()
+
+		// The client's cached policies are still valid if no template has changed since it last updated
+		policiesNotChanged := false
+		if lastUpdate, ok := cmd.Body.LastUpdate(); ok && !template.UpdatedAt.After(lastUpdate) && !certificates.TemplatesUpdatedAt.After(lastUpdate) {
+			policiesNotChanged = true
+		}
+
+		// The templates are sorted by name so the OID references are stable between requests. Machine templates are only offered to authenticated devices.
+		templateNames := make([]string, 0, len(certificates.Templates))
+		for name, namedTemplate := range certificates.Templates {
+			if auth == Certificate || !namedTemplate.IsMachine() {
+				templateNames = append(templateNames, name)
+			}
+		}
+		sort.Strings(templateNames)
+
+		var policies []enrollpolicy.MdePolicy
+		oids := enrollpolicy.AlgorithmOIDs(template)
+		for i, name := range templateNames {
+			namedTemplate := certificates.Templates[name]
+			oidReference := enrollpolicy.FirstFreeOIDReference + i
+			oids = append(oids, enrollpolicy.MdeOID{
+				Value:          namedTemplate.OID(policyOID),
+				Group:          enrollpolicy.OIDGroupEnrollmentObject,
+				OIDReferenceID: oidReference,
+				DefaultName:    namedTemplate.Name,
+			})
+
+			if !policiesNotChanged && cmd.Body.IsPolicyRequested(namedTemplate.OID(policyOID)) {
+				policies = append(policies, enrollpolicy.NewPolicy(oidReference, namedTemplate.Name, namedTemplate, true, []int{caReference}))
+			}
+		}
+
+		soap.Respond(w, enrollpolicy.ResponseEnvelope{
+			NamespaceS: "http://www.w3.org/2003/05/soap-envelope",
+			NamespaceA: "http://www.w3.org/2005/08/addressing",
+			NamespaceU: "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd",
+			Header:     soap.NewHeaderRes("http://schemas.microsoft.com/windows/pki/2009/01/enrollmentpolicy/IPolicy/GetPoliciesResponse", header),
+			Body: enrollpolicy.ResponseBody{
+				NamespaceXSI: "http://www.w3.org/2001/XMLSchema-instance",
+				NamespaceXSD: "http://www.w3.org/2001/XMLSchema",
+				PoliciesResponse: enrollpolicy.Response{
+					PolicyID:           certificates.PolicyID,
+					PolicyFriendlyName: "Mattrax Certificate Enrollment",
+					NextUpdateHours:    12,
+					PoliciesNotChanged: policiesNotChanged,
+					Policies:           policies,
+					CAs: enrollpolicy.MdeCAs{
+						CAs: []enrollpolicy.MdeCA{
+							{
+								URIs: []enrollpolicy.MdeCAURI{
+									{
+										ClientAuthentication: int(auth),
+										URI:                  serviceURL(server, r, auth.enrollmentPath()),
+										Priority:             1,
+									},
+								},
+								Certificate:      base64.StdEncoding.EncodeToString(certificates.Identity.CertRaw),
+								EnrollPermission: true,
+								CAReferenceID:    caReference,
+							},
+						},
+					},
+					OIDs: oids,
+				},
+			},
+		})
+	}
+}
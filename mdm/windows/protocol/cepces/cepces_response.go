@@ -0,0 +1,27 @@
+package cepces
+
+import (
+	enrollprovision "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_provision"
+	"github.com/mattrax/Mattrax/mdm/windows/soap"
+	"github.com/mattrax/Mattrax/pkg/xml"
+)
+
+// ResponseBody contains the issued certificate and its chain
+// Reference: MS-WSTEP 3.1.4.1.1.2 RequestSecurityTokenResponseCollection
+type ResponseBody struct {
+	TokenType              string                              `xml:"RequestSecurityTokenResponse>TokenType"`
+	DispositionMessage     string                              `xml:"http://schemas.microsoft.com/windows/pki/2009/01/enrollment RequestSecurityTokenResponse>DispositionMessage"`
+	BinarySecurityToken    enrollprovision.BinarySecurityToken `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd RequestSecurityTokenResponse>BinarySecurityToken"`
+	RequestedSecurityToken enrollprovision.BinarySecurityToken `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd RequestSecurityTokenResponse>RequestedSecurityToken>BinarySecurityToken"`
+	RequestID              int                                 `xml:"http://schemas.microsoft.com/windows/pki/2009/01/enrollment RequestSecurityTokenResponse>RequestID"`
+}
+
+// ResponseEnvelope is the SOAP Envelope of the enrollment response
+type ResponseEnvelope struct {
+	XMLName    xml.Name       `xml:"s:Envelope"`
+	NamespaceS string         `xml:"xmlns:s,attr"`
+	NamespaceA string         `xml:"xmlns:a,attr"`
+	NamespaceU string         `xml:"xmlns:u,attr"`
+	Header     soap.HeaderRes `xml:"s:Header"`
+	Body       ResponseBody   `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 s:Body>RequestSecurityTokenResponseCollection"`
+}
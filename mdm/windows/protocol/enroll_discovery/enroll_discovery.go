@@ -3,14 +3,13 @@ package enrolldiscovery
 import (
 	"net/http"
 	"net/url"
-	"strconv"
-	"sync"
+	"strings"
 
 	mattrax "github.com/mattrax/Mattrax/internal"
-	"github.com/mattrax/Mattrax/internal/generic"
+	"github.com/mattrax/Mattrax/internal/enrollment"
 	"github.com/mattrax/Mattrax/internal/types"
+	enrollprovision "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_provision"
 	"github.com/mattrax/Mattrax/mdm/windows/soap"
-	"github.com/mattrax/Mattrax/pkg/xml"
 	"github.com/rs/zerolog/log"
 )
 
@@ -27,62 +26,32 @@ func GETHandler(server *mattrax.Server) http.HandlerFunc {
 // The handler parses the device details and responds with the location of the enrollment endpoints and the authentication policy required
 // It MUST be mounted at the path "/EnrollmentServer/Discovery.svc"
 func Handler(server *mattrax.Server) http.HandlerFunc {
-	const maxRequestBodySize = 5000
-
-	enrollmentPolicyServiceURL := (&url.URL{
-		Scheme: "https",
-		Host:   server.Config.Domain,
-		Path:   "/EnrollmentServer/Policy.svc",
-	}).String()
-
-	enrollmentServiceURL := (&url.URL{
-		Scheme: "https",
-		Host:   server.Config.Domain,
-		Path:   "/EnrollmentServer/Enrollment.svc",
-	}).String()
-
-	federationServiceURL := (&url.URL{
-		Scheme: "https",
-		Host:   server.Config.Domain,
-		Path:   "/EnrollmentServer/Authenticate",
-	}).String()
+	endpoint := soap.Endpoint{
+		Action:      "http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover",
+		MaxBodySize: 5000,
+		ClockSkew:   server.Config.ClockSkew,
+	}
 
-	var (
-		authPolicy = "Federated" // For now this is the only supported by Mattrax
-		once       sync.Once
-		response   []byte
-	)
+	authPolicy := "Federated" // For now this is the only supported by Mattrax
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.ContentLength > maxRequestBodySize {
-			fault := soap.NewBasicFault("s:Sender", "s:MessageFormat", "client request body too large to process")
-			fault.Response(w)
-			return
-		}
-
 		var cmd Request
-		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
-		if err := xml.NewDecoder(r.Body).Decode(&cmd); err != nil {
-			log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Err(err).Msg("error: discovery request: failed to parse client request body")
-			fault := soap.NewBasicFault("s:Sender", "s:MessageFormat", "client request body couldn't be parsed")
-			fault.Response(w)
-			return
-		}
-
-		if cmd.Header.Action != "http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover" {
-			fault := soap.NewBasicFault("s:Sender", "a:ActionMismatch", "client request body is invalid")
-			fault.Response(w)
+		header, ok := endpoint.ReadRequest(w, r, &cmd)
+		if !ok {
 			return
 		}
 
-		if url, err := url.ParseRequestURI(cmd.Header.To); err != nil || url.Scheme != "https" {
-			fault := soap.NewEnrollmentFault("s:Sender", "a:EndpointUnavailable", "invalid To address", "EnrollmentServer", "EnrollmentInternalServiceError", "")
+		if cmd.Body.EmailAddress == "" || !types.ValidEmail.MatchString(cmd.Body.EmailAddress) {
+			fault := soap.NewBasicFault("s:Sender", "s:MessageFormat", "client request body missing or invalid email address")
 			fault.Response(w)
 			return
 		}
 
-		if cmd.Body.EmailAddress == "" || !types.ValidEmail.MatchString(cmd.Body.EmailAddress) {
-			fault := soap.NewBasicFault("s:Sender", "s:MessageFormat", "client request body missing or invalid email address")
+		emailDomain := cmd.Body.EmailAddress[strings.LastIndex(cmd.Body.EmailAddress, "@")+1:]
+		publicDomain, ok := server.Config.PublicDomain(r.Host, emailDomain)
+		if !ok {
+			log.Debug().Str("remote-addr", r.RemoteAddr).Str("host", r.Host).Str("email-domain", emailDomain).Msg("rejected discovery request for an unknown domain")
+			fault := soap.NewEnrollmentFault("s:Sender", "a:EndpointUnavailable", "the domain "+emailDomain+" is not configured for enrollment", "NotSupported", "unknown enrollment domain", "")
 			fault.Response(w)
 			return
 		}
@@ -100,6 +69,18 @@ func Handler(server *mattrax.Server) http.HandlerFunc {
 			return
 		}
 
+		// Note: ApplicationVersion contains the version of Windows the device is running
+		if decision := server.Enrollment.Check(enrollment.Discovery, r.RemoteAddr, enrollment.Attempt{
+			EmailDomain: emailDomain,
+			OSEdition:   cmd.Body.OSEdition,
+			OSVersion:   cmd.Body.ApplicationVersion,
+			DeviceType:  cmd.Body.DeviceType,
+		}); !decision.Allowed {
+			fault := soap.NewEnrollmentFault("s:Sender", "a:InternalServiceFault", decision.Reason, decision.FaultType, "enrollment restricted", "")
+			fault.Response(w)
+			return
+		}
+
 		// Note: Intune disregards what the device supports and returns the AuthPolicy it desires
 		if !cmd.Body.AuthPolicies.IsAuthPolicySupported(authPolicy) {
 			fault := soap.NewEnrollmentFault("s:Sender", "a:InternalServiceFault", authPolicy+" auth policy is not supported by your device by required for enrollment", "DeviceNotSupported", "unsupported auth policy", "")
@@ -107,46 +88,21 @@ func Handler(server *mattrax.Server) http.HandlerFunc {
 			return
 		}
 
-		once.Do(func() {
-			res := Response{
-				NamespaceS: "http://www.w3.org/2003/05/soap-envelope",
-				NamespaceA: "http://www.w3.org/2005/08/addressing",
-				Header: soap.HeaderRes{
-					Action: soap.MustUnderstand{
-						MustUnderstand: "1",
-						Value:          "http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/DiscoverResponse",
-					},
-					ActivityID: generic.GenerateID(),
-					RelatesTo:  cmd.Header.MessageID,
-				},
-				Body: ResponseBody{
-					NamespaceXSI: "http://www.w3.org/2001/XMLSchema-instance",
-					NamespaceXSD: "http://www.w3.org/2001/XMLSchema",
-					DiscoverResponse: DiscoverResponse{
-						AuthPolicy:                 authPolicy,
-						EnrollmentVersion:          cmd.Body.RequestVersion,
-						EnrollmentPolicyServiceURL: enrollmentPolicyServiceURL,
-						EnrollmentServiceURL:       enrollmentServiceURL,
-						AuthenticationServiceURL:   federationServiceURL,
-					},
+		soap.Respond(w, Response{
+			NamespaceS: "http://www.w3.org/2003/05/soap-envelope",
+			NamespaceA: "http://www.w3.org/2005/08/addressing",
+			Header:     soap.NewHeaderRes("http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/DiscoverResponse", header),
+			Body: ResponseBody{
+				NamespaceXSI: "http://www.w3.org/2001/XMLSchema-instance",
+				NamespaceXSD: "http://www.w3.org/2001/XMLSchema",
+				DiscoverResponse: DiscoverResponse{
+					AuthPolicy:                 authPolicy,
+					EnrollmentVersion:          cmd.Body.RequestVersion,
+					EnrollmentPolicyServiceURL: (&url.URL{Scheme: "https", Host: publicDomain, Path: "/EnrollmentServer/Policy.svc"}).String(),
+					EnrollmentServiceURL:       (&url.URL{Scheme: "https", Host: publicDomain, Path: "/EnrollmentServer/Enrollment.svc", RawQuery: url.Values{enrollprovision.EmailDomainQuery: {strings.ToLower(emailDomain)}}.Encode()}).String(),
+					AuthenticationServiceURL:   (&url.URL{Scheme: "https", Host: publicDomain, Path: "/EnrollmentServer/Authenticate"}).String(),
 				},
-			}
-
-			// Marshal and send the response to client
-			var err error
-			response, err = xml.Marshal(res)
-			if err != nil {
-				fault := soap.NewBasicFault("s:Reciever", "a:InternalServiceFault", "mattrax error: failed to generate discovery response")
-				fault.Response(w)
-				return
-			}
+			},
 		})
-
-		w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
-		w.Header().Set("Content-Length", strconv.Itoa(len(response)))
-		_, err := w.Write(response)
-		if err != nil {
-			log.Error().Str("email", cmd.Body.EmailAddress).Str("device-type", cmd.Body.DeviceType).Err(err).Msg("error: failed to send discovery response body")
-		}
 	}
 }
@@ -9,6 +9,8 @@ import (
 
 	"github.com/matryer/is"
 	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/enrollment"
+	enrollprovision "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_provision"
 	"github.com/mattrax/Mattrax/mdm/windows/soap"
 	"github.com/mattrax/Mattrax/pkg/xml"
 )
@@ -174,3 +176,116 @@ func TestDiscoveryPOST_MismatchedAuthPolicies(t *testing.T) {
 	is.Equal(cmd.Subcode, "a:InternalServiceFault")
 	is.True(cmd.Reason.Text != "")
 }
+
+func TestDiscoveryPOST_UnknownDomain(t *testing.T) {
+	is := is.New(t)
+
+	body := []byte(`<s:Envelope xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover</a:Action><a:MessageID>urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478</a:MessageID><a:ReplyTo><a:Address>http://www.w3.org/2005/08/addressing/anonymous</a:Address></a:ReplyTo><a:To s:mustUnderstand="1">https://EnterpriseEnrollment.example.com:443/EnrollmentServer/Discovery.svc</a:To></s:Header><s:Body><Discover xmlns="http://schemas.microsoft.com/windows/management/2012/01/enrollment"><request xmlns:i="http://www.w3.org/2001/XMLSchema-instance"><EmailAddress>oscar@example.com</EmailAddress><RequestVersion>4.0</RequestVersion><DeviceType>CIMClient_Windows</DeviceType><ApplicationVersion>10.0.18362.0</ApplicationVersion><OSEdition>48</OSEdition><AuthPolicies><AuthPolicy>OnPremise</AuthPolicy><AuthPolicy>Federated</AuthPolicy></AuthPolicies></request></Discover></s:Body></s:Envelope>`)
+	req, err := http.NewRequest("POST", "https://EnterpriseEnrollment.example.com/EnrollmentServer/Discovery.svc", bytes.NewBuffer(body))
+	is.NoErr(err) // Error creating mock request
+
+	server := mattrax.NewMockServer(t)
+	server.Config.Domain = "mdm.otbeaumont.me"
+	server.Config.EnrollmentDomains = []string{"otbeaumont.me"}
+
+	res := httptest.NewRecorder()
+	Handler(server)(res, req)
+
+	is.Equal(res.Code, http.StatusBadRequest) // Request should response status BadRequest
+
+	var cmd soap.FaultEnvelop
+	err = xml.NewDecoder(res.Body).Decode(&cmd)
+	is.NoErr(err) // Error decoding response body
+
+	is.Equal(cmd.Value, "s:Sender")
+	is.Equal(cmd.Subcode, "a:EndpointUnavailable")
+}
+
+func TestDiscoveryPOST_UnknownDomainDirectHost(t *testing.T) {
+	is := is.New(t)
+
+	body := []byte(`<s:Envelope xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover</a:Action><a:MessageID>urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478</a:MessageID><a:ReplyTo><a:Address>http://www.w3.org/2005/08/addressing/anonymous</a:Address></a:ReplyTo><a:To s:mustUnderstand="1">https://mdm.otbeaumont.me:443/EnrollmentServer/Discovery.svc</a:To></s:Header><s:Body><Discover xmlns="http://schemas.microsoft.com/windows/management/2012/01/enrollment"><request xmlns:i="http://www.w3.org/2001/XMLSchema-instance"><EmailAddress>oscar@example.com</EmailAddress><RequestVersion>4.0</RequestVersion><DeviceType>CIMClient_Windows</DeviceType><ApplicationVersion>10.0.18362.0</ApplicationVersion><OSEdition>48</OSEdition><AuthPolicies><AuthPolicy>OnPremise</AuthPolicy><AuthPolicy>Federated</AuthPolicy></AuthPolicies></request></Discover></s:Body></s:Envelope>`)
+	req, err := http.NewRequest("POST", "https://mdm.otbeaumont.me/EnrollmentServer/Discovery.svc", bytes.NewBuffer(body))
+	is.NoErr(err) // Error creating mock request
+
+	server := mattrax.NewMockServer(t)
+	server.Config.Domain = "mdm.otbeaumont.me"
+	server.Config.EnrollmentDomains = []string{"otbeaumont.me"}
+
+	res := httptest.NewRecorder()
+	Handler(server)(res, req)
+
+	is.Equal(res.Code, http.StatusBadRequest) // Email domain should be checked when the request is sent to the server's domain
+
+	var cmd soap.FaultEnvelop
+	err = xml.NewDecoder(res.Body).Decode(&cmd)
+	is.NoErr(err) // Error decoding response body
+
+	is.Equal(cmd.Value, "s:Sender")
+	is.Equal(cmd.Subcode, "a:EndpointUnavailable")
+}
+
+// discoverThenProvision sends a discovery request for the email followed by a provision request with the EnrollmentType to the enrollment service URL from discovery.
+// It returns the fault the provision request was rejected with.
+func discoverThenProvision(t *testing.T, server *mattrax.Server, email string, enrollmentType string) soap.FaultEnvelop {
+	is := is.New(t)
+
+	body := []byte(`<s:Envelope xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover</a:Action><a:MessageID>urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478</a:MessageID><a:ReplyTo><a:Address>http://www.w3.org/2005/08/addressing/anonymous</a:Address></a:ReplyTo><a:To s:mustUnderstand="1">https://mdm.example.com:443/EnrollmentServer/Discovery.svc</a:To></s:Header><s:Body><Discover xmlns="http://schemas.microsoft.com/windows/management/2012/01/enrollment"><request xmlns:i="http://www.w3.org/2001/XMLSchema-instance"><EmailAddress>` + email + `</EmailAddress><RequestVersion>4.0</RequestVersion><DeviceType>CIMClient_Windows</DeviceType><ApplicationVersion>10.0.18362.0</ApplicationVersion><OSEdition>48</OSEdition><AuthPolicies><AuthPolicy>OnPremise</AuthPolicy><AuthPolicy>Federated</AuthPolicy></AuthPolicies></request></Discover></s:Body></s:Envelope>`)
+	req, err := http.NewRequest("POST", "https://mdm.example.com/EnrollmentServer/Discovery.svc", bytes.NewBuffer(body))
+	is.NoErr(err) // Error creating mock request
+
+	res := httptest.NewRecorder()
+	Handler(server)(res, req)
+	is.Equal(res.Code, http.StatusOK) // Discovery should be allowed as the rule depends on the enrollment type
+
+	var cmd Response
+	is.NoErr(xml.NewDecoder(res.Body).Decode(&cmd)) // Error decoding response body
+	enrollmentServiceURL := cmd.Body.DiscoverResponse.EnrollmentServiceURL
+
+	body = []byte(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:wsse="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd" xmlns:wst="http://docs.oasis-open.org/ws-sx/ws-trust/200512" xmlns:ac="http://schemas.xmlsoap.org/ws/2006/12/authorization"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/pki/2009/01/enrollment/RST/wstep</a:Action><a:MessageID>urn:uuid:0d5a1441-5891-453b-becf-a2e5f6ea3749</a:MessageID><a:ReplyTo><a:Address>http://www.w3.org/2005/08/addressing/anonymous</a:Address></a:ReplyTo><a:To s:mustUnderstand="1">` + enrollmentServiceURL + `</a:To><wsse:Security s:mustUnderstand="1"><wsse:BinarySecurityToken ValueType="http://schemas.microsoft.com/5.0.0.0/ConfigurationManager/Enrollment/DeviceEnrollmentUserToken" EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd#base64binary">TODOSpecialTokenWhichVerifiesAuth</wsse:BinarySecurityToken></wsse:Security></s:Header><s:Body><wst:RequestSecurityToken><wst:TokenType>http://schemas.microsoft.com/5.0.0.0/ConfigurationManager/Enrollment/DeviceEnrollmentToken</wst:TokenType><wst:RequestType>http://docs.oasis-open.org/ws-sx/ws-trust/200512/Issue</wst:RequestType><wsse:BinarySecurityToken ValueType="http://schemas.microsoft.com/windows/pki/2009/01/enrollment#PKCS10" EncodingType="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd#base64binary">bm90LWEtY3Ny</wsse:BinarySecurityToken><ac:AdditionalContext><ac:ContextItem Name="EnrollmentType"><ac:Value>` + enrollmentType + `</ac:Value></ac:ContextItem><ac:ContextItem Name="OSEdition"><ac:Value>48</ac:Value></ac:ContextItem></ac:AdditionalContext></wst:RequestSecurityToken></s:Body></s:Envelope>`)
+	req, err = http.NewRequest("POST", enrollmentServiceURL, bytes.NewBuffer(body))
+	is.NoErr(err) // Error creating mock request
+
+	res = httptest.NewRecorder()
+	enrollprovision.Handler(server)(res, req)
+
+	var fault soap.FaultEnvelop
+	is.NoErr(xml.NewDecoder(res.Body).Decode(&fault)) // Error decoding response body
+	return fault
+}
+
+func TestDiscoveryThenProvision_MixedRule(t *testing.T) {
+	is := is.New(t)
+
+	server := mattrax.NewMockServer(t)
+	is.NoErr(server.Enrollment.Set(enrollment.Restrictions{
+		Rules: []enrollment.Rule{
+			{Name: "contoso-full", Action: enrollment.Deny, EmailDomains: []string{"contoso.com"}, EnrollmentTypes: []string{"Full"}},
+		},
+	})) // Error saving restrictions
+
+	fault := discoverThenProvision(t, server, "oscar@contoso.com", "Full")
+	is.Equal(fault.Subcode, "a:InternalServiceFault")                                                     // Provision should be rejected by the restrictions
+	is.Equal(fault.Reason.Text, "enrollment of this device is blocked by the restriction 'contoso-full'") // The mixed rule should match using the email domain from discovery
+
+	fault = discoverThenProvision(t, server, "oscar@example.com", "Full")
+	is.Equal(fault.Subcode, "s:CertificateRequest") // Other email domains should not match the rule
+}
+
+func TestDiscoveryThenProvision_MixedRuleDefaultDeny(t *testing.T) {
+	is := is.New(t)
+
+	server := mattrax.NewMockServer(t)
+	is.NoErr(server.Enrollment.Set(enrollment.Restrictions{
+		Rules: []enrollment.Rule{
+			{Name: "contoso-full", Action: enrollment.Allow, EmailDomains: []string{"contoso.com"}, EnrollmentTypes: []string{"Full"}},
+		},
+		DefaultAction: enrollment.Deny,
+	})) // Error saving restrictions
+
+	fault := discoverThenProvision(t, server, "oscar@contoso.com", "Full")
+	is.Equal(fault.Subcode, "s:CertificateRequest") // Federated enrollments matching the allow rule should pass the restrictions
+
+	fault = discoverThenProvision(t, server, "oscar@contoso.com", "Device")
+	is.Equal(fault.Subcode, "a:InternalServiceFault") // Other enrollment types should take the default action
+}
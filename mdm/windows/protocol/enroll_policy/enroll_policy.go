@@ -1,159 +1,202 @@
 package enrollpolicy
 
 import (
-	"log"
 	"net/http"
 	"strconv"
 
 	mattrax "github.com/mattrax/Mattrax/internal"
-	"github.com/mattrax/Mattrax/internal/generic"
+	mattraxcertificates "github.com/mattrax/Mattrax/internal/certificates"
 	"github.com/mattrax/Mattrax/mdm/windows/soap"
-	"github.com/mattrax/Mattrax/pkg/xml"
-	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
 )
 
+// OID reference ids used to link the policy to the OIDs in the response
+const (
+	policyOIDReference             = 0
+	hashAlgorithmOIDReference      = 1
+	publicKeyAlgorithmOIDReference = 2
+)
+
+// FirstFreeOIDReference is the lowest OID reference id which isn't used by the OIDs from AlgorithmOIDs
+const FirstFreeOIDReference = 3
+
+// Key specs defined in MS-XCEP 3.1.4.1.3.20 PrivateKeyAttributes
+const (
+	keySpecKeyExchange = "1" // AT_KEYEXCHANGE allows the key to be used for signing and encryption
+	keySpecSignature   = "2" // AT_SIGNATURE only allows the key to be used for signing
+)
+
+// ecdsaCryptoProviders are the Windows key storage providers which can create ECDSA keys. The legacy CSPs only support RSA.
+var ecdsaCryptoProviders = []string{
+	"Microsoft Platform Crypto Provider",
+	"Microsoft Software Key Storage Provider",
+}
+
+// Handler handles the HTTP POST request for the enrollment policy.
+// The handler responds with the policy for the certificate the device should request during enrollment
+// It MUST be mounted at the path returned in the discovery response
 func Handler(server *mattrax.Server) http.HandlerFunc {
+	endpoint := soap.Endpoint{
+		Action:      "http://schemas.microsoft.com/windows/pki/2009/01/enrollmentpolicy/IPolicy/GetPolicies",
+		MaxBodySize: 5000,
+		ClockSkew:   server.Config.ClockSkew,
+		MessageIDs:  soap.NewMessageIDCache(soap.MessageIDCacheSize),
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Decode request from client
 		var cmd Request
-		if err := xml.NewDecoder(r.Body).Decode(&cmd); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusBadRequest) // TODO: Correct Spec way of doing this??
+		header, ok := endpoint.ReadRequest(w, r, &cmd)
+		if !ok {
 			return
 		}
 
-		// Verify request
 		if err := cmd.Verify(server.Config, server.UserService); err != nil {
-			log.Println(errors.Wrap(err, "invalid MdePoliciesRequest:"))
-			w.WriteHeader(http.StatusBadRequest) // TODO: Correct Spec way of doing this??
+			log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Err(err).Msg("error: policy request: client request failed verification")
+			endpoint.Release(header)
+			fault := soap.NewBasicFault("s:Sender", "s:Authentication", "client request could not be authenticated")
+			fault.Response(w)
 			return
 		}
 
-		// TODO: Use the Request Body to work out if changes have happened for PolciiesNotChanged. What is requestFilter???
-		// TODO: This response is hardcoded. Automatically generate from CertService + Settings
+		certificates := server.Certificates.Get()
+		template := certificates.Template
+		policyOID := certificates.PolicyOID()
+
+		// The client's cached policies are still valid if the template hasn't changed since it last updated
+		policiesNotChanged := false
+		if lastUpdate, ok := cmd.Body.LastUpdate(); ok && !template.UpdatedAt.After(lastUpdate) {
+			policiesNotChanged = true
+		}
+
+		var policies []MdePolicy
+		if !policiesNotChanged && cmd.Body.IsPolicyRequested(policyOID) {
+			policies = append(policies, NewPolicy(policyOIDReference, "Mattrax Device Identity", template, false, nil))
+		}
 
-		res := ResponseEnvelope{
+		soap.Respond(w, ResponseEnvelope{
 			NamespaceS: "http://www.w3.org/2003/05/soap-envelope",
 			NamespaceA: "http://www.w3.org/2005/08/addressing",
 			NamespaceU: "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd",
-			HeaderAction: soap.MustUnderstand{
-				MustUnderstand: "1",
-				Value:          "http://schemas.microsoft.com/windows/pki/2009/01/enrollmentpolicy/IPolicy/GetPoliciesResponse",
-			},
-			// HeaderActivityID: GenerateActivityID(),
-			HeaderRelatesTo: cmd.Header.MessageID,
+			Header:     soap.NewHeaderRes("http://schemas.microsoft.com/windows/pki/2009/01/enrollmentpolicy/IPolicy/GetPoliciesResponse", header),
 			Body: ResponseBody{
 				NamespaceXSI: "http://www.w3.org/2001/XMLSchema-instance",
 				NamespaceXSD: "http://www.w3.org/2001/XMLSchema",
 				PoliciesResponse: Response{
-					PolicyID:           generic.GenerateID(), // TODO: Does this have to stay constant????
-					PolicyFriendlyName: "Mattrax Identity",   // TODO: Does it show
-					NextUpdateHours:    12,                   // TODO: After 12 hours does it request this same endpoint like Apple?????????
-					PoliciesNotChanged: false,                // TODO: Track this. False means policies have changed since last updateHour
-					Policies: []MdePolicy{
-						MdePolicy{
-							OIDReference: 0,
-							CAs: MdeCACollection{
-								Nil: true,
-							},
-							Attributes: MdeAttributes{
-								CommonName:   "Mattrax Identity2", // TODO: Does it show
-								PolicySchema: 3,
-								CertificateValidity: MdeAttributesCertificateValidity{
-									// TODO: What is good for these values. Also how does renewal work??
-									ValidityPeriodSeconds: 1209600,
-									RenewalPeriodSeconds:  172800,
-								},
-								EnrollmentPermission: MdeEnrollmentPermission{
-									Enroll:     true,  // TODO: Try false as rejection
-									AutoEnroll: false, // TODO: See what is changes
-								},
-								PrivateKeyAttributes: MdePrivateKeyAttributes{
-									MinimalKeyLength: 2048, // TODO: Get from CertService
-									KeySpec: MdeKeySpec{
-										Nil: true,
-									},
-									KeyUsageProperty: MdeKeyUsageProperty{
-										Nil: true,
-									},
-									Permissions: MdePermissions{
-										Nil: true,
-									},
-									AlgorithmOIDReference: MdeAlgorithmOIDReference{
-										Nil: true,
-									},
-									CryptoProviders: MdeCryptoProviders{
-										Nil: true,
-									},
-								},
-								Revision: MdeRevision{
-									MajorRevision: 101, // TODO: Change and see what happens. Version control inside Mattrax???
-									MinorRevision: 0,   // TODO: Change and see what happens.
-								},
-								SupersededPolicies: MdeSupersededPolicies{
-									Nil: true,
-								},
-								PrivateKeyFlags: MdePrivateKeyFlags{
-									Nil: true,
-								},
-								SubjectNameFlags: MdeSubjectNameFlags{
-									Nil: true,
-								},
-								EnrollmentFlags: MdeEnrollmentFlags{
-									Nil: true,
-								},
-								GeneralFlags: MdeGeneralFlags{
-									Nil: true,
-								},
-								HashAlgorithmOIDReference: 0, // TODO: What dis do?
-								RARequirements: MdeRARequirements{
-									Nil: true,
-								},
-								KeyArchivalAttributes: MdeKeyArchivalAttributes{
-									Nil: true,
-								},
-								Extensions: MdeExtensions{
-									Nil: true,
-								},
-							},
+					PolicyID:           certificates.PolicyID,
+					PolicyFriendlyName: "Mattrax Identity", // TODO: Does it show
+					NextUpdateHours:    12,                 // TODO: After 12 hours does it request this same endpoint like Apple?????????
+					PoliciesNotChanged: policiesNotChanged,
+					Policies:           policies,
+					OIDs: append([]MdeOID{
+						MdeOID{
+							Value:          policyOID,
+							Group:          OIDGroupEnrollmentObject,
+							OIDReferenceID: policyOIDReference,
+							DefaultName:    "Mattrax Device Identity",
 						},
-					},
+					}, AlgorithmOIDs(template)...),
 				},
 			},
-		}
+		})
+	}
+}
 
-		// Marshal and send the response to client
-		if response, err := xml.Marshal(res); err != nil {
-			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			/* TEMP */
-			// response = []byte(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://www.w3.org/2005/08/addressing"><s:Body><s:Fault><s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value xmlns:a="http://schemas.microsoft.com/net/2005/12/windowscommunicationfoundation/dispatcher">a:InternalServiceFault</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en-US">InvalidMessage</s:Text></s:Reason><s:Detail><DeviceEnrollmentServiceError xmlns="http://schemas.microsoft.com/windows/pki/2009/01/enrollment"><ErrorType>EnrollmentServer</ErrorType><Message>EnrollmentInternalServiceError</Message><TraceId>efec7f6f-7d54-4430-b56c-aeb41685d601</TraceId></DeviceEnrollmentServiceError></s:Detail></s:Fault></s:Body></s:Envelope>`)
-			// w.WriteHeader(http.StatusInternalServerError)
-			// 			response = []byte(`<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://www.w3.org/2005/08/addressing">
-			// 	<s:Header>
-			// 		<a:Action s:mustunderstand="1">http://schemas.microsoft.com/windows/pki/2009/01/enrollmentpolicy/IPolicy/GetPoliciesResponse</a:Action>
-			// 		<ActivityID xmlns="http://schemas.microsoft.com/2004/09/servicemodel/diagnostics">` + generic.GenerateID() + `</ActivityID>
-			// 		<a:RelatesTo>` + cmd.Header.Action + `</a:RelatesTo>
-			// 	</s:Header>
-			// 	<s:Body>
-			// 		<s:Fault>
-			// 			<s:Code>
-			// 				<s:Value>s:receiver</s:value>
-			// 				<s:Subcode>
-			// 					<s:Value>s:Authorization</s:Value>
-			// 				</s:Subcode>
-			// 			</s:Code>
-			// 			<s:Reason>
-			// 				<s:Text xml:lang="en-US">This User is not authorized to enroll</s:text>
-			// 			</s:Reason>
-			// 		</s:Fault>
-			// 	</s:Body>
-			// </s:Envelope>`)
-			/* END TEMP */
-			w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
-			w.Header().Set("Content-Length", strconv.Itoa(len(response)))
-			w.Write(response)
+// NewPolicy creates the policy for certificates issued using the template. The policy must be returned with the OIDs from AlgorithmOIDs.
+// caReferences are the cAReferenceIDs of the CAs in the response which issue the policy. If there are none the client enrolls with the server which sent the policy.
+func NewPolicy(policyOIDReference int, commonName string, template mattraxcertificates.Template, autoEnroll bool, caReferences []int) MdePolicy {
+	// RSA keys are created by any provider. ECDSA keys can only sign and must be created by a key storage provider.
+	keySpec := keySpecKeyExchange
+	cryptoProviders := MdeCryptoProviders{
+		Nil: true,
+	}
+	if template.PublicKeyAlgorithm == mattraxcertificates.PublicKeyAlgorithmECDSA {
+		keySpec = keySpecSignature
+		cryptoProviders = MdeCryptoProviders{
+			Providers: ecdsaCryptoProviders,
 		}
 	}
+
+	return MdePolicy{
+		OIDReference: policyOIDReference,
+		CAs: MdeCACollection{
+			Nil:          len(caReferences) == 0,
+			CAReferences: caReferences,
+		},
+		Attributes: MdeAttributes{
+			CommonName:   commonName,
+			PolicySchema: 3,
+			CertificateValidity: MdeAttributesCertificateValidity{
+				ValidityPeriodSeconds: int(template.ValidityPeriod.Seconds()),
+				RenewalPeriodSeconds:  int(template.RenewalPeriod.Seconds()),
+			},
+			EnrollmentPermission: MdeEnrollmentPermission{
+				Enroll:     true, // TODO: Try false as rejection
+				AutoEnroll: autoEnroll,
+			},
+			PrivateKeyAttributes: MdePrivateKeyAttributes{
+				MinimalKeyLength: template.MinimalKeyLength,
+				KeySpec: MdeKeySpec{
+					Value: keySpec,
+				},
+				KeyUsageProperty: MdeKeyUsageProperty{
+					Nil: true,
+				},
+				Permissions: MdePermissions{
+					Nil: true,
+				},
+				AlgorithmOIDReference: MdeAlgorithmOIDReference{
+					Value: strconv.Itoa(publicKeyAlgorithmOIDReference),
+				},
+				CryptoProviders: cryptoProviders,
+			},
+			Revision: MdeRevision{
+				MajorRevision: template.Revision,
+				MinorRevision: 0,
+			},
+			SupersededPolicies: MdeSupersededPolicies{
+				Nil: true,
+			},
+			PrivateKeyFlags: MdePrivateKeyFlags{
+				Nil: true,
+			},
+			SubjectNameFlags: MdeSubjectNameFlags{
+				Nil: true,
+			},
+			EnrollmentFlags: MdeEnrollmentFlags{
+				Nil: true,
+			},
+			GeneralFlags: MdeGeneralFlags{
+				Nil: true,
+			},
+			HashAlgorithmOIDReference: hashAlgorithmOIDReference,
+			RARequirements: MdeRARequirements{
+				Nil: true,
+			},
+			KeyArchivalAttributes: MdeKeyArchivalAttributes{
+				Nil: true,
+			},
+			Extensions: MdeExtensions{
+				Nil: true,
+			},
+		},
+	}
+}
+
+// AlgorithmOIDs returns the hash and public key algorithm OIDs referenced by policies created by NewPolicy
+func AlgorithmOIDs(template mattraxcertificates.Template) []MdeOID {
+	publicKeyAlgorithmOID, publicKeyAlgorithmName := template.PublicKeyAlgorithmOID()
+	return []MdeOID{
+		MdeOID{
+			Value:          template.HashAlgorithmOID,
+			Group:          OIDGroupHashAlgorithm,
+			OIDReferenceID: hashAlgorithmOIDReference,
+			DefaultName:    template.HashAlgorithmName(),
+		},
+		MdeOID{
+			Value:          publicKeyAlgorithmOID,
+			Group:          OIDGroupPublicKeyAlgorithm,
+			OIDReferenceID: publicKeyAlgorithmOIDReference,
+			DefaultName:    publicKeyAlgorithmName,
+		},
+	}
 }
@@ -1,6 +1,8 @@
 package enrollpolicy
 
 import (
+	"time"
+
 	"github.com/mattrax/Mattrax/pkg/xml"
 
 	mattrax "github.com/mattrax/Mattrax/internal"
@@ -11,6 +13,54 @@ import (
 type Request struct {
 	XMLName xml.Name    `xml:"s:Envelope"`
 	Header  soap.Header `xml:"s:Header"`
+	Body    RequestBody `xml:"s:Body>GetPolicies"`
+}
+
+// RequestBody contains the body of the SOAP Envelope
+// Reference: MS-XCEP 3.1.4.1.1.1 GetPoliciesRequest
+type RequestBody struct {
+	Client        RequestClient `xml:"client"`
+	RequestFilter RequestFilter `xml:"requestFilter"`
+}
+
+// RequestClient contains details about the policies the client has cached
+// Reference: MS-XCEP 3.1.4.1.3.2 Client
+type RequestClient struct {
+	LastUpdate        string `xml:"lastUpdate"` // The time the client last received policies. It is empty if nil.
+	PreferredLanguage string `xml:"preferredLanguage"`
+}
+
+// RequestFilter is used by the client to restrict the policies returned
+// Reference: MS-XCEP 3.1.4.1.3.23 RequestFilter
+type RequestFilter struct {
+	PolicyOIDs []string `xml:"policyOIDs>oid"`
+}
+
+// LastUpdate returns the time the client last received policies. The bool is false if the client has never received them.
+func (cmd RequestBody) LastUpdate() (time.Time, bool) {
+	if cmd.Client.LastUpdate == "" {
+		return time.Time{}, false
+	}
+
+	lastUpdate, err := time.Parse(time.RFC3339Nano, cmd.Client.LastUpdate)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return lastUpdate, true
+}
+
+// IsPolicyRequested checks if the policy is allowed by the requestFilter. If the client didn't filter policies all are requested.
+func (cmd RequestBody) IsPolicyRequested(policyOID string) bool {
+	if len(cmd.RequestFilter.PolicyOIDs) == 0 {
+		return true
+	}
+
+	for _, oid := range cmd.RequestFilter.PolicyOIDs {
+		if oid == policyOID {
+			return true
+		}
+	}
+	return false
 }
 
 func (cmd Request) Verify(config mattrax.Config, userService types.UserService) error {
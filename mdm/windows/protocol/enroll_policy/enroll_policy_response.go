@@ -5,13 +5,43 @@ import (
 	"github.com/mattrax/Mattrax/pkg/xml"
 )
 
+// MdeCA contains a CA which issues certificates for policies in the response
+// Reference: MS-XCEP 3.1.4.1.3.1 CA
 type MdeCA struct {
-	// TODO: file:///Users/oscar.beaumont/Downloads/[MS-XCEP].pdf#page=22&zoom=100,92,322
+	XMLName          xml.Name   `xml:"cA"`
+	URIs             []MdeCAURI `xml:"uris>cAURI"`
+	Certificate      string     `xml:"certificate"` // The base64 encoded DER certificate of the CA
+	EnrollPermission bool       `xml:"enrollPermission"`
+	CAReferenceID    int        `xml:"cAReferenceID"` // Unique id used to reference the CA from a policy
 }
 
+// MdeCAs contains the CAs which issue certificates for the policies in the response
+type MdeCAs struct {
+	CAs []MdeCA `xml:"cA"`
+}
+
+// MdeCAURI contains the URL of an enrollment web service for a CA and how the client authenticates to it
+// Reference: MS-XCEP 3.1.4.1.3.3 CAURI
+type MdeCAURI struct {
+	ClientAuthentication int    `xml:"clientAuthentication"`
+	URI                  string `xml:"uri"`
+	Priority             int    `xml:"priority"`
+	RenewalOnly          bool   `xml:"renewalOnly"`
+}
+
+// Client authentication types defined in MS-XCEP 3.1.4.1.3.3 CAURI
+const (
+	ClientAuthenticationAnonymous        = 1
+	ClientAuthenticationKerberos         = 2
+	ClientAuthenticationUsernamePassword = 4
+	ClientAuthenticationCertificate      = 8
+)
+
+// MdeCACollection references the CAs in the response which issue certificates for the policy
+// Reference: MS-XCEP 3.1.4.1.3.2 CACollection
 type MdeCACollection struct {
-	Nil   bool    `xml:"xsi:nil,attr"`
-	Value []MdeCA `xml:",innerxml"`
+	Nil          bool  `xml:"xsi:nil,attr,omitempty"`
+	CAReferences []int `xml:"cAReference"`
 }
 
 // MdeAttributesCertificateValidity contains information about the expected validity of an issued certificate
@@ -29,9 +59,11 @@ type MdeEnrollmentPermission struct {
 	AutoEnroll bool `xml:"autoEnroll"`
 }
 
+// MdeKeySpec is the type of key the device must create. It is AT_KEYEXCHANGE (1) or AT_SIGNATURE (2).
+// Reference: MS-XCEP 3.1.4.1.3.20 PrivateKeyAttributes
 type MdeKeySpec struct {
-	Nil bool `xml:"xsi:nil,attr"`
-	// TODO
+	Nil   bool   `xml:"xsi:nil,attr,omitempty"`
+	Value string `xml:",chardata"`
 }
 
 type MdeKeyUsageProperty struct {
@@ -44,21 +76,25 @@ type MdePermissions struct {
 	// TODO
 }
 
+// MdeAlgorithmOIDReference references the OID of the public key algorithm the device's key must use
+// Reference: MS-XCEP 3.1.4.1.3.20 PrivateKeyAttributes
 type MdeAlgorithmOIDReference struct {
-	Nil bool `xml:"xsi:nil,attr"`
-	// TODO
+	Nil   bool   `xml:"xsi:nil,attr,omitempty"`
+	Value string `xml:",chardata"`
 }
 
+// MdeCryptoProviders is the list of cryptographic providers the device can create its key with
+// Reference: MS-XCEP 3.1.4.1.3.6 CryptoProviders
 type MdeCryptoProviders struct {
-	Nil bool `xml:"xsi:nil,attr"`
-	// TODO
+	Nil       bool     `xml:"xsi:nil,attr,omitempty"`
+	Providers []string `xml:"provider"`
 }
 
 // MdePrivateKeyAttributes contains the attributes for the private key that will be associated with any certificate request
 // Reference 3.1.4.1.3.20 PrivateKeyAttributes
 type MdePrivateKeyAttributes struct {
 	// MinimalKeyLength must be a positive nonzero number
-	MinimalKeyLength      int
+	MinimalKeyLength      int                      `xml:"minimalKeyLength"`
 	KeySpec               MdeKeySpec               `xml:"keySpec"`
 	KeyUsageProperty      MdeKeyUsageProperty      `xml:"keyUsageProperty"`
 	Permissions           MdePermissions           `xml:"permissions"`
@@ -134,6 +170,23 @@ type MdeAttributes struct {
 	Extensions                MdeExtensions                    `xml:"extensions"`
 }
 
+// MdeOID contains an object identifier referenced by the policies in the response
+// Reference: MS-XCEP 3.1.4.1.3.18 OID
+type MdeOID struct {
+	XMLName        xml.Name `xml:"oID"`
+	Value          string   `xml:"value"`
+	Group          int      `xml:"group"`
+	OIDReferenceID int      `xml:"oIDReferenceID"` // Unique id used to reference the OID from a policy
+	DefaultName    string   `xml:"defaultName"`
+}
+
+// OID groups defined in MS-XCEP 3.1.4.1.3.18 OID
+const (
+	OIDGroupHashAlgorithm      = 1
+	OIDGroupPublicKeyAlgorithm = 3
+	OIDGroupEnrollmentObject   = 9
+)
+
 type MdePolicy struct {
 	XMLName      xml.Name        `xml:"policy"`
 	OIDReference int             `xml:"policyOIDReference"` // Unique policy "id"
@@ -146,10 +199,9 @@ type Response struct {
 	PolicyFriendlyName string      `xml:"xcep:response>policyFriendlyName"`
 	NextUpdateHours    int         `xml:"xcep:response>nextUpdateHours,omitempty"`
 	PoliciesNotChanged bool        `xml:"xcep:response>policiesNotChanged,omitempty"`
-	Policies           []MdePolicy `xml:"xcep:response>policies"`
-	// TODO: Verify CAS + OIDS types are correct here
-	CAS  string `xml:"xcep:cAs"`
-	OIDS string `xml:"xcep:oIDs"`
+	Policies           []MdePolicy `xml:"xcep:response>policies>policy"`
+	CAs                MdeCAs      `xml:"xcep:cAs"`
+	OIDs               []MdeOID    `xml:"xcep:oIDs>oID"`
 }
 
 type ResponseBody struct {
@@ -164,8 +216,6 @@ type ResponseEnvelope struct {
 	NamespaceA string   `xml:"xmlns:a,attr"`
 	NamespaceU string   `xml:"xmlns:u,attr"`
 
-	HeaderAction soap.MustUnderstand `xml:"s:Header>a:Action"`
-	// HeaderActivityID string                `xml:"s:Header>a:ActivityID"` // TODO: Should this be included as the docs don't show it
-	HeaderRelatesTo string       `xml:"s:Header>a:RelatesTo"`
-	Body            ResponseBody `xml:"s:Body"`
+	Header soap.HeaderRes `xml:"s:Header"`
+	Body   ResponseBody   `xml:"s:Body"`
 }
@@ -2,14 +2,15 @@ package enrollprovision
 
 import (
 	"encoding/base64"
-	"fmt"
 	"net/http"
 	"net/url"
-	"strconv"
+	"strings"
 	"time"
 
 	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/certificates"
 	"github.com/mattrax/Mattrax/internal/devices"
+	"github.com/mattrax/Mattrax/internal/enrollment"
 	"github.com/mattrax/Mattrax/internal/generic"
 	"github.com/mattrax/Mattrax/internal/types"
 	"github.com/mattrax/Mattrax/mdm/windows/soap"
@@ -17,22 +18,21 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func Handler(server *mattrax.Server) http.HandlerFunc {
-	const maxRequestBodySize = 5000
+// EmailDomainQuery is the query parameter of the enrollment service URL which contains the email domain the device sent to discovery
+const EmailDomainQuery = "email-domain"
 
-	managementServerURL := (&url.URL{
-		Scheme: "https",
-		Host:   server.Config.Domain,
-		Path:   "/ManagementServer/Manage.svc",
-	}).String()
+// Handler handles the HTTP POST request for enrollment.
+// The handler signs the devices certificate request and responds with the provisioning profile for the device
+// It MUST be mounted at the path returned in the discovery response
+func Handler(server *mattrax.Server) http.HandlerFunc {
+	endpoint := soap.Endpoint{
+		Action:      "http://schemas.microsoft.com/windows/pki/2009/01/enrollment/RST/wstep",
+		MaxBodySize: 10000,
+		ClockSkew:   server.Config.ClockSkew,
+		MessageIDs:  soap.NewMessageIDCache(soap.MessageIDCacheSize),
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		if r.ContentLength > maxRequestBodySize {
-			fault := soap.NewBasicFault("s:Sender", "s:MessageFormat", "client request body too large to process")
-			fault.Response(w)
-			return
-		}
-
 		// TODO: On Policy endpoint instead if possibleEn
 		if server.Settings.Get().Tenant.EnrollmentDisabled {
 			// TODO: Advanced Fault
@@ -42,27 +42,22 @@ func Handler(server *mattrax.Server) http.HandlerFunc {
 		}
 
 		var cmd Request
-		r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
-		if err := xml.NewDecoder(r.Body).Decode(&cmd); err != nil {
-			log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Err(err).Msg("error: provision request: failed to parse client request body")
-			fault := soap.NewBasicFault("s:Sender", "s:MessageFormat", "client request body couldn't be parsed")
-			fault.Response(w)
+		header, ok := endpoint.ReadRequest(w, r, &cmd)
+		if !ok {
 			return
 		}
 
-		if cmd.Header.Action != "http://schemas.microsoft.com/windows/pki/2009/01/enrollment/RST/wstep" {
-			fault := soap.NewBasicFault("s:Sender", "a:ActionMismatch", "client request body is invalid")
-			fault.Response(w)
-			return
+		publicDomain, ok := server.Config.HostPublicDomain(r.Host)
+		if !ok {
+			publicDomain = server.Config.Domain
 		}
+		managementServerURL := (&url.URL{
+			Scheme: "https",
+			Host:   publicDomain,
+			Path:   "/ManagementServer/Manage.svc",
+		}).String()
 
-		if url, err := url.ParseRequestURI(cmd.Header.To); err != nil || url.Scheme != "https" {
-			fault := soap.NewEnrollmentFault("s:Sender", "a:EndpointUnavailable", "invalid To address", "EnrollmentServer", "EnrollmentInternalServiceError", "")
-			fault.Response(w)
-			return
-		}
-
-		fmt.Println(cmd.Header.WSSESecurity.BinarySecurityToken) // TODO: Verify (check valid Microsoft or Mattrax token)
+		// TODO: Verify the BinarySecurityToken (check valid Microsoft or Mattrax token)
 
 		// FINISH CHECKING INPUT: Verify CSR exists
 		// Required EnrollmentType and possibly DeviceID
@@ -77,14 +72,42 @@ func Handler(server *mattrax.Server) http.HandlerFunc {
 		// Check if device exists. Get users other devices.
 		// AAD isManaged true
 
+		// On premise authentication sends the user's login which is verified before it is used for the restrictions
+		var enrolledBy types.User
+		if username := header.WSSESecurity.Username; username != "" {
+			loggedIn, err := server.UserService.VerifyLogin(username, header.WSSESecurity.Password)
+			if err != nil || !loggedIn {
+				log.Debug().Str("remote-addr", r.RemoteAddr).Str("username", username).Err(err).Msg("error: provision request: failed to authenticate user")
+				endpoint.Release(header)
+				fault := soap.NewBasicFault("s:Sender", "s:Authentication", "client request could not be authenticated")
+				fault.Response(w)
+				return
+			}
+			enrolledBy.Email = username
+		}
+
+		// Federated enrollments don't send the user's email so the email domain checked at discovery is added to the enrollment service URL.
+		// It is reported by the device like the email address in the discovery request.
+		attemptEmailDomain := strings.ToLower(r.URL.Query().Get(EmailDomainQuery))
+		if enrolledBy.Email != "" {
+			attemptEmailDomain = emailDomain(enrolledBy.Email)
+		}
+		if attemptEmailDomain != "" {
+			if _, ok := server.Config.PublicDomain(r.Host, attemptEmailDomain); !ok {
+				log.Debug().Str("remote-addr", r.RemoteAddr).Str("email-domain", attemptEmailDomain).Msg("error: provision request: the user's domain is not configured for enrollment")
+				endpoint.Release(header)
+				fault := soap.NewEnrollmentFault("s:Sender", "a:EndpointUnavailable", "the domain "+attemptEmailDomain+" is not configured for enrollment", "NotSupported", "unknown enrollment domain", "")
+				fault.Response(w)
+				return
+			}
+		}
+
 		device := devices.Device{
 			UUID:        generic.GenerateID(),
 			DisplayName: cmd.Body.GetAdditionalContextItem("DeviceName"),
 			Protocol:    devices.WindowsMDM,
 			EnrolledAt:  time.Now(),
-			EnrolledBy:  types.User{
-				// TODO: UUID
-			},
+			EnrolledBy:  enrolledBy,
 			Hardware: devices.DeviceHardware{
 				ID:  cmd.Body.GetAdditionalContextItem("HWDevID"),
 				MAC: cmd.Body.GetAdditionalContextItems("MAC"),
@@ -99,51 +122,78 @@ func Handler(server *mattrax.Server) http.HandlerFunc {
 			},
 		}
 
+		// Rules depending on the email domain don't match if the device didn't use the enrollment service URL from discovery
+		if decision := server.Enrollment.Check(enrollment.Provision, r.RemoteAddr, enrollment.Attempt{
+			EmailDomain:    attemptEmailDomain,
+			OSEdition:      device.Windows.OSEdition,
+			OSVersion:      device.Windows.OSVersion,
+			DeviceType:     device.Windows.DeviceType,
+			EnrollmentType: device.Windows.EnrollmentType,
+			HardwareID:     device.Hardware.ID,
+		}); !decision.Allowed {
+			endpoint.Release(header)
+			fault := soap.NewEnrollmentFault("s:Sender", "a:InternalServiceFault", decision.Reason, decision.FaultType, "enrollment restricted", "")
+			fault.Response(w)
+			return
+		}
+
+		// Pre-registered hardware is named and assigned automatically
+		if hardware, ok := server.Enrollment.LookupHardware(device.Hardware.ID); ok {
+			if deviceName := hardware.GenerateDeviceName(); deviceName != "" {
+				device.DisplayName = deviceName
+			}
+			device.AssignedUser = hardware.User
+			if hardware.Group != "" {
+				device.Groups = []string{hardware.Group}
+			}
+			device.Hardware.SerialNumber = hardware.SerialNumber
+		}
+
 		faultLogger := log.With().Str("device-uuid", device.UUID).Str("device-display-name", device.DisplayName).Str("win-device-id", device.Windows.DeviceID).Logger()
 
 		// defer func() {
 		// 	// server.DeviceService
 		// }()
 
-		identityCertificate := server.Certificates.Get().Identity
+		trustedIdentities := server.Certificates.Get().TrustedIdentities()
 
-		clientCertificateDer, err := SignClientCertificate(server, device, cmd.Body.BinarySecurityToken.Value, identityCertificate)
+		clientCertificateDer, err := SignClientCertificate(server, &device, cmd.Body.BinarySecurityToken.Value)
 		if err != nil {
-			// TODO
+			faultLogger.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Err(err).Msg("error: provision request: failed to sign client certificate request")
+			endpoint.Release(header)
+			fault := soap.NewEnrollmentFault("s:Receiver", "s:CertificateRequest", "the certificate request could not be signed", "EnrollmentServer", "EnrollmentInternalServiceError", "")
+			fault.Response(w)
 			return
 		}
 
-		fmt.Println(device)
+		// The provisioning profile installs the trusted identities
+		device.Windows.TrustedCertificates = certificates.TrustChainHashes(trustedIdentities)
 
-		provisioningProfile := GenerateProvisioningProfile(server, managementServerURL, identityCertificate, device, clientCertificateDer)
+		if err := server.Devices.EditOrCreate(device); err != nil {
+			faultLogger.Error().Err(err).Msg("error: provision request: failed to save device")
+			fault := soap.NewBasicFault("s:Receiver", "a:InternalServiceFault", "mattrax error: failed to save device")
+			fault.Response(w)
+			return
+		}
+
+		provisioningProfile := GenerateProvisioningProfile(server, managementServerURL, trustedIdentities, device, clientCertificateDer)
 
 		provisioningProfileXML, err := xml.Marshal(provisioningProfile)
 		if err != nil {
-			log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Err(err).Msg("error: discovery request: failed to parse client request body")
-			fault := soap.NewBasicFault("s:Reciever", "a:InternalServiceFault", "mattrax error: failed to generate provisioning profile")
+			faultLogger.Error().Err(err).Msg("error: provision request: failed to marshal provisioning profile")
+			fault := soap.NewBasicFault("s:Receiver", "a:InternalServiceFault", "mattrax error: failed to generate provisioning profile")
 			fault.Response(w)
 			return
 		}
 
-		res := ResponseEnvelope{
+		responseHeader := soap.NewHeaderRes("http://schemas.microsoft.com/windows/pki/2009/01/enrollment/RSTRC/wstep", header)
+		responseHeader.Security = soap.NewHeaderSecurity()
+
+		soap.Respond(w, ResponseEnvelope{
 			NamespaceS: "http://www.w3.org/2003/05/soap-envelope",
 			NamespaceA: "http://www.w3.org/2005/08/addressing",
 			NamespaceU: "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd",
-			HeaderAction: soap.MustUnderstand{
-				MustUnderstand: "1",
-				Value:          "http://schemas.microsoft.com/windows/pki/2009/01/enrollment/RSTRC/wstep",
-			},
-			HeaderRelatesTo: cmd.Header.MessageID,
-			HeaderSecurity: HeaderSecurity{
-				NamespaceO:     "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd",
-				MustUnderstand: "1",
-				Timestamp: HeaderSecurityTimestamp{
-					// TODO: all these values do what??
-					ID:      "_0",
-					Created: "2018-11-30T00:32:59.420Z",
-					Expires: "2018-12-30T00:37:59.420Z",
-				},
-			},
+			Header:     responseHeader,
 			Body: ResponseBody{
 				TokenType:          "http://schemas.microsoft.com/5.0.0.0/ConfigurationManager/Enrollment/DeviceEnrollmentToken",
 				DispositionMessage: "", // TODO: Wrong type + What does it do?
@@ -154,21 +204,14 @@ func Handler(server *mattrax.Server) http.HandlerFunc {
 				},
 				RequestID: 0,
 			},
-		}
-
-		// Marshal and send the response to client
-		response, err := xml.Marshal(res)
-		if err != nil {
-			fault := soap.NewBasicFault("s:Reciever", "a:InternalServiceFault", "mattrax error: failed to generate provision response")
-			fault.Response(w)
-			return
-		}
+		})
+	}
+}
 
-		w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
-		w.Header().Set("Content-Length", strconv.Itoa(len(response)))
-		_, err = w.Write(response)
-		if err != nil {
-			faultLogger.Error().Err(err).Msg("error: failed to send provision response body")
-		}
+// emailDomain returns the domain of the email address or an empty string if it doesn't have one
+func emailDomain(email string) string {
+	if i := strings.LastIndex(email, "@"); i != -1 {
+		return strings.ToLower(email[i+1:])
 	}
+	return ""
 }
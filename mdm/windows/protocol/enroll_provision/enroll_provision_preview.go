@@ -0,0 +1,58 @@
+package enrollprovision
+
+import (
+	"net/http"
+	"net/url"
+
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/devices"
+	"github.com/mattrax/Mattrax/pkg/xml"
+	"github.com/rs/zerolog/log"
+)
+
+// PreviewHandler renders the provisioning profile a device would receive if it enrolled now.
+// The device is loaded using the "device" query parameter. Otherwise an example device is created from the "device_name" and "enrollment_type" query parameters.
+// The device's client certificate is left empty because one is only issued during enrollment.
+func PreviewHandler(server *mattrax.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		device := devices.Device{
+			DisplayName: query.Get("device_name"),
+			Protocol:    devices.WindowsMDM,
+			Windows: devices.WindowsDevice{
+				EnrollmentType: query.Get("enrollment_type"),
+			},
+		}
+
+		if uuid := query.Get("device"); uuid != "" {
+			var err error
+			if device, err = server.Devices.Get(uuid); err != nil {
+				http.Error(w, "the device '"+uuid+"' could not be found", http.StatusNotFound)
+				return
+			}
+		}
+
+		publicDomain, ok := server.Config.HostPublicDomain(r.Host)
+		if !ok {
+			publicDomain = server.Config.Domain
+		}
+		managementServerURL := (&url.URL{
+			Scheme: "https",
+			Host:   publicDomain,
+			Path:   "/ManagementServer/Manage.svc",
+		}).String()
+
+		provisioningProfile := GenerateProvisioningProfile(server, managementServerURL, server.Certificates.Get().TrustedIdentities(), device, nil)
+
+		provisioningProfileXML, err := xml.MarshalIndent(provisioningProfile, "", "  ")
+		if err != nil {
+			log.Error().Err(err).Msg("error: provisioning preview: failed to marshal provisioning profile")
+			http.Error(w, "failed to generate provisioning profile", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.Write(provisioningProfileXML)
+	}
+}
@@ -0,0 +1,55 @@
+package enrollprovision
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/settings"
+)
+
+func TestPreviewHandler(t *testing.T) {
+	is := is.New(t)
+
+	server := mattrax.NewMockServer(t)
+	pollOnLogin, connectionRetryFrequency, numberOfFirstRetries := false, 0, 0
+	initialBackoffTime, maxBackoffTime := time.Duration(0), time.Hour
+	is.NoErr(server.Settings.Set(settings.Settings{
+		Tenant: settings.TenantSettings{
+			Name: "Acme",
+		},
+		Provisioning: settings.ProvisioningSettings{
+			Poll: settings.PollSettings{
+				IntervalForRemainingScheduledRetries: 480,
+				NumberOfFirstRetries:                 &numberOfFirstRetries,
+				PollOnLogin:                          &pollOnLogin,
+			},
+			ConnectionRetryFrequency: &connectionRetryFrequency,
+			InitialBackoffTime:       &initialBackoffTime,
+			MaxBackoffTime:           &maxBackoffTime,
+		},
+	})) // Error saving settings
+
+	req, err := http.NewRequest("GET", "/api/windows/provisioning-profile/preview?device_name=LAB-0001&enrollment_type=Device", nil)
+	is.NoErr(err) // Error creating mock request
+
+	res := httptest.NewRecorder()
+	PreviewHandler(server)(res, req)
+
+	is.Equal(res.Code, http.StatusOK) // Request should response status OK
+	body := res.Body.String()
+	is.True(strings.Contains(body, `<parm name="IntervalForRemainingScheduledRetries" value="480" datatype="integer"></parm>`))   // Poll schedule should come from the settings
+	is.True(strings.Contains(body, `<parm name="MAXBACKOFFTIME" value="3600000"></parm>`))                                        // Backoff should come from the settings
+	is.True(strings.Contains(body, `<parm name="CONNRETRYFREQ" value="0"></parm>`))                                               // Zero should replace the default
+	is.True(strings.Contains(body, `<parm name="NumberOfFirstRetries" value="0" datatype="integer"></parm>`))                     // Zero retries should replace the default
+	is.True(strings.Contains(body, `<parm name="INITIALBACKOFFTIME" value="0"></parm>`))                                          // Zero backoff should replace the default
+	is.True(strings.Contains(body, `<parm name="PollOnLogin" value="false" datatype="boolean"></parm>`))                          // False should replace the default
+	is.True(strings.Contains(body, `<parm name="NumberOfDaysAfterLostContactToUnenroll" value="730" datatype="integer"></parm>`)) // Unset values should use the defaults
+	is.True(strings.Contains(body, "Your device is now being managed by &#39;Acme&#39;"))                                         // Tenant name should be filled into the body text
+	is.True(strings.Contains(body, `<parm name="EntDeviceName" value="LAB-0001" datatype="string"></parm>`))
+	is.True(!strings.Contains(body, "HelpWebsite")) // No help website is sent if the tenant doesn't have one
+}
@@ -5,18 +5,6 @@ import (
 	"github.com/mattrax/Mattrax/pkg/xml"
 )
 
-type HeaderSecurityTimestamp struct {
-	ID      string `xml:"u:Id,attr"`
-	Created string `xml:"u:Created"`
-	Expires string `xml:"u:Expires"`
-}
-
-type HeaderSecurity struct {
-	NamespaceO     string                  `xml:"xmlns:o,attr"`
-	MustUnderstand string                  `xml:"s:mustUnderstand,attr"`
-	Timestamp      HeaderSecurityTimestamp `xml:"u:Timestamp"`
-}
-
 type BinarySecurityToken struct {
 	ValueType    string `xml:"ValueType,attr"`
 	EncodingType string `xml:"EncodingType,attr"`
@@ -31,14 +19,10 @@ type ResponseBody struct {
 }
 
 type ResponseEnvelope struct {
-	XMLName    xml.Name `xml:"s:Envelope"`
-	NamespaceS string   `xml:"xmlns:s,attr"`
-	NamespaceA string   `xml:"xmlns:a,attr"`
-	NamespaceU string   `xml:"xmlns:u,attr"`
-	// Header     soap.HeaderRes `xml:"s:Header"`
-	HeaderAction soap.MustUnderstand `xml:"s:Header>a:Action"`
-	// HeaderActivityID string                   `xml:"s:Header>a:ActivityID"` // TODO: Is this needed
-	HeaderRelatesTo string         `xml:"s:Header>a:RelatesTo"`
-	HeaderSecurity  HeaderSecurity `xml:"s:Header>o:Security"`
-	Body            ResponseBody   `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 s:Body>RequestSecurityTokenResponseCollection"`
+	XMLName    xml.Name       `xml:"s:Envelope"`
+	NamespaceS string         `xml:"xmlns:s,attr"`
+	NamespaceA string         `xml:"xmlns:a,attr"`
+	NamespaceU string         `xml:"xmlns:u,attr"`
+	Header     soap.HeaderRes `xml:"s:Header"`
+	Body       ResponseBody   `xml:"http://docs.oasis-open.org/ws-sx/ws-trust/200512 s:Body>RequestSecurityTokenResponseCollection"`
 }
@@ -1,20 +1,29 @@
 package enrollprovision
 
 import (
+	"crypto/sha1"
+	"crypto/x509"
 	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	mattrax "github.com/mattrax/Mattrax/internal"
 	"github.com/mattrax/Mattrax/internal/certificates"
 	"github.com/mattrax/Mattrax/internal/devices"
 )
 
-func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL string, identityCertificate certificates.Identity, device devices.Device, clientCertificateDer []byte) WapProvisioningDoc {
+// GenerateProvisioningProfile creates the provisioning profile for an enrolling device.
+// Every trusted identity is installed so the device continues to trust the server during an identity rollover.
+func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL string, trustedIdentities []certificates.Identity, device devices.Device, clientCertificateDer []byte) WapProvisioningDoc {
 	certStore := "User"
 	if device.Windows.EnrollmentType == "Device" { // TODO: Possibly error no EnrollmentType??
 		certStore = "System"
 	}
 
 	serverSettings := server.Settings.Get()
+	provisioning := serverSettings.Provisioning
 
 	DMCLientProviderParameters := []WapParameter{}
 
@@ -40,11 +49,30 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 			Value:    serverSettings.Tenant.SupportWebsite,
 			DataType: "string",
 		})
-	} else {
-		DMCLientProviderParameters = append(DMCLientProviderParameters, WapParameter{
-			Name:     "HelpWebsite",
-			Value:    "https://mattrax.otbeaumont.me",
-			DataType: "string",
+	}
+
+	roots, intermediates := certificates.TrustChain(trustedIdentities)
+	certificateStores := []WapCharacteristic{
+		WapCharacteristic{
+			Type: "Root",
+			Characteristics: []WapCharacteristic{
+				WapCharacteristic{
+					Type:            "System",
+					Characteristics: encodedCertificates(roots),
+				},
+			},
+		},
+	}
+	if len(intermediates) != 0 {
+		// Identities issued by an offline root are installed as intermediate certificates
+		certificateStores = append(certificateStores, WapCharacteristic{
+			Type: "CA",
+			Characteristics: []WapCharacteristic{
+				WapCharacteristic{
+					Type:            "System",
+					Characteristics: encodedCertificates(intermediates),
+				},
+			},
 		})
 	}
 
@@ -54,26 +82,7 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 			WapCharacteristic{
 				// Spec: https://docs.microsoft.com/en-us/windows/client-management/mdm/certificatestore-csp
 				Type: "CertificateStore",
-				Characteristics: []WapCharacteristic{
-					WapCharacteristic{
-						Type: "Root",
-						Characteristics: []WapCharacteristic{
-							WapCharacteristic{
-								Type: "System",
-								Characteristics: []WapCharacteristic{
-									WapCharacteristic{
-										Type: identityCertificate.CertHash,
-										Params: []WapParameter{
-											WapParameter{
-												Name:  "EncodedCertificate",
-												Value: base64.StdEncoding.EncodeToString(identityCertificate.CertRaw), // TODO: Can CertRaw be removed by using .Cert.Raw ???
-											},
-										},
-									},
-								},
-							},
-						},
-					},
+				Characteristics: append(certificateStores,
 					WapCharacteristic{
 						Type: "My",
 						Characteristics: []WapCharacteristic{
@@ -97,7 +106,7 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 							},
 						},
 					},
-				},
+				),
 			},
 			WapCharacteristic{
 				// Spec: https://docs.microsoft.com/en-us/windows/client-management/mdm/w7-application-csp
@@ -125,7 +134,7 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 					},
 					WapParameter{
 						Name:  "CONNRETRYFREQ",
-						Value: "3",
+						Value: strconv.Itoa(intValue(provisioning.ConnectionRetryFrequency)),
 					},
 					WapParameter{
 						Name:  "DEFAULTENCODING",
@@ -133,11 +142,11 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 					},
 					WapParameter{
 						Name:  "INITIALBACKOFFTIME",
-						Value: "16000", // Note: In milliseconds
+						Value: strconv.FormatInt(durationValue(provisioning.InitialBackoffTime).Milliseconds(), 10), // Note: In milliseconds
 					},
 					WapParameter{
 						Name:  "MAXBACKOFFTIME",
-						Value: "86400000", // Note: In milliseconds
+						Value: strconv.FormatInt(durationValue(provisioning.MaxBackoffTime).Milliseconds(), 10), // Note: In milliseconds
 					},
 					WapParameter{
 						Name:  "PROTOVER",
@@ -145,7 +154,7 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 					},
 					WapParameter{
 						Name:  "ROLE",
-						Value: "4294967295", // TODO
+						Value: strconv.FormatUint(uint64(uint32Value(provisioning.Role)), 10),
 					},
 					// WapParameter{
 					// 	Name:  "SSLCLIENTCERTSEARCHCRITERIA",
@@ -214,7 +223,7 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 								Params: append([]WapParameter{
 									WapParameter{
 										Name:     "EntDeviceName",
-										Value:    "Demo Persons Device", // TODO: Device Name from Context
+										Value:    device.DisplayName,
 										DataType: "string",
 									},
 									WapParameter{
@@ -254,7 +263,7 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 									// },
 									WapParameter{
 										Name:     "NumberOfDaysAfterLostContactToUnenroll",
-										Value:    "730", // 2 years
+										Value:    strconv.Itoa(provisioning.NumberOfDaysAfterLostContactToUnenroll),
 										DataType: "integer",
 									},
 									// Note Mattrax currently doesn't support: ExchangeID, PublisherDeviceID, CommercialID
@@ -265,42 +274,42 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 										Params: []WapParameter{
 											WapParameter{
 												Name:     "IntervalForFirstSetOfRetries",
-												Value:    "15",
+												Value:    strconv.Itoa(provisioning.Poll.IntervalForFirstSetOfRetries),
 												DataType: "integer",
 											},
 											WapParameter{
 												Name:     "NumberOfFirstRetries",
-												Value:    "5",
+												Value:    strconv.Itoa(intValue(provisioning.Poll.NumberOfFirstRetries)),
 												DataType: "integer",
 											},
 											WapParameter{
 												Name:     "IntervalForSecondSetOfRetries",
-												Value:    "60",
+												Value:    strconv.Itoa(provisioning.Poll.IntervalForSecondSetOfRetries),
 												DataType: "integer",
 											},
 											WapParameter{
 												Name:     "NumberOfSecondRetries",
-												Value:    "10",
+												Value:    strconv.Itoa(intValue(provisioning.Poll.NumberOfSecondRetries)),
 												DataType: "integer",
 											},
 											WapParameter{
 												Name:     "IntervalForRemainingScheduledRetries",
-												Value:    "1440",
+												Value:    strconv.Itoa(provisioning.Poll.IntervalForRemainingScheduledRetries),
 												DataType: "integer",
 											},
 											WapParameter{
 												Name:     "NumberOfRemainingScheduledRetries",
-												Value:    "0",
+												Value:    strconv.Itoa(intValue(provisioning.Poll.NumberOfRemainingScheduledRetries)),
 												DataType: "integer",
 											},
 											WapParameter{
 												Name:     "PollOnLogin",
-												Value:    "true",
+												Value:    strconv.FormatBool(provisioning.Poll.PollOnLogin != nil && *provisioning.Poll.PollOnLogin),
 												DataType: "boolean",
 											},
 											WapParameter{
 												Name:     "AllUsersPollOnFirstLogin",
-												Value:    "true",
+												Value:    strconv.FormatBool(provisioning.Poll.AllUsersPollOnFirstLogin != nil && *provisioning.Poll.AllUsersPollOnFirstLogin),
 												DataType: "boolean",
 											},
 										},
@@ -310,12 +319,12 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 										Params: []WapParameter{
 											WapParameter{
 												Name:     "Title",
-												Value:    "Enrollment Complete",
+												Value:    provisioning.EnrollmentCompleteTitle,
 												DataType: "string",
 											},
 											WapParameter{
 												Name:     "BodyText",
-												Value:    "Your device is now being managed by '" + serverSettings.Tenant.Name + "'. Please contact your IT administrators for support if you have any problems.",
+												Value:    strings.ReplaceAll(provisioning.EnrollmentCompleteBodyText, "%TENANT_NAME%", serverSettings.Tenant.Name),
 												DataType: "string",
 											},
 										},
@@ -340,3 +349,44 @@ func GenerateProvisioningProfile(server *mattrax.Server, managementServerURL str
 		},
 	}
 }
+
+// encodedCertificates creates the CertificateStore CSP nodes which install the certificates
+func encodedCertificates(certs []*x509.Certificate) []WapCharacteristic {
+	characteristics := []WapCharacteristic{}
+	for _, cert := range certs {
+		characteristics = append(characteristics, WapCharacteristic{
+			Type: strings.ToUpper(fmt.Sprintf("%x", sha1.Sum(cert.Raw))),
+			Params: []WapParameter{
+				WapParameter{
+					Name:  "EncodedCertificate",
+					Value: base64.StdEncoding.EncodeToString(cert.Raw),
+				},
+			},
+		})
+	}
+	return characteristics
+}
+
+// intValue returns the value of an optional setting or 0 if it isn't set
+func intValue(value *int) int {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
+
+// uint32Value returns the value of an optional setting or 0 if it isn't set
+func uint32Value(value *uint32) uint32 {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
+
+// durationValue returns the value of an optional setting or 0 if it isn't set
+func durationValue(value *time.Duration) time.Duration {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
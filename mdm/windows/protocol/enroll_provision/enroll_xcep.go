@@ -1,12 +1,11 @@
 package enrollprovision
 
 import (
-	"crypto/rand"
 	"crypto/sha1"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"fmt"
-	"math/big"
 	mathrand "math/rand"
 	"strings"
 	"time"
@@ -14,17 +13,18 @@ import (
 	mattrax "github.com/mattrax/Mattrax/internal"
 	"github.com/mattrax/Mattrax/internal/certificates"
 	"github.com/mattrax/Mattrax/internal/devices"
+	"github.com/mattrax/Mattrax/pki"
 )
 
 // SignClientCertificate uses the Mattrax Identity CA to sign the CSR contained inside the Binary Security Token
 // It also updates the device object to contain details about the certificate.
-func SignClientCertificate(server *mattrax.Server, device devices.Device, binarySecurityToken string, identityCertificate certificates.Identity) ([]byte, error) {
-	device.IdentityCertificate.NotBefore = time.Now().Add(time.Duration(mathrand.Int31n(120)) * -time.Minute) // This randomises the creation time a bit for added security (Recommended by x509 certificate signing not the MDM spec)
-	device.IdentityCertificate.NotAfter = device.IdentityCertificate.NotBefore.Add(365 * 24 * time.Hour)
+func SignClientCertificate(server *mattrax.Server, device *devices.Device, binarySecurityToken string) ([]byte, error) {
+	template := server.Certificates.Get().Template
+	var defaultSubject pkix.Name
 	if device.Windows.EnrollmentType == "Device" {
-		device.IdentityCertificate.Subject.CommonName = device.Windows.DeviceID
+		defaultSubject.CommonName = device.Windows.DeviceID
 	} else {
-		device.IdentityCertificate.Subject.CommonName = device.EnrolledBy.Email
+		defaultSubject.CommonName = device.EnrolledBy.Email
 	}
 
 	certificateSigningRequestDer, err := base64.StdEncoding.DecodeString(binarySecurityToken)
@@ -39,29 +39,30 @@ func SignClientCertificate(server *mattrax.Server, device devices.Device, binary
 		return nil, err
 	}
 
-	clientCertificate := &x509.Certificate{
-		// TODO: Verify against other device certs
-		Signature:          certificateSigningRequest.Signature,
-		SignatureAlgorithm: certificateSigningRequest.SignatureAlgorithm,
-		PublicKeyAlgorithm: certificateSigningRequest.PublicKeyAlgorithm,
-		PublicKey:          certificateSigningRequest.PublicKey,
-		SerialNumber:       big.NewInt(2), // TODO: ??? Increasing ???
-		Issuer:             identityCertificate.Cert.Issuer,
-		Subject:            device.IdentityCertificate.Subject,
-		NotBefore:          device.IdentityCertificate.NotBefore,
-		NotAfter:           device.IdentityCertificate.NotAfter,
-		KeyUsage:           x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	if err := template.VerifyPublicKey(certificateSigningRequest.PublicKey); err != nil {
+		return nil, err
+	}
+
+	variables := pki.DeviceTemplateVariables(*device)
+	variables.RequestCommonName = certificateSigningRequest.Subject.CommonName
+	certificate, err := template.Certificate(variables, certificateSigningRequest, defaultSubject)
+	if err != nil {
+		return nil, err
 	}
+	certificate.NotBefore = time.Now().Add(time.Duration(mathrand.Int31n(120)) * -time.Minute) // This randomises the creation time a bit for added security (Recommended by x509 certificate signing not the MDM spec)
+	certificate.NotAfter = certificate.NotBefore.Add(template.ValidityPeriod)
 
-	clientCertificateDer, err := x509.CreateCertificate(rand.Reader, clientCertificate, identityCertificate.Cert, certificateSigningRequest.PublicKey, identityCertificate.Key)
+	// The signature algorithm is chosen by the identity's key type. The request's algorithm is not used because the device key type may differ.
+	clientCertificate, err := server.Certificates.Issue(certificate, certificateSigningRequest.PublicKey, device.UUID)
 	if err != nil {
 		return nil, err
 	}
 
-	h := sha1.New()
-	h.Write(clientCertificateDer)
-	device.IdentityCertificate.Hash = strings.ToUpper(fmt.Sprintf("%x", h.Sum(nil))) // TODO: Cleanup -> This line is probally messer than it needs to be
+	device.IdentityCertificate.Subject = clientCertificate.Subject
+	device.IdentityCertificate.NotBefore = clientCertificate.NotBefore
+	device.IdentityCertificate.NotAfter = clientCertificate.NotAfter
+	device.IdentityCertificate.SerialNumber = certificates.FormatSerialNumber(clientCertificate.SerialNumber)
+	device.IdentityCertificate.Hash = strings.ToUpper(fmt.Sprintf("%x", sha1.Sum(clientCertificate.Raw)))
 
-	return clientCertificateDer, nil
+	return clientCertificate.Raw, nil
 }
@@ -1,19 +1,196 @@
 package mdmmanage
 
 import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net/http"
-	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/mattrax/Mattrax/internal/devices"
+	"github.com/mattrax/Mattrax/internal/middleware"
+	"github.com/mattrax/Mattrax/pkg/xml"
+	"github.com/rs/zerolog/log"
+)
+
+// maxBodySize is the largest management message which will be accepted
+const maxBodySize = 100 * 1024
+
+// The CertificateStore CSP nodes the trusted identities are installed in. Spec: https://docs.microsoft.com/en-us/windows/client-management/mdm/certificatestore-csp
+const (
+	rootStoreURI         = "./Vendor/MSFT/CertificateStore/Root/System"
+	intermediateStoreURI = "./Vendor/MSFT/CertificateStore/CA/System"
 )
 
-func Handler() http.HandlerFunc {
+// Handler handles the HTTP POST request for the device management session (MS-MDM). The device is authenticated by its client certificate.
+// Each session installs the certificates of the trusted identities which are missing from the device so it trusts the next identity before a rollover cuts over.
+func Handler(server *mattrax.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// TODO: Make work
+		// TODO: Issue additional device certificates (eg. for Wi-Fi or VPN) with the ClientCertificateInstall CSP (./Device/Vendor/MSFT/ClientCertificateInstall/SCEP/{UniqueID}/Install) using the ServerURL and Challenge from pki.SCEPServer and server.Certificates.SCEPChallenge
+
+		issuedCertificate, ok := middleware.GetDeviceCertificate(r)
+		if !ok {
+			http.Error(w, "the request was not authenticated with a device certificate", http.StatusUnauthorized)
+			return
+		}
+
+		device, err := server.Devices.Get(issuedCertificate.DeviceUUID)
+		if err != nil {
+			log.Debug().Str("device-uuid", issuedCertificate.DeviceUUID).Err(err).Msg("error: manage request: failed to load device")
+			http.Error(w, "the device is not enrolled", http.StatusForbidden)
+			return
+		} else if device.Status != devices.StatusActive {
+			http.Error(w, "the device is no longer managed", http.StatusForbidden)
+			return
+		}
+
+		var cmd SyncML
+		if err := xml.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&cmd); err != nil {
+			log.Debug().Str("device-uuid", device.UUID).Err(err).Msg("error: manage request: failed to decode message")
+			http.Error(w, "the management message is invalid", http.StatusBadRequest)
+			return
+		}
 
-		requestDump, err := httputil.DumpRequest(r, true)
+		roots, intermediates := certificates.TrustChain(server.Certificates.Get().TrustedIdentities())
+		response, installed := Respond(cmd, roots, intermediates)
+		if installed != nil && !equalHashes(installed, device.Windows.TrustedCertificates) {
+			device.Windows.TrustedCertificates = installed
+			if err := server.Devices.EditOrCreate(device); err != nil {
+				log.Error().Str("device-uuid", device.UUID).Err(err).Msg("error: manage request: failed to save device's trusted certificates")
+			}
+		}
+
+		body, err := xml.Marshal(response)
 		if err != nil {
-			fmt.Println(err)
+			log.Error().Err(err).Msg("error: manage request: failed to marshal response")
+			http.Error(w, "mattrax error: failed to generate response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.syncml.dm+xml")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if _, err := w.Write(body); err != nil {
+			log.Error().Err(err).Msg("error: manage request: failed to send response body")
+		}
+	}
+}
+
+// Respond creates the response to a message of the management session.
+// At the start of a session the certificate stores are requested from the device. When the device returns them the missing certificates are added.
+// installed contains the hashes of the certificates the device reported it has installed or is nil if the message doesn't contain them.
+func Respond(cmd SyncML, roots []*x509.Certificate, intermediates []*x509.Certificate) (response SyncML, installed []string) {
+	response = SyncML{
+		Namespace: "SYNCML:SYNCML1.2",
+		Header: SyncHdr{
+			VerDTD:    "1.2",
+			VerProto:  "DM/1.2",
+			SessionID: cmd.Header.SessionID,
+			MsgID:     cmd.Header.MsgID,
+			Target:    cmd.Header.Source,
+			Source:    cmd.Header.Target,
+		},
+		Body: SyncBody{
+			Final: &struct{}{},
+		},
+	}
+
+	cmdID := 0
+	nextCmdID := func() string {
+		cmdID++
+		return strconv.Itoa(cmdID)
+	}
+
+	// Every command from the device except a Status is acknowledged
+	response.Body.Status = append(response.Body.Status, Status{CmdID: nextCmdID(), MsgRef: cmd.Header.MsgID, CmdRef: "0", Cmd: "SyncHdr", Data: "200"})
+	for _, commands := range []struct {
+		name     string
+		commands []Command
+	}{{"Alert", cmd.Body.Alert}, {"Replace", cmd.Body.Replace}, {"Results", cmd.Body.Results}} {
+		for _, command := range commands.commands {
+			response.Body.Status = append(response.Body.Status, Status{CmdID: nextCmdID(), MsgRef: cmd.Header.MsgID, CmdRef: command.CmdID, Cmd: commands.name, Data: "200"})
+		}
+	}
+
+	if !repliesToGet(cmd) {
+		// The stores are only requested at the start of a session so the session ends once the certificates are added
+		if len(cmd.Body.Alert) != 0 {
+			response.Body.Get = append(response.Body.Get, Command{
+				CmdID: nextCmdID(),
+				Items: []Item{{Target: &LocURI{rootStoreURI}}, {Target: &LocURI{intermediateStoreURI}}},
+			})
+		}
+		return response, nil
+	}
+
+	// The stores are interior nodes so their results contain the hashes of the installed certificates separated by a slash
+	installed = []string{}
+	installedSet := map[string]bool{}
+	for _, results := range cmd.Body.Results {
+		for _, item := range results.Items {
+			if item.Source == nil || (item.Source.LocURI != rootStoreURI && item.Source.LocURI != intermediateStoreURI) || item.Data == "" {
+				continue
+			}
+
+			for _, hash := range strings.Split(item.Data, "/") {
+				hash = strings.ToUpper(hash)
+				if !installedSet[hash] {
+					installedSet[hash] = true
+					installed = append(installed, hash)
+				}
+			}
+		}
+	}
+	sort.Strings(installed)
+
+	for _, store := range []struct {
+		uri          string
+		certificates []*x509.Certificate
+	}{{rootStoreURI, roots}, {intermediateStoreURI, intermediates}} {
+		for _, certificate := range store.certificates {
+			hash := fmt.Sprintf("%X", sha1.Sum(certificate.Raw))
+			if installedSet[hash] {
+				continue
+			}
+
+			response.Body.Add = append(response.Body.Add, Command{
+				CmdID: nextCmdID(),
+				Items: []Item{{
+					Target: &LocURI{store.uri + "/" + hash + "/EncodedCertificate"},
+					Meta:   &Meta{Format: Format{Namespace: "syncml:metinf", Value: "b64"}},
+					Data:   base64.StdEncoding.EncodeToString(certificate.Raw),
+				}},
+			})
+		}
+	}
+
+	return response, installed
+}
+
+// repliesToGet checks if the message contains the device's reply to the request for the certificate stores
+func repliesToGet(cmd SyncML) bool {
+	for _, status := range cmd.Body.Status {
+		if status.Cmd == "Get" {
+			return true
+		}
+	}
+	return false
+}
+
+// equalHashes checks if the sorted lists of hashes are equal
+func equalHashes(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
-		fmt.Println(string(requestDump))
 	}
+	return true
 }
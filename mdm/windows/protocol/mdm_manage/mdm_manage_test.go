@@ -0,0 +1,71 @@
+package mdmmanage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestRespond(t *testing.T) {
+	is := is.New(t)
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // Error generating key
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Identity"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certificateDer, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	is.NoErr(err) // Error creating certificate
+	root, err := x509.ParseCertificate(certificateDer)
+	is.NoErr(err) // Error parsing certificate
+	rootHash := fmt.Sprintf("%X", sha1.Sum(root.Raw))
+
+	session := SyncML{
+		Header: SyncHdr{SessionID: "1", MsgID: "1"},
+		Body:   SyncBody{Alert: []Command{{CmdID: "1", Data: "1201"}}},
+	}
+	response, installed := Respond(session, []*x509.Certificate{root}, nil)
+	is.Equal(installed, nil)                                                    // The start of a session doesn't report the installed certificates
+	is.Equal(len(response.Body.Status), 2)                                      // The header and alert should be acknowledged
+	is.Equal(response.Body.Status[1].CmdRef, "1")                               // The alert should be acknowledged
+	is.Equal(len(response.Body.Get), 1)                                         // The certificate stores should be requested
+	is.Equal(response.Body.Get[0].Items[0].Target.LocURI, rootStoreURI)         // The root store should be requested
+	is.Equal(response.Body.Get[0].Items[1].Target.LocURI, intermediateStoreURI) // The intermediate store should be requested
+	is.Equal(len(response.Body.Add), 0)                                         // Certificates shouldn't be added before the stores are known
+
+	results := SyncML{
+		Header: SyncHdr{SessionID: "1", MsgID: "2"},
+		Body: SyncBody{
+			Status:  []Status{{CmdID: "1", MsgRef: "1", CmdRef: "3", Cmd: "Get", Data: "200"}},
+			Results: []Command{{CmdID: "2", Items: []Item{{Source: &LocURI{rootStoreURI}, Data: "0123ABCD"}}}},
+		},
+	}
+	response, installed = Respond(results, []*x509.Certificate{root}, nil)
+	is.Equal(installed, []string{"0123ABCD"})                                                              // The installed certificates should be reported
+	is.Equal(len(response.Body.Get), 0)                                                                    // The stores should only be requested once
+	is.Equal(len(response.Body.Add), 1)                                                                    // The missing root should be added
+	is.Equal(response.Body.Add[0].Items[0].Target.LocURI, rootStoreURI+"/"+rootHash+"/EncodedCertificate") // The root should be added to the root store
+
+	results.Body.Results[0].Items[0].Data = "0123ABCD/" + strings.ToLower(rootHash)
+	response, installed = Respond(results, []*x509.Certificate{root}, nil)
+	expected := []string{"0123ABCD", rootHash}
+	sort.Strings(expected)
+	is.Equal(installed, expected)       // Hashes should be reported sorted and in uppercase
+	is.Equal(len(response.Body.Add), 0) // Installed certificates shouldn't be added again
+}
@@ -0,0 +1,74 @@
+package mdmmanage
+
+import "github.com/mattrax/Mattrax/pkg/xml"
+
+// SyncML is a message of an OMA-DM management session (MS-MDM)
+type SyncML struct {
+	XMLName   xml.Name `xml:"SyncML"`
+	Namespace string   `xml:"xmlns,attr,omitempty"`
+	Header    SyncHdr  `xml:"SyncHdr"`
+	Body      SyncBody `xml:"SyncBody"`
+}
+
+// SyncHdr identifies the session and message
+type SyncHdr struct {
+	VerDTD    string `xml:"VerDTD"`
+	VerProto  string `xml:"VerProto"`
+	SessionID string `xml:"SessionID"`
+	MsgID     string `xml:"MsgID"`
+	Target    LocURI `xml:"Target"`
+	Source    LocURI `xml:"Source"`
+}
+
+// LocURI is the location of a device, server or CSP node
+type LocURI struct {
+	LocURI string `xml:"LocURI"`
+}
+
+// SyncBody contains the commands of a message. Statuses are marshalled before the commands as required by OMA-DM.
+type SyncBody struct {
+	Status  []Status  `xml:"Status"`
+	Alert   []Command `xml:"Alert"`
+	Replace []Command `xml:"Replace"`
+	Results []Command `xml:"Results"`
+	Get     []Command `xml:"Get"`
+	Add     []Command `xml:"Add"`
+	Final   *struct{} `xml:"Final"`
+}
+
+// Command is an OMA-DM command. Data contains the alert code of an Alert.
+type Command struct {
+	CmdID  string `xml:"CmdID"`
+	MsgRef string `xml:"MsgRef,omitempty"`
+	CmdRef string `xml:"CmdRef,omitempty"`
+	Data   string `xml:"Data,omitempty"`
+	Items  []Item `xml:"Item"`
+}
+
+// Item is a CSP node a command acts on
+type Item struct {
+	Source *LocURI `xml:"Source,omitempty"`
+	Target *LocURI `xml:"Target,omitempty"`
+	Meta   *Meta   `xml:"Meta,omitempty"`
+	Data   string  `xml:"Data,omitempty"`
+}
+
+// Meta describes the format of an item's data
+type Meta struct {
+	Format Format `xml:"Format"`
+}
+
+// Format is the format of an item's data (eg. b64 or node)
+type Format struct {
+	Namespace string `xml:"xmlns,attr"`
+	Value     string `xml:",chardata"`
+}
+
+// Status is the result of a command sent in the previous message
+type Status struct {
+	CmdID  string `xml:"CmdID"`
+	MsgRef string `xml:"MsgRef"`
+	CmdRef string `xml:"CmdRef"`
+	Cmd    string `xml:"Cmd"`
+	Data   string `xml:"Data"`
+}
@@ -10,7 +10,7 @@ func AzureTOSHandler() http.HandlerFunc {
 		authHeader := r.Header.Get("Authorization") // AzureAD JWT
 		// fmt.Println(authHeader)
 		if authHeader == "" {
-			fmt.Fprintf(w, `<html>
+			fmt.Fprint(w, `<html>
 		<head>
 			<title>MDM Concent</title>
 		</head>
@@ -22,7 +22,7 @@ func AzureTOSHandler() http.HandlerFunc {
 		}
 
 		// TODO
-		fmt.Fprintf(w, `<html>
+		fmt.Fprint(w, `<html>
 		<head>
 			<title>MDM Concent</title>
 		</head>
@@ -27,7 +27,7 @@ type FaultEnvelop struct {
 func (fault FaultEnvelop) Response(w http.ResponseWriter) {
 	faultLogger := log.With().Str("value", fault.Value).Str("subcode", fault.Subcode).Str("reason", fault.Reason.Text).Str("error-type", fault.DeviceEnrollmentServiceError.Type).Str("message", fault.DeviceEnrollmentServiceError.Message).Str("traceID", fault.DeviceEnrollmentServiceError.TraceID).Logger()
 
-	if fault.Value != "s:Sender" && fault.Value != "s:Receiver" {
+	if fault.Value != "s:Sender" && fault.Value != "s:Receiver" && fault.Value != "s:MustUnderstand" {
 		log.Error().Msg("|||||||||||||||||||||||| DEVELOPER BUG ||||||||||||||||||||||||")
 		faultLogger.Error().Bool("developer-bug-please-report", true).Msg("error: fault.Respond(): invalid value")
 		fault.Value = "s:Receiver"
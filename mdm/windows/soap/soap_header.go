@@ -1,5 +1,7 @@
 package soap
 
+import "github.com/mattrax/Mattrax/internal/generic"
+
 // Header is the SOAP Header for a request. It contains the intent, id and authentication details for a SOAP request.
 type Header struct {
 	Action    string `xml:"a:Action"`
@@ -13,14 +15,48 @@ type Header struct {
 
 // HeaderRes is the SOAP Header for a response. It contains the intent, request id and devices request id for a SOAP response.
 type HeaderRes struct {
-	Action     MustUnderstand `xml:"a:Action"`
-	ActivityID string         `xml:"a:ActivityID"`
-	RelatesTo  string         `xml:"a:RelatesTo"`
+	Action     MustUnderstand  `xml:"a:Action"`
+	ActivityID string          `xml:"a:ActivityID"`
+	RelatesTo  string          `xml:"a:RelatesTo"`
+	Security   *HeaderSecurity `xml:"o:Security,omitempty"`
+}
+
+// HeaderSecurity is contained in the SOAP Header of a response. It contains the WS-Security timestamp of the response.
+type HeaderSecurity struct {
+	NamespaceO     string                  `xml:"xmlns:o,attr"`
+	MustUnderstand string                  `xml:"s:mustUnderstand,attr"`
+	Timestamp      HeaderSecurityTimestamp `xml:"u:Timestamp"`
+}
+
+// HeaderSecurityTimestamp contains the creation and expiry time of a response
+type HeaderSecurityTimestamp struct {
+	ID      string `xml:"u:Id,attr"`
+	Created string `xml:"u:Created"`
+	Expires string `xml:"u:Expires"`
+}
+
+// NewHeaderRes creates the SOAP Header for a response to the request with the header requestHeader
+func NewHeaderRes(action string, requestHeader Header) HeaderRes {
+	return HeaderRes{
+		Action: MustUnderstand{
+			MustUnderstand: "1",
+			Value:          action,
+		},
+		ActivityID: generic.GenerateID(),
+		RelatesTo:  requestHeader.MessageID,
+	}
 }
 
 // HeaderMdeWSSESecurity is contained in SOAP Header and it carries the user authentication details.
 type HeaderMdeWSSESecurity struct {
-	Username            string `xml:"wsse:UsernameToken>wsse:Username"`
-	Password            string `xml:"wsse:UsernameToken>wsse:Password"`
-	BinarySecurityToken string `xml:"wsse:BinarySecurityToken"`
+	Username            string              `xml:"wsse:UsernameToken>wsse:Username"`
+	Password            string              `xml:"wsse:UsernameToken>wsse:Password"`
+	BinarySecurityToken string              `xml:"wsse:BinarySecurityToken"`
+	Timestamp           HeaderWSSETimestamp `xml:"wsu:Timestamp"`
+}
+
+// HeaderWSSETimestamp is the optional WS-Security timestamp of a request. It contains when the request was created and when it expires.
+type HeaderWSSETimestamp struct {
+	Created string `xml:"wsu:Created"`
+	Expires string `xml:"wsu:Expires"`
 }
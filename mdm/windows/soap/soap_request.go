@@ -0,0 +1,189 @@
+package soap
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattrax/Mattrax/pkg/xml"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultMaxBodySize is the largest request body (in bytes) accepted by an Endpoint which doesn't set MaxBodySize
+const DefaultMaxBodySize = 5000
+
+// anonymousAddress is the WS-Addressing address used by a client to request the response on the same connection
+const anonymousAddress = "http://www.w3.org/2005/08/addressing/anonymous"
+
+// understoodHeaders contains the local names of the header elements which are processed by Mattrax.
+// A request containing any other header marked with mustUnderstand will be rejected.
+var understoodHeaders = map[string]bool{
+	"Action":    true,
+	"MessageID": true,
+	"ReplyTo":   true,
+	"To":        true,
+	"Security":  true,
+}
+
+// Endpoint contains the details required to decode and validate requests sent to a SOAP endpoint
+type Endpoint struct {
+	Action      string          // The WS-Addressing Action the endpoint accepts
+	MaxBodySize int64           // The largest request body accepted by the endpoint (in bytes)
+	ClockSkew   time.Duration   // The difference allowed between the client's and server's clock when checking WS-Security timestamps. DefaultClockSkew is used if it is 0.
+	MessageIDs  *MessageIDCache // If set requests with a MessageID which has already been received are rejected
+}
+
+// requestEnvelope is used to decode the Header from a SOAP request independent of its body
+type requestEnvelope struct {
+	XMLName xml.Name `xml:"s:Envelope"`
+	Header  Header   `xml:"s:Header"`
+}
+
+// rawRequestEnvelope is used to decode every element in the Header of a SOAP request
+type rawRequestEnvelope struct {
+	XMLName xml.Name `xml:"s:Envelope"`
+	Header  struct {
+		Elements []headerElement `xml:",any"`
+	} `xml:"s:Header"`
+}
+
+// headerElement is a generic SOAP Header element. It is used to check for the mustUnderstand attribute.
+type headerElement struct {
+	XMLName    xml.Name
+	Attributes []xml.Attr `xml:",any,attr"`
+}
+
+// localName returns the elements name without a namespace prefix
+func (element headerElement) localName() string {
+	return element.XMLName.Local[strings.LastIndex(element.XMLName.Local, ":")+1:]
+}
+
+// mustUnderstand checks if the client requires the header to be processed
+func (element headerElement) mustUnderstand() bool {
+	for _, attr := range element.Attributes {
+		if attr.Name.Local == "mustUnderstand" || strings.HasSuffix(attr.Name.Local, ":mustUnderstand") {
+			return attr.Value == "1" || attr.Value == "true"
+		}
+	}
+	return false
+}
+
+// ReadRequest reads the SOAP Envelope from the HTTP request into cmd and validates its Header.
+// cmd must be a pointer to the endpoint's request Envelope. If the request is invalid a fault is sent to the client and false is returned.
+func (endpoint Endpoint) ReadRequest(w http.ResponseWriter, r *http.Request, cmd interface{}) (Header, bool) {
+	maxBodySize := endpoint.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+
+	if r.ContentLength > maxBodySize {
+		fault := NewBasicFault("s:Sender", "s:MessageFormat", "client request body too large to process")
+		fault.Response(w)
+		return Header{}, false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Str("action", endpoint.Action).Err(err).Msg("error: soap request: failed to read client request body")
+		fault := NewBasicFault("s:Sender", "s:MessageFormat", "client request body couldn't be read")
+		fault.Response(w)
+		return Header{}, false
+	}
+
+	var envelope requestEnvelope
+	var rawEnvelope rawRequestEnvelope
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Str("action", endpoint.Action).Err(err).Msg("error: soap request: failed to parse client request envelope")
+		fault := NewBasicFault("s:Sender", "s:MessageFormat", "client request body couldn't be parsed")
+		fault.Response(w)
+		return Header{}, false
+	}
+
+	if err := xml.Unmarshal(body, &rawEnvelope); err != nil {
+		log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Str("action", endpoint.Action).Err(err).Msg("error: soap request: failed to parse client request header")
+		fault := NewBasicFault("s:Sender", "s:MessageFormat", "client request body couldn't be parsed")
+		fault.Response(w)
+		return Header{}, false
+	}
+
+	if err := xml.Unmarshal(body, cmd); err != nil {
+		log.Debug().Str("type", "error").Str("remote-addr", r.RemoteAddr).Str("action", endpoint.Action).Err(err).Msg("error: soap request: failed to parse client request body")
+		fault := NewBasicFault("s:Sender", "s:MessageFormat", "client request body couldn't be parsed")
+		fault.Response(w)
+		return Header{}, false
+	}
+
+	for _, element := range rawEnvelope.Header.Elements {
+		if element.mustUnderstand() && !understoodHeaders[element.localName()] {
+			fault := NewBasicFault("s:MustUnderstand", "s:MessageFormat", "the header "+element.localName()+" is not understood by the server")
+			fault.Response(w)
+			return Header{}, false
+		}
+	}
+
+	if !endpoint.verifyHeader(w, r, envelope.Header) {
+		return Header{}, false
+	}
+
+	return envelope.Header, true
+}
+
+// Release forgets the MessageID reserved by ReadRequest so the request can be sent again.
+// Handlers must call it if they reject the request before it is processed so the client can retry it.
+func (endpoint Endpoint) Release(header Header) {
+	if endpoint.MessageIDs != nil {
+		endpoint.MessageIDs.Remove(header.MessageID)
+	}
+}
+
+// verifyHeader validates the WS-Addressing details contained in the request Header.
+// If they are invalid a fault is sent to the client and false is returned.
+func (endpoint Endpoint) verifyHeader(w http.ResponseWriter, r *http.Request, header Header) bool {
+	if header.Action != endpoint.Action {
+		fault := NewBasicFault("s:Sender", "a:ActionMismatch", "the action '"+header.Action+"' is not supported by this endpoint")
+		fault.Response(w)
+		return false
+	}
+
+	if header.MessageID == "" {
+		fault := NewBasicFault("s:Sender", "s:MessageFormat", "client request is missing a MessageID")
+		fault.Response(w)
+		return false
+	}
+
+	if header.ReplyTo.Address != "" && header.ReplyTo.Address != anonymousAddress {
+		fault := NewBasicFault("s:Sender", "s:MessageFormat", "only anonymous ReplyTo addresses are supported")
+		fault.Response(w)
+		return false
+	}
+
+	if url, err := url.ParseRequestURI(header.To); err != nil || url.Scheme != "https" || !strings.EqualFold(url.Path, r.URL.Path) {
+		fault := NewEnrollmentFault("s:Sender", "a:EndpointUnavailable", "invalid To address", "EnrollmentServer", "EnrollmentInternalServiceError", "")
+		fault.Response(w)
+		return false
+	}
+
+	clockSkew := endpoint.ClockSkew
+	if clockSkew == 0 {
+		clockSkew = DefaultClockSkew
+	}
+
+	if !header.WSSESecurity.Timestamp.IsValidAt(time.Now(), clockSkew) {
+		log.Debug().Str("remote-addr", r.RemoteAddr).Str("action", endpoint.Action).Str("created", header.WSSESecurity.Timestamp.Created).Str("expires", header.WSSESecurity.Timestamp.Expires).Msg("rejected soap request with an invalid timestamp")
+		fault := NewBasicFault("s:Sender", "a:InvalidSecurity", "the request timestamp is invalid or has expired")
+		fault.Response(w)
+		return false
+	}
+
+	// The MessageID is reserved when the request is read so concurrent copies of the request aren't both processed. It is checked last so invalid requests don't reserve it.
+	if endpoint.MessageIDs != nil && !endpoint.MessageIDs.Add(header.MessageID) {
+		log.Warn().Str("remote-addr", r.RemoteAddr).Str("action", endpoint.Action).Str("message-id", header.MessageID).Msg("rejected replayed soap request")
+		fault := NewBasicFault("s:Sender", "a:InvalidSecurity", "the request has already been processed")
+		fault.Response(w)
+		return false
+	}
+
+	return true
+}
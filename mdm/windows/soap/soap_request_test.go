@@ -0,0 +1,146 @@
+package soap
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mattrax/Mattrax/pkg/xml"
+)
+
+var testEndpoint = Endpoint{
+	Action: "http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover",
+}
+
+type testRequest struct {
+	XMLName xml.Name `xml:"s:Envelope"`
+	Header  Header   `xml:"s:Header"`
+}
+
+func readTestRequest(t *testing.T, body string) (*httptest.ResponseRecorder, Header, bool) {
+	req, err := http.NewRequest("POST", "/EnrollmentServer/Discovery.svc", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	var cmd testRequest
+	header, ok := testEndpoint.ReadRequest(res, req, &cmd)
+	return res, header, ok
+}
+
+func decodeTestFault(t *testing.T, res *httptest.ResponseRecorder) FaultEnvelop {
+	var fault FaultEnvelop
+	if err := xml.NewDecoder(res.Body).Decode(&fault); err != nil {
+		t.Fatal(err)
+	}
+	return fault
+}
+
+func TestReadRequest(t *testing.T) {
+	is := is.New(t)
+
+	res, header, ok := readTestRequest(t, `<s:Envelope xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover</a:Action><a:MessageID>urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478</a:MessageID><a:ReplyTo><a:Address>http://www.w3.org/2005/08/addressing/anonymous</a:Address></a:ReplyTo><a:To s:mustUnderstand="1">https://EnterpriseEnrollment.otbeaumont.me:443/EnrollmentServer/Discovery.svc</a:To></s:Header><s:Body></s:Body></s:Envelope>`)
+
+	is.True(ok)                                  // Request should be valid
+	is.Equal(res.Body.Len(), 0)                  // No fault should be sent
+	is.Equal(header.Action, testEndpoint.Action) // Header should be decoded
+	is.Equal(header.MessageID, "urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478")
+
+	resHeader := NewHeaderRes("http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/DiscoverResponse", header)
+	is.Equal(resHeader.RelatesTo, header.MessageID) // RelatesTo must match the MessageID of the request
+	is.True(resHeader.ActivityID != "")             // ActivityID must be set in response
+}
+
+func TestReadRequest_ActionMismatch(t *testing.T) {
+	is := is.New(t)
+
+	res, _, ok := readTestRequest(t, `<s:Envelope xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/pki/2009/01/enrollment/RST/wstep</a:Action><a:MessageID>urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478</a:MessageID><a:To s:mustUnderstand="1">https://EnterpriseEnrollment.otbeaumont.me:443/EnrollmentServer/Discovery.svc</a:To></s:Header><s:Body></s:Body></s:Envelope>`)
+
+	is.True(!ok)                              // Request should be rejected
+	is.Equal(res.Code, http.StatusBadRequest) // Request should response status BadRequest
+
+	fault := decodeTestFault(t, res)
+	is.Equal(fault.Value, "s:Sender")
+	is.Equal(fault.Subcode, "a:ActionMismatch")
+}
+
+func TestReadRequest_UnknownMustUnderstandHeader(t *testing.T) {
+	is := is.New(t)
+
+	res, _, ok := readTestRequest(t, `<s:Envelope xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover</a:Action><a:MessageID>urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478</a:MessageID><a:To s:mustUnderstand="1">https://EnterpriseEnrollment.otbeaumont.me:443/EnrollmentServer/Discovery.svc</a:To><x:Unknown xmlns:x="urn:example" s:mustUnderstand="1">value</x:Unknown></s:Header><s:Body></s:Body></s:Envelope>`)
+
+	is.True(!ok)                                       // Request should be rejected
+	is.Equal(res.Code, http.StatusInternalServerError) // MustUnderstand faults are not sender faults
+
+	fault := decodeTestFault(t, res)
+	is.Equal(fault.Value, "s:MustUnderstand")
+}
+
+func TestReadRequest_InvalidToPath(t *testing.T) {
+	is := is.New(t)
+
+	res, _, ok := readTestRequest(t, `<s:Envelope xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover</a:Action><a:MessageID>urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478</a:MessageID><a:To s:mustUnderstand="1">https://EnterpriseEnrollment.otbeaumont.me:443/EnrollmentServer/Policy.svc</a:To></s:Header><s:Body></s:Body></s:Envelope>`)
+
+	is.True(!ok) // Request should be rejected
+
+	fault := decodeTestFault(t, res)
+	is.Equal(fault.Value, "s:Sender")
+	is.Equal(fault.Subcode, "a:EndpointUnavailable")
+}
+
+func TestReadRequest_ReplayedMessageID(t *testing.T) {
+	is := is.New(t)
+
+	endpoint := testEndpoint
+	endpoint.MessageIDs = NewMessageIDCache(2)
+	body := `<s:Envelope xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover</a:Action><a:MessageID>urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478</a:MessageID><a:To s:mustUnderstand="1">https://EnterpriseEnrollment.otbeaumont.me:443/EnrollmentServer/Discovery.svc</a:To></s:Header><s:Body></s:Body></s:Envelope>`
+
+	req, err := http.NewRequest("POST", "/EnrollmentServer/Discovery.svc", bytes.NewBufferString(body))
+	is.NoErr(err) // Error creating mock request
+	header, ok := endpoint.ReadRequest(httptest.NewRecorder(), req, &testRequest{})
+	is.True(ok) // First request should be accepted
+	endpoint.Release(header)
+
+	req, err = http.NewRequest("POST", "/EnrollmentServer/Discovery.svc", bytes.NewBufferString(body))
+	is.NoErr(err) // Error creating mock request
+	_, ok = endpoint.ReadRequest(httptest.NewRecorder(), req, &testRequest{})
+	is.True(ok) // Released request should be accepted again
+
+	req, err = http.NewRequest("POST", "/EnrollmentServer/Discovery.svc", bytes.NewBufferString(body))
+	is.NoErr(err) // Error creating mock request
+	res := httptest.NewRecorder()
+	_, ok = endpoint.ReadRequest(res, req, &testRequest{})
+	is.True(!ok) // Replayed request should be rejected
+
+	fault := decodeTestFault(t, res)
+	is.Equal(fault.Subcode, "a:InvalidSecurity")
+}
+
+func TestReadRequest_ExpiredTimestamp(t *testing.T) {
+	is := is.New(t)
+
+	res, _, ok := readTestRequest(t, `<s:Envelope xmlns:a="http://www.w3.org/2005/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Header><a:Action s:mustUnderstand="1">http://schemas.microsoft.com/windows/management/2012/01/enrollment/IDiscoveryService/Discover</a:Action><a:MessageID>urn:uuid:748132ec-a575-4329-b01b-6171a9cf8478</a:MessageID><a:To s:mustUnderstand="1">https://EnterpriseEnrollment.otbeaumont.me:443/EnrollmentServer/Discovery.svc</a:To><wsse:Security xmlns:wsse="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd" xmlns:wsu="http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd" s:mustUnderstand="1"><wsu:Timestamp wsu:Id="_0"><wsu:Created>2018-11-30T00:32:59.420Z</wsu:Created><wsu:Expires>2018-11-30T00:37:59.420Z</wsu:Expires></wsu:Timestamp></wsse:Security></s:Header><s:Body></s:Body></s:Envelope>`)
+
+	is.True(!ok) // Expired request should be rejected
+
+	fault := decodeTestFault(t, res)
+	is.Equal(fault.Subcode, "a:InvalidSecurity")
+}
+
+func TestMessageIDCache(t *testing.T) {
+	is := is.New(t)
+
+	cache := NewMessageIDCache(2)
+	is.True(cache.Add("1"))  // New MessageID should be accepted
+	is.True(!cache.Add("1")) // Duplicate MessageID should be rejected
+	is.True(cache.Add("2"))  // New MessageID should be accepted
+	is.True(cache.Add("3"))  // New MessageID should be accepted and evict the oldest
+	is.True(cache.Add("1"))  // Evicted MessageID should be accepted again
+	cache.Remove("1")
+	is.True(cache.Add("1"))  // Removed MessageID should be accepted again
+	is.True(cache.Add("4"))  // New MessageID should be accepted
+	is.True(!cache.Add("1")) // MessageID added again must not be evicted with its removed entry
+}
@@ -0,0 +1,27 @@
+package soap
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mattrax/Mattrax/pkg/xml"
+	"github.com/rs/zerolog/log"
+)
+
+// Respond marshals and sends the SOAP response Envelope to the client.
+// If the response can't be marshalled a fault is sent instead. If it is unable to respond to the client it logs the error.
+func Respond(w http.ResponseWriter, res interface{}) {
+	response, err := xml.Marshal(res)
+	if err != nil {
+		log.Error().Err(err).Msg("error: soap.Respond(): failed to marshal response")
+		fault := NewBasicFault("s:Receiver", "a:InternalServiceFault", "mattrax error: failed to generate response")
+		fault.Response(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+	if _, err := w.Write(response); err != nil {
+		log.Error().Err(err).Msg("error: soap.Respond(): failed to send response body")
+	}
+}
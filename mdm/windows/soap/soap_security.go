@@ -0,0 +1,99 @@
+package soap
+
+import (
+	"sync"
+	"time"
+)
+
+// TimestampFormat is the format of the Created and Expires values in a WS-Security timestamp
+const TimestampFormat = "2006-01-02T15:04:05.000Z"
+
+// DefaultClockSkew is the clock skew allowed between the server and a client by an Endpoint which doesn't set ClockSkew
+const DefaultClockSkew = 5 * time.Minute
+
+// responseLifetime is how long a response is valid for after it is created
+const responseLifetime = 5 * time.Minute
+
+// MessageIDCacheSize is the number of recent request MessageIDs an Endpoint remembers to detect replayed requests
+const MessageIDCacheSize = 10000
+
+// NewHeaderSecurity creates the WS-Security header for a response. The response is timestamped as created now.
+func NewHeaderSecurity() *HeaderSecurity {
+	created := time.Now().UTC()
+	return &HeaderSecurity{
+		NamespaceO:     "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd",
+		MustUnderstand: "1",
+		Timestamp: HeaderSecurityTimestamp{
+			ID:      "_0",
+			Created: created.Format(TimestampFormat),
+			Expires: created.Add(responseLifetime).Format(TimestampFormat),
+		},
+	}
+}
+
+// IsValidAt checks if the timestamp is valid at the time now, allowing for the clock skew between the client and the server.
+// A timestamp without a Created or Expires value is not checked against that value.
+func (timestamp HeaderWSSETimestamp) IsValidAt(now time.Time, clockSkew time.Duration) bool {
+	if timestamp.Created != "" {
+		created, err := time.Parse(time.RFC3339Nano, timestamp.Created)
+		if err != nil || created.After(now.Add(clockSkew)) {
+			return false
+		}
+	}
+
+	if timestamp.Expires != "" {
+		expires, err := time.Parse(time.RFC3339Nano, timestamp.Expires)
+		if err != nil || expires.Before(now.Add(-clockSkew)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MessageIDCache is a bounded cache of the most recently received MessageIDs. It is used to detect replayed requests.
+// Once the cache is full the oldest MessageID is forgotten for each new MessageID that is added.
+type MessageIDCache struct {
+	ids   map[string]int // ids maps each MessageID to its index in order
+	order []string       // order is a ring buffer of the MessageIDs in the order they were received
+	next  int
+	mutex sync.Mutex
+}
+
+// NewMessageIDCache creates a MessageIDCache which remembers up to size MessageIDs
+func NewMessageIDCache(size int) *MessageIDCache {
+	return &MessageIDCache{
+		ids:   make(map[string]int, size),
+		order: make([]string, size),
+	}
+}
+
+// Add records the MessageID as received. It returns false if the MessageID has already been received.
+func (cache *MessageIDCache) Add(messageID string) bool {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if _, ok := cache.ids[messageID]; ok {
+		return false
+	}
+
+	if oldest := cache.order[cache.next]; oldest != "" {
+		delete(cache.ids, oldest)
+	}
+	cache.order[cache.next] = messageID
+	cache.ids[messageID] = cache.next
+	cache.next = (cache.next + 1) % len(cache.order)
+
+	return true
+}
+
+// Remove forgets the MessageID so it is accepted if it is received again
+func (cache *MessageIDCache) Remove(messageID string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if i, ok := cache.ids[messageID]; ok {
+		delete(cache.ids, messageID)
+		cache.order[i] = ""
+	}
+}
@@ -3,9 +3,12 @@ package windows
 import (
 	"github.com/gorilla/mux"
 	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/middleware"
+	"github.com/mattrax/Mattrax/mdm/windows/protocol/cepces"
 	enrolldiscovery "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_discovery"
 	enrollpolicy "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_policy"
 	enrollprovision "github.com/mattrax/Mattrax/mdm/windows/protocol/enroll_provision"
+	mdmmanage "github.com/mattrax/Mattrax/mdm/windows/protocol/mdm_manage"
 	"github.com/mattrax/Mattrax/mdm/windows/protocol/portals"
 )
 
@@ -22,9 +25,11 @@ func Init(server *mattrax.Server, r *mux.Router) (MDM, error) {
 	r.Path("/EnrollmentServer/Discovery.svc").Methods("POST").HandlerFunc(defaultHeaders(enrolldiscovery.Handler(server)))
 	r.Path("/EnrollmentServer/Policy.svc").Methods("POST").HandlerFunc(defaultHeaders(enrollpolicy.Handler(server)))
 	r.Path("/EnrollmentServer/Enrollment.svc").Methods("POST").HandlerFunc(defaultHeaders(enrollprovision.Handler(server)))
-	r.Path("/ManagementServer/Manage.svc").Methods("POST").HandlerFunc(defaultHeaders(enrollprovision.Handler(server)))
+	r.Path("/ManagementServer/Manage.svc").Methods("POST").HandlerFunc(defaultHeaders(middleware.DeviceCertificate(server.Certificates, mdmmanage.Handler(server))))
 	r.Path("/EnrollmentServer/Authenticate").Methods("GET").HandlerFunc(portals.FederatedLoginHandler())
 	r.Path("/EnrollmentServer/ToS").Methods("GET").HandlerFunc(portals.AzureTOSHandler())
+	cepces.Init(server, r)
+	r.Path("/api/windows/provisioning-profile/preview").Methods("GET").HandlerFunc(enrollprovision.PreviewHandler(server))
 
 	return mdm, nil
 }
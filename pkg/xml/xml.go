@@ -1053,7 +1053,7 @@ Input:
 					d.buf.WriteByte(';')
 					n, err := strconv.ParseUint(s, base, 64)
 					if err == nil && n <= unicode.MaxRune {
-						text = string(n)
+						text = string(rune(n))
 						haveText = true
 					}
 				}
@@ -1075,7 +1075,7 @@ Input:
 					if isName(name) {
 						s := string(name)
 						if r, ok := entity[s]; ok {
-							text = string(r)
+							text = string(rune(r))
 							haveText = true
 						} else if d.Entity != nil {
 							text, haveText = d.Entity[s]
@@ -0,0 +1,267 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/mattrax/Mattrax/internal/middleware"
+	"github.com/micromdm/scep/v2/scep"
+	"github.com/rs/zerolog/log"
+)
+
+// ESTPath is the path prefix the EST server (RFC 7030) is served at
+const ESTPath = "/.well-known/est"
+
+// estRealm is the HTTP basic authentication realm of the EST server
+const estRealm = "Mattrax EST"
+
+// maxESTRequestSize is the largest base64 encoded certificate request which will be accepted
+const maxESTRequestSize = 64 * 1024
+
+// OIDs used in the CSR attributes response and to compare re-enrollment requests
+var (
+	oidECPublicKey             = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidRSAPublicKey            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+)
+
+// ESTHandlers attaches the EST server's handlers to the router.
+// Enrollment is authenticated with a certificate issued by Mattrax or the email and password of a user. Re-enrollment requires the certificate which is being renewed.
+// The optional label (RFC 7030 Section 3.2.2) is the name of the certificate template. The default template is used without a label.
+func ESTHandlers(server *mattrax.Server, r *mux.Router) {
+	for _, prefix := range []string{ESTPath, ESTPath + "/{label:[a-z0-9-]+}"} {
+		r.Path(prefix + "/cacerts").Methods("GET").HandlerFunc(ESTCACertsHandler(server))
+		r.Path(prefix + "/csrattrs").Methods("GET").HandlerFunc(ESTCSRAttrsHandler(server))
+		r.Path(prefix + "/simpleenroll").Methods("POST").HandlerFunc(estAuthentication(server, ESTEnrollHandler(server, false)))
+		r.Path(prefix + "/simplereenroll").Methods("POST").HandlerFunc(middleware.DeviceCertificate(server.Certificates, ESTEnrollHandler(server, true)))
+	}
+}
+
+// estTemplate returns the certificate template named by the request's label. If it doesn't exist a not found error is sent to the client and false is returned.
+func estTemplate(server *mattrax.Server, w http.ResponseWriter, r *http.Request) (certificates.Template, bool) {
+	template, err := server.Certificates.Get().GetTemplate(mux.Vars(r)["label"])
+	if err != nil {
+		http.Error(w, "the certificate template does not exist", http.StatusNotFound)
+		return certificates.Template{}, false
+	}
+	return template, true
+}
+
+// estAuthentication authenticates the request with the client certificate if one was sent otherwise with HTTP basic authentication
+func estAuthentication(server *mattrax.Server, next http.HandlerFunc) http.HandlerFunc {
+	certificateAuthentication := middleware.DeviceCertificate(server.Certificates, next)
+	loginAuthentication := middleware.UserLogin(server.UserService, estRealm, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+			certificateAuthentication(w, r)
+			return
+		}
+		loginAuthentication(w, r)
+	}
+}
+
+// ESTCACertsHandler serves the certificates clients should trust. It contains the identity certificate and its chain to the root.
+func ESTCACertsHandler(server *mattrax.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity := server.Certificates.Get().Identity
+		if identity.Cert == nil {
+			http.Error(w, "the identity certificate has not been generated", http.StatusServiceUnavailable)
+			return
+		}
+
+		certs := append([]*x509.Certificate{identity.Cert}, identity.Chain...)
+		if identity.RootCert != nil {
+			certs = append(certs, identity.RootCert)
+		}
+
+		writeESTCertificates(w, certs)
+	}
+}
+
+// ESTCSRAttrsHandler serves the attributes clients should include in their certificate requests. They are derived from the certificate template named by the label.
+func ESTCSRAttrsHandler(server *mattrax.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		template, ok := estTemplate(server, w, r)
+		if !ok {
+			return
+		}
+
+		var attributes []asn1.RawValue
+		var err error
+		if template.PublicKeyAlgorithm == certificates.PublicKeyAlgorithmECDSA {
+			curveOID, _ := template.PublicKeyAlgorithmOID()
+			attributes, err = appendCSRAttribute(attributes, oidECPublicKey, []asn1.ObjectIdentifier{certificates.ParseOID(curveOID)})
+		} else {
+			attributes, err = appendCSRAttribute(attributes, oidRSAPublicKey, []int{template.MinimalKeyLength})
+		}
+
+		if hashAlgorithmOID := certificates.ParseOID(template.HashAlgorithmOID); err == nil && hashAlgorithmOID != nil {
+			attributes, err = appendCSRAttribute(attributes, hashAlgorithmOID, nil)
+		}
+
+		var csrAttrs []byte
+		if err == nil {
+			csrAttrs, err = asn1.Marshal(attributes)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("error encoding est csr attributes")
+			http.Error(w, "error encoding csr attributes", http.StatusInternalServerError)
+			return
+		}
+
+		writeESTResponse(w, "application/csrattrs", csrAttrs)
+	}
+}
+
+// ESTEnrollHandler issues a certificate for the base64 encoded PKCS#10 certificate request in the body using the template named by the label.
+// When reenroll is true the request must have the same subject and subject alternative names as the client certificate (RFC 7030 section 4.2.2) and the new certificate is recorded against the same device.
+func ESTEnrollHandler(server *mattrax.Server, reenroll bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "application/pkcs10") {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxESTRequestSize))
+		if err != nil {
+			http.Error(w, "the certificate request is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		csr, err := parseESTCertificateRequest(body)
+		if err != nil {
+			http.Error(w, "the certificate request is invalid: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		template, ok := estTemplate(server, w, r)
+		if !ok {
+			return
+		}
+
+		// Requests authenticated with a user's login aren't recorded against a device.
+		// The subject defaults to the authenticated device or user so the client can't choose it.
+		var deviceUUID string
+		var variables certificates.TemplateVariables
+		var defaultSubject pkix.Name
+		if issuedCertificate, ok := middleware.GetDeviceCertificate(r); ok {
+			deviceUUID = issuedCertificate.DeviceUUID
+			if reenroll && csr.Subject.String() != r.TLS.PeerCertificates[0].Subject.String() {
+				http.Error(w, "the certificate request subject must match the certificate being renewed", http.StatusBadRequest)
+				return
+			} else if reenroll && !bytes.Equal(subjectAltNameExtension(csr.Extensions), subjectAltNameExtension(r.TLS.PeerCertificates[0].Extensions)) {
+				http.Error(w, "the certificate request subject alternative names must match the certificate being renewed", http.StatusBadRequest)
+				return
+			}
+
+			variables.DeviceUUID = deviceUUID
+			defaultSubject = r.TLS.PeerCertificates[0].Subject
+			if device, err := server.Devices.Get(deviceUUID); err == nil {
+				variables = DeviceTemplateVariables(device)
+				if len(device.IdentityCertificate.Subject.ToRDNSequence()) != 0 {
+					defaultSubject = device.IdentityCertificate.Subject
+				}
+			}
+		} else if email, ok := middleware.GetUserLogin(r); ok {
+			variables.UPN = email
+			defaultSubject = UserSubject(email)
+		}
+
+		certificate, err := Issue(server, template, variables, csr, defaultSubject, deviceUUID)
+		if err != nil {
+			log.Debug().Err(err).Msg("error issuing est certificate")
+			http.Error(w, "the certificate could not be issued: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if email, ok := middleware.GetUserLogin(r); ok {
+			log.Info().Str("serial-number", certificates.FormatSerialNumber(certificate.SerialNumber)).Str("email", email).Msg("Issued EST certificate to user")
+		}
+
+		writeESTCertificates(w, []*x509.Certificate{certificate})
+	}
+}
+
+// subjectAltNameExtension returns the value of the subject alternative name extension or nil if there isn't one
+func subjectAltNameExtension(extensions []pkix.Extension) []byte {
+	for _, extension := range extensions {
+		if extension.Id.Equal(oidExtensionSubjectAltName) {
+			return extension.Value
+		}
+	}
+	return nil
+}
+
+// parseESTCertificateRequest decodes the base64 PKCS#10 certificate request and checks its signature
+func parseESTCertificateRequest(body []byte) (*x509.CertificateRequest, error) {
+	csrDer, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDer)
+	if err != nil {
+		return nil, err
+	} else if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	return csr, nil
+}
+
+// writeESTCertificates writes the certificates as a base64 encoded certs-only PKCS#7 response
+func writeESTCertificates(w http.ResponseWriter, certs []*x509.Certificate) {
+	degenerate, err := scep.DegenerateCertificates(certs)
+	if err != nil {
+		log.Error().Err(err).Msg("error encoding est certificates")
+		http.Error(w, "error encoding certificates", http.StatusInternalServerError)
+		return
+	}
+
+	writeESTResponse(w, "application/pkcs7-mime; smime-type=certs-only", degenerate)
+}
+
+// writeESTResponse writes the body base64 encoded as required by RFC 7030
+func writeESTResponse(w http.ResponseWriter, contentType string, body []byte) {
+	encoded := base64.StdEncoding.EncodeToString(body)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+	w.Write([]byte(encoded))
+}
+
+// appendCSRAttribute appends an AttrOrOID (RFC 7030 Section 4.5.2) to the CSR attributes. A bare OID is appended if values is nil.
+func appendCSRAttribute(attributes []asn1.RawValue, oid asn1.ObjectIdentifier, values interface{}) ([]asn1.RawValue, error) {
+	var attribute []byte
+	var err error
+	switch values := values.(type) {
+	case nil:
+		attribute, err = asn1.Marshal(oid)
+	case []asn1.ObjectIdentifier:
+		attribute, err = asn1.Marshal(struct {
+			Type   asn1.ObjectIdentifier
+			Values []asn1.ObjectIdentifier `asn1:"set"`
+		}{oid, values})
+	case []int:
+		attribute, err = asn1.Marshal(struct {
+			Type   asn1.ObjectIdentifier
+			Values []int `asn1:"set"`
+		}{oid, values})
+	default:
+		err = errors.New("unsupported csr attribute value type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(attributes, asn1.RawValue{FullBytes: attribute}), nil
+}
@@ -0,0 +1,227 @@
+package pki
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/rs/zerolog/log"
+)
+
+// expiryCheckInterval is how often the expiry of certificates is checked
+const expiryCheckInterval = time.Hour
+
+// webhookTimeout is how long the expiry webhook has to respond
+const webhookTimeout = 10 * time.Second
+
+// ExpiryMetrics are the certificate expiry metrics published using expvar.
+// The seconds until each server certificate expires is set and the number of devices whose certificate expires within each threshold.
+var ExpiryMetrics = expvar.NewMap("certificate_expiry")
+
+// ExpiryNotification is the body of the request sent to the expiry webhook when a certificate reaches a threshold
+type ExpiryNotification struct {
+	Certificate string    `json:"certificate"` // The certificate being watched. It is "identity", "https:" with the certificate's common name or "devices".
+	Subject     string    `json:"subject,omitempty"`
+	NotAfter    time.Time `json:"not_after"`         // It is zero for device notifications
+	Threshold   string    `json:"threshold"`         // The threshold which was reached, for example "168h0m0s"
+	Devices     int       `json:"devices,omitempty"` // The number of devices whose certificate expires within the threshold
+}
+
+// expiryMonitor tracks the thresholds which have been notified so each is only sent once per certificate
+type expiryMonitor struct {
+	server   *mattrax.Server
+	client   *http.Client
+	notified map[string]expiryNotified
+}
+
+// expiryNotified is the smallest threshold notified for a certificate. It is reset when the certificate is renewed.
+type expiryNotified struct {
+	notAfter  time.Time
+	threshold time.Duration
+	devices   int
+}
+
+// runExpiryMonitor periodically checks the expiry of the server's certificates and renews the ones it owns until stop is closed
+func runExpiryMonitor(server *mattrax.Server, stop chan struct{}) {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	monitor := &expiryMonitor{
+		server:   server,
+		client:   &http.Client{Timeout: webhookTimeout},
+		notified: make(map[string]expiryNotified),
+	}
+
+	for {
+		monitor.renew()
+		if err := monitor.check(); err != nil {
+			log.Error().Err(err).Msg("error checking certificate expiry")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// renew renews the server-side certificates which are close to expiring. The OCSP signer and SCEP registration authority renew themselves when loaded.
+func (monitor *expiryMonitor) renew() {
+	if monitor.server.Certificates.Get().Identity.Cert == nil {
+		return
+	}
+
+	if _, err := monitor.server.Certificates.RenewIdentity(monitor.server.Config.IdentityRenewBefore, monitor.server.Config.KeyAlgorithm()); err != nil {
+		log.Error().Err(err).Msg("error renewing the identity certificate")
+	}
+
+	if _, err := monitor.server.Certificates.OCSPSigner(); err != nil {
+		log.Error().Err(err).Msg("error renewing the ocsp signer")
+	}
+
+	if _, err := monitor.server.Certificates.SCEPRA(); err != nil {
+		log.Error().Err(err).Msg("error renewing the scep registration authority")
+	}
+}
+
+// check updates the expiry metrics and warns about certificates which have reached a threshold
+func (monitor *expiryMonitor) check() error {
+	identity := monitor.server.Certificates.Get().Identity
+	if identity.Cert != nil {
+		monitor.checkCertificate("identity", identity.Cert)
+	}
+
+	if monitor.server.TLS != nil {
+		leaves, err := monitor.server.TLS.Leaves()
+		if err != nil {
+			return err
+		}
+
+		for _, leaf := range leaves {
+			monitor.checkCertificate("https:"+leaf.Subject.CommonName, leaf)
+		}
+	}
+
+	return monitor.checkDevices()
+}
+
+// checkCertificate publishes the time until the certificate expires and warns if it has reached a threshold
+func (monitor *expiryMonitor) checkCertificate(name string, certificate *x509.Certificate) {
+	remaining := time.Until(certificate.NotAfter)
+	seconds := new(expvar.Int)
+	seconds.Set(int64(remaining.Seconds()))
+	ExpiryMetrics.Set(name+"_seconds", seconds)
+
+	threshold, ok := monitor.threshold(remaining)
+	if !ok {
+		return
+	}
+
+	if notified, ok := monitor.notified[name]; ok && notified.notAfter.Equal(certificate.NotAfter) && notified.threshold <= threshold {
+		return
+	}
+	monitor.notified[name] = expiryNotified{notAfter: certificate.NotAfter, threshold: threshold}
+
+	log.Warn().Str("certificate", name).Str("subject", certificate.Subject.String()).Time("not-after", certificate.NotAfter).Msg("Certificate is close to expiring!")
+	monitor.notify(ExpiryNotification{
+		Certificate: name,
+		Subject:     certificate.Subject.String(),
+		NotAfter:    certificate.NotAfter,
+		Threshold:   threshold.String(),
+	})
+}
+
+// checkDevices publishes the number of devices whose certificate expires within each threshold and warns when it increases
+func (monitor *expiryMonitor) checkDevices() error {
+	thresholds := monitor.server.Config.ExpiryThresholds
+	if len(thresholds) == 0 {
+		return nil
+	}
+
+	largest := thresholds[0]
+	for _, threshold := range thresholds {
+		if threshold > largest {
+			largest = threshold
+		}
+	}
+
+	expiring, err := monitor.server.Certificates.ExpiringDevices(largest)
+	if err != nil {
+		return err
+	}
+
+	for _, threshold := range thresholds {
+		var devices int
+		for _, issuedCertificate := range expiring {
+			if time.Until(issuedCertificate.NotAfter) <= threshold {
+				devices++
+			}
+		}
+
+		count := new(expvar.Int)
+		count.Set(int64(devices))
+		ExpiryMetrics.Set("devices_within_"+threshold.String(), count)
+
+		name := "devices:" + threshold.String()
+		if devices > 0 && devices > monitor.notified[name].devices {
+			log.Warn().Int("devices", devices).Str("threshold", threshold.String()).Msg("Device certificates are close to expiring!")
+			monitor.notify(ExpiryNotification{
+				Certificate: "devices",
+				Threshold:   threshold.String(),
+				Devices:     devices,
+			})
+		}
+		monitor.notified[name] = expiryNotified{threshold: threshold, devices: devices}
+	}
+
+	return nil
+}
+
+// threshold returns the smallest configured threshold the remaining time is within. The bool is false if it isn't within any threshold.
+func (monitor *expiryMonitor) threshold(remaining time.Duration) (time.Duration, bool) {
+	var smallest time.Duration
+	var ok bool
+	for _, threshold := range monitor.server.Config.ExpiryThresholds {
+		if remaining <= threshold && (!ok || threshold < smallest) {
+			smallest, ok = threshold, true
+		}
+	}
+	return smallest, ok
+}
+
+// notify sends the notification to the expiry webhook if one is configured
+func (monitor *expiryMonitor) notify(notification ExpiryNotification) {
+	if monitor.server.Config.ExpiryWebhook == "" {
+		return
+	}
+
+	if err := monitor.sendWebhook(notification); err != nil {
+		log.Error().Str("certificate", notification.Certificate).Err(err).Msg("error sending certificate expiry webhook")
+	}
+}
+
+// sendWebhook POSTs the notification to the expiry webhook as JSON
+func (monitor *expiryMonitor) sendWebhook(notification ExpiryNotification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	res, err := monitor.client.Post(monitor.server.Config.ExpiryWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("the webhook responded with status " + strconv.Itoa(res.StatusCode))
+	}
+	return nil
+}
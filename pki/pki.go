@@ -0,0 +1,228 @@
+package pki
+
+import (
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/mattrax/Mattrax/internal/devices"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+)
+
+// CRLPath is the path the certificate revocation list of the current identity certificate is served at
+const CRLPath = "/pki/identity.crl"
+
+// identityCRLPath is the path prefix the certificate revocation list of each trusted identity is served at
+const identityCRLPath = "/pki/crl/"
+
+// rolloverCheckInterval is how often the identity rollover schedule is checked
+const rolloverCheckInterval = 15 * time.Minute
+
+// stopScheduler is closed to stop the rollover scheduler and expiry monitor
+var stopScheduler chan struct{}
+
+// CRLDistributionPoint returns the URL of the CRL for the identity with the CertHash. It is embedded into certificates issued by the identity.
+func CRLDistributionPoint(server *mattrax.Server, certHash string) string {
+	return (&url.URL{
+		Scheme: "http",
+		Host:   revocationHost(server),
+		Path:   identityCRLPath + certHash + ".crl",
+	}).String()
+}
+
+// revocationHost returns the host of the plain HTTP webserver serving the revocation status of issued certificates
+func revocationHost(server *mattrax.Server) string {
+	if server.Config.HTTPPort == 80 {
+		return server.Config.Domain
+	}
+	return net.JoinHostPort(server.Config.Domain, strconv.Itoa(server.Config.HTTPPort))
+}
+
+// OCSPPath is the path the OCSP responder for the identity certificate is served at
+const OCSPPath = "/pki/ocsp"
+
+// maxOCSPRequestSize is the largest OCSP request which will be accepted
+const maxOCSPRequestSize = 10 * 1024
+
+// OCSPServer returns the URL of the OCSP responder. It is embedded into the authority information access extension of issued certificates.
+func OCSPServer(server *mattrax.Server) string {
+	return (&url.URL{
+		Scheme: "http",
+		Host:   revocationHost(server),
+		Path:   OCSPPath,
+	}).String()
+}
+
+// Initialise starts the PKI services and attaches their HTTP handlers to the router
+func Initialise(server *mattrax.Server, r *mux.Router) error {
+	server.Certificates.SetRevocationLocations(func(issuerCertHash string) ([]string, []string) {
+		return []string{CRLDistributionPoint(server, issuerCertHash)}, []string{OCSPServer(server)}
+	})
+
+	mountRevocationHandlers(server, r)
+	r.Path(SCEPPath).Methods("GET", "POST").HandlerFunc(SCEPHandler(server))
+	ESTHandlers(server, r)
+
+	stopScheduler = make(chan struct{})
+	go runRolloverScheduler(server, stopScheduler)
+	go runExpiryMonitor(server, stopScheduler)
+
+	return nil
+}
+
+// RevocationHandler returns the handler for the plain HTTP webserver. It only serves the CRLs and OCSP responder.
+func RevocationHandler(server *mattrax.Server) http.Handler {
+	r := mux.NewRouter()
+	mountRevocationHandlers(server, r)
+	return r
+}
+
+// mountRevocationHandlers attaches the CRL and OCSP handlers to the router
+func mountRevocationHandlers(server *mattrax.Server, r *mux.Router) {
+	r.Path(CRLPath).Methods("GET").HandlerFunc(CRLHandler(server))
+	r.Path(identityCRLPath + "{hash:[0-9A-Fa-f]+}.crl").Methods("GET").HandlerFunc(CRLHandler(server))
+	r.Path(OCSPPath).Methods("POST").HandlerFunc(OCSPHandler(server))
+	r.PathPrefix(OCSPPath + "/").Methods("GET").HandlerFunc(OCSPHandler(server))
+}
+
+// Deinitialise stops the PKI services
+func Deinitialise() error {
+	if stopScheduler != nil {
+		close(stopScheduler)
+		stopScheduler = nil
+	}
+	return nil
+}
+
+// runRolloverScheduler periodically runs the scheduled steps of the identity rollover until stop is closed
+func runRolloverScheduler(server *mattrax.Server, stop chan struct{}) {
+	ticker := time.NewTicker(rolloverCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := server.Certificates.CheckRollover(PendingDevices(server)); err != nil {
+			log.Error().Err(err).Msg("error running scheduled identity rollover")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// PendingDevices returns a function listing the UUIDs of the managed Windows devices which haven't reported the next identity as installed by their management session
+func PendingDevices(server *mattrax.Server) func(next certificates.Identity) ([]string, error) {
+	return func(next certificates.Identity) ([]string, error) {
+		enrolledDevices, err := server.Devices.GetAll()
+		if err != nil {
+			return nil, err
+		}
+
+		var pending []string
+		for _, device := range enrolledDevices {
+			if device.Status != devices.StatusActive || device.Protocol != devices.WindowsMDM {
+				continue
+			}
+
+			installed := map[string]bool{}
+			for _, hash := range device.Windows.TrustedCertificates {
+				installed[hash] = true
+			}
+			for _, hash := range certificates.TrustChainHashes([]certificates.Identity{next}) {
+				if !installed[hash] {
+					pending = append(pending, device.UUID)
+					break
+				}
+			}
+		}
+		return pending, nil
+	}
+}
+
+// CRLHandler serves the certificate revocation list signed by the identity with the CertHash in the "hash" path variable.
+// The CRL of the current identity is served if the path has no hash.
+func CRLHandler(server *mattrax.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		certHash, ok := mux.Vars(r)["hash"]
+		if !ok {
+			certHash = server.Certificates.Get().Identity.CertHash
+		}
+
+		crl, nextUpdate, err := server.Certificates.CRL(certHash)
+		if err == certificates.ErrUnknownIdentity {
+			http.Error(w, "the identity was not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Error().Err(err).Msg("error generating certificate revocation list")
+			http.Error(w, "error generating certificate revocation list", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Header().Set("Content-Length", strconv.Itoa(len(crl)))
+		w.Header().Set("Expires", nextUpdate.UTC().Format(http.TimeFormat))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Write(crl)
+	}
+}
+
+// OCSPHandler serves the OCSP responder (RFC 6960). Requests can be POSTed or sent as a GET request with the base64 encoded request in the path (RFC 6960 Appendix A.1).
+func OCSPHandler(server *mattrax.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request []byte
+		var err error
+		if r.Method == http.MethodPost {
+			if r.Header.Get("Content-Type") != "application/ocsp-request" {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			request, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOCSPRequestSize))
+		} else {
+			// The request is taken from the escaped path as the base64 encoding can contain '/' and '+'
+			var encodedRequest string
+			encodedRequest, err = url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), OCSPPath+"/"))
+			if err == nil {
+				request, err = base64.StdEncoding.DecodeString(encodedRequest)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		if err != nil {
+			w.Write(ocsp.MalformedRequestErrorResponse)
+			return
+		}
+
+		response, err := server.Certificates.OCSPResponse(request)
+		if err == certificates.ErrOCSPUnauthorized {
+			w.Write(ocsp.UnauthorizedErrorResponse)
+			return
+		} else if _, ok := err.(asn1.StructuralError); ok {
+			w.Write(ocsp.MalformedRequestErrorResponse)
+			return
+		} else if _, ok := err.(ocsp.ParseError); ok {
+			w.Write(ocsp.MalformedRequestErrorResponse)
+			return
+		} else if err != nil {
+			log.Error().Err(err).Msg("error generating ocsp response")
+			w.Write(ocsp.InternalErrorErrorResponse)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(certificates.OCSPResponseLifetime.Seconds()))+", public, no-transform, must-revalidate")
+		}
+		w.Write(response)
+	}
+}
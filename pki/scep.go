@@ -0,0 +1,163 @@
+package pki
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/devices"
+	"github.com/micromdm/scep/v2/scep"
+	"github.com/rs/zerolog/log"
+)
+
+// SCEPPath is the path the SCEP server (RFC 8894) is served at
+const SCEPPath = "/pki/scep"
+
+// errUnsupportedSCEPMessage is returned when a SCEP message isn't a certificate request
+var errUnsupportedSCEPMessage = errors.New("the scep message type is not supported")
+
+// errDeviceNotManaged is returned when a certificate is requested for a device which has been retired or wiped
+var errDeviceNotManaged = errors.New("the device is no longer managed")
+
+// maxSCEPRequestSize is the largest SCEP PKIOperation message which will be accepted
+const maxSCEPRequestSize = 64 * 1024
+
+// scepCapabilities are the capabilities returned by the GetCACaps operation
+const scepCapabilities = "POSTPKIOperation\nSHA-256\nSHA-512\nAES\nSCEPStandard\n"
+
+// SCEPServer returns the URL of the SCEP server. It is given to devices in the ClientCertificateInstall CSP and the Apple SCEP payload.
+func SCEPServer(server *mattrax.Server) string {
+	return (&url.URL{
+		Scheme: "https",
+		Host:   server.Config.Domain,
+		Path:   SCEPPath,
+	}).String()
+}
+
+// SCEPHandler serves the SCEP server (RFC 8894). Devices authenticate their certificate requests with the challenge password from Certificates.SCEPChallenge.
+func SCEPHandler(server *mattrax.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("operation") {
+		case "GetCACaps":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(scepCapabilities))
+		case "GetCACert":
+			ra, err := server.Certificates.SCEPRA()
+			if err != nil {
+				log.Error().Err(err).Msg("error loading scep registration authority")
+				http.Error(w, "error loading scep registration authority", http.StatusInternalServerError)
+				return
+			}
+
+			identity := server.Certificates.Get().Identity
+			certs := append([]*x509.Certificate{ra.Cert, identity.Cert}, identity.Chain...)
+			if identity.RootCert != nil {
+				certs = append(certs, identity.RootCert)
+			}
+
+			degenerate, err := scep.DegenerateCertificates(certs)
+			if err != nil {
+				log.Error().Err(err).Msg("error encoding scep ca certificates")
+				http.Error(w, "error encoding scep ca certificates", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+			w.Header().Set("Content-Length", strconv.Itoa(len(degenerate)))
+			w.Write(degenerate)
+		case "PKIOperation":
+			var message []byte
+			var err error
+			if r.Method == http.MethodPost {
+				message, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSCEPRequestSize))
+			} else {
+				message, err = base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+			}
+			if err != nil {
+				http.Error(w, "the scep message is malformed", http.StatusBadRequest)
+				return
+			}
+
+			response, err := scepPKIOperation(server, message)
+			if err != nil {
+				log.Debug().Err(err).Msg("error handling scep pki operation")
+				http.Error(w, "the scep message is invalid", http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/x-pki-message")
+			w.Header().Set("Content-Length", strconv.Itoa(len(response)))
+			w.Write(response)
+		default:
+			http.Error(w, "the scep operation is not supported", http.StatusBadRequest)
+		}
+	}
+}
+
+// scepPKIOperation handles a certificate request and returns the CertRep message. An error is only returned if the message couldn't be decrypted so no CertRep can be sent.
+// The issued certificate is recorded against the device the challenge password was created for so it can be revoked with the device's other certificates.
+func scepPKIOperation(server *mattrax.Server, message []byte) ([]byte, error) {
+	ra, err := server.Certificates.SCEPRA()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := scep.ParsePKIMessage(message)
+	if err != nil {
+		return nil, err
+	} else if err := msg.DecryptPKIEnvelope(ra.Cert, ra.PrivateKey()); err != nil {
+		return nil, err
+	}
+
+	certificate, err := issueSCEPCertificate(server, msg)
+	if err != nil {
+		log.Debug().Err(err).Str("transaction-id", string(msg.TransactionID)).Msg("rejected scep certificate request")
+		response, err := msg.Fail(ra.Cert, ra.PrivateKey(), scep.BadRequest)
+		if err != nil {
+			return nil, err
+		}
+		return response.Raw, nil
+	}
+
+	response, err := msg.Success(ra.Cert, ra.PrivateKey(), certificate)
+	if err != nil {
+		return nil, err
+	}
+	return response.Raw, nil
+}
+
+// issueSCEPCertificate verifies the certificate request in the decrypted SCEP message and issues the device's certificate using the template the challenge password was created for
+func issueSCEPCertificate(server *mattrax.Server, msg *scep.PKIMessage) (*x509.Certificate, error) {
+	if msg.MessageType != scep.PKCSReq && msg.MessageType != scep.RenewalReq {
+		return nil, errUnsupportedSCEPMessage
+	}
+
+	csr := msg.CSRReqMessage.CSR
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	deviceUUID, templateName, err := server.Certificates.VerifySCEPChallenge(msg.CSRReqMessage.ChallengePassword)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := server.Devices.Get(deviceUUID)
+	if err != nil {
+		return nil, err
+	} else if device.Status != devices.StatusActive {
+		return nil, errDeviceNotManaged
+	}
+
+	template, err := server.Certificates.Get().GetTemplate(templateName)
+	if err != nil {
+		return nil, err
+	}
+
+	return Issue(server, template, DeviceTemplateVariables(device), csr, csr.Subject, deviceUUID)
+}
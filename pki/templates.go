@@ -0,0 +1,47 @@
+package pki
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+
+	mattrax "github.com/mattrax/Mattrax/internal"
+	"github.com/mattrax/Mattrax/internal/certificates"
+	"github.com/mattrax/Mattrax/internal/devices"
+)
+
+// DeviceTemplateVariables returns the values of the certificate template variables for the device
+func DeviceTemplateVariables(device devices.Device) certificates.TemplateVariables {
+	return certificates.TemplateVariables{
+		DeviceUUID: device.UUID,
+		DeviceID:   device.Windows.DeviceID,
+		HWDevID:    device.Hardware.ID,
+		UPN:        device.EnrolledBy.Email,
+	}
+}
+
+// UserSubject returns the subject of certificates issued to a user authenticated by their login using a template without a subject pattern
+func UserSubject(upn string) pkix.Name {
+	return pkix.Name{CommonName: upn}
+}
+
+// Issue issues a certificate for the request using the template. The CRL and OCSP locations are added to it by the certificates service.
+// The defaultSubject is used if the template doesn't have a subject pattern. Templates without a subject pattern are rejected if the defaultSubject is empty.
+func Issue(server *mattrax.Server, template certificates.Template, variables certificates.TemplateVariables, request *x509.CertificateRequest, defaultSubject pkix.Name, deviceUUID string) (*x509.Certificate, error) {
+	if err := template.VerifyPublicKey(request.PublicKey); err != nil {
+		return nil, err
+	} else if template.Subject == "" && len(defaultSubject.ToRDNSequence()) == 0 {
+		return nil, errors.New("the certificate template '" + template.Name + "' must have a subject pattern as the subject can't be taken from the authenticated user or device")
+	}
+
+	if variables.RequestCommonName == "" {
+		variables.RequestCommonName = request.Subject.CommonName
+	}
+
+	certificate, err := template.Certificate(variables, request, defaultSubject)
+	if err != nil {
+		return nil, err
+	}
+
+	return server.Certificates.Issue(certificate, request.PublicKey, deviceUUID)
+}